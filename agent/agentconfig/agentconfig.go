@@ -0,0 +1,315 @@
+/*
+	The Agent's configuration region.
+
+	Agents are built once per GOOS/GOARCH as "stubs" containing a fixed-size,
+	marker-delimited region of bytes. Generating an Agent is then only a
+	matter of copying the stub and patching that region with the Agent's
+	configuration, no compiler required.
+
+	Region layout (RegionSize bytes total):
+
+		BeginMarker                  (16 bytes)
+		layout version, big endian   (2 bytes)
+		payload length, big endian   (2 bytes)
+		payload (JSON-encoded Config)
+		padding
+		EndMarker                    (16 bytes)
+*/
+package agentconfig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/agent/proxy"
+)
+
+const (
+	RegionSize int = 4096
+
+	// Bump this whenever the payload format changes in a way older Agents
+	// can't read.
+	LayoutVersion uint16 = 1
+
+	BeginMarker string = "<<PWNTS:CONFIG>>"
+	EndMarker   string = "<</PWNTS:CONFIG>"
+
+	// The only transport callback servers currently speak: the Agent's UUID
+	// sent over a TLS connection.
+	TransportTLS string = "tls"
+
+	// Largest random deviation from the callback frequency an Agent may use.
+	MaxJitterPercent int = 50
+
+	headerSize     int = len(BeginMarker) + 4
+	MaxPayloadSize int = RegionSize - headerSize - len(EndMarker)
+
+	// Compile-time construction of an unconfigured region, see `EmptyRegion`.
+	padding16   string = "................"
+	padding64   string = padding16 + padding16 + padding16 + padding16
+	padding256  string = padding64 + padding64 + padding64 + padding64
+	padding1024 string = padding256 + padding256 + padding256 + padding256
+	padding4060 string = padding1024 + padding1024 + padding1024 + padding256 + padding256 + padding256 + padding64 + padding64 + padding64 + padding16 + "............"
+
+	/*
+		The region as it is compiled into a stub: the current layout version
+		and an empty payload. Because it's a constant it is stored contiguously
+		in the binary's read-only data, where `Patch()` can find it.
+	*/
+	EmptyRegion string = BeginMarker + "\x00\x01" + "\x00\x00" + padding4060 + EndMarker
+)
+
+var (
+	ErrNotConfigured error = errors.New("agent has not been configured")
+	ErrRegionMissing error = errors.New("configuration region not found in stub")
+	ErrRegionCount   error = errors.New("found more than one configuration region in stub")
+	ErrTooLarge      error = errors.New("configuration does not fit in the region")
+	ErrVersion       error = errors.New("unsupported configuration layout version")
+
+	hostnameRegex *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]{0,251}[a-zA-Z0-9])?$`)
+)
+
+// A callback server an Agent can call back to.
+type Endpoint struct {
+	Address   string `json:"address"` // "host:port"
+	Transport string `json:"transport"`
+}
+
+// Everything an Agent needs to know, set at generation time.
+type Config struct {
+	AgentUUID       string `json:"uuid"`
+	LocalPort       int    `json:"lport"`
+	ServerIP        string `json:"server"`
+	ServerPort      int    `json:"port"`
+	CallbackMinutes int    `json:"mins"`
+	ServerKeyPin    string `json:"pin,omitempty"`    // hex SHA-256 of the server's public key, empty to skip pinning
+	KillDateUnix    int64  `json:"kill,omitempty"`   // Agent exits after this time, 0 for never
+	JitterPercent   int    `json:"jitter,omitempty"` // each sleep is CallbackMinutes +/- this percentage
+
+	// Fallback callback servers, tried in order when ServerIP:ServerPort
+	// can't be reached.
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+
+	// Proxy URL to tunnel callbacks through, see `agent/proxy`. When empty
+	// the Agent looks for one in HTTPS_PROXY/ALL_PROXY at runtime.
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// Check that the endpoint is a valid "host:port" with a known transport.
+func (endpoint Endpoint) Validate() error {
+	host, portString, err := net.SplitHostPort(endpoint.Address)
+	if err != nil {
+		return errors.New("invalid callback endpoint '" + endpoint.Address + "'")
+	}
+	if net.ParseIP(host) == nil && !hostnameRegex.MatchString(host) {
+		return errors.New("invalid callback endpoint address '" + host + "'")
+	}
+	if port, err := strconv.Atoi(portString); err != nil || port < 1 || port > 65535 {
+		return errors.New("invalid callback endpoint port '" + portString + "'")
+	}
+	if endpoint.Transport != TransportTLS {
+		return errors.New("unknown callback endpoint transport '" + endpoint.Transport + "'")
+	}
+
+	return nil
+}
+
+/*
+	Check every value for sanity before it is patched into a stub.
+*/
+func (config Config) Validate() error {
+	if _, err := uuid.Parse(config.AgentUUID); err != nil {
+		return errors.New("invalid Agent UUID")
+	}
+	if net.ParseIP(config.ServerIP) == nil && !hostnameRegex.MatchString(config.ServerIP) {
+		return errors.New("invalid server address '" + config.ServerIP + "'")
+	}
+	if config.LocalPort < 1 || config.LocalPort > 65535 || config.ServerPort < 1 || config.ServerPort > 65535 {
+		return errors.New("ports must range between 1 and 65535")
+	}
+	if config.CallbackMinutes < 1 || config.CallbackMinutes > 15 {
+		return errors.New("invalid callback frequency")
+	}
+	if config.KillDateUnix < 0 {
+		return errors.New("invalid kill date")
+	}
+	if config.JitterPercent < 0 || config.JitterPercent > MaxJitterPercent {
+		return errors.New("invalid callback jitter")
+	}
+	for _, endpoint := range config.Endpoints {
+		if err := endpoint.Validate(); err != nil {
+			return err
+		}
+	}
+	if config.Proxy != "" {
+		if _, err := proxy.Parse(config.Proxy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+	Every callback server the Agent may use, in order of preference:
+	ServerIP:ServerPort followed by the fallback endpoints.
+*/
+func (config Config) CallbackEndpoints() []Endpoint {
+	primary := Endpoint{
+		Address:   net.JoinHostPort(config.ServerIP, strconv.Itoa(config.ServerPort)),
+		Transport: TransportTLS,
+	}
+	return append([]Endpoint{primary}, config.Endpoints...)
+}
+
+/*
+	How long to sleep before the next callback: the callback frequency,
+	randomly lengthened or shortened by up to JitterPercent. `random` must
+	be in [0, 1), e.g. from `rand.Float64()`.
+*/
+func (config Config) CallbackDelay(random float64) time.Duration {
+	nominal := time.Duration(config.CallbackMinutes) * time.Minute
+	deviation := (random*2 - 1) * float64(config.JitterPercent) / 100
+	return nominal + time.Duration(float64(nominal)*deviation)
+}
+
+// Whether the Agent is past its kill date.
+func (config Config) Expired(now time.Time) bool {
+	return config.KillDateUnix != 0 && now.Unix() >= config.KillDateUnix
+}
+
+/*
+	Encode the configuration into a complete region of exactly RegionSize
+	bytes.
+*/
+func Encode(config Config) ([]byte, error) {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > MaxPayloadSize {
+		return nil, ErrTooLarge
+	}
+
+	region := make([]byte, RegionSize)
+	copy(region, BeginMarker)
+	binary.BigEndian.PutUint16(region[len(BeginMarker):], LayoutVersion)
+	binary.BigEndian.PutUint16(region[len(BeginMarker)+2:], uint16(len(payload)))
+	copy(region[headerSize:], payload)
+	copy(region[RegionSize-len(EndMarker):], EndMarker)
+
+	return region, nil
+}
+
+/*
+	Decode a region, as returned by `Encode()` or as found in a running
+	Agent. An unpatched region returns ErrNotConfigured.
+*/
+func Decode(region []byte) (config Config, err error) {
+	if len(region) != RegionSize || !bytes.HasPrefix(region, []byte(BeginMarker)) || !bytes.HasSuffix(region, []byte(EndMarker)) {
+		err = ErrRegionMissing
+		return
+	}
+
+	version := binary.BigEndian.Uint16(region[len(BeginMarker):])
+	payloadLength := int(binary.BigEndian.Uint16(region[len(BeginMarker)+2:]))
+	if version != LayoutVersion {
+		err = ErrVersion
+		return
+	}
+	if payloadLength == 0 {
+		err = ErrNotConfigured
+		return
+	}
+	if payloadLength > MaxPayloadSize {
+		err = ErrTooLarge
+		return
+	}
+
+	err = json.Unmarshal(region[headerSize:headerSize+payloadLength], &config)
+	return
+}
+
+/*
+	Find the offset of the one and only configuration region in a stub.
+
+	The marker strings may also appear on their own elsewhere in the binary,
+	so a region only counts if both markers are exactly RegionSize apart.
+*/
+func FindRegion(stub []byte) (int, error) {
+	offset := -1
+	searchFrom := 0
+
+	for {
+		index := bytes.Index(stub[searchFrom:], []byte(BeginMarker))
+		if index == -1 {
+			break
+		}
+		index += searchFrom
+		searchFrom = index + 1
+
+		regionEnd := index + RegionSize
+		if regionEnd > len(stub) || !bytes.Equal(stub[regionEnd-len(EndMarker):regionEnd], []byte(EndMarker)) {
+			continue
+		}
+
+		if offset != -1 {
+			return -1, ErrRegionCount
+		}
+		offset = index
+	}
+
+	if offset == -1 {
+		return -1, ErrRegionMissing
+	}
+
+	return offset, nil
+}
+
+/*
+	Return a copy of the stub with its configuration region replaced by
+	`config`.
+*/
+func Patch(stub []byte, config Config) ([]byte, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	offset, err := FindRegion(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := Encode(config)
+	if err != nil {
+		return nil, err
+	}
+
+	patched := make([]byte, len(stub))
+	copy(patched, stub)
+	copy(patched[offset:], region)
+
+	return patched, nil
+}
+
+// Read the configuration back out of a patched binary.
+func Extract(agent []byte) (Config, error) {
+	offset, err := FindRegion(agent)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Decode(agent[offset : offset+RegionSize])
+}
+
+// Compile-time check that EmptyRegion is exactly RegionSize bytes long.
+var _ [RegionSize - len(EmptyRegion)]struct{}
+var _ [len(EmptyRegion) - RegionSize]struct{}
@@ -0,0 +1,158 @@
+package agentconfig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testConfig() Config {
+	return Config{
+		AgentUUID:       "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		LocalPort:       443,
+		ServerIP:        "10.0.0.5",
+		ServerPort:      444,
+		CallbackMinutes: 5,
+		ServerKeyPin:    strings.Repeat("ab", 32),
+		KillDateUnix:    1700000000,
+		JitterPercent:   20,
+		Endpoints:       []Endpoint{{Address: "callbacks.example.com:8444", Transport: TransportTLS}},
+		Proxy:           "socks5://127.0.0.1:1080",
+	}
+}
+
+// A stub-sized binary with the empty region somewhere in the middle, like a compiled stub.
+func testStub() []byte {
+	stub := bytes.Repeat([]byte{0x90}, 3*RegionSize)
+	copy(stub[RegionSize+123:], EmptyRegion)
+	return stub
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+	stub := testStub()
+	config := testConfig()
+
+	patched, err := Patch(stub, config)
+	if err != nil {
+		t.Fatalf("Patch() failed: %v", err)
+	}
+	if len(patched) != len(stub) {
+		t.Fatalf("patched Agent is %d bytes, the stub %d", len(patched), len(stub))
+	}
+	if !bytes.Equal(patched[:RegionSize+123], stub[:RegionSize+123]) || !bytes.Equal(patched[2*RegionSize+123:], stub[2*RegionSize+123:]) {
+		t.Error("Patch() changed bytes outside the configuration region")
+	}
+
+	extracted, err := Extract(patched)
+	if err != nil {
+		t.Fatalf("Extract() failed: %v", err)
+	}
+	if !reflect.DeepEqual(extracted, config) {
+		t.Errorf("Extract() = %+v, want %+v", extracted, config)
+	}
+
+	// The stub itself is left untouched, and reads as unconfigured
+	if _, err = Extract(stub); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("Extract() of the stub returned %v, want %v", err, ErrNotConfigured)
+	}
+}
+
+func TestFindRegion(t *testing.T) {
+	duplicate := testStub()
+	copy(duplicate, EmptyRegion)
+
+	// Markers on their own, not RegionSize apart, aren't a region
+	loneMarkers := bytes.Repeat([]byte{0x90}, 3*RegionSize)
+	copy(loneMarkers[100:], BeginMarker)
+	copy(loneMarkers[RegionSize:], EndMarker)
+
+	tests := []struct {
+		name   string
+		stub   []byte
+		offset int
+		err    error
+	}{
+		{"one region", testStub(), RegionSize + 123, nil},
+		{"no region", bytes.Repeat([]byte{0x90}, 2*RegionSize), -1, ErrRegionMissing},
+		{"lone markers", loneMarkers, -1, ErrRegionMissing},
+		{"region cut short", testStub()[:2*RegionSize], -1, ErrRegionMissing},
+		{"two regions", duplicate, -1, ErrRegionCount},
+	}
+	for _, test := range tests {
+		offset, err := FindRegion(test.stub)
+		if offset != test.offset || !errors.Is(err, test.err) {
+			t.Errorf("%s: FindRegion() = %d, %v, want %d, %v", test.name, offset, err, test.offset, test.err)
+		}
+
+		if test.err != nil {
+			if _, err = Patch(test.stub, testConfig()); !errors.Is(err, test.err) {
+				t.Errorf("%s: Patch() returned %v, want %v", test.name, err, test.err)
+			}
+		}
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	config := testConfig()
+	for len(config.Endpoints) < MaxPayloadSize/20 {
+		config.Endpoints = append(config.Endpoints, Endpoint{Address: "callbacks.example.com:8444", Transport: TransportTLS})
+	}
+
+	if _, err := Encode(config); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Encode() returned %v, want %v", err, ErrTooLarge)
+	}
+	if _, err := Patch(testStub(), config); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Patch() returned %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+	versionOffset, lengthOffset := len(BeginMarker), len(BeginMarker)+2
+
+	tests := []struct {
+		name    string
+		corrupt func(region []byte) []byte
+		err     error // nil for any error
+	}{
+		{"version mismatch", func(region []byte) []byte {
+			binary.BigEndian.PutUint16(region[versionOffset:], LayoutVersion+1)
+			return region
+		}, ErrVersion},
+		{"length past the region", func(region []byte) []byte {
+			binary.BigEndian.PutUint16(region[lengthOffset:], uint16(MaxPayloadSize+1))
+			return region
+		}, ErrTooLarge},
+		{"length cutting the payload short", func(region []byte) []byte {
+			binary.BigEndian.PutUint16(region[lengthOffset:], binary.BigEndian.Uint16(region[lengthOffset:])/2)
+			return region
+		}, nil},
+		{"length including the padding", func(region []byte) []byte {
+			binary.BigEndian.PutUint16(region[lengthOffset:], binary.BigEndian.Uint16(region[lengthOffset:])+10)
+			return region
+		}, nil},
+		{"length of zero", func(region []byte) []byte {
+			binary.BigEndian.PutUint16(region[lengthOffset:], 0)
+			return region
+		}, ErrNotConfigured},
+		{"region truncated", func(region []byte) []byte {
+			return region[:RegionSize-1]
+		}, ErrRegionMissing},
+		{"header truncated", func(region []byte) []byte {
+			return region[:lengthOffset+1]
+		}, ErrRegionMissing},
+	}
+	for _, test := range tests {
+		region, err := Encode(testConfig())
+		if err != nil {
+			t.Fatalf("Encode() failed: %v", err)
+		}
+
+		_, err = Decode(test.corrupt(region))
+		if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("%s: Decode() returned %v, want %v", test.name, err, test.err)
+		}
+	}
+}
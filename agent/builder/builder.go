@@ -0,0 +1,297 @@
+/*
+	Generates Agents from prebuilt stubs.
+
+	A stub is the Agent compiled once per target with an empty configuration
+	region. Stubs are built by running the Go toolchain directly (never
+	through a shell), and every Agent after that is just a patched copy.
+*/
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/utils"
+)
+
+type Builder struct {
+	goBinary      string // empty if stubs can't be built
+	unbuildable   error  // why stubs can't be built
+	agentSource   string
+	stubDirectory string
+	targets       map[Target]bool
+	targetList    []Target // in configured order
+
+	// Only one build of each stub at a time
+	stubMutexes map[Target]*sync.Mutex
+}
+
+var (
+	ErrUnsupportedTarget error = errors.New("target is not enabled for Agent builds")
+	ErrNoToolchain       error = errors.New("the Go toolchain is not available to build stubs")
+	ErrNoAgentSource     error = errors.New("the Agent source is not available to build stubs")
+
+	// Only these variables are overridden, the rest of the site's environment
+	// (PATH, HOME, GOCACHE, GOPATH, ...) is passed through to `go build`.
+	overriddenEnvironment []string = []string{"GOOS", "GOARCH", "CGO_ENABLED", "GOFLAGS", "GOARM", "GOMIPS"}
+)
+
+/*
+	Set up Agent generation for the configured targets. Intended to be called
+	once at startup.
+
+	Every target needs either a stub in `stubDirectory`, or `agentSource`
+	(`agent/agent.go` in a pwnts source tree) and a Go toolchain that
+	supports it (according to `go tool dist list`). Missing stubs are built
+	the first time they're needed, and `rebuildStubs` rebuilds all of them
+	right away (e.g. after `agent.go` has changed). Without the source tree,
+	every stub must be shipped alongside the site.
+*/
+func New(goBinary string, agentSource string, stubDirectory string, targets []string, rebuildStubs bool) (*Builder, error) {
+	builder := &Builder{
+		agentSource:   agentSource,
+		stubDirectory: stubDirectory,
+		targets:       make(map[Target]bool),
+		stubMutexes:   make(map[Target]*sync.Mutex),
+	}
+
+	err := os.MkdirAll(stubDirectory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	supportedPlatforms, err := builder.findToolchain(goBinary)
+	if err != nil {
+		builder.unbuildable = err
+		utils.LogError(utils.Warning, err, "Stubs can't be built, only prebuilt stubs can be used")
+	}
+
+	for _, targetString := range targets {
+		target, err := ParseTarget(targetString)
+		if err != nil {
+			return nil, err
+		}
+		if builder.targets[target] {
+			return nil, errors.New("target '" + target.String() + "' is listed more than once")
+		}
+
+		if builder.goBinary == "" {
+			if !builder.haveStub(target) {
+				return nil, fmt.Errorf("no stub for target '%s' at '%s', and it can't be built: %w", target.String(), builder.StubPath(target), builder.unbuildable)
+			}
+		} else if !supportedPlatforms[target.Platform()] {
+			return nil, errors.New("the Go toolchain does not support target '" + target.String() + "'")
+		}
+
+		builder.targets[target] = true
+		builder.targetList = append(builder.targetList, target)
+		builder.stubMutexes[target] = &sync.Mutex{}
+	}
+
+	if rebuildStubs && builder.goBinary != "" {
+		for _, target := range builder.targetList {
+			output, err := builder.BuildStub(target)
+			if err != nil {
+				return nil, fmt.Errorf("could not build stub for '%s': %w\n%s", target.String(), err, output)
+			}
+		}
+	}
+
+	return builder, nil
+}
+
+/*
+	Locate the Agent source, the Go toolchain, and the targets it supports.
+	Leaves `builder.goBinary` empty if stubs can't be built.
+*/
+func (builder *Builder) findToolchain(goBinary string) (map[string]bool, error) {
+	if builder.agentSource == "" {
+		return nil, fmt.Errorf("%w: no Agent source is configured", ErrNoAgentSource)
+	}
+	if _, err := os.Stat(builder.agentSource); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoAgentSource, err)
+	}
+
+	goPath, err := exec.LookPath(goBinary)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not find '%s': %v", ErrNoToolchain, goBinary, err)
+	}
+
+	versionOutput, err := exec.Command(goPath, "version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not run '%s version': %w", goPath, err)
+	}
+	utils.Log(utils.Done, "Found", strings.TrimSpace(string(versionOutput)))
+
+	distListOutput, err := exec.Command(goPath, "tool", "dist", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the toolchain's supported targets: %w", err)
+	}
+	supportedTargets := make(map[string]bool)
+	for _, line := range strings.Split(string(distListOutput), "\n") {
+		supportedTargets[strings.TrimSpace(line)] = true
+	}
+
+	builder.goBinary = goPath
+	return supportedTargets, nil
+}
+
+// Where the stub for a target is kept.
+func (builder *Builder) StubPath(target Target) string {
+	return filepath.Join(builder.stubDirectory, target.stubFilename())
+}
+
+func (builder *Builder) haveStub(target Target) bool {
+	_, err := os.Stat(builder.StubPath(target))
+	return err == nil
+}
+
+// Whether the target is one of the configured targets.
+func (builder *Builder) Supports(target Target) bool {
+	return builder.targets[target]
+}
+
+// The configured targets, in the order they were configured.
+func (builder *Builder) Targets() []Target {
+	return builder.targetList
+}
+
+// The build environment with the target variables set explicitly.
+func buildEnvironment(target Target, temporaryDirectory string) []string {
+	var environment []string
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		overridden := name == "GOTMPDIR"
+		for _, overriddenName := range overriddenEnvironment {
+			overridden = overridden || name == overriddenName
+		}
+		if !overridden {
+			environment = append(environment, variable)
+		}
+	}
+
+	environment = append(environment,
+		"GOOS="+target.OS,
+		"GOARCH="+target.Arch,
+		"CGO_ENABLED=0",
+		"GOFLAGS=",
+		"GOTMPDIR="+temporaryDirectory,
+	)
+	return append(environment, target.environment()...)
+}
+
+/*
+	Compile the stub for `target`, returning the compiler's output. Each
+	build runs in its own temporary directory which is removed afterwards,
+	and the stub is only replaced once the build has succeeded.
+*/
+func (builder *Builder) BuildStub(target Target) ([]byte, error) {
+	if builder.goBinary == "" {
+		return nil, builder.unbuildable
+	}
+	if !builder.Supports(target) {
+		return nil, ErrUnsupportedTarget
+	}
+
+	builder.stubMutexes[target].Lock()
+	defer builder.stubMutexes[target].Unlock()
+
+	utils.Log(utils.Info, "Building Agent stub for", target.String())
+
+	temporaryDirectory, err := os.MkdirTemp("", "pwnts_stub_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(temporaryDirectory)
+
+	temporaryOutput := filepath.Join(temporaryDirectory, "stub")
+
+	command := exec.Command(builder.goBinary,
+		"build",
+		"-trimpath",
+		"-ldflags", "-s -w",
+		"-o", temporaryOutput,
+		builder.agentSource,
+	)
+	command.Dir = filepath.Dir(builder.agentSource)
+	command.Env = buildEnvironment(target, temporaryDirectory)
+
+	var output bytes.Buffer
+	command.Stdout = &output
+	command.Stderr = &output
+
+	err = command.Run()
+	if err != nil {
+		return output.Bytes(), err
+	}
+
+	// Make sure the region survived compilation before accepting the stub
+	stub, err := os.ReadFile(temporaryOutput)
+	if err != nil {
+		return output.Bytes(), err
+	}
+	if _, err = agentconfig.FindRegion(stub); err != nil {
+		return output.Bytes(), err
+	}
+
+	err = copyFile(temporaryOutput, builder.StubPath(target), 0700)
+	if err == nil {
+		utils.Log(utils.Done, "Built Agent stub for", target.String())
+	}
+	return output.Bytes(), err
+}
+
+/*
+	Generate an Agent for `target` by patching `config` into a copy of the
+	target's stub and writing it to `outputPath`. If the stub doesn't exist
+	yet it is built first, and the compiler's output is returned.
+*/
+func (builder *Builder) Generate(target Target, config agentconfig.Config, outputPath string) ([]byte, error) {
+	if !builder.Supports(target) {
+		return nil, ErrUnsupportedTarget
+	}
+
+	var output []byte
+	if !builder.haveStub(target) {
+		var err error
+		output, err = builder.BuildStub(target)
+		if err != nil {
+			return output, err
+		}
+	}
+
+	stub, err := os.ReadFile(builder.StubPath(target))
+	if err != nil {
+		return output, err
+	}
+
+	agent, err := agentconfig.Patch(stub, config)
+	if err != nil {
+		return output, err
+	}
+
+	return output, os.WriteFile(outputPath, agent, 0755)
+}
+
+func copyFile(sourcePath string, destinationPath string, mode os.FileMode) error {
+	contents, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	// Write next to the destination first so a half-written stub is never used
+	temporaryPath := destinationPath + ".tmp"
+	err = os.WriteFile(temporaryPath, contents, mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, destinationPath)
+}
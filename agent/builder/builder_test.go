@@ -0,0 +1,78 @@
+package builder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStubsWithoutSource(t *testing.T) {
+	stubDirectory := t.TempDir()
+	err := os.WriteFile(filepath.Join(stubDirectory, "stub_linux_amd64"), []byte("stub"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSource := filepath.Join(t.TempDir(), "agent.go")
+	err = os.WriteFile(agentSource, []byte("package main\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		goBinary    string
+		agentSource string
+		want        error
+	}{
+		{"no source configured", "go", "", ErrNoAgentSource},
+		{"source missing", "go", filepath.Join(t.TempDir(), "agent.go"), ErrNoAgentSource},
+		{"toolchain missing", "pwnts-no-such-go", agentSource, ErrNoToolchain},
+	}
+
+	for _, test := range tests {
+		// Shipped stubs are enough
+		builder, err := New(test.goBinary, test.agentSource, stubDirectory, []string{"linux/amd64"}, false)
+		if err != nil {
+			t.Errorf("%s: New() with every stub present = %v, want no error", test.description, err)
+		} else if _, err = builder.BuildStub(Target{OS: "linux", Arch: "amd64"}); !errors.Is(err, test.want) {
+			t.Errorf("%s: BuildStub() = %v, want %v", test.description, err, test.want)
+		}
+
+		// A missing one is named along with why it can't be built
+		_, err = New(test.goBinary, test.agentSource, stubDirectory, []string{"linux/amd64", "windows/amd64"}, false)
+		if !errors.Is(err, test.want) || !strings.Contains(err.Error(), filepath.Join(stubDirectory, "stub_windows_amd64")) {
+			t.Errorf("%s: New() with a stub missing = %v, want %v naming the stub", test.description, err, test.want)
+		}
+	}
+}
+
+func TestDuplicateTargets(t *testing.T) {
+	stubDirectory := t.TempDir()
+	for _, stubFilename := range []string{"stub_linux_amd64", "stub_linux_arm_7", "stub_linux_arm_6"} {
+		err := os.WriteFile(filepath.Join(stubDirectory, stubFilename), []byte("stub"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		targets []string
+		valid   bool
+	}{
+		{[]string{"linux/amd64", "linux/arm/7", "linux/arm/6"}, true},
+		{[]string{"linux/amd64", "linux/amd64"}, false},
+		{[]string{"linux/arm/7", "linux/amd64", "linux/arm/7"}, false},
+	}
+
+	for _, test := range tests {
+		builder, err := New("go", "", stubDirectory, test.targets, false)
+		if test.valid && (err != nil || len(builder.Targets()) != len(test.targets)) {
+			t.Errorf("%v: New() = %v, want every target", test.targets, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v: New() = no error, want the duplicate rejected", test.targets)
+		}
+	}
+}
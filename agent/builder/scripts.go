@@ -0,0 +1,107 @@
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"text/template"
+
+	"github.com/s-christian/pwnts/agent/agentconfig"
+)
+
+type (
+	// A script Agent, for hosts where a binary can't be dropped.
+	ScriptType struct {
+		Name         string // as stored in the Agents table, see `utils.AgentTypes`
+		Label        string
+		TemplateFile string
+		Filename     string // offered when downloading the Agent
+	}
+
+	// The values available to the script templates.
+	scriptServer struct {
+		Host    string
+		Port    string
+		Address string // "host:port"
+	}
+
+	scriptValues struct {
+		agentconfig.Config
+		Servers         []scriptServer // every callback endpoint, in order of preference
+		CallbackSeconds int
+		JitterSeconds   int // each sleep is CallbackSeconds +/- up to this many seconds
+	}
+)
+
+var (
+	ErrUnknownScriptType error = errors.New("unknown script Agent type")
+	ErrScriptProxy       error = errors.New("script Agents do not support proxies")
+
+	ScriptTypes []ScriptType = []ScriptType{
+		{Name: "sh", Label: "POSIX sh (openssl)", TemplateFile: "agent.sh.tmpl", Filename: "agent.sh"},
+		{Name: "python", Label: "Python 3", TemplateFile: "agent.py.tmpl", Filename: "agent.py"},
+		{Name: "powershell", Label: "PowerShell", TemplateFile: "agent.ps1.tmpl", Filename: "agent.ps1"},
+	}
+)
+
+// Look up a script type by its name.
+func GetScriptType(name string) (ScriptType, error) {
+	for _, scriptType := range ScriptTypes {
+		if scriptType.Name == name {
+			return scriptType, nil
+		}
+	}
+	return ScriptType{}, ErrUnknownScriptType
+}
+
+/*
+	Generate a script Agent of the given type from its template in
+	`templates` (see `agent/scripts`), writing it to `outputPath`.
+
+	Every templated value has already been validated by
+	`agentconfig.Config.Validate()` (UUID, IP address or hostname, integers),
+	so none of them can break out of the quoting in the templates.
+*/
+func GenerateScript(templates fs.FS, scriptTypeName string, config agentconfig.Config, outputPath string) error {
+	scriptType, err := GetScriptType(scriptTypeName)
+	if err != nil {
+		return err
+	}
+
+	if err = config.Validate(); err != nil {
+		return err
+	}
+	if config.Proxy != "" {
+		return ErrScriptProxy
+	}
+
+	scriptTemplate, err := template.ParseFS(templates, scriptType.TemplateFile)
+	if err != nil {
+		return err
+	}
+
+	// Every script speaks TLS, the only transport there is
+	var servers []scriptServer
+	for _, endpoint := range config.CallbackEndpoints() {
+		host, port, err := net.SplitHostPort(endpoint.Address)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, scriptServer{Host: host, Port: port, Address: endpoint.Address})
+	}
+
+	var script bytes.Buffer
+	err = scriptTemplate.Execute(&script, scriptValues{
+		Config:          config,
+		Servers:         servers,
+		CallbackSeconds: config.CallbackMinutes * 60,
+		JitterSeconds:   config.CallbackMinutes * 60 * config.JitterPercent / 100,
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(outputPath, script.Bytes(), 0755)
+}
@@ -0,0 +1,191 @@
+package builder
+
+import (
+	"errors"
+	"strings"
+)
+
+type (
+	/*
+		A platform Agents can be generated for, written as "os/arch" like
+		`go tool dist list`, or "os/arch/variant" for architectures with a
+		GOARM or GOMIPS variant (e.g. "linux/arm/7", "linux/mipsle/softfloat").
+	*/
+	Target struct {
+		OS      string
+		Arch    string
+		Variant string
+	}
+
+	// Targets of the same OS, for rendering the dashboard's platform list.
+	TargetGroup struct {
+		OS      string
+		Label   string
+		Targets []TargetOption
+	}
+
+	TargetOption struct {
+		ID    string
+		Label string
+	}
+)
+
+var (
+	// The environment variable holding each architecture's variant, and the
+	// variants it accepts.
+	variantVariables map[string]string = map[string]string{
+		"arm":    "GOARM",
+		"mips":   "GOMIPS",
+		"mipsle": "GOMIPS",
+	}
+	validVariants map[string][]string = map[string][]string{
+		"GOARM":  {"5", "6", "7"},
+		"GOMIPS": {"hardfloat", "softfloat"},
+	}
+
+	osLabels map[string]string = map[string]string{
+		"windows": "Windows",
+		"linux":   "Linux",
+		"darwin":  "macOS",
+		"freebsd": "FreeBSD",
+		"openbsd": "OpenBSD",
+		"netbsd":  "NetBSD",
+	}
+	archLabels map[string]string = map[string]string{
+		"amd64":  "64-bit",
+		"386":    "32-bit",
+		"arm64":  "ARM64",
+		"arm":    "ARMv",
+		"mips":   "MIPS (big endian)",
+		"mipsle": "MIPS (little endian)",
+	}
+)
+
+/*
+	Parse an "os/arch" or "os/arch/variant" string. Architectures with a
+	variant must have one, and it must be a value Go accepts.
+*/
+func ParseTarget(targetString string) (Target, error) {
+	if strings.ContainsAny(targetString, " \t\r\n") {
+		return Target{}, errors.New("target '" + targetString + "' must not contain whitespace")
+	}
+
+	targetSplit := strings.Split(targetString, "/")
+	if len(targetSplit) < 2 || len(targetSplit) > 3 || targetSplit[0] == "" || targetSplit[1] == "" || (len(targetSplit) == 3 && targetSplit[2] == "") {
+		return Target{}, errors.New("target '" + targetString + "' must be in the form 'os/arch' or 'os/arch/variant'")
+	}
+
+	target := Target{OS: targetSplit[0], Arch: targetSplit[1]}
+	if len(targetSplit) == 3 {
+		target.Variant = targetSplit[2]
+	}
+
+	variantVariable, hasVariant := variantVariables[target.Arch]
+	if !hasVariant {
+		if target.Variant != "" {
+			return Target{}, errors.New("target '" + targetString + "': architecture '" + target.Arch + "' has no variants")
+		}
+		return target, nil
+	}
+
+	for _, validVariant := range validVariants[variantVariable] {
+		if target.Variant == validVariant {
+			return target, nil
+		}
+	}
+	return Target{}, errors.New("target '" + targetString + "': " + variantVariable + " must be one of " + strings.Join(validVariants[variantVariable], ", "))
+}
+
+// The target in the same form `ParseTarget()` accepts.
+func (target Target) String() string {
+	if target.Variant != "" {
+		return target.OS + "/" + target.Arch + "/" + target.Variant
+	}
+	return target.OS + "/" + target.Arch
+}
+
+// The GOOS/GOARCH pair as listed by `go tool dist list`.
+func (target Target) Platform() string {
+	return target.OS + "/" + target.Arch
+}
+
+// The GOARM/GOMIPS setting for the target, if any.
+func (target Target) environment() []string {
+	if variantVariable, hasVariant := variantVariables[target.Arch]; hasVariant {
+		return []string{variantVariable + "=" + target.Variant}
+	}
+	return nil
+}
+
+func (target Target) OSLabel() string {
+	if label, ok := osLabels[target.OS]; ok {
+		return label
+	}
+	return target.OS
+}
+
+// A human-readable name for the dashboard, e.g. "Linux ARMv7".
+func (target Target) Label() string {
+	archLabel, ok := archLabels[target.Arch]
+	if !ok {
+		archLabel = target.Arch
+	}
+
+	switch variantVariables[target.Arch] {
+	case "GOARM":
+		archLabel += target.Variant
+	case "GOMIPS":
+		archLabel += ", " + target.Variant
+	}
+
+	return target.OSLabel() + " " + archLabel
+}
+
+/*
+	The filename offered when downloading an Agent for this target, with the
+	extension the platform expects.
+*/
+func (target Target) AgentFilename() string {
+	filename := "agent_" + target.OS + "_" + target.Arch
+	switch variantVariables[target.Arch] {
+	case "GOARM":
+		filename += "v" + target.Variant
+	case "GOMIPS":
+		filename += "_" + target.Variant
+	}
+
+	if target.OS == "windows" {
+		filename += ".exe"
+	}
+
+	return filename
+}
+
+// Name of the stub file for this target.
+func (target Target) stubFilename() string {
+	if target.Variant != "" {
+		return "stub_" + target.OS + "_" + target.Arch + "_" + target.Variant
+	}
+	return "stub_" + target.OS + "_" + target.Arch
+}
+
+/*
+	Group targets by OS, in the order the OSes first appear, for rendering
+	the dashboard.
+*/
+func GroupTargets(targets []Target) []TargetGroup {
+	var groups []TargetGroup
+	groupIndexes := make(map[string]int)
+
+	for _, target := range targets {
+		index, ok := groupIndexes[target.OS]
+		if !ok {
+			index = len(groups)
+			groupIndexes[target.OS] = index
+			groups = append(groups, TargetGroup{OS: target.OS, Label: target.OSLabel()})
+		}
+		groups[index].Targets = append(groups[index].Targets, TargetOption{ID: target.String(), Label: target.Label()})
+	}
+
+	return groups
+}
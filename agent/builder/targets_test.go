@@ -0,0 +1,54 @@
+package builder
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		targetString string
+		want         Target
+		valid        bool
+	}{
+		{"windows/amd64", Target{OS: "windows", Arch: "amd64"}, true},
+		{"linux/386", Target{OS: "linux", Arch: "386"}, true},
+		{"darwin/arm64", Target{OS: "darwin", Arch: "arm64"}, true},
+		{"linux/arm/7", Target{OS: "linux", Arch: "arm", Variant: "7"}, true},
+		{"linux/arm/5", Target{OS: "linux", Arch: "arm", Variant: "5"}, true},
+		{"linux/mips/hardfloat", Target{OS: "linux", Arch: "mips", Variant: "hardfloat"}, true},
+		{"linux/mipsle/softfloat", Target{OS: "linux", Arch: "mipsle", Variant: "softfloat"}, true},
+
+		// Malformed
+		{"", Target{}, false},
+		{"linux", Target{}, false},
+		{"linux/", Target{}, false},
+		{"/amd64", Target{}, false},
+		{"linux/arm/7/extra", Target{}, false},
+		{"linux_amd64", Target{}, false},
+
+		// Variants
+		{"linux/arm", Target{}, false},
+		{"linux/arm/8", Target{}, false},
+		{"linux/mips", Target{}, false},
+		{"linux/mipsle/7", Target{}, false},
+		{"linux/amd64/7", Target{}, false},
+		{"linux/amd64/", Target{}, false},
+
+		// Whitespace
+		{" linux/amd64", Target{}, false},
+		{"linux/amd64\n", Target{}, false},
+		{"linux/ amd64", Target{}, false},
+		{"linux/arm/\t7", Target{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTarget(test.targetString)
+		if test.valid && (err != nil || got != test.want) {
+			t.Errorf("%q: ParseTarget() = %+v, %v, want %+v", test.targetString, got, err, test.want)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: ParseTarget() = %+v, want an error", test.targetString, got)
+		}
+		if test.valid && got.String() != test.targetString {
+			t.Errorf("%q: String() = %q, want it unchanged", test.targetString, got.String())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package fingerprint
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+)
+
+/*
+	Collect this host's fingerprint, for the Agent's checkins. Anything that
+	can't be determined is left empty.
+*/
+func Collect() Fingerprint {
+	fingerprint := Fingerprint{
+		OS:        runtime.GOOS,
+		OSVersion: osVersion(),
+		Arch:      runtime.GOARCH,
+		MachineID: machineID(),
+		IPs:       localIPs(),
+		PID:       os.Getpid(),
+	}
+
+	fingerprint.Hostname, _ = os.Hostname()
+
+	if currentUser, err := user.Current(); err == nil {
+		fingerprint.User = currentUser.Username
+	} else if fingerprint.User = os.Getenv("USER"); fingerprint.User == "" {
+		fingerprint.User = os.Getenv("USERNAME")
+	}
+
+	fingerprint.Normalize()
+	return fingerprint
+}
+
+// Addresses of the interfaces that are up, skipping loopback and link-local addresses.
+func localIPs() []string {
+	ips := []string{}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ips
+	}
+
+	for _, networkInterface := range interfaces {
+		if networkInterface.Flags&net.FlagUp == 0 || networkInterface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addresses, err := networkInterface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			ipNet, ok := address.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+
+	return ips
+}
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package fingerprint
+
+import "syscall"
+
+// macOS reports its product version, the BSDs their kernel release.
+func osVersion() string {
+	return firstSysctl("kern.osproductversion", "kern.osrelease")
+}
+
+// The host UUID, where the kernel exposes one (not on macOS).
+func machineID() string {
+	return firstSysctl("kern.hostuuid", "hw.uuid")
+}
+
+func firstSysctl(names ...string) string {
+	for _, name := range names {
+		if value, err := syscall.Sysctl(name); err == nil && value != "" {
+			return value
+		}
+	}
+	return ""
+}
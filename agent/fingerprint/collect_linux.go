@@ -0,0 +1,38 @@
+package fingerprint
+
+import (
+	"os"
+	"strings"
+)
+
+// The distribution's name and the kernel release, e.g. "Ubuntu 22.04.3 LTS (5.15.0-88-generic)".
+func osVersion() string {
+	version := ""
+	if osRelease, err := os.ReadFile("/etc/os-release"); err == nil {
+		for _, line := range strings.Split(string(osRelease), "\n") {
+			if strings.HasPrefix(line, "PRETTY_NAME=") {
+				version = strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"'`)
+			}
+		}
+	}
+
+	if kernelRelease, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		if version == "" {
+			version = "Linux " + strings.TrimSpace(string(kernelRelease))
+		} else {
+			version += " (" + strings.TrimSpace(string(kernelRelease)) + ")"
+		}
+	}
+
+	return version
+}
+
+// The systemd/D-Bus machine ID, unique to each install.
+func machineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if id, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(id))) > 0 {
+			return strings.TrimSpace(string(id))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package fingerprint
+
+// Not known on this platform.
+func osVersion() string {
+	return ""
+}
+
+// Not known on this platform.
+func machineID() string {
+	return ""
+}
@@ -0,0 +1,54 @@
+package fingerprint
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Read from the 64-bit registry even when the Agent is a 32-bit binary
+const keyWow6464Key uint32 = 0x0100
+
+// The product name and build, e.g. "Windows 10 Pro (build 19045)".
+func osVersion() string {
+	currentVersionKey := `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+
+	version := readRegistryString(currentVersionKey, "ProductName")
+	if build := readRegistryString(currentVersionKey, "CurrentBuildNumber"); build != "" {
+		version += " (build " + build + ")"
+	}
+	return version
+}
+
+// The GUID Windows generates at install time.
+func machineID() string {
+	return readRegistryString(`SOFTWARE\Microsoft\Cryptography`, "MachineGuid")
+}
+
+// Read a string value under HKEY_LOCAL_MACHINE, empty if it can't be read.
+func readRegistryString(keyPath string, valueName string) string {
+	keyPathPointer, err := syscall.UTF16PtrFromString(keyPath)
+	if err != nil {
+		return ""
+	}
+	valueNamePointer, err := syscall.UTF16PtrFromString(valueName)
+	if err != nil {
+		return ""
+	}
+
+	var key syscall.Handle
+	err = syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, keyPathPointer, 0, syscall.KEY_READ|keyWow6464Key, &key)
+	if err != nil {
+		return ""
+	}
+	defer syscall.RegCloseKey(key)
+
+	var valueType uint32
+	buffer := make([]uint16, 256)
+	bufferLength := uint32(len(buffer) * 2)
+	err = syscall.RegQueryValueEx(key, valueNamePointer, nil, &valueType, (*byte)(unsafe.Pointer(&buffer[0])), &bufferLength)
+	if err != nil || valueType != syscall.REG_SZ {
+		return ""
+	}
+
+	return syscall.UTF16ToString(buffer)
+}
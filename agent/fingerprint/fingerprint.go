@@ -0,0 +1,177 @@
+/*
+	Host fingerprints, reported by Agents with every checkin so the server can
+	tell which host an Agent is running on, whether several Agents share a
+	host, and whether an Agent has moved to another host mid-game.
+
+	A checkin is the Agent's UUID, a space, and the fingerprint as compact
+	JSON:
+
+		<agent UUID> {"hostname":"web01","os":"linux",...}
+
+	Agents that can't report a fingerprint send only their UUID. Every Agent
+	type builds the same JSON, so the server normalizes what it receives
+	before storing or comparing it.
+*/
+package fingerprint
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"unicode"
+)
+
+const (
+	MaxLength      int = 1024 // of the encoded JSON
+	MaxFieldLength int = 128
+	MaxIPs         int = 8
+)
+
+var (
+	ErrTooLong error = errors.New("host fingerprint is too long")
+
+	// Script Agents report the architecture as the OS names it
+	archAliases map[string]string = map[string]string{
+		"x86_64":  "amd64",
+		"x64":     "amd64",
+		"aarch64": "arm64",
+		"armv8":   "arm64",
+		"i386":    "386",
+		"i686":    "386",
+		"x86":     "386",
+	}
+)
+
+type Fingerprint struct {
+	Hostname  string   `json:"hostname"`
+	OS        string   `json:"os"` // as GOOS, e.g. "linux" or "windows"
+	OSVersion string   `json:"os_version"`
+	Arch      string   `json:"arch"` // as GOARCH, e.g. "amd64"
+	MachineID string   `json:"machine_id"`
+	User      string   `json:"user"`
+	IPs       []string `json:"ips"` // the host's primary local addresses
+	PID       int      `json:"pid"`
+}
+
+/*
+	Parse a fingerprint sent by an Agent. Unknown fields are ignored and
+	every value is normalized, see `Normalize()`.
+*/
+func Parse(data string) (Fingerprint, error) {
+	var fingerprint Fingerprint
+	if len(data) > MaxLength {
+		return fingerprint, ErrTooLong
+	}
+
+	err := json.Unmarshal([]byte(data), &fingerprint)
+	if err != nil {
+		return fingerprint, errors.New("invalid host fingerprint: " + err.Error())
+	}
+
+	fingerprint.Normalize()
+	return fingerprint, nil
+}
+
+/*
+	Trim and shorten every value, lowercase the OS and architecture names
+	and map them to Go's, and drop invalid or excess IP addresses.
+*/
+func (fingerprint *Fingerprint) Normalize() {
+	fingerprint.Hostname = clean(fingerprint.Hostname)
+	fingerprint.OS = strings.ToLower(clean(fingerprint.OS))
+	fingerprint.OSVersion = clean(fingerprint.OSVersion)
+	fingerprint.Arch = strings.ToLower(clean(fingerprint.Arch))
+	fingerprint.MachineID = clean(fingerprint.MachineID)
+	fingerprint.User = clean(fingerprint.User)
+
+	if arch, ok := archAliases[fingerprint.Arch]; ok {
+		fingerprint.Arch = arch
+	}
+
+	ips := []string{}
+	for _, ip := range fingerprint.IPs {
+		parsedIP := net.ParseIP(strings.TrimSpace(ip))
+		if parsedIP == nil || len(ips) == MaxIPs {
+			continue
+		}
+		ips = append(ips, parsedIP.String())
+	}
+	fingerprint.IPs = ips
+
+	if fingerprint.PID < 0 {
+		fingerprint.PID = 0
+	}
+}
+
+// Strip control characters and surrounding whitespace, and cap the length.
+func clean(value string) string {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value))
+
+	if len(value) > MaxFieldLength {
+		// Don't leave half a character at the end
+		value = strings.ToValidUTF8(value[:MaxFieldLength], "")
+	}
+	return value
+}
+
+/*
+	Encode the fingerprint for a checkin, dropping IP addresses if needed to
+	stay within `MaxLength`.
+*/
+func (fingerprint Fingerprint) Encode() string {
+	fingerprint.Normalize()
+
+	for {
+		encoded, err := json.Marshal(fingerprint)
+		if err == nil && (len(encoded) <= MaxLength || len(fingerprint.IPs) == 0) {
+			return string(encoded)
+		}
+		fingerprint.IPs = fingerprint.IPs[:len(fingerprint.IPs)-1]
+	}
+}
+
+/*
+	The names of the fields identifying the host that differ between two
+	fingerprints: hostname, machine ID, OS, and architecture. A field that's
+	empty in either fingerprint is never counted. The user, IP addresses, and
+	process ID change without the Agent moving, so they aren't compared.
+*/
+func Changes(previous Fingerprint, current Fingerprint) []string {
+	changes := []string{}
+	compare := func(name string, previousValue string, currentValue string) {
+		if previousValue != "" && currentValue != "" && previousValue != currentValue {
+			changes = append(changes, name)
+		}
+	}
+
+	compare("hostname", previous.Hostname, current.Hostname)
+	compare("machine_id", previous.MachineID, current.MachineID)
+	compare("os", previous.OS, current.OS)
+	compare("arch", previous.Arch, current.Arch)
+
+	return changes
+}
+
+// A short description of the host for logs, e.g. "web01 (linux amd64) as www-data".
+func (fingerprint Fingerprint) String() string {
+	description := fingerprint.Hostname
+	if description == "" {
+		description = "unknown host"
+	}
+
+	platform := strings.TrimSpace(fingerprint.OS + " " + fingerprint.Arch)
+	if platform != "" {
+		description += " (" + platform + ")"
+	}
+	if fingerprint.User != "" {
+		description += " as " + fingerprint.User
+	}
+
+	return description
+}
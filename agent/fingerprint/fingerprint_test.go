@@ -0,0 +1,106 @@
+package fingerprint
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		data  string
+		want  Fingerprint
+		valid bool
+	}{
+		{
+			`{"hostname":"web01","os":"linux","os_version":"Ubuntu 22.04","arch":"amd64","machine_id":"abc123","user":"www-data","ips":["10.0.0.5"],"pid":4242}`,
+			Fingerprint{Hostname: "web01", OS: "linux", OSVersion: "Ubuntu 22.04", Arch: "amd64", MachineID: "abc123", User: "www-data", IPs: []string{"10.0.0.5"}, PID: 4242},
+			true,
+		},
+		{
+			`{"hostname":" WIN-DC01\r\n","os":"Windows","arch":"x86_64","ips":["not an ip"," fe80::0001 "],"pid":-1,"extra":true}`,
+			Fingerprint{Hostname: "WIN-DC01", OS: "windows", Arch: "amd64", IPs: []string{"fe80::1"}},
+			true,
+		},
+		{`{}`, Fingerprint{IPs: []string{}}, true},
+
+		// Malformed
+		{``, Fingerprint{}, false},
+		{`web01 linux amd64`, Fingerprint{}, false},
+		{`{"hostname":"web01"`, Fingerprint{}, false},
+		{`["web01","linux"]`, Fingerprint{}, false},
+		{`{"hostname":["web01"]}`, Fingerprint{}, false},
+		{`{"pid":"4242"}`, Fingerprint{}, false},
+		{`{"hostname":"` + strings.Repeat("a", MaxLength) + `"}`, Fingerprint{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.data)
+		if test.valid && (err != nil || !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("%.40q: Parse() = %+v, %v, want %+v", test.data, got, err, test.want)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%.40q: Parse() = %+v, want an error", test.data, got)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	previous := Fingerprint{Hostname: "web01", OS: "linux", OSVersion: "Ubuntu 22.04", Arch: "amd64", MachineID: "abc123", User: "www-data", IPs: []string{"10.0.0.5"}, PID: 4242}
+
+	tests := []struct {
+		description string
+		change      func(current *Fingerprint)
+		want        []string
+	}{
+		{"identical", func(current *Fingerprint) {}, []string{}},
+		{"hostname", func(current *Fingerprint) { current.Hostname = "web02" }, []string{"hostname"}},
+		{"machine ID", func(current *Fingerprint) { current.MachineID = "def456" }, []string{"machine_id"}},
+		{"OS", func(current *Fingerprint) { current.OS = "freebsd" }, []string{"os"}},
+		{"architecture", func(current *Fingerprint) { current.Arch = "arm64" }, []string{"arch"}},
+		{"another host", func(current *Fingerprint) {
+			*current = Fingerprint{Hostname: "dc01", OS: "windows", Arch: "386", MachineID: "def456"}
+		}, []string{"hostname", "machine_id", "os", "arch"}},
+
+		// Not compared
+		{"user, IPs, PID and OS version", func(current *Fingerprint) {
+			current.User = "root"
+			current.IPs = []string{"10.0.0.6"}
+			current.PID = 1
+			current.OSVersion = "Ubuntu 24.04"
+		}, []string{}},
+		{"fields not reported", func(current *Fingerprint) {
+			*current = Fingerprint{Hostname: "web01"}
+		}, []string{}},
+	}
+
+	for _, test := range tests {
+		current := previous
+		test.change(&current)
+		if got := Changes(previous, current); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Changes() = %v, want %v", test.description, got, test.want)
+		}
+		if got := Changes(current, previous); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Changes() back = %v, want %v", test.description, got, test.want)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	fingerprint := Fingerprint{Hostname: "web01", OS: "linux", Arch: "arm64", MachineID: "abc123", PID: 7}
+	for i := 0; i < 200; i++ {
+		fingerprint.IPs = append(fingerprint.IPs, "10.0.0.1")
+	}
+
+	encoded := fingerprint.Encode()
+	if len(encoded) > MaxLength {
+		t.Fatalf("Encode() is %d bytes, want at most %d", len(encoded), MaxLength)
+	}
+	parsed, err := Parse(encoded)
+	if err != nil {
+		t.Fatalf("Parse(Encode()) = %v", err)
+	}
+	if len(parsed.IPs) != MaxIPs || len(Changes(fingerprint, parsed)) != 0 {
+		t.Errorf("Parse(Encode()) = %+v, want the same host with %d IPs", parsed, MaxIPs)
+	}
+}
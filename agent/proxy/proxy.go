@@ -0,0 +1,328 @@
+/*
+	Dials callback servers directly or through an HTTP CONNECT or SOCKS5
+	proxy, for target networks that only reach the outside world through a
+	proxy.
+
+	Proxies are given as URLs: "http://[user:password@]host:port" for HTTP
+	CONNECT, "socks5://[user:password@]host:port" for SOCKS5 with the
+	callback server's hostname resolved locally, or "socks5h://..." to have
+	the proxy resolve it.
+*/
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Where a Dialer's proxy came from.
+const (
+	SourceNone        string = ""
+	SourceBuild       string = "build"
+	SourceEnvironment string = "environment"
+)
+
+var (
+	ErrUnsupportedScheme error = errors.New("proxy scheme must be http, socks5, or socks5h")
+
+	// Checked in order, the first one set is used. HTTPS_PROXY is the one
+	// that applies since callbacks are TLS.
+	environmentVariables []string = []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"}
+)
+
+type Dialer struct {
+	Forward *net.Dialer // reaches the proxy, or the server itself when there's no proxy
+	Proxy   *url.URL    // nil to dial directly
+	Source  string      // SourceBuild or SourceEnvironment, for diagnostics
+}
+
+/*
+	Parse and check a proxy URL. Only the scheme, host, port, and optional
+	username and password are allowed.
+*/
+func Parse(proxyURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.New("invalid proxy URL")
+	}
+
+	switch parsedURL.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, ErrUnsupportedScheme
+	}
+
+	if parsedURL.Hostname() == "" || (parsedURL.Path != "" && parsedURL.Path != "/") || parsedURL.RawQuery != "" || parsedURL.Fragment != "" {
+		return nil, errors.New("proxy URL must be in the form scheme://[user:password@]host:port")
+	}
+	if port, err := strconv.Atoi(parsedURL.Port()); err != nil || port < 1 || port > 65535 {
+		return nil, errors.New("proxy URL must include a valid port")
+	}
+
+	return parsedURL, nil
+}
+
+/*
+	Create a dialer that uses `buildProxy` if one was set at build time,
+	otherwise the first proxy found in the environment, otherwise no proxy.
+*/
+func New(forward *net.Dialer, buildProxy string) (*Dialer, error) {
+	dialer := &Dialer{Forward: forward}
+
+	if buildProxy != "" {
+		proxyURL, err := Parse(buildProxy)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Proxy, dialer.Source = proxyURL, SourceBuild
+		return dialer, nil
+	}
+
+	for _, variable := range environmentVariables {
+		value := os.Getenv(variable)
+		if value == "" {
+			continue
+		}
+
+		proxyURL, err := Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", variable, err)
+		}
+		dialer.Proxy, dialer.Source = proxyURL, SourceEnvironment
+		break
+	}
+
+	return dialer, nil
+}
+
+// A description of how connections are made, for `--test`.
+func (dialer *Dialer) Path() string {
+	if dialer.Proxy == nil {
+		return "direct"
+	}
+
+	kind := "HTTP CONNECT"
+	if dialer.Proxy.Scheme != "http" {
+		kind = "SOCKS5"
+	}
+
+	auth := ""
+	if dialer.Proxy.User != nil {
+		auth = " with authentication"
+	}
+
+	return kind + " proxy " + dialer.Proxy.Host + auth + " (from " + dialer.Source + ")"
+}
+
+/*
+	Open a TCP connection to `address` ("host:port"), tunnelled through the
+	proxy if there is one.
+*/
+func (dialer *Dialer) Dial(address string) (net.Conn, error) {
+	if dialer.Proxy == nil {
+		return dialer.Forward.Dial("tcp", address)
+	}
+
+	conn, err := dialer.Forward.Dial("tcp", dialer.Proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach proxy: %w", err)
+	}
+
+	// Don't let a stalled proxy hang the Agent
+	if dialer.Forward.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Forward.Timeout))
+	}
+
+	tunnel := conn
+	if dialer.Proxy.Scheme == "http" {
+		tunnel, err = dialer.connectHTTP(conn, address)
+	} else {
+		err = dialer.connectSOCKS5(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// A connection whose first bytes were already buffered while reading the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn bufferedConn) Read(buffer []byte) (int, error) {
+	return conn.reader.Read(buffer)
+}
+
+func (dialer *Dialer) connectHTTP(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if dialer.Proxy.User != nil {
+		password, _ := dialer.Proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(dialer.Proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from proxy: %w", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("proxy refused CONNECT: " + response.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// SOCKS5 as described by RFC 1928, with username/password authentication from RFC 1929.
+const (
+	socksVersion         byte = 5
+	socksNoAuth          byte = 0
+	socksPasswordAuth    byte = 2
+	socksNoMethods       byte = 0xff
+	socksConnect         byte = 1
+	socksAddressIPv4     byte = 1
+	socksAddressHostname byte = 3
+	socksAddressIPv6     byte = 4
+)
+
+func (dialer *Dialer) connectSOCKS5(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	// socks5:// resolves the server's hostname locally, socks5h:// lets the proxy do it
+	if net.ParseIP(host) == nil && dialer.Proxy.Scheme == "socks5" {
+		addresses, err := net.LookupIP(host)
+		if err != nil || len(addresses) == 0 {
+			return fmt.Errorf("could not resolve '%s': %w", host, err)
+		}
+		host = addresses[0].String()
+	}
+
+	/* --- Choose an authentication method --- */
+	methods := []byte{socksNoAuth}
+	if dialer.Proxy.User != nil {
+		methods = []byte{socksPasswordAuth}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("invalid response from proxy: %w", err)
+	}
+	if reply[0] != socksVersion || reply[1] == socksNoMethods || (reply[1] != socksNoAuth && reply[1] != socksPasswordAuth) {
+		return errors.New("proxy accepted none of our authentication methods")
+	}
+
+	if reply[1] == socksPasswordAuth {
+		if dialer.Proxy.User == nil {
+			return errors.New("proxy requires a username and password")
+		}
+		username := dialer.Proxy.User.Username()
+		password, _ := dialer.Proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("proxy username and password must be at most 255 bytes")
+		}
+
+		authRequest := []byte{1, byte(len(username))}
+		authRequest = append(authRequest, username...)
+		authRequest = append(authRequest, byte(len(password)))
+		authRequest = append(authRequest, password...)
+		if _, err = conn.Write(authRequest); err != nil {
+			return err
+		}
+
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("invalid response from proxy: %w", err)
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy rejected our username and password")
+		}
+	}
+
+	/* --- Connect to the server --- */
+	connectRequest := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("hostname too long for SOCKS5")
+		}
+		connectRequest = append(connectRequest, socksAddressHostname, byte(len(host)))
+		connectRequest = append(connectRequest, host...)
+	} else if ipv4 := ip.To4(); ipv4 != nil {
+		connectRequest = append(connectRequest, socksAddressIPv4)
+		connectRequest = append(connectRequest, ipv4...)
+	} else {
+		connectRequest = append(connectRequest, socksAddressIPv6)
+		connectRequest = append(connectRequest, ip.To16()...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	connectRequest = append(connectRequest, portBytes...)
+	if _, err = conn.Write(connectRequest); err != nil {
+		return err
+	}
+
+	// Version, reply code, reserved, address type
+	connectReply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, connectReply); err != nil {
+		return fmt.Errorf("invalid response from proxy: %w", err)
+	}
+	if connectReply[1] != 0 {
+		return fmt.Errorf("proxy could not connect to the server (SOCKS5 reply %d)", connectReply[1])
+	}
+
+	// Skip the bound address and port, we don't need them
+	var boundAddressLength int
+	switch connectReply[3] {
+	case socksAddressIPv4:
+		boundAddressLength = net.IPv4len
+	case socksAddressIPv6:
+		boundAddressLength = net.IPv6len
+	case socksAddressHostname:
+		lengthByte := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lengthByte); err != nil {
+			return err
+		}
+		boundAddressLength = int(lengthByte[0])
+	default:
+		return errors.New("invalid response from proxy: unknown address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundAddressLength+2))
+	return err
+}
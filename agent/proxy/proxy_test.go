@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	--- Fakes ---
+	: A callback server that greets every connection then echoes, and HTTP
+	  CONNECT and SOCKS5 proxies in front of it, all on the loopback
+	  interface.
+*/
+
+type fakeProxy struct {
+	username, password string // required when set
+	refuse             bool   // refuse every tunnel
+	requested          chan string
+}
+
+func listen(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func startServer(t *testing.T) string {
+	return listen(t, func(conn net.Conn) {
+		conn.Write([]byte("hello\n"))
+		io.Copy(conn, conn)
+	})
+}
+
+// Relay between the client and the server until either side is done.
+func relay(client io.ReadWriter, server net.Conn) {
+	go io.Copy(server, client)
+	io.Copy(client, server)
+}
+
+func startHTTPProxy(t *testing.T, proxy *fakeProxy) string {
+	proxy.requested = make(chan string, 1)
+	return listen(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil || request.Method != http.MethodConnect {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+		proxy.requested <- request.Host
+
+		if proxy.username != "" {
+			expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.username+":"+proxy.password))
+			if request.Header.Get("Proxy-Authorization") != expected {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+				return
+			}
+		}
+		if proxy.refuse {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+			return
+		}
+
+		server, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		defer server.Close()
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		relay(struct {
+			io.Reader
+			io.Writer
+		}{reader, conn}, server)
+	})
+}
+
+// Requested addresses are recorded as "<address type>:<host:port>".
+func startSOCKS5Proxy(t *testing.T, proxy *fakeProxy) string {
+	proxy.requested = make(chan string, 1)
+	return listen(t, func(conn net.Conn) {
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		methods := make([]byte, greeting[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+
+		wanted := socksNoAuth
+		if proxy.username != "" {
+			wanted = socksPasswordAuth
+		}
+		if !strings.ContainsRune(string(methods), rune(wanted)) {
+			conn.Write([]byte{socksVersion, socksNoMethods})
+			return
+		}
+		conn.Write([]byte{socksVersion, wanted})
+
+		if wanted == socksPasswordAuth {
+			credentials := make([]string, 2)
+			for i := range credentials {
+				header := make([]byte, 2-i) // version and username length, then password length
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				credential := make([]byte, header[len(header)-1])
+				if _, err := io.ReadFull(conn, credential); err != nil {
+					return
+				}
+				credentials[i] = string(credential)
+			}
+			if credentials[0] != proxy.username || credentials[1] != proxy.password {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil || request[1] != socksConnect {
+			return
+		}
+		var host string
+		switch request[3] {
+		case socksAddressIPv4, socksAddressIPv6:
+			ip := make([]byte, net.IPv4len)
+			if request[3] == socksAddressIPv6 {
+				ip = make([]byte, net.IPv6len)
+			}
+			if _, err := io.ReadFull(conn, ip); err != nil {
+				return
+			}
+			host = net.IP(ip).String()
+		case socksAddressHostname:
+			length := make([]byte, 1)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			hostname := make([]byte, length[0])
+			if _, err := io.ReadFull(conn, hostname); err != nil {
+				return
+			}
+			host = string(hostname)
+		}
+		portBytes := make([]byte, 2)
+		if _, err := io.ReadFull(conn, portBytes); err != nil {
+			return
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+		proxy.requested <- strconv.Itoa(int(request[3])) + ":" + address
+
+		// Connection refused, bound to 0.0.0.0:0
+		if proxy.refuse {
+			conn.Write([]byte{socksVersion, 5, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+
+		server, err := net.Dial("tcp", address)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 1, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer server.Close()
+
+		// Bound to a hostname, which the client must skip too
+		reply := []byte{socksVersion, 0, 0, socksAddressHostname, 9}
+		reply = append(reply, "localhost"...)
+		conn.Write(append(reply, portBytes...))
+		relay(conn, server)
+	})
+}
+
+func newDialer(t *testing.T, proxyURL string) *Dialer {
+	dialer, err := New(&net.Dialer{Timeout: 5 * time.Second}, proxyURL)
+	if err != nil {
+		t.Fatalf("New(%q) failed: %v", proxyURL, err)
+	}
+	return dialer
+}
+
+// Check the tunnel reaches the fake callback server both ways.
+func checkTunnel(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	if greeting, err := reader.ReadString('\n'); err != nil || greeting != "hello\n" {
+		t.Fatalf("Read %q, %v through the tunnel, want the server's greeting", greeting, err)
+	}
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("Could not write through the tunnel: %v", err)
+	}
+	if echo, err := reader.ReadString('\n'); err != nil || echo != "ping\n" {
+		t.Fatalf("Read %q, %v through the tunnel, want the echo", echo, err)
+	}
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	serverAddress := startServer(t)
+
+	tests := []struct {
+		name  string
+		proxy fakeProxy
+		user  string // in the proxy URL
+		ok    bool
+	}{
+		{"no authentication", fakeProxy{}, "", true},
+		{"basic authentication", fakeProxy{username: "agent", password: "p@ss:word"}, url.UserPassword("agent", "p@ss:word").String() + "@", true},
+		{"wrong password", fakeProxy{username: "agent", password: "secret"}, "agent:wrong@", false},
+		{"missing credentials", fakeProxy{username: "agent", password: "secret"}, "", false},
+		{"tunnel refused", fakeProxy{refuse: true}, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxyAddress := startHTTPProxy(t, &test.proxy)
+			dialer := newDialer(t, "http://"+test.user+proxyAddress)
+
+			conn, err := dialer.Dial(serverAddress)
+			if requested := <-test.proxy.requested; requested != serverAddress {
+				t.Errorf("Proxy was asked for %q, want %q", requested, serverAddress)
+			}
+			if !test.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Dial() succeeded through a proxy that refused the tunnel")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial() failed: %v", err)
+			}
+			checkTunnel(t, conn)
+		})
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	serverAddress := startServer(t)
+	_, serverPort, _ := net.SplitHostPort(serverAddress)
+
+	tests := []struct {
+		name      string
+		proxy     fakeProxy
+		scheme    string
+		user      string // in the proxy URL
+		address   string // dialled through the proxy
+		requested string // what the proxy is asked for, see `startSOCKS5Proxy()`
+		ok        bool
+	}{
+		{"no authentication", fakeProxy{}, "socks5", "", serverAddress, "1:" + serverAddress, true},
+		{"password authentication", fakeProxy{username: "agent", password: "secret"}, "socks5", "agent:secret@", serverAddress, "1:" + serverAddress, true},
+		{"wrong password", fakeProxy{username: "agent", password: "secret"}, "socks5", "agent:wrong@", serverAddress, "", false},
+		{"missing credentials", fakeProxy{username: "agent", password: "secret"}, "socks5", "", serverAddress, "", false},
+		{"resolved locally", fakeProxy{}, "socks5", "", "localhost:" + serverPort, "", true},
+		{"resolved by the proxy", fakeProxy{}, "socks5h", "", "localhost:" + serverPort, "3:localhost:" + serverPort, true},
+		{"tunnel refused", fakeProxy{refuse: true}, "socks5", "", serverAddress, "1:" + serverAddress, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxyAddress := startSOCKS5Proxy(t, &test.proxy)
+			dialer := newDialer(t, test.scheme+"://"+test.user+proxyAddress)
+
+			conn, err := dialer.Dial(test.address)
+			if !test.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Dial() succeeded through a proxy that refused the tunnel")
+				}
+			} else if err != nil {
+				t.Fatalf("Dial() failed: %v", err)
+			}
+
+			select {
+			case requested := <-test.proxy.requested:
+				if test.requested != "" && requested != test.requested {
+					t.Errorf("Proxy was asked for %q, want %q", requested, test.requested)
+				}
+				if test.requested == "" && strings.HasPrefix(requested, "3:") {
+					t.Errorf("Proxy was asked to resolve %q, the Agent should have", requested)
+				}
+			default:
+				if test.ok || test.requested != "" {
+					t.Error("Proxy was never asked for a tunnel")
+				}
+			}
+
+			if test.ok {
+				checkTunnel(t, conn)
+			}
+		})
+	}
+}
+
+func TestDialDirect(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("https_proxy", "")
+	t.Setenv("ALL_PROXY", "")
+	t.Setenv("all_proxy", "")
+
+	dialer := newDialer(t, "")
+	if dialer.Proxy != nil || dialer.Path() != "direct" {
+		t.Fatalf("Dialer without a proxy goes %s", dialer.Path())
+	}
+
+	conn, err := dialer.Dial(startServer(t))
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	checkTunnel(t, conn)
+}
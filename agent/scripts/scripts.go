@@ -0,0 +1,7 @@
+// Templates for script Agents, embedded so the site needs no files on disk.
+package scripts
+
+import "embed"
+
+//go:embed *.tmpl
+var Templates embed.FS
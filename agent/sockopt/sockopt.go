@@ -0,0 +1,9 @@
+/*
+	Socket options for the Agent's outgoing connections, set through
+	`net.Dialer.Control` before the socket is bound.
+
+	Agents call back from the same local port every time. Without
+	SO_REUSEADDR that port can't be bound again while the previous
+	connection sits in TIME_WAIT.
+*/
+package sockopt
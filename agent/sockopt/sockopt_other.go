@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !illumos && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!illumos,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package sockopt
+
+import "syscall"
+
+// Not supported on this platform, the local port may take a while to become reusable.
+func ReuseAddress(network string, address string, conn syscall.RawConn) error {
+	return nil
+}
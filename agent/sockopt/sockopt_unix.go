@@ -0,0 +1,18 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
+
+package sockopt
+
+import "syscall"
+
+// Allow binding a local port that still has connections in TIME_WAIT.
+func ReuseAddress(network string, address string, conn syscall.RawConn) error {
+	var setErr error
+	err := conn.Control(func(fd uintptr) {
+		setErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package sockopt
+
+import "syscall"
+
+/*
+	Allow binding a local port that still has connections in TIME_WAIT.
+	Windows' SO_REUSEADDR is looser than on other platforms (it also lets
+	two sockets bind the same port), which is fine for a client socket.
+*/
+func ReuseAddress(network string, address string, conn syscall.RawConn) error {
+	var setErr error
+	err := conn.Control(func(fd uintptr) {
+		setErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,386 @@
+/*
+	The single `pwnts` executable. Templates, static files and SQL are
+	embedded, so a deployment only needs this binary, the TLS certificate
+	and key (`pwnts_cert.pem`, `pwnts_key.pem` in the working directory),
+	and the Agent stubs.
+
+	Commands:
+		serve callbacks:	Run the callback server.
+			--test:				Listen on localhost instead of the default interface's IP address.
+			--port:				Port to listen on, unless the config lists `callbacks.listeners`.
+			--quiet:			Don't print the banner.
+		serve site:			Run the web application.
+			--test, --port:		As above, for the site.
+			--rebuild-stubs:	Rebuild every Agent stub at startup.
+		serve all:			Run both in one process, sharing the config and database.
+			--callback-port, --site-port, --test, --rebuild-stubs, --quiet
+		serve collector:	Run a callback listener that forwards to the central callback
+							server (the config's `collectors` section), without a database.
+			--test, --port, --quiet:	As for `serve callbacks`.
+		db init:			Create the database and its tables.
+		db migrate:			Apply the pending schema migrations. Serving also applies them on startup.
+		db verify-holdings:	Check the host holdings against the ones recomputed from every checkin.
+		db rebuild-holdings:
+							Recompute the host holdings from every checkin, then verify them.
+		team add:			Create a team with --name and --password.
+		target import:		Add the targets in a file of "ip,value" lines (default `tools/targets.txt`).
+		agent add:			Register an Agent UUID with --team-id, see `pwnts agent add --help`.
+		agent list:			List every Agent, or only those of --team-id.
+
+	Every command takes --config (the JSON config file) and --database (the
+	Sqlite3 database file, unless the config's `database.backend` is
+	"postgres").
+
+	Signals, while serving:
+		SIGINT, SIGTERM:	Stop accepting, finish the callbacks, requests and Agent builds
+							already received (for up to `shutdown_timeout`), then flush and
+							close the database.
+		SIGHUP:				Reload the config file, the build targets and the TLS
+							certificate without closing the listeners.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/s-christian/pwnts/server"
+	"github.com/s-christian/pwnts/site"
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/tools"
+	"github.com/s-christian/pwnts/utils"
+)
+
+type command struct {
+	name        string // the words that select it, e.g. "serve callbacks"
+	description string
+	run         func(flags *flag.FlagSet, paths *commonPaths)
+}
+
+// Flags every command takes.
+type commonPaths struct {
+	configPath   string
+	databasePath string
+}
+
+var commands []command = []command{
+	{"serve callbacks", "Run the callback server", serveCallbacks},
+	{"serve site", "Run the web application", serveSite},
+	{"serve all", "Run the callback server and the web application in one process", serveAll},
+	{"serve collector", "Run a callback listener that forwards to the central callback server", serveCollector},
+	{"db init", "Create the database and its tables", initDatabase},
+	{"db migrate", "Apply the pending schema migrations", migrateDatabase},
+	{"db verify-holdings", "Check the host holdings against the ones recomputed from every checkin", verifyHoldings},
+	{"db rebuild-holdings", "Recompute the host holdings from every checkin, then verify them", rebuildHoldings},
+	{"team add", "Create a team", addTeam},
+	{"target import", "Add the targets in a file of \"ip,value\" lines", importTargets},
+	{"agent add", "Register an Agent UUID", addAgent},
+	{"agent list", "List the registered Agents", listAgents},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: pwnts <command> [flags], where <command> is one of:")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-22s%s\n", command.name, command.description)
+	}
+	fmt.Fprintln(os.Stderr, "Run `pwnts <command> --help` for its flags.")
+}
+
+/*
+	Open the database `config.database` selects and exit unless it's valid.
+	With `migrate`, apply the pending migrations first instead of refusing
+	an older schema.
+*/
+func openDatabase(paths *commonPaths, config utils.Config, migrate bool) storage.Repository {
+	utils.DatabaseFilepath = paths.databasePath
+	repository := storage.OpenExit(config.Database, paths.databasePath)
+	if migrate {
+		storage.MigrateExit(repository)
+	} else {
+		storage.ValidateExit(repository)
+	}
+	return repository
+}
+
+/*
+	--- Serving ---
+*/
+
+// Read the config file again on SIGHUP, keeping `config` if it's invalid.
+func reloadConfig(paths *commonPaths, config utils.Config) utils.Config {
+	utils.Log(utils.Info, "Reloading config and TLS certificate")
+
+	newConfig, err := utils.LoadConfig(paths.configPath)
+	if utils.CheckError(utils.Error, err, "Could not reload config file '"+paths.configPath+"', keeping the current config") {
+		return config
+	}
+
+	utils.Log(utils.Done, "Reloaded config")
+	return newConfig
+}
+
+/*
+	Start the callback server, the site, or both on one config and database,
+	and keep them running until SIGINT or SIGTERM.
+*/
+func serve(paths *commonPaths, callbackOptions *server.Options, siteOptions *site.Options) {
+	config := utils.LoadConfigExit(paths.configPath)
+	repository := openDatabase(paths, config, true)
+	defer storage.Close(repository)
+
+	if callbackOptions != nil {
+		server.Start(repository, config, *callbackOptions)
+	}
+	if siteOptions != nil {
+		site.Start(repository, config, *siteOptions)
+	}
+
+	utils.WaitForShutdown(func() {
+		newConfig := reloadConfig(paths, config)
+		if newConfig.Database != config.Database {
+			utils.Log(utils.Warning, "The database config changed, restart to use it")
+		}
+		config = newConfig
+
+		if callbackOptions != nil {
+			server.Reload(newConfig)
+		}
+		if siteOptions != nil {
+			site.Reload(newConfig)
+		}
+	})
+
+	// Both drain at the same time, each within `shutdown_timeout`
+	var stopping sync.WaitGroup
+	if callbackOptions != nil {
+		stopping.Add(1)
+		go func() {
+			defer stopping.Done()
+			server.Shutdown()
+		}()
+	}
+	if siteOptions != nil {
+		stopping.Add(1)
+		go func() {
+			defer stopping.Done()
+			site.Shutdown()
+		}()
+	}
+	stopping.Wait()
+}
+
+func serveCallbacks(flags *flag.FlagSet, paths *commonPaths) {
+	var options server.Options
+	var argQuiet bool
+	flags.BoolVar(&options.Test, "test", false, "Listen on localhost instead of the default interface's IP address")
+	flags.IntVar(&options.Port, "port", 444, "Port to listen on, unless the config lists `callbacks.listeners`")
+	flags.BoolVar(&argQuiet, "quiet", false, "Don't print the banner")
+	flags.Parse(os.Args[3:])
+
+	if !argQuiet {
+		server.PrintBanner()
+	}
+	serve(paths, &options, nil)
+}
+
+func serveSite(flags *flag.FlagSet, paths *commonPaths) {
+	var options site.Options
+	flags.BoolVar(&options.Test, "test", false, "Listen on localhost instead of the default interface's IP address")
+	flags.IntVar(&options.Port, "port", 443, "Port to listen on")
+	flags.BoolVar(&options.RebuildStubs, "rebuild-stubs", false, "Rebuild every Agent stub at startup, e.g. after changing `agent/agent.go`")
+	flags.Parse(os.Args[3:])
+
+	utils.Log(utils.Debug, "----------Initializing----------")
+	serve(paths, nil, &options)
+}
+
+func serveAll(flags *flag.FlagSet, paths *commonPaths) {
+	var callbackOptions server.Options
+	var siteOptions site.Options
+	var argQuiet bool
+	flags.BoolVar(&siteOptions.Test, "test", false, "Listen on localhost instead of the default interface's IP address")
+	flags.IntVar(&callbackOptions.Port, "callback-port", 444, "Port to listen for callbacks on, unless the config lists `callbacks.listeners`")
+	flags.IntVar(&siteOptions.Port, "site-port", 443, "Port to serve the site on")
+	flags.BoolVar(&siteOptions.RebuildStubs, "rebuild-stubs", false, "Rebuild every Agent stub at startup, e.g. after changing `agent/agent.go`")
+	flags.BoolVar(&argQuiet, "quiet", false, "Don't print the banner")
+	flags.Parse(os.Args[3:])
+	callbackOptions.Test = siteOptions.Test
+
+	if !argQuiet {
+		server.PrintBanner()
+	}
+	serve(paths, &callbackOptions, &siteOptions)
+}
+
+/*
+	Run a collector until SIGINT or SIGTERM. It has no database, see
+	`server.StartCollector()`.
+*/
+func serveCollector(flags *flag.FlagSet, paths *commonPaths) {
+	var options server.Options
+	var argQuiet bool
+	flags.BoolVar(&options.Test, "test", false, "Listen on localhost instead of the default interface's IP address")
+	flags.IntVar(&options.Port, "port", 444, "Port to listen on, unless the config lists `callbacks.listeners`")
+	flags.BoolVar(&argQuiet, "quiet", false, "Don't print the banner")
+	flags.Parse(os.Args[3:])
+
+	if !argQuiet {
+		server.PrintBanner()
+	}
+
+	config := utils.LoadConfigExit(paths.configPath)
+	server.StartCollector(config, options)
+
+	utils.WaitForShutdown(func() {
+		config = reloadConfig(paths, config)
+		server.Reload(config)
+	})
+
+	server.Shutdown()
+}
+
+/*
+	--- Administration ---
+*/
+
+func initDatabase(flags *flag.FlagSet, paths *commonPaths) {
+	flags.Parse(os.Args[3:])
+
+	utils.DatabaseFilepath = paths.databasePath
+	tools.InitializeDatabase(utils.LoadConfigExit(paths.configPath).Database)
+}
+
+func migrateDatabase(flags *flag.FlagSet, paths *commonPaths) {
+	flags.Parse(os.Args[3:])
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), true)
+	storage.Close(repository)
+}
+
+func verifyHoldings(flags *flag.FlagSet, paths *commonPaths) {
+	flags.Parse(os.Args[3:])
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), false)
+	defer utils.Close(repository)
+
+	if !tools.VerifyHostHoldings(repository) {
+		os.Exit(utils.ERR_DATABASE_INVALID)
+	}
+}
+
+func rebuildHoldings(flags *flag.FlagSet, paths *commonPaths) {
+	flags.Parse(os.Args[3:])
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), false)
+	defer utils.Close(repository)
+
+	tools.RebuildHostHoldings(repository)
+	if !tools.VerifyHostHoldings(repository) {
+		os.Exit(utils.ERR_DATABASE_INVALID)
+	}
+}
+
+func addTeam(flags *flag.FlagSet, paths *commonPaths) {
+	var argName, argPassword string
+	flags.StringVar(&argName, "name", "", "The name of the team")
+	flags.StringVar(&argPassword, "password", "", "The plaintext password for the team (to be hashed with bcrypt)")
+	flags.Parse(os.Args[3:])
+
+	if argName == "" || argPassword == "" {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "A `--name` and `--password` must be provided")
+	}
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), false)
+	defer utils.Close(repository)
+
+	tools.RegisterTeam(repository, argName, argPassword)
+}
+
+func importTargets(flags *flag.FlagSet, paths *commonPaths) {
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: pwnts target import [flags] [file], the file defaults to `tools/targets.txt`")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[3:])
+
+	targetsPath := utils.CurrentDirectory + "/tools/targets.txt"
+	if flags.NArg() > 0 {
+		targetsPath = flags.Arg(0)
+	}
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), false)
+	defer utils.Close(repository)
+
+	tools.RegisterTargetsFromFile(repository, targetsPath)
+}
+
+func addAgent(flags *flag.FlagSet, paths *commonPaths) {
+	var agent utils.AgentRegistration
+	flags.IntVar(&agent.TeamID, "team-id", -1, "The Team ID the Agent should belong to (required)")
+	flags.StringVar(&agent.AgentType, "agent-type", utils.AgentTypeBinary, "The kind of Agent being registered: "+strings.Join(utils.AgentTypes, ", "))
+	flags.IntVar(&agent.CallbackMinutes, "callback-mins", 0, "The Agent's callback frequency in minutes, used to score jittered callbacks (0 if unknown)")
+	flags.IntVar(&agent.JitterPercent, "jitter", 0, "The Agent's callback jitter percentage")
+	flags.IntVar(&agent.LocalPort, "local-port", 0, "The source port the Agent calls back from, used to detect root access (0 if it doesn't bind one)")
+	flags.StringVar(&agent.Platform, "platform", "", "The Agent's \"os/arch\" platform, if known")
+	flags.StringVar(&agent.TargetIP, "target", "", "The in-scope target IP the Agent may only call back from, if any")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: pwnts agent add --team-id <id> [flags] <uuid>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[3:])
+
+	if flags.NArg() != 1 {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "Please give the Agent's UUID")
+	}
+	if agent.TeamID == -1 {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "Please specify a `--team-id <integer>`")
+	}
+	agent.AgentUUID = flags.Arg(0)
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), false)
+	defer utils.Close(repository)
+
+	tools.ValidateTeamID(repository, agent.TeamID)
+	err := storage.RegisterAgent(repository, agent)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not register Agent")
+}
+
+func listAgents(flags *flag.FlagSet, paths *commonPaths) {
+	var argTeamID int
+	flags.IntVar(&argTeamID, "team-id", -1, "Only list the Agents of this team")
+	flags.Parse(os.Args[3:])
+
+	repository := openDatabase(paths, utils.LoadConfigExit(paths.configPath), false)
+	defer utils.Close(repository)
+
+	tools.ListAgents(repository, argTeamID)
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+		os.Exit(utils.ERR_USAGE)
+	}
+
+	name := os.Args[1] + " " + os.Args[2]
+	for _, command := range commands {
+		if command.name != name {
+			continue
+		}
+
+		flags := flag.NewFlagSet("pwnts "+name, flag.ExitOnError)
+		paths := &commonPaths{}
+		flags.StringVar(&paths.configPath, "config", utils.ConfigFilepath, "Path to the JSON config file")
+		flags.StringVar(&paths.databasePath, "database", utils.DatabaseFilepath, "Path to the Sqlite3 database file, for the sqlite database backend")
+
+		command.run(flags, paths)
+		return
+	}
+
+	utils.LogPlain(utils.Error, "Unknown command `"+name+"`")
+	usage()
+	os.Exit(utils.ERR_USAGE)
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	The callbacks a collector has received but the central node doesn't
+	have yet, kept on disk so that neither an outage of the central node nor
+	a restart of the collector loses any. Callbacks are appended to the
+	newest of a series of segment files, one JSON object per line, and
+	forwarded from the oldest. How far a segment has been forwarded is kept
+	next to it, in a ".sent" file holding the byte offset.
+*/
+type callbackBuffer struct {
+	directory string
+
+	mutex     sync.Mutex
+	segments  []string // file names, oldest first
+	appending *os.File // the last segment, nil until the next `Append()` starts a new one
+	pending   int      // callbacks not forwarded yet
+}
+
+const segmentPrefix, segmentSuffix string = "callbacks-", ".jsonl"
+
+/*
+	Open the buffer in `directory`, creating it if needed. Segments left by
+	a previous run are forwarded first, new callbacks always start a new
+	segment.
+*/
+func openCallbackBuffer(directory string) (*callbackBuffer, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	dirEntries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := &callbackBuffer{directory: directory}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		numPending, err := buffer.countPending(name)
+		if err != nil {
+			return nil, err
+		}
+		buffer.segments = append(buffer.segments, name)
+		buffer.pending += numPending
+	}
+	sort.Strings(buffer.segments)
+
+	return buffer, nil
+}
+
+func (buffer *callbackBuffer) segmentPath(segment string) string {
+	return filepath.Join(buffer.directory, segment)
+}
+
+// The byte offset up to which the segment has been forwarded.
+func (buffer *callbackBuffer) sentOffset(segment string) (int64, error) {
+	offsetFileContents, err := os.ReadFile(buffer.segmentPath(segment) + ".sent")
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// A ".sent" file cut short by a crash means sending some callbacks again, the central node ignores them
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(offsetFileContents)), 10, 64)
+	if err != nil {
+		utils.Log(utils.Warning, "Invalid offset in", buffer.segmentPath(segment)+".sent, forwarding the whole segment again")
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// The number of lines in the segment that haven't been forwarded.
+func (buffer *callbackBuffer) countPending(segment string) (int, error) {
+	offset, err := buffer.sentOffset(segment)
+	if err != nil {
+		return 0, err
+	}
+
+	segmentContents, err := os.ReadFile(buffer.segmentPath(segment))
+	if err != nil {
+		return 0, err
+	}
+	if offset > int64(len(segmentContents)) {
+		return 0, nil
+	}
+	return bytes.Count(segmentContents[offset:], []byte("\n")), nil
+}
+
+// The number of callbacks not forwarded yet.
+func (buffer *callbackBuffer) Len() int {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.pending
+}
+
+/*
+	Add a callback to the newest segment. It's synced to disk before this
+	returns, callbacks are few enough that this costs nothing noticeable.
+*/
+func (buffer *callbackBuffer) Append(callback forwardedCallback) error {
+	line, err := json.Marshal(callback)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if buffer.appending == nil {
+		segment := fmt.Sprintf("%s%020d%s", segmentPrefix, time.Now().UnixNano(), segmentSuffix)
+		buffer.appending, err = os.OpenFile(buffer.segmentPath(segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		buffer.segments = append(buffer.segments, segment)
+	}
+
+	if _, err = buffer.appending.Write(line); err != nil {
+		return err
+	}
+	if err = buffer.appending.Sync(); err != nil {
+		return err
+	}
+
+	buffer.pending++
+	return nil
+}
+
+/*
+	Read up to `max` of the oldest callbacks not forwarded yet. Once they
+	have been, `commit()` marks them as forwarded so they're never read
+	again. Returns no callbacks if there are none.
+
+	Only the goroutine forwarding callbacks may call this.
+*/
+func (buffer *callbackBuffer) Next(max int) (batch []forwardedCallback, commit func() error, err error) {
+	for {
+		buffer.mutex.Lock()
+		if len(buffer.segments) == 0 {
+			buffer.mutex.Unlock()
+			return nil, nil, nil
+		}
+
+		// New callbacks go to a new segment from now on, so this one can be read without the lock
+		segment := buffer.segments[0]
+		if len(buffer.segments) == 1 && buffer.appending != nil {
+			err = buffer.appending.Close()
+			buffer.appending = nil
+		}
+		buffer.mutex.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		batch, commit, err = buffer.readSegment(segment, max)
+		if err != nil || len(batch) != 0 {
+			return
+		}
+
+		// Nothing left in it but lines that couldn't be read
+		if err = commit(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (buffer *callbackBuffer) readSegment(segment string, max int) (batch []forwardedCallback, commit func() error, err error) {
+	offset, err := buffer.sentOffset(segment)
+	if err != nil {
+		return
+	}
+
+	segmentFile, err := os.Open(buffer.segmentPath(segment))
+	if err != nil {
+		return
+	}
+	defer utils.Close(segmentFile)
+
+	if _, err = segmentFile.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(segmentFile)
+	numLines, finished := 0, false
+	for len(batch) < max {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			// A line without its newline was cut short by a crash while it was written
+			if len(line) != 0 {
+				utils.Log(utils.Warning, "Skipping an incomplete callback at the end of", buffer.segmentPath(segment))
+			}
+			finished = true
+			break
+		} else if readErr != nil {
+			return nil, nil, readErr
+		}
+
+		offset += int64(len(line))
+		numLines++
+
+		var callback forwardedCallback
+		if err := json.Unmarshal(line, &callback); err != nil {
+			utils.LogError(utils.Warning, err, "Skipping a callback that can't be read in", buffer.segmentPath(segment))
+			continue
+		}
+		batch = append(batch, callback)
+	}
+	if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+		finished = true
+	}
+
+	commit = func() error {
+		buffer.mutex.Lock()
+		buffer.pending -= numLines
+		if finished {
+			buffer.segments = buffer.segments[1:]
+		}
+		buffer.mutex.Unlock()
+
+		if !finished {
+			return os.WriteFile(buffer.segmentPath(segment)+".sent", []byte(strconv.FormatInt(offset, 10)), 0600)
+		}
+
+		if err := os.Remove(buffer.segmentPath(segment) + ".sent"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Remove(buffer.segmentPath(segment))
+	}
+	return
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	--- Collector mode ---
+	: A collector runs the same listeners as the callback server, but has no
+	  database. It checks each callback's framing, buffers it on disk, and
+	  forwards it to the central node's intake (see `intake.go`), which
+	  scores it as if it had arrived there directly.
+*/
+
+// The certificate a collector and the central intake present to each other, see `utils.CollectorConfig`.
+var collectorCertificate *utils.ReloadableCertificate
+
+// How often the targets in scope are loaded again, or asked for from the central node by a collector.
+const scopeRefreshInterval time.Duration = time.Minute
+
+// A callback as a collector forwards it to the central node.
+type forwardedCallback struct {
+	ID      string                `json:"id"`      // random, so a callback sent twice is only recorded once
+	Event   storage.CallbackEvent `json:"event"`   // with the collector's ID and the time it was received
+	Payload string                `json:"payload"` // what the Agent sent, for the central node to score; empty if it wasn't a checkin
+}
+
+type callbackForwarder struct {
+	collectorID string
+	centralURL  string // without a trailing slash
+	client      *http.Client
+	buffer      *callbackBuffer
+
+	wake    chan struct{} // a callback was buffered
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+/*
+	Load the collector certificate and the buffer, then start forwarding to
+	`collectors.central_url`. Exits if the collector can't start.
+*/
+func startForwarder() {
+	collectors := config.Collectors
+
+	caPool, err := utils.LoadCertificatePool(collectors.CACertificate)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't load the collectors' CA certificate")
+	collectorCertificate, err = utils.LoadReloadableCertificate(collectors.Certificate, collectors.Key)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't load the collector's X509 keypair")
+
+	// The central node checks every callback comes from the collector its certificate names
+	collectorID, err := collectorCertificate.CommonName()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't read the collector's certificate")
+	if collectorID == "" {
+		utils.LogPlainExit(utils.Error, utils.ERR_CONFIG, "The collector's certificate has no common name to use as its ID")
+	}
+
+	buffer, err := openCallbackBuffer(collectors.BufferDirectory)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't open the callback buffer in '"+collectors.BufferDirectory+"'")
+
+	forwarder = &callbackForwarder{
+		collectorID: collectorID,
+		centralURL:  strings.TrimRight(collectors.CentralURL, "/"),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:              caPool,
+				GetClientCertificate: collectorCertificate.GetClientCertificate,
+				MinVersion:           tls.VersionTLS12,
+			}},
+			Timeout: 30 * time.Second,
+		},
+		buffer: buffer,
+		wake:   make(chan struct{}, 1),
+	}
+	forwarder.ctx, forwarder.cancel = context.WithCancel(context.Background())
+	if expvar.Get("collector_buffered") == nil { // already published if the forwarder was started before
+		expvar.Publish("collector_buffered", expvar.Func(func() interface{} { return forwarder.buffer.Len() }))
+	}
+
+	utils.Log(utils.Done, "Collector", collectorID, "forwarding to", forwarder.centralURL+",", fmt.Sprint(buffer.Len()), "callbacks buffered")
+
+	forwarder.running.Add(2)
+	go func() {
+		defer forwarder.running.Done()
+		forwarder.refreshScope()
+	}()
+	go func() {
+		defer forwarder.running.Done()
+		forwarder.forward()
+	}()
+}
+
+// Stop forwarding, waiting for a request in progress to be cancelled.
+func (forwarder *callbackForwarder) stop() {
+	forwarder.cancel()
+	forwarder.running.Wait()
+}
+
+// Buffer a connection for the central node, see `recordConnection()`.
+func (forwarder *callbackForwarder) bufferCallback(event storage.CallbackEvent, payload string) error {
+	event.CollectorID = forwarder.collectorID
+
+	err := forwarder.buffer.Append(forwardedCallback{ID: uuid.New().String(), Event: event, Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case forwarder.wake <- struct{}{}:
+	default: // already awake
+	}
+	return nil
+}
+
+// Wait for the delay, returning false if the forwarder was stopped first.
+func (forwarder *callbackForwarder) sleep(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-forwarder.ctx.Done():
+		return false
+	}
+}
+
+/*
+	Send buffered callbacks to the central node in batches, oldest first,
+	until stopped. While it can't be reached they stay buffered, and every
+	batch is tried again after `collectors.retry_delay`.
+*/
+func (forwarder *callbackForwarder) forward() {
+	reachable := true
+	for {
+		batch, commit, err := forwarder.buffer.Next(currentConfig().Collectors.BatchSize)
+		if utils.CheckError(utils.Error, err, "Could not read the callback buffer") {
+			if !forwarder.sleep(currentConfig().Collectors.RetryDelay.Duration) {
+				return
+			}
+			continue
+		}
+
+		if len(batch) == 0 {
+			select {
+			case <-forwarder.wake:
+				continue
+			case <-forwarder.ctx.Done():
+				return
+			}
+		}
+
+		verdicts, err := forwarder.send(batch)
+		if errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			// Logged once per outage, the buffer keeps growing in the meantime
+			if reachable {
+				utils.LogError(utils.Warning, err, "Could not forward callbacks to the central node, buffering them in", forwarder.buffer.directory)
+				reachable = false
+			}
+			if !forwarder.sleep(currentConfig().Collectors.RetryDelay.Duration) {
+				return
+			}
+			continue
+		}
+
+		// Not committing means sending them again, which the central node ignores
+		err = commit()
+		if utils.CheckError(utils.Error, err, "Could not mark forwarded callbacks in the buffer") {
+			forwarder.sleep(currentConfig().Collectors.RetryDelay.Duration)
+		}
+		forwarder.recordVerdicts(batch, verdicts)
+
+		if !reachable {
+			utils.Log(utils.Done, "Reached the central node again,", fmt.Sprint(forwarder.buffer.Len()), "callbacks left to forward")
+			reachable = true
+		}
+	}
+}
+
+/*
+	Send one batch of callbacks to the central intake. Returns the verdicts
+	of the checkins it recorded.
+*/
+func (forwarder *callbackForwarder) send(batch []forwardedCallback) (verdicts []forwardedVerdict, err error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return
+	}
+
+	request, err := http.NewRequestWithContext(forwarder.ctx, http.MethodPost, forwarder.centralURL+"/callbacks", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := forwarder.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer utils.Close(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("central node answered %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	// The batch was recorded, an answer we can't read only loses the verdicts
+	err = json.NewDecoder(response.Body).Decode(&verdicts)
+	utils.CheckError(utils.Warning, err, "Could not read the verdicts of forwarded checkins")
+	return verdicts, nil
+}
+
+/*
+	Count the checkins the central node rejected for an unknown Agent toward
+	a ban of their source, and clear the record of those it accepted, just
+	like `handleConnection()` does on the central node. Invalid framing was
+	already counted when the callback was received.
+*/
+func (forwarder *callbackForwarder) recordVerdicts(batch []forwardedCallback, verdicts []forwardedVerdict) {
+	events := make(map[string]storage.CallbackEvent, len(batch))
+	for _, callback := range batch {
+		events[callback.ID] = callback.Event
+	}
+
+	for _, verdict := range verdicts {
+		event, ok := events[verdict.ID]
+		if !ok {
+			continue
+		}
+
+		var scoreErr error
+		if verdict.UnknownAgent {
+			scoreErr = errUnknownAgent
+		}
+		event.Verdict = verdict.Verdict
+		recordSourceVerdict(&event, isTargetInScope(event.SourceIP), scoreErr)
+	}
+}
+
+/*
+	Ask the central node for the targets in scope now and every
+	`scopeRefreshInterval`, until stopped, for the limits in scope. The
+	last answer is kept while it can't be reached.
+*/
+func (forwarder *callbackForwarder) refreshScope() {
+	for {
+		targetIPs, err := forwarder.fetchScope()
+		if errors.Is(err, context.Canceled) {
+			return
+		} else if !utils.CheckError(utils.Warning, err, "Could not get the targets in scope from the central node, keeping the current ones") {
+			targetsInScope.replace(targetIPs)
+		}
+
+		if !forwarder.sleep(scopeRefreshInterval) {
+			return
+		}
+	}
+}
+
+func (forwarder *callbackForwarder) fetchScope() (targetIPs []string, err error) {
+	request, err := http.NewRequestWithContext(forwarder.ctx, http.MethodGet, forwarder.centralURL+"/scope", nil)
+	if err != nil {
+		return
+	}
+
+	response, err := forwarder.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer utils.Close(response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("central node answered " + response.Status)
+	}
+	err = json.NewDecoder(response.Body).Decode(&targetIPs)
+	return
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+// An address nothing listens on yet, for the intake.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+/*
+	Set up a central server with an intake at a free address, trusting
+	collectors that `ca` signed. The intake isn't started, see
+	`startTestIntake()`.
+*/
+func startTestCentral(t *testing.T, ca *testCA) {
+	intakeAddress := freeAddress(t)
+	startTestServer(t, func(config *utils.Config) {
+		config.Collectors.IntakeAddress = intakeAddress
+		config.Collectors.CentralURL = "https://" + intakeAddress
+		config.Collectors.CACertificate = ca.path
+		config.Collectors.BufferDirectory = t.TempDir()
+		config.Collectors.RetryDelay = utils.Duration{Duration: 20 * time.Millisecond}
+	})
+}
+
+// Use the certificate for whichever of the intake or the forwarder starts next.
+func useCollectorCertificate(certPath string, keyPath string) {
+	configMutex.Lock()
+	config.Collectors.Certificate, config.Collectors.Key = certPath, keyPath
+	configMutex.Unlock()
+}
+
+/*
+	Start the intake, returning how to take it down, closing every
+	connection at once like a crash would. It's taken down after the test if
+	it's still up.
+*/
+func startTestIntake(t *testing.T, ca *testCA) (stop func()) {
+	useCollectorCertificate(ca.issue(t, "central"))
+	startIntake()
+
+	running := intake
+	stop = func() {
+		if running != nil {
+			running.Close()
+			running, intake = nil, nil
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// A collector's client for the intake, with a certificate for `collectorID`.
+func newIntakeClient(t *testing.T, ca *testCA, collectorID string) *http.Client {
+	certificate, err := tls.LoadX509KeyPair(ca.issue(t, collectorID))
+	if err != nil {
+		t.Fatalf("Could not load the certificate of %s: %v", collectorID, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{certificate}}},
+		Timeout:   5 * time.Second,
+	}
+}
+
+// Post a batch to the intake, returning its status and the verdicts it answered with.
+func postBatch(t *testing.T, client *http.Client, batch []forwardedCallback) (status int, verdicts []forwardedVerdict) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("Could not encode the batch: %v", err)
+	}
+	response, err := client.Post(currentConfig().Collectors.CentralURL+"/callbacks", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Could not post the batch: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(response.Body).Decode(&verdicts); err != nil {
+			t.Fatalf("Could not decode the verdicts: %v", err)
+		}
+	}
+	return response.StatusCode, verdicts
+}
+
+// A connection to a collector, as `handleConnection()` leaves it for the central node to score.
+func collectedCallback(collectorID string, sourceIP string, payload string) forwardedCallback {
+	event := storage.CallbackEvent{
+		TimeUnix:    time.Now().Unix(),
+		SourceIP:    sourceIP,
+		SourcePort:  40000,
+		Listener:    "192.0.2.10:444",
+		Transport:   agentconfig.TransportTLS,
+		MessageType: utils.MessageNone,
+		Verdict:     utils.VerdictRejected,
+		Reason:      "forwarded to the central node",
+		CollectorID: collectorID,
+	}
+	if payload == "" {
+		event.MessageType, event.Verdict, event.Reason = utils.MessageUnknown, utils.VerdictInvalid, "not a valid UUID"
+	}
+	return forwardedCallback{ID: uuid.NewString(), Event: event, Payload: payload}
+}
+
+func TestCollectorBuffersWhileIntakeIsDown(t *testing.T) {
+	ca := newTestCA(t)
+	startTestCentral(t, ca)
+	stopTestIntake := startTestIntake(t, ca)
+
+	useCollectorCertificate(ca.issue(t, "dmz-1"))
+	startForwarder()
+	t.Cleanup(func() {
+		forwarder.stop()
+		forwarder = nil
+	})
+
+	// Forwarded straight away while the intake is up
+	firstUUID := addTestAgent(t, "10.0.0.1")
+	first := collectedCallback("", "10.0.0.1", firstUUID)
+	if err := forwarder.bufferCallback(first.Event, first.Payload); err != nil {
+		t.Fatalf("Could not buffer a callback: %v", err)
+	}
+	waitForEvents(t, 1)
+
+	// Kept on disk while it's down
+	stopTestIntake()
+	secondUUID := addTestAgent(t, "10.0.0.2")
+	for _, callback := range []forwardedCallback{collectedCallback("", "10.0.0.2", secondUUID), collectedCallback("", "203.0.113.7", "")} {
+		if err := forwarder.bufferCallback(callback.Event, callback.Payload); err != nil {
+			t.Fatalf("Could not buffer a callback: %v", err)
+		}
+	}
+	time.Sleep(10 * currentConfig().Collectors.RetryDelay.Duration)
+	if buffered := forwarder.buffer.Len(); buffered != 2 {
+		t.Fatalf("%d callbacks buffered while the intake is down, want 2", buffered)
+	}
+	waitForEvents(t, 1)
+
+	// And replayed in order once it's back
+	startTestIntake(t, ca)
+	events := waitForEvents(t, 3)
+	for i, sourceIP := range []string{"203.0.113.7", "10.0.0.2", "10.0.0.1"} {
+		if events[i].SourceIP != sourceIP || events[i].CollectorID != "dmz-1" {
+			t.Errorf("Event %d is from %s via %q, want %s via \"dmz-1\"", len(events)-i, events[i].SourceIP, events[i].CollectorID, sourceIP)
+		}
+	}
+	if events[1].Verdict != utils.VerdictAccepted || events[1].AgentUUID != secondUUID {
+		t.Errorf("Replayed checkin was recorded as %+v, want it accepted", events[1])
+	}
+
+	checkins, err := repository.ScoredCheckins()
+	if err != nil {
+		t.Fatalf("Could not get the scored checkins: %v", err)
+	}
+	if len(checkins) != 2 || checkins[1].AgentUUID != secondUUID || checkins[1].TargetIP != "10.0.0.2" {
+		t.Errorf("Scored checkins are %+v, want the replayed one from 10.0.0.2 last", checkins)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for forwarder.buffer.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if buffered := forwarder.buffer.Len(); buffered != 0 {
+		t.Errorf("%d callbacks still buffered once forwarded", buffered)
+	}
+}
+
+func TestIntakeIgnoresResentCallbacks(t *testing.T) {
+	ca := newTestCA(t)
+	startTestCentral(t, ca)
+	stopTestIntake := startTestIntake(t, ca)
+	client := newIntakeClient(t, ca, "dmz-1")
+
+	agentUUID := addTestAgent(t, "10.0.0.1")
+	batch := []forwardedCallback{collectedCallback("dmz-1", "10.0.0.1", agentUUID), collectedCallback("dmz-1", "203.0.113.7", "")}
+
+	// Sent again as if the collector never saw the answer, again after the
+	// intake restarted, then along with a new one
+	for i, resent := range [][]forwardedCallback{batch, batch, nil, batch, append(batch, collectedCallback("dmz-1", "203.0.113.8", ""))} {
+		if resent == nil {
+			stopTestIntake()
+			startTestIntake(t, ca)
+			client.CloseIdleConnections()
+			continue
+		}
+
+		status, verdicts := postBatch(t, client, resent)
+		if status != http.StatusOK {
+			t.Fatalf("Batch %d answered %d, want %d", i+1, status, http.StatusOK)
+		}
+		if i == 0 && (len(verdicts) != 1 || verdicts[0].ID != batch[0].ID || verdicts[0].Verdict != utils.VerdictAccepted) {
+			t.Errorf("First batch answered %+v, want the checkin accepted", verdicts)
+		} else if i > 0 && len(verdicts) != 0 {
+			t.Errorf("Batch %d answered %+v, want no verdicts for callbacks already recorded", i+1, verdicts)
+		}
+	}
+
+	events := waitForEvents(t, 3)
+	if events[0].SourceIP != "203.0.113.8" {
+		t.Errorf("Newest event is from %s, want the callback only in the last batch", events[0].SourceIP)
+	}
+	numCheckins, err := repository.CountCheckins(agentUUID)
+	if err != nil {
+		t.Fatalf("Could not count the checkins: %v", err)
+	}
+	if numCheckins != 1 {
+		t.Errorf("%d checkins recorded from a batch sent three times, want 1", numCheckins)
+	}
+}
+
+func TestIntakeChecksCollectorID(t *testing.T) {
+	ca := newTestCA(t)
+	startTestCentral(t, ca)
+	startTestIntake(t, ca)
+	client := newIntakeClient(t, ca, "dmz-1")
+
+	agentUUID := addTestAgent(t, "10.0.0.1")
+	tests := []struct {
+		name   string
+		batch  []forwardedCallback
+		status int
+	}{
+		{"another collector's ID", []forwardedCallback{collectedCallback("dmz-2", "10.0.0.1", agentUUID)}, http.StatusForbidden},
+		{"no collector ID", []forwardedCallback{collectedCallback("", "10.0.0.1", agentUUID)}, http.StatusForbidden},
+		{"one callback with another ID", []forwardedCallback{collectedCallback("dmz-1", "203.0.113.7", ""), collectedCallback("dmz-2", "10.0.0.1", agentUUID)}, http.StatusForbidden},
+		{"its own ID", []forwardedCallback{collectedCallback("dmz-1", "203.0.113.8", "")}, http.StatusOK},
+	}
+	for _, test := range tests {
+		if status, _ := postBatch(t, client, test.batch); status != test.status {
+			t.Errorf("%s: batch answered %d, want %d", test.name, status, test.status)
+		}
+	}
+
+	// Nothing from a refused batch is recorded, not even its valid callbacks
+	events := waitForEvents(t, 1)
+	if events[0].SourceIP != "203.0.113.8" {
+		t.Errorf("Recorded an event from %s, want only the accepted batch's", events[0].SourceIP)
+	}
+}
+
+// A batch whose checkins can't be scored isn't answered as recorded, so the collector sends it again.
+func TestIntakeFailsBatchWhenScoringFails(t *testing.T) {
+	ca := newTestCA(t)
+	startTestCentral(t, ca)
+	startTestIntake(t, ca)
+	client := newIntakeClient(t, ca, "dmz-1")
+
+	agentUUID := addTestAgent(t, "10.0.0.1")
+	utils.Close(repository)
+
+	if status, _ := postBatch(t, client, []forwardedCallback{collectedCallback("dmz-1", "10.0.0.1", agentUUID)}); status != http.StatusServiceUnavailable {
+		t.Errorf("Batch answered %d with the database gone, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+// Checkins the central node rejects for an unknown Agent count toward a ban on the collector.
+func TestCollectorBansUnknownAgents(t *testing.T) {
+	ca := newTestCA(t)
+	intakeAddress := freeAddress(t)
+	startTestServer(t, func(config *utils.Config) {
+		config.Collectors.IntakeAddress = intakeAddress
+		config.Collectors.CentralURL = "https://" + intakeAddress
+		config.Collectors.CACertificate = ca.path
+		config.Collectors.BufferDirectory = t.TempDir()
+		config.Collectors.RetryDelay = utils.Duration{Duration: 20 * time.Millisecond}
+		config.Callbacks.Limits.MaxInvalid = 2
+	})
+	startTestIntake(t, ca)
+
+	useCollectorCertificate(ca.issue(t, "dmz-1"))
+	startForwarder()
+	t.Cleanup(func() {
+		forwarder.stop()
+		forwarder = nil
+	})
+
+	agentUUID := addTestAgent(t, "10.0.0.1")
+	for _, payload := range []string{agentUUID, uuid.NewString(), uuid.NewString()} {
+		callback := collectedCallback("", "203.0.113.7", payload)
+		if err := forwarder.bufferCallback(callback.Event, callback.Payload); err != nil {
+			t.Fatalf("Could not buffer a callback: %v", err)
+		}
+	}
+	waitForEvents(t, 3)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		allowed, reason := limiter.AllowConnection("203.0.113.7", time.Now(), false)
+		if !allowed && strings.HasPrefix(reason, "banned") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Source not banned after %d unknown Agents, connection allowed: %v (%s)", currentConfig().Callbacks.Limits.MaxInvalid, allowed, reason)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
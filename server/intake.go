@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	--- Collector intake ---
+	: The central node's side of collector mode, an HTTPS server at
+	  `collectors.intake_address` that only talks to clients whose
+	  certificate `collectors.ca_certificate` signed. Collectors POST
+	  batches of callbacks to /callbacks, and GET the targets in scope from
+	  /scope.
+*/
+
+const maxForwardedBatchBytes int64 = 16 << 20
+
+var (
+	intake *http.Server
+
+	callbacksForwarded *expvar.Int = expvar.NewInt("callbacks_forwarded")
+)
+
+/*
+	What the central node made of a forwarded checkin, so the collector can
+	count it toward a ban of its source like it would have if it had scored
+	it itself, see `recordSourceVerdict()`.
+*/
+type forwardedVerdict struct {
+	ID           string `json:"id"`
+	Verdict      string `json:"verdict"`
+	UnknownAgent bool   `json:"unknown_agent"`
+}
+
+// Start the intake. Exits if it can't listen.
+func startIntake() {
+	collectors := config.Collectors
+
+	caPool, err := utils.LoadCertificatePool(collectors.CACertificate)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't load the collectors' CA certificate")
+	collectorCertificate, err = utils.LoadReloadableCertificate(collectors.Certificate, collectors.Key)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't load the intake's X509 keypair")
+
+	intakeMux := http.NewServeMux()
+	intakeMux.HandleFunc("/callbacks", receiveForwardedCallbacks)
+	intakeMux.HandleFunc("/scope", serveScope)
+
+	intake = &http.Server{
+		Handler: intakeMux,
+		TLSConfig: &tls.Config{
+			GetCertificate: collectorCertificate.GetCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      caPool,
+			MinVersion:     tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Listen here rather than in `ServeTLS()`, so a taken address stops the server from starting
+	listener, err := net.Listen("tcp", collectors.IntakeAddress)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't set up the collector intake on", collectors.IntakeAddress)
+
+	go func() {
+		err := intake.ServeTLS(listener, "", "")
+		if !errors.Is(err, http.ErrServerClosed) {
+			utils.LogError(utils.Error, err, "Collector intake stopped")
+		}
+	}()
+	utils.Log(utils.Done, "Accepting forwarded callbacks on https://"+collectors.IntakeAddress)
+}
+
+/*
+	Stop accepting forwarded callbacks, giving the batches being recorded
+	until `shutdown_timeout` to finish. The returned channel is closed once
+	they have.
+*/
+func stopIntake() <-chan struct{} {
+	stopped := make(chan struct{})
+	if intake == nil {
+		close(stopped)
+		return stopped
+	}
+
+	go func() {
+		defer close(stopped)
+
+		ctx, cancel := context.WithTimeout(context.Background(), currentConfig().ShutdownTimeout.Duration)
+		defer cancel()
+		utils.CheckError(utils.Warning, intake.Shutdown(ctx), "Collector intake didn't stop cleanly")
+	}()
+	return stopped
+}
+
+/*
+	Record a batch of callbacks from a collector, in the order they were
+	received. The collector only removes them from its buffer once this
+	answers "200 OK", so anything that can't be recorded or scored fails
+	the whole batch; callbacks already recorded are skipped when it's sent
+	again, even after a restart. Answers with the verdicts of the checkins
+	recorded.
+*/
+func receiveForwardedCallbacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collectorID := r.TLS.PeerCertificates[0].Subject.CommonName
+	if collectorID == "" {
+		http.Error(w, "certificate has no common name", http.StatusForbidden)
+		return
+	}
+
+	var callbacks []forwardedCallback
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxForwardedBatchBytes)).Decode(&callbacks)
+	if err != nil {
+		http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, callback := range callbacks {
+		if callback.Event.CollectorID != collectorID {
+			utils.Log(utils.Warning, "Collector", collectorID, "forwarded a callback as", "'"+callback.Event.CollectorID+"', refusing its batch")
+			http.Error(w, "callbacks must carry the collector ID "+collectorID, http.StatusForbidden)
+			return
+		}
+		if callback.ID == "" || !utils.IsVerdict(callback.Event.Verdict) {
+			http.Error(w, "invalid callback", http.StatusBadRequest)
+			return
+		}
+	}
+
+	utils.Log(utils.List, "Received", fmt.Sprint(len(callbacks)), "callbacks from collector", collectorID)
+	verdicts := []forwardedVerdict{}
+	for _, callback := range callbacks {
+		verdict, recorded, err := recordForwardedCallback(callback)
+		if utils.CheckError(utils.Error, err, "Could not record forwarded callback") {
+			http.Error(w, "could not record callback", http.StatusServiceUnavailable)
+			return
+		}
+		if !recorded {
+			continue
+		}
+
+		callbacksForwarded.Add(1)
+		if callback.Payload != "" {
+			verdicts = append(verdicts, verdict)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verdicts)
+}
+
+/*
+	Score a forwarded checkin as if it had arrived directly, at the time the
+	collector received it, and record its event. Anything else the
+	collector already gave a verdict, and is recorded as it is. Both happen
+	in one write, which skips the callback if its ID was already recorded.
+	Returns whether it was recorded now, and its verdict if so.
+*/
+func recordForwardedCallback(callback forwardedCallback) (verdict forwardedVerdict, recorded bool, err error) {
+	event := callback.Event
+	event.EventID, event.TeamName, event.ForwardedID = 0, "", callback.ID
+
+	var checkin *agentCheckin
+	if callback.Payload != "" {
+		utils.Log(utils.List, "\t\t["+event.SourceIP+":"+fmt.Sprint(event.SourcePort)+" via "+event.CollectorID+"] Received", time.Unix(event.TimeUnix, 0).Format(time.RFC3339))
+
+		event.Verdict, event.Reason = utils.VerdictError, "server error"
+		if checkin = parseCallback(&event, callback.Payload); checkin != nil {
+			ready, err := lookUpCheckin(&event, checkin)
+			if errors.Is(err, errUnknownAgent) {
+				verdict.UnknownAgent = true
+			} else if err != nil {
+				return verdict, false, err
+			}
+			if !ready {
+				checkin = nil
+			}
+		}
+	}
+
+	err = writer.Write(func(tx storage.Tx) error {
+		alreadyRecorded, err := tx.ForwardedCallbackRecorded(callback.ID)
+		if err != nil || alreadyRecorded {
+			return err
+		}
+
+		if checkin != nil {
+			event.Verdict, event.Reason, err = recordCheckin(tx, *checkin)
+			if err != nil {
+				return err
+			}
+		}
+		recorded = true
+		return recordCallbackEvent(tx, event)
+	})
+	if err != nil {
+		return verdict, false, err
+	}
+
+	verdict.ID, verdict.Verdict = callback.ID, event.Verdict
+	return verdict, recorded, nil
+}
+
+// The IP addresses of the targets in scope, for collectors.
+func serveScope(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targets, err := repository.ListTargets()
+	if utils.CheckError(utils.Error, err, "Could not get the targets in scope") {
+		http.Error(w, "could not get the targets in scope", http.StatusInternalServerError)
+		return
+	}
+
+	targetIPs := []string{}
+	for _, target := range targets {
+		targetIPs = append(targetIPs, target.IP)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetIPs)
+}
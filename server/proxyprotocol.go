@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+	--- PROXY protocol ---
+	: Redirectors (HAProxy, nginx stream, socat, ...) in front of the
+	  callback listeners hide the Agent's address behind their own. Those in
+	  `callbacks.trusted_redirectors` start each connection with a PROXY
+	  protocol header (version 1 or 2, see
+	  https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt) saying
+	  where it really came from. Nobody else's header is ever read, or
+	  anyone could claim to be calling back from a target.
+*/
+
+const proxyV1MaxLength int = 107 // "PROXY TCP6 " and two full IPv6 addresses and ports, with the CRLF
+
+var proxyV2Signature []byte = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A connection from a redirector, which reports the address it really came from.
+type proxiedConn struct {
+	net.Conn
+	reader     *bufio.Reader // holds whatever followed the header
+	remoteAddr net.Addr
+}
+
+func (conn *proxiedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *proxiedConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+/*
+	Read the PROXY protocol header a redirector starts the connection with.
+	Returns the connection as from the source the header gives, or as from
+	the redirector itself for headers without one (e.g. a redirector's
+	health checks).
+*/
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var source net.Addr
+	if bytes.Equal(signature, proxyV2Signature) {
+		source, err = readProxyV2Header(reader)
+	} else if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		source, err = readProxyV1Header(reader)
+	} else {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if source == nil {
+		source = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, remoteAddr: source}, nil
+}
+
+// "PROXY TCP4 <source IP> <destination IP> <source port> <destination port>\r\n", or "PROXY UNKNOWN ...\r\n"
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header is too long or doesn't end in CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+
+	sourceIP, destinationIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if sourceIP == nil || destinationIP == nil || (sourceIP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errors.New("invalid address in PROXY protocol v1 header")
+	}
+	sourcePort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port in PROXY protocol v1 header")
+	}
+	if _, err = strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errors.New("invalid port in PROXY protocol v1 header")
+	}
+
+	return &net.TCPAddr{IP: sourceIP, Port: int(sourcePort)}, nil
+}
+
+// The binary header: the signature, version and command, address family, length, then the addresses.
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, errors.New("unsupported PROXY protocol version " + strconv.Itoa(int(version)))
+	}
+
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL, the redirector's own connection
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.New("unsupported PROXY protocol v2 command")
+	}
+
+	// Anything but TCP over IPv4 or IPv6 has no source we could use
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(addresses) < 12 {
+			return nil, errors.New("PROXY protocol v2 header is too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addresses) < 36 {
+			return nil, errors.New("PROXY protocol v2 header is too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
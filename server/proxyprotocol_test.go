@@ -0,0 +1,299 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	--- Fakes ---
+	: The callback listeners with their workers, a redirector in front of
+	  them that starts each connection with a PROXY protocol header, and
+	  Agents calling back through it, all on the loopback interface.
+*/
+
+// Start the callback listener and a worker, like `startListening()`. Returns its address.
+func startTestListener(t *testing.T) string {
+	ca := newTestCA(t)
+	certificate, err := tls.LoadX509KeyPair(ca.issue(t, "pwnts"))
+	if err != nil {
+		t.Fatalf("Could not load the callback listener's certificate: %v", err)
+	}
+	tlsConfig = tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	testPending := make(chan net.Conn, 8)
+	listening, working := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(listening)
+		listenForCallbacks(listener, testPending)
+	}()
+	go func() {
+		defer close(working)
+		handleConnections(testPending)
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		<-listening
+		close(testPending)
+		<-working
+		tlsConfig = tls.Config{}
+	})
+	return listener.Addr().String()
+}
+
+type proxyHeaderFunc func(source *net.TCPAddr, destination *net.TCPAddr) []byte
+
+func proxyV1Header(source *net.TCPAddr, destination *net.TCPAddr) []byte {
+	return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", source.IP, destination.IP, source.Port, destination.Port))
+}
+
+func proxyV2Header(source *net.TCPAddr, destination *net.TCPAddr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12) // version 2 PROXY, TCP over IPv4, 12 bytes of addresses
+	header = append(header, source.IP.To4()...)
+	header = append(header, destination.IP.To4()...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-4:], uint16(source.Port))
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(destination.Port))
+	return header
+}
+
+/*
+	Start a redirector in front of the callback listener, which says each
+	connection comes from `source` with the header `header` writes. Returns
+	its address.
+*/
+func startRedirector(t *testing.T, serverAddress string, source *net.TCPAddr, header proxyHeaderFunc) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				server, err := net.Dial("tcp", serverAddress)
+				if err != nil {
+					return
+				}
+				defer server.Close()
+
+				server.Write(header(source, server.RemoteAddr().(*net.TCPAddr)))
+				go io.Copy(server, client)
+				io.Copy(client, server)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Call back like an Agent, sending `payload` once the TLS handshake is done.
+func callBack(t *testing.T, address string, payload string) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Could not call back to %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(payload)); err != nil {
+		t.Fatalf("Could not send the callback: %v", err)
+	}
+	// Wait for the server to close the connection once it has read it
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+func trustRedirector(network string) func(config *utils.Config) {
+	return func(config *utils.Config) {
+		config.Callbacks.Redirectors = nil
+		if network != "" {
+			redirector, _ := utils.ParseIPNetwork(network)
+			config.Callbacks.Redirectors = utils.IPNetworks{redirector}
+		}
+	}
+}
+
+func TestRedirectedCallbacks(t *testing.T) {
+	for _, version := range []struct {
+		name   string
+		header proxyHeaderFunc
+	}{{"v1", proxyV1Header}, {"v2", proxyV2Header}} {
+		t.Run(version.name, func(t *testing.T) {
+			startTestServer(t, trustRedirector("127.0.0.1"))
+			serverAddress := startTestListener(t)
+
+			// Checkins from a target in scope and from elsewhere
+			agentUUID := addTestAgent(t, "10.0.0.1")
+			target := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}
+			callBack(t, startRedirector(t, serverAddress, target, version.header), agentUUID)
+
+			strayUUID := addTestAgent(t, "10.0.0.2")
+			stray := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40002}
+			callBack(t, startRedirector(t, serverAddress, stray, version.header), strayUUID)
+
+			events := waitForEvents(t, 2)
+			checks := []struct {
+				event    storage.CallbackEvent
+				source   *net.TCPAddr
+				verdict  string
+				reasonOf string
+			}{
+				{events[1], target, utils.VerdictAccepted, ""},
+				{events[0], stray, utils.VerdictRejected, "not in scope"},
+			}
+			for _, check := range checks {
+				event := check.event
+				if event.SourceIP != check.source.IP.String() || event.SourcePort != check.source.Port {
+					t.Errorf("Event recorded from %s:%d, want the redirected source %s", event.SourceIP, event.SourcePort, check.source)
+				}
+				if event.Verdict != check.verdict || !strings.Contains(event.Reason, check.reasonOf) {
+					t.Errorf("Callback from %s was %s (%s), want %s", check.source, event.Verdict, event.Reason, check.verdict)
+				}
+			}
+
+			checkins, err := repository.ScoredCheckins()
+			if err != nil {
+				t.Fatalf("Could not get the scored checkins: %v", err)
+			}
+			if len(checkins) != 1 || checkins[0].AgentUUID != agentUUID || checkins[0].TargetIP != "10.0.0.1" {
+				t.Errorf("Scored checkins are %+v, want one from target 10.0.0.1", checkins)
+			}
+		})
+	}
+}
+
+// Redirected sources are limited by their real address, targets in scope by their own limits.
+func TestRedirectedSourcesAreLimited(t *testing.T) {
+	startTestServer(t, func(config *utils.Config) {
+		trustRedirector("127.0.0.1")(config)
+		config.Callbacks.Limits.ConnectionsPerMinute, config.Callbacks.Limits.ConnectionBurst = 0.001, 1
+		config.Callbacks.Limits.HandshakesPerMinute, config.Callbacks.Limits.HandshakeBurst = 0.001, 1
+		config.Callbacks.InScopeLimits.ConnectionsPerMinute, config.Callbacks.InScopeLimits.ConnectionBurst = 0.001, 3
+		config.Callbacks.InScopeLimits.HandshakesPerMinute, config.Callbacks.InScopeLimits.HandshakeBurst = 0.001, 3
+	})
+	serverAddress := startTestListener(t)
+
+	// Refused without being recorded once past the burst
+	refuse := func(redirector string) {
+		conn, err := net.Dial("tcp", redirector)
+		if err != nil {
+			t.Fatalf("Could not connect to the redirector: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+
+	agentUUID := addTestAgent(t, "10.0.0.1")
+	target := startRedirector(t, serverAddress, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}, proxyV2Header)
+	for i := 0; i < 3; i++ {
+		callBack(t, target, agentUUID+" TEST")
+	}
+	refuse(target)
+	waitForEvents(t, 3)
+
+	stray := startRedirector(t, serverAddress, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40002}, proxyV2Header)
+	callBack(t, stray, agentUUID+" TEST")
+	refuse(stray)
+
+	events := waitForEvents(t, 4)
+	for _, event := range events {
+		if event.Verdict != utils.VerdictTest {
+			t.Errorf("Callback from %s was %s (%s), want %s", event.SourceIP, event.Verdict, event.Reason, utils.VerdictTest)
+		}
+	}
+	refused := map[string]int64{}
+	for _, change := range limiter.TakeSourceChanges(time.Now()) {
+		refused[change.SourceIP] = change.Throttled
+	}
+	if len(refused) != 2 || refused["10.0.0.1"] != 1 || refused["203.0.113.7"] != 1 {
+		t.Errorf("Throttled sources are %v, want 10.0.0.1 and 203.0.113.7 once each", refused)
+	}
+}
+
+func TestMalformedProxyHeader(t *testing.T) {
+	startTestServer(t, trustRedirector("127.0.0.1"))
+	serverAddress := startTestListener(t)
+
+	headers := []struct {
+		name   string
+		header []byte
+	}{
+		{"no header", []byte("\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03")},
+		{"v1 missing fields", []byte("PROXY TCP4 10.0.0.1 10.0.0.5\r\n")},
+		{"v1 invalid address", []byte("PROXY TCP4 10.0.0.300 10.0.0.5 40001 444\r\n")},
+		{"v1 truncated", []byte("PROXY TCP4 10.0.0.1 10.0.0.5 400")},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n")},
+		{"v2 truncated", proxyV2Header(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 444})[:20]},
+		{"v2 unsupported version", append(append([]byte{}, proxyV2Signature...), 0x31, 0x11, 0, 0)},
+	}
+	for _, header := range headers {
+		conn, err := net.Dial("tcp", serverAddress)
+		if err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+		conn.Write(header.header)
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+
+	events := waitForEvents(t, len(headers))
+	for i, event := range events {
+		header := headers[len(headers)-1-i]
+		if event.SourceIP != "127.0.0.1" || event.Verdict != utils.VerdictInvalid || !strings.HasPrefix(event.Reason, "invalid PROXY protocol header") {
+			t.Errorf("%s: recorded %s from %s (%s), want an invalid header from the redirector", header.name, event.Verdict, event.SourceIP, event.Reason)
+		}
+	}
+}
+
+// Anyone who isn't a trusted redirector can't claim to call back from a target.
+func TestUntrustedProxyHeader(t *testing.T) {
+	for _, version := range []struct {
+		name   string
+		header proxyHeaderFunc
+	}{{"v1", proxyV1Header}, {"v2", proxyV2Header}} {
+		t.Run(version.name, func(t *testing.T) {
+			startTestServer(t, trustRedirector("192.0.2.1"))
+			serverAddress := startTestListener(t)
+
+			agentUUID := addTestAgent(t, "10.0.0.1")
+			redirector := startRedirector(t, serverAddress, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}, version.header)
+			if conn, err := tls.Dial("tcp", redirector, &tls.Config{InsecureSkipVerify: true}); err == nil {
+				conn.Write([]byte(agentUUID))
+				conn.Close()
+				t.Error("TLS handshake succeeded after a header from an untrusted address")
+			}
+
+			events := waitForEvents(t, 1)
+			if event := events[0]; event.SourceIP != "127.0.0.1" || event.Verdict != utils.VerdictInvalid || !strings.HasPrefix(event.Reason, "TLS handshake failed") {
+				t.Errorf("Recorded %s from %s (%s), want a failed handshake from the untrusted address itself", event.Verdict, event.SourceIP, event.Reason)
+			}
+			if numCheckins, err := repository.CountCheckins(agentUUID); err != nil || numCheckins != 0 {
+				t.Errorf("%d checkins recorded (%v), want none", numCheckins, err)
+			}
+		})
+	}
+}
@@ -1,42 +1,115 @@
-package main
-
 /*
-	Add flag for port number
-*/
-
-/*
-	Flags:
-		--test:				Sets the server's listener to listen on localhost instead of the proper
-							network interface IP address.
-		--port:				Port to listen on.
+	The callback server, which receives Agent callbacks over TLS, scores
+	them, and records every connection. Run by `pwnts serve callbacks` or
+	`pwnts serve all`, see `cmd/pwnts`. `pwnts serve collector` runs the
+	same listeners as a collector instead, see `collector.go`.
 */
+package server
 
 import (
 	"crypto/tls"
-	"database/sql"
-	"flag"
+	"errors"
+	"expvar"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/google/uuid"
 
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/agent/fingerprint"
+	"github.com/s-christian/pwnts/storage"
 	"github.com/s-christian/pwnts/utils"
-
-	_ "github.com/mattn/go-sqlite3"
-)
-
-const (
-	minCallbackTime time.Duration = 59 * time.Second
 )
 
 var (
-	db *sql.DB
+	repository  storage.Repository
+	config      utils.Config
+	configMutex sync.RWMutex // `config` is replaced on SIGHUP, see `currentConfig()`
+	certificate *utils.ReloadableCertificate
+	tlsConfig   tls.Config // for the callback listeners, serves `certificate`
+
+	writer          *storage.BatchWriter // every database write goes through here, nil on a collector
+	forwarder       *callbackForwarder   // set on a collector only, see `StartCollector()`
+	limiter         *utils.SourceLimiter
+	targetsInScope  targetScope   // decides which limits apply to a source, see `isTargetInScope()`
+	handshakeSlots  chan struct{} // held by every source during its TLS handshake
+	shutdownExpired chan struct{} // closed when `shutdown_timeout` runs out, queued connections are then dropped
+
+	// Set up by `Start()`, torn down by `Shutdown()`
+	listeners        []net.Listener
+	listenersRunning sync.WaitGroup
+	pending          chan net.Conn // connections waiting for a worker, see `listenForCallbacks()`
+	workersRunning   sync.WaitGroup
+
+	// The central node's background loops, see `startBackground()`
+	backgroundStop    chan struct{} // closed by `Shutdown()` to stop them
+	backgroundRunning sync.WaitGroup
+
+	// Metrics, served at `callbacks.metrics_address`
+	connectionsInFlight *expvar.Int = expvar.NewInt("callbacks_in_flight")
+	connectionsHandled  *expvar.Int = expvar.NewInt("callbacks_handled")
+	connectionsDropped  *expvar.Int = expvar.NewInt("callbacks_dropped") // queue was full
+	connectionsRefused  *expvar.Int = expvar.NewInt("callbacks_refused") // source was throttled or banned
 )
 
+// Settings for `Start()` that don't come from the config file.
+type Options struct {
+	Test bool // listen on localhost, unless `callbacks.listeners` says otherwise
+	Port int  // port to listen on, unless `callbacks.listeners` says otherwise
+}
+
+// A checkin from a known Agent on an in-scope target, ready to be recorded.
+type agentCheckin struct {
+	AgentUUID       string
+	TeamID          int
+	RootDate        int64
+	CallbackMinutes int
+	JitterPercent   int
+	LocalPort       int
+	Platform        string
+	BoundTarget     string
+	TargetLocked    bool
+	TargetIP        string
+	TargetValue     int
+	SourcePort      int
+	TimeUnix        int64                    // when it was received, by us or by a collector
+	Fingerprint     *fingerprint.Fingerprint // nil if the Agent didn't send one
+}
+
+// The IP address and port a connection came from.
+func remoteAddress(conn net.Conn) (remoteIP string, remotePort int) {
+	remoteIP, remotePortString, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	fmt.Sscan(remotePortString, &remotePort)
+	return remoteIP, remotePort
+}
+
+// Whether connections from the IP address start with a PROXY protocol header, see `proxyprotocol.go`.
+func isTrustedRedirector(remoteIP string) bool {
+	return currentConfig().Callbacks.Redirectors.ContainsString(remoteIP)
+}
+
+// The audit log entry for a new connection, until we know what it is.
+func newCallbackEvent(conn net.Conn) storage.CallbackEvent {
+	remoteIP, remotePort := remoteAddress(conn)
+
+	return storage.CallbackEvent{
+		TimeUnix:    time.Now().Unix(),
+		SourceIP:    remoteIP,
+		SourcePort:  remotePort,
+		Listener:    conn.LocalAddr().String(),
+		Transport:   agentconfig.TransportTLS,
+		MessageType: utils.MessageNone,
+		Verdict:     utils.VerdictError,
+		Reason:      "server error",
+	}
+}
+
 func handleConnection(conn net.Conn) {
 	// At the end, close the connection with error checking using the anonymous function
 	defer func() {
@@ -45,28 +118,98 @@ func handleConnection(conn net.Conn) {
 		}
 	}()
 
-	remoteAddress := conn.RemoteAddr().String()
-	remoteAddressSplit := strings.Split(remoteAddress, ":")
-	remoteIP := remoteAddressSplit[0]
-	var remotePort int
-	fmt.Sscan(remoteAddressSplit[1], &remotePort)
+	// Every connection is recorded, however far it gets. Returning without
+	// a verdict means something went wrong on our side.
+	event := newCallbackEvent(conn)
+	inScope, refused := false, false
+	var payload string // what a collector forwards to be scored, see `recordConnection()`
+	var scoreErr error // see `scoreCheckin()`
+	defer func() {
+		if refused {
+			return
+		}
+		recordSourceVerdict(&event, inScope, scoreErr)
 
-	//rootAccess := remotePort < 1024 // TODO: I don't think Windows has privileged ports, what to do in this case?
-	// if rootAccess {
-	// 	fmt.Println("Double pwnts, yay!")
-	// }
+		err := recordConnection(event, payload)
+		utils.CheckError(utils.Error, err, "Could not record callback event")
+	}()
 
 	logPrefix := "\t\t[" + conn.RemoteAddr().String() + "]"
 
-	err := conn.SetReadDeadline(time.Now().Add(time.Second * 1))
+	// Covers the PROXY protocol header and the TLS handshake too
+	readDeadline := time.Now().Add(time.Second * 1)
+	err := conn.SetReadDeadline(readDeadline)
 	utils.CheckError(utils.Warning, err, logPrefix, "Setting read deadline failed, this is weird")
 
-	readBuffer := make([]byte, 1024) // must be initialized for conn.Read, therefore we use make()
-	numBytes, err := conn.Read(readBuffer)
+	/*
+		--- Find the source behind a redirector ---
+		: Its connections are only limited once we know where they're from,
+		  see `listenForCallbacks()`
+	*/
+	redirected := isTrustedRedirector(event.SourceIP)
+	if redirected {
+		redirector := conn.RemoteAddr().String()
+		redirectedConn, err := readProxyHeader(conn)
+		if err != nil {
+			utils.LogError(utils.Warning, err, logPrefix, "Invalid PROXY protocol header from trusted redirector")
+			event.Verdict, event.Reason = utils.VerdictInvalid, "invalid PROXY protocol header: "+err.Error()
+			return
+		}
+		conn = redirectedConn
+
+		event.SourceIP, event.SourcePort = remoteAddress(conn)
+		logPrefix = "\t\t[" + conn.RemoteAddr().String() + " via " + redirector + "]"
+		utils.Log(utils.List, logPrefix, "Redirected connection")
+	}
+
+	remoteIP := event.SourceIP
+
+	/*
+		--- Limit the source ---
+		: Targets in scope have their own, higher limits, and wait for a
+		  handshake slot rather than being turned away when a flood from
+		  anywhere else holds them all
+	*/
+	inScope = isTargetInScope(remoteIP)
+
+	if redirected {
+		if allowed, _ := limiter.AllowConnection(remoteIP, time.Now(), inScope); !allowed {
+			connectionsRefused.Add(1)
+			refused = true
+			return
+		}
+	}
+
+	if !limiter.AllowHandshake(remoteIP, time.Now(), inScope) {
+		utils.Log(utils.Warning, logPrefix, "Handshake rate exceeded")
+		event.Verdict, event.Reason = utils.VerdictRejected, "handshake rate exceeded"
+		return
+	}
+
+	if !takeHandshakeSlot(inScope, readDeadline) {
+		utils.Log(utils.Warning, logPrefix, "Too many handshakes in progress")
+		event.Verdict, event.Reason = utils.VerdictRejected, "too many handshakes in progress"
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tlsConfig)
+	err = tlsConn.Handshake()
+	<-handshakeSlots
+	if err != nil {
+		utils.LogError(utils.Warning, err, logPrefix, "TLS handshake failed")
+		event.Verdict, event.Reason = utils.VerdictInvalid, "TLS handshake failed: "+err.Error()
+		return
+	}
+
+	// Room for the UUID and a fingerprint of up to `fingerprint.MaxLength`
+	readBuffer := make([]byte, 2048) // must be initialized for conn.Read, therefore we use make()
+	numBytes, err := tlsConn.Read(readBuffer)
 	if err != nil {
 		utils.LogError(utils.Warning, err, logPrefix, "Could not read bytes (took too long?)")
+		event.Verdict, event.Reason = utils.VerdictInvalid, "could not read data: "+err.Error()
 	} else if numBytes == 0 {
 		utils.Log(utils.Warning, logPrefix, "No data received")
+		event.Verdict, event.Reason = utils.VerdictInvalid, "no data received"
 	} else {
 		utils.Log(utils.Info, logPrefix, fmt.Sprint(numBytes), "bytes received")
 
@@ -77,212 +220,727 @@ func handleConnection(conn net.Conn) {
 
 		// TODO: Decryption of encrypted Agent message. Encryption on either side not yet implemented.
 
-		/*
-			--- Validate Agent callback format ---
-		*/
-		// The callback format assumes one piece of data, the Agent's UUID,
-		// but allows for future flexibility with space-separated values.
 		dataReceived := string(readBuffer[:numBytes])
-		dataReceivedSplit := strings.Split(dataReceived, " ")
-
-		agentUUID, err := uuid.Parse(dataReceivedSplit[0])
-
-		// Invalid Agent callback
-		if utils.CheckError(utils.Error, err, "Data received from non-Agent (Not a valid UUID)!") {
+		checkin := parseCallback(&event, dataReceived)
+		if checkin == nil {
 			return
 		}
 
-		// Valid Agent callback
-		utils.Log(utils.List, "\t\t\tCallback from agent", agentUUID.String())
-
-		// Agent is only testing connection, no additional processing needed
-		// Response looks like "UUID TEST"
-		if len(dataReceivedSplit) > 1 && dataReceivedSplit[1] == "TEST" {
-			utils.Log(utils.Done, "\t\t\tAgent is testing connection, do nothing")
+		// A collector leaves the scoring to the central node, see `receiveForwardedCallbacks()`
+		if forwarder != nil {
+			utils.Log(utils.Done, "\t\t\tForwarding checkin to the central node")
+			event.Reason, payload = "forwarded to the central node", dataReceived
 			return
 		}
 
-		/*
-			--- Validate Agent registration ---
-			: Check that Agent is known to us (registered in our db)
-		*/
-		checkAgentRegistrationSQL := `
-			SELECT * FROM Agents
-			WHERE agent_uuid = ?
-		`
-		checkAgentRegistrationStatement, err := db.Prepare(checkAgentRegistrationSQL)
-		if utils.CheckError(utils.Error, err, "Could not create CheckAgentRegistration statement") {
-			return
+		scoreErr = scoreCheckin(&event, *checkin)
+	}
+}
+
+/*
+	Take one of the `max_handshakes` slots every source shares. A target in
+	scope waits for one until its handshake would have timed out anyway,
+	anyone else gets one right away or not at all.
+*/
+func takeHandshakeSlot(inScope bool, deadline time.Time) bool {
+	select {
+	case handshakeSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if !inScope {
+		return false
+	}
+
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	select {
+	case handshakeSlots <- struct{}{}:
+		return true
+	case <-timeout.C:
+		return false
+	}
+}
+
+/*
+	Check that the data received is framed like a callback, and fill in
+	what it claims to be. Returns the checkin to score, nil if there's
+	nothing to score.
+*/
+func parseCallback(event *storage.CallbackEvent, dataReceived string) *agentCheckin {
+	/*
+		--- Validate Agent callback format ---
+	*/
+	// The callback format is the Agent's UUID, optionally followed by a
+	// space and either "TEST" or the host's fingerprint, see `agent/fingerprint`.
+	dataReceivedSplit := strings.SplitN(dataReceived, " ", 2)
+
+	agentUUID, err := uuid.Parse(dataReceivedSplit[0])
+
+	// Invalid Agent callback
+	if utils.CheckError(utils.Error, err, "Data received from non-Agent (Not a valid UUID)!") {
+		event.MessageType, event.Verdict, event.Reason = utils.MessageUnknown, utils.VerdictInvalid, "not a valid UUID"
+		return nil
+	}
+	event.AgentUUID = agentUUID.String()
+
+	// Valid Agent callback
+	utils.Log(utils.List, "\t\t\tCallback from agent", agentUUID.String())
+
+	// Agent is only testing connection, no additional processing needed
+	// Response looks like "UUID TEST"
+	if len(dataReceivedSplit) > 1 && dataReceivedSplit[1] == "TEST" {
+		utils.Log(utils.Done, "\t\t\tAgent is testing connection, do nothing")
+		event.MessageType, event.Verdict, event.Reason = utils.MessageTest, utils.VerdictTest, ""
+		return nil
+	}
+	event.MessageType = utils.MessageCheckin
+
+	checkin := agentCheckin{AgentUUID: agentUUID.String(), TargetIP: event.SourceIP, SourcePort: event.SourcePort, TimeUnix: event.TimeUnix}
+
+	// Older Agents don't send a fingerprint, and a bad one doesn't
+	// invalidate the checkin itself
+	if len(dataReceivedSplit) > 1 {
+		parsedFingerprint, err := fingerprint.Parse(dataReceivedSplit[1])
+		if !utils.CheckError(utils.Warning, err, "\t\t\tIgnoring invalid host fingerprint") {
+			checkin.Fingerprint = &parsedFingerprint
+			utils.Log(utils.List, "\t\t\tHost:", checkin.Fingerprint.String())
 		}
+	}
+
+	return &checkin
+}
 
-		// TODO: change Query() to QueryRow()
-		agentRegistrationRows, err := checkAgentRegistrationStatement.Query(agentUUID.String())
-		if utils.CheckError(utils.Warning, err, "Could not execute CheckAgentRegistration statement") {
+// The one rejected checkin that counts against its source, see `recordSourceVerdict()`.
+var errUnknownAgent error = errors.New("unknown agent")
+
+/*
+	Look up the checkin's Agent and target, then score and record it. The
+	event's verdict and reason say what came of it. Returns
+	`errUnknownAgent` if the Agent isn't registered, or the error if it
+	couldn't be looked up or recorded.
+*/
+func scoreCheckin(event *storage.CallbackEvent, checkin agentCheckin) error {
+	if ready, err := lookUpCheckin(event, &checkin); !ready {
+		return err
+	}
+
+	/*
+		--- Record the checkin ---
+		: Everything from here on reads and writes the Agent's state, so it
+		  runs as a single write, one checkin at a time
+	*/
+	var verdict, reason string
+	err := writer.Write(func(tx storage.Tx) (err error) {
+		verdict, reason, err = recordCheckin(tx, checkin)
+		return
+	})
+	if utils.CheckError(utils.Error, err, "Could not record checkin") {
+		return err
+	}
+	event.Verdict, event.Reason = verdict, reason
+	return nil
+}
+
+/*
+	Fill in the checkin's Agent and target. Returns whether it's ready to be
+	recorded; if not, the event's verdict says why, unless it returns an
+	error other than `errUnknownAgent`.
+*/
+func lookUpCheckin(event *storage.CallbackEvent, checkin *agentCheckin) (ready bool, err error) {
+	/*
+		--- Validate Agent registration ---
+		: Check that Agent is known to us (registered in our db)
+	*/
+	// All timestamps are in seconds from the UNIX epoch
+	dbAgent, err := repository.GetAgent(checkin.AgentUUID)
+
+	// Unknown (non-registered) Agent UUID
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.Log(utils.Error, "\t\t\tAgent", checkin.AgentUUID, "is unknown!")
+		event.Verdict, event.Reason = utils.VerdictRejected, errUnknownAgent.Error()
+		return false, errUnknownAgent
+	} else if utils.CheckError(utils.Warning, err, "Could not execute GetAgent statement") {
+		return false, err
+	}
+
+	// Agent is known, continue
+	checkin.TeamID, checkin.RootDate = dbAgent.TeamID, dbAgent.RootDateUnix
+	checkin.CallbackMinutes, checkin.JitterPercent = dbAgent.CallbackMinutes, dbAgent.JitterPercent
+	checkin.LocalPort, checkin.Platform = dbAgent.LocalPort, dbAgent.Platform
+	checkin.BoundTarget, checkin.TargetLocked = dbAgent.BoundTarget, dbAgent.TargetLocked
+	utils.Log(utils.Done, "\t\t\t"+dbAgent.AgentType+" Agent (Team "+fmt.Sprint(checkin.TeamID)+") is known: created", time.Unix(dbAgent.CreatedUnix, 0).String())
+
+	/*
+		--- Check if callback source IP is in scope ---
+	*/
+	dbTarget, err := repository.GetTarget(checkin.TargetIP)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.Log(utils.Error, "\t\t\tSource IP '"+checkin.TargetIP+"' is not in scope!")
+		event.Verdict, event.Reason = utils.VerdictRejected, "source IP "+checkin.TargetIP+" is not in scope"
+		return false, nil
+	} else if utils.CheckError(utils.Error, err, "Could not execute GetTarget statement") {
+		return false, err
+	}
+
+	checkin.TargetValue = dbTarget.Value
+	utils.Log(utils.Done, "\t\t\tTarget '"+checkin.TargetIP+"' is in scope and has a value of '"+fmt.Sprint(checkin.TargetValue)+"'")
+	return true, nil
+}
+
+/*
+	Check a checkin against the Agent's binding and callback frequency, and
+	record it if it counts. Returns the checkin's verdict and reason for the
+	audit log; an error means nothing it did should be kept.
+*/
+func recordCheckin(tx storage.Tx, checkin agentCheckin) (verdict string, reason string, err error) {
+	/*
+		--- Check the Agent is calling back from its own target ---
+		: An Agent is bound to the target it was generated for, or else
+		  to the first target it calls back from. The same UUID calling
+		  back from anywhere else means the binary has been copied to
+		  other hosts.
+	*/
+	if checkin.BoundTarget == "" {
+		checkin.BoundTarget, err = bindAgentToTarget(tx, checkin.AgentUUID, checkin.TargetIP)
+		if utils.CheckError(utils.Error, err, "Could not bind Agent to target") {
 			return
 		}
+	}
 
-		knownAgent := agentRegistrationRows.Next()
+	if checkin.BoundTarget != checkin.TargetIP {
+		// Agents generated for a target are only ever accepted from it
+		if checkin.TargetLocked {
+			err = recordAgentReuse(tx, checkin.AgentUUID, checkin.TargetIP, checkin.TimeUnix, utils.ReusePolicyReject)
+			utils.Log(utils.Error, "\t\t\tAgent was generated for target '"+checkin.BoundTarget+"', rejecting callback from '"+checkin.TargetIP+"'")
+			return utils.VerdictRejected, "agent was generated for target " + checkin.BoundTarget, err
+		}
 
-		// Unknown (non-registered) Agent UUID
-		if !knownAgent {
-			utils.Log(utils.Error, "\t\t\tAgent", agentUUID.String(), "is unknown!")
+		reusePolicy := currentConfig().Callbacks.ReusePolicy
+		err = recordAgentReuse(tx, checkin.AgentUUID, checkin.TargetIP, checkin.TimeUnix, reusePolicy)
+		if reusePolicy == utils.ReusePolicyReject {
+			utils.Log(utils.Error, "\t\t\tAgent is bound to target '"+checkin.BoundTarget+"', rejecting callback from '"+checkin.TargetIP+"' (copied binary?)")
+			return utils.VerdictRejected, "agent is bound to target " + checkin.BoundTarget + " (copied binary?)", err
+		} else if err != nil {
 			return
 		}
+		utils.Log(utils.Warning, "\t\t\tAgent is bound to target '"+checkin.BoundTarget+"', flagging callback from '"+checkin.TargetIP+"' (copied binary?)")
+		reason = "flagged, agent is bound to target " + checkin.BoundTarget + " (copied binary?)"
+	}
 
-		// Agent is known, continue
-		// All timestamps are in seconds from the UNIX epoch
-		var dbAgentUUID string
-		var dbAgentTeam int
-		var dbServerPrivateKey string
-		var dbAgentPublicKey string
-		var dbAgentDate int
-		var dbAgentRootDate int
-		agentRegistrationRows.Scan(&dbAgentUUID, &dbAgentTeam, &dbServerPrivateKey, &dbAgentPublicKey, &dbAgentDate, &dbAgentRootDate)
-		utils.Log(utils.Done, "\t\t\tAgent (Team "+fmt.Sprint(dbAgentTeam)+") is known: created", time.Unix(int64(dbAgentDate), 0).String())
-
-		// let go of db lock
-		checkAgentRegistrationStatement.Close()
-		agentRegistrationRows.Close()
-
-		/*
-			--- Check if callback source IP is in scope ---
-		*/
-		checkSourceIPInScopeSQL := `
-			SELECT * FROM TargetsInScope
-			WHERE target_ipv4_address = ?
-		`
-		checkSourceIPInScopeStatement, err := db.Prepare(checkSourceIPInScopeSQL)
-		if utils.CheckError(utils.Error, err, "Could not create CheckSourceIPInScope statement") {
-			return
+	/*
+		--- Check time difference between last callback ---
+		: Per target, so copies of a flagged Agent don't count against each other
+	*/
+	holding, err := tx.GetHostHolding(checkin.TeamID, checkin.TargetIP, checkin.AgentUUID)
+	if utils.CheckError(utils.Error, err, "Could not get host holding") {
+		return
+	}
+
+	checkinTime := checkin.TimeUnix
+	if holding.LatestUnix == 0 { // first callback
+		utils.Log(utils.List, "\t\t\tThis is this Agent's first callback")
+	} else if checkinTime < holding.LatestUnix {
+		// A collector forwarded it late, after a newer checkin arrived some other way
+		utils.Log(utils.Warning, "\t\t\tAgent has already checked in after this callback was received, ignoring")
+		return utils.VerdictRejected, "received before the agent's latest checkin", nil
+	} else { // not first callback
+		// convert UNIX seconds to a time.Duration by multiplying by time.Second
+		var checkinTimeDifference time.Duration = time.Duration(checkinTime-holding.LatestUnix) * time.Second
+		utils.Log(utils.List, "\t\t\tLast callback was", checkinTimeDifference.String(), "ago")
+
+		// Agent called back too soon, must be no earlier than its
+		// callback frequency allows for (including jitter), skip this callback
+		minCallbackTime, _ := utils.CallbackWindow(checkin.CallbackMinutes, checkin.JitterPercent)
+		if checkinTimeDifference < minCallbackTime {
+			utils.Log(utils.Warning, "\t\t\tAgent called back too soon, ignoring ("+checkinTimeDifference.String()+" < "+minCallbackTime.String()+")")
+			return utils.VerdictRejected, "called back too soon (" + checkinTimeDifference.String() + " < " + minCallbackTime.String() + ")", nil
 		}
+	}
 
-		var dbTargetIP string
-		var dbTargetValue int
-		err = checkSourceIPInScopeStatement.QueryRow(remoteIP).Scan(&dbTargetIP, &dbTargetValue)
-		if err == sql.ErrNoRows {
-			utils.Log(utils.Error, "\t\t\tSource IP '"+remoteIP+"' is not in scope!")
-			return
-		} else if utils.CheckError(utils.Error, err, "Could not execute CheckSourceIPInScope statement") {
-			return
+	/*
+		--- Register Agent checkin ---
+		: The checkin and the Agent's host holding are recorded together, so
+		  the scoreboard never sees one without the other
+	*/
+	utils.Log(utils.Info, "\t\t\tRegistering new checkin")
+
+	err = tx.AddCheckin(checkin.AgentUUID, checkin.TargetIP, checkinTime)
+	if utils.CheckError(utils.Error, err, "Could not execute AddCheckin statement") {
+		return
+	}
+
+	holding = utils.NextHostHolding(holding, checkinTime, checkin.CallbackMinutes, checkin.JitterPercent, checkin.TargetValue)
+	err = tx.SaveHostHolding(holding)
+	if utils.CheckError(utils.Error, err, "Could not record host holding") {
+		return
+	}
+
+	utils.Log(utils.Done, "\t\t\tAgent checkin registered, now holding", fmt.Sprint(holding.Points), "points with a streak of", fmt.Sprint(holding.Streak))
+
+	/*
+		--- Record host fingerprint ---
+	*/
+	if checkin.Fingerprint != nil {
+		tx.Savepoint(func(tx storage.Tx) error {
+			return recordHostFingerprint(tx, checkin.AgentUUID, checkin.TargetIP, checkinTime, *checkin.Fingerprint)
+		})
+	}
+
+	/*
+		--- Record root access ---
+		: The first callback from the Agent's privileged local port proves it has root
+	*/
+	if checkin.RootDate == 0 && utils.HasRootSignal(checkin.Platform, checkin.LocalPort, checkin.SourcePort) {
+		err = tx.Savepoint(func(tx storage.Tx) error {
+			return tx.SetAgentRootDate(checkin.AgentUUID, checkinTime)
+		})
+		if !utils.CheckError(utils.Error, err, "Could not execute SetAgentRootDate statement") {
+			utils.Log(utils.Done, "\t\t\tAgent has root, called back from privileged port", fmt.Sprint(checkin.SourcePort))
 		}
+	}
+
+	// The checkin counts even if the extras above couldn't be recorded
+	return utils.VerdictAccepted, reason, nil
+}
+
+/*
+	Bind an Agent to the target it's calling back from, unless another
+	callback got there first. Returns the target the Agent is bound to.
+*/
+func bindAgentToTarget(tx storage.Tx, agentUUID string, targetIP string) (boundTarget string, err error) {
+	boundTarget, err = tx.BindAgentToTarget(agentUUID, targetIP)
+	if err == nil && boundTarget == targetIP {
+		utils.Log(utils.Done, "\t\t\tAgent is now bound to target '"+targetIP+"'")
+	}
+	return
+}
+
+/*
+	The IP addresses of the targets in scope, as of the last refresh. Only
+	decides which limits apply to a source, so it's looked up without
+	touching the database on every connection; scoring still checks the
+	database.
+*/
+type targetScope struct {
+	mutex     sync.RWMutex
+	targetIPs map[string]bool
+}
+
+func (scope *targetScope) contains(targetIP string) bool {
+	scope.mutex.RLock()
+	defer scope.mutex.RUnlock()
+
+	return scope.targetIPs[targetIP]
+}
 
-		utils.Log(utils.Done, "\t\t\tTarget '"+dbTargetIP+"' is in scope and has a value of '"+fmt.Sprint(dbTargetValue)+"'")
-
-		// Let go of db lock
-		checkSourceIPInScopeStatement.Close()
-
-		/*
-			--- Check time difference between last callback ---
-		*/
-		checkCallbackTimeDifferenceSQL := `
-			SELECT time_unix FROM AgentCheckins
-			WHERE agent_uuid = ?
-			ORDER BY time_unix DESC
-			LIMIT 1
-		` // get only the most recent callback
-		checkCallbackTimeDifferenceStatement, err := db.Prepare(checkCallbackTimeDifferenceSQL)
-		if utils.CheckError(utils.Error, err, "Could not create CheckCallbackTimeDifference statement") {
+func (scope *targetScope) replace(targetIPs []string) {
+	newTargetIPs := make(map[string]bool, len(targetIPs))
+	for _, targetIP := range targetIPs {
+		newTargetIPs[targetIP] = true
+	}
+
+	scope.mutex.Lock()
+	scope.targetIPs = newTargetIPs
+	scope.mutex.Unlock()
+}
+
+/*
+	Whether the IP address is a target in scope, as of the last time they
+	were loaded from the database or, on a collector, fetched from the
+	central node.
+*/
+func isTargetInScope(targetIP string) bool {
+	return targetsInScope.contains(targetIP)
+}
+
+// Load the targets in scope from the database, keeping the current ones if it can't be read.
+func loadTargetsInScope() {
+	targets, err := repository.ListTargets()
+	if utils.CheckError(utils.Error, err, "Could not get the targets in scope, keeping the current ones") {
+		return
+	}
+
+	targetIPs := make([]string, 0, len(targets))
+	for _, target := range targets {
+		targetIPs = append(targetIPs, target.IP)
+	}
+	targetsInScope.replace(targetIPs)
+}
+
+// Load the targets in scope again every `scopeRefreshInterval`, until stopped.
+func refreshTargetsInScope() {
+	ticker := time.NewTicker(scopeRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			loadTargetsInScope()
+		case <-backgroundStop:
 			return
 		}
+	}
+}
 
-		var callbackPoints int
+/*
+	Count the connection toward a ban if it wasn't from an Agent at all,
+	including one that isn't registered (`scoreErr` is `errUnknownAgent`),
+	or clear the source's record if it was. Targets in scope are banned
+	too, but only after `callbacks.in_scope_limits.max_invalid`.
+*/
+func recordSourceVerdict(event *storage.CallbackEvent, inScope bool, scoreErr error) {
+	switch {
+	case event.Verdict == utils.VerdictInvalid, errors.Is(scoreErr, errUnknownAgent):
+		bannedUntil := limiter.RecordInvalid(event.SourceIP, time.Now(), inScope)
+		if !bannedUntil.IsZero() {
+			utils.Log(utils.Warning, "\t\t\tBanning", event.SourceIP, "until", bannedUntil.Format(time.RFC3339), "for sending invalid payloads")
+			event.Reason += ", source banned until " + bannedUntil.Format(time.RFC3339)
+		}
+	case event.Verdict == utils.VerdictAccepted, event.Verdict == utils.VerdictTest:
+		limiter.RecordValid(event.SourceIP)
+	}
+}
 
-		// UNIX time, uses seconds
-		var dbLastAgentCheckin int64
-		err = checkCallbackTimeDifferenceStatement.QueryRow(agentUUID.String()).Scan(&dbLastAgentCheckin)
-		if err == sql.ErrNoRows { // first callback
-			utils.Log(utils.List, "\t\t\tThis is this Agent's first callback")
-			callbackPoints = 100 // pwn = 100 points at first, no matter what
-		} else if utils.CheckError(utils.Warning, err, "Could not execute CheckCallbackTimeDifference statement") { // genuine error
+/*
+	Save what the rate limits and bans did to each source every few seconds,
+	until stopped, so admins can see it. Refused connections aren't recorded
+	as callback events, a flood would only fill the database.
+*/
+func recordCallbackSources() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			saveCallbackSources()
+		case <-backgroundStop:
 			return
-		} else { // not first callback
-			// convert UNIX seconds to a time.Duration by multiplying by time.Second
-			var checkinTimeDifference time.Duration = time.Duration(time.Now().Unix()-dbLastAgentCheckin) * time.Second
-			utils.Log(utils.List, "\t\t\tLast callback was", checkinTimeDifference.String(), "ago")
-
-			// Agent called back too soon, must be greater than minTime, skip this callback
-			// In testing, callbacks have rarely came back 59 seconds apart instead of 60
-			if checkinTimeDifference < minCallbackTime {
-				utils.Log(utils.Warning, "\t\t\tAgent called back too soon, ignoring ("+checkinTimeDifference.String()+" < "+minCallbackTime.String()+")")
-				return
-			}
+		}
+	}
+}
 
-			callbackPoints = utils.CalculateCallbackPoints(checkinTimeDifference, dbTargetValue)
+func saveCallbackSources() {
+	now := time.Now()
+	changes := limiter.TakeSourceChanges(now)
+	if len(changes) == 0 {
+		return
+	}
 
-			utils.Log(utils.Done, "\t\t\tTime between callbacks = "+checkinTimeDifference.String()+", worth", fmt.Sprint(callbackPoints), "points")
+	err := writer.Write(func(tx storage.Tx) error {
+		for _, change := range changes {
+			if err := tx.RecordCallbackSource(change, now.Unix()); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	utils.CheckError(utils.Error, err, "Could not execute RecordCallbackSource statement")
+}
 
-		// Let go of db lock
-		checkCallbackTimeDifferenceStatement.Close()
+// Reinstate the bans that hadn't run out when the server last stopped.
+func restoreCallbackBans() {
+	bans, err := repository.CallbackBans(time.Now().Unix())
+	if utils.CheckError(utils.Error, err, "Could not execute GetCallbackBans statement") {
+		return
+	}
 
-		/*
-			--- Add points for callback ---
-		*/
+	for dbSourceIP, dbBannedUntil := range bans {
+		limiter.Ban(dbSourceIP, time.Unix(dbBannedUntil, 0))
+		utils.Log(utils.Info, "Source", dbSourceIP, "is still banned until", time.Unix(dbBannedUntil, 0).Format(time.RFC3339))
+	}
+}
 
-		// actually we're using the current score in the moment, not a cumulative total,
-		// so no need to do anything here for now.
-		//println("hi")
+// Append a connection to the audit log.
+func recordCallbackEvent(tx storage.Tx, event storage.CallbackEvent) error {
+	return tx.AddCallbackEvent(event)
+}
+
+/*
+	Record a connection in the audit log or, on a collector, buffer it for
+	the central node along with the `payload` it should score, if any.
+*/
+func recordConnection(event storage.CallbackEvent, payload string) error {
+	if forwarder != nil {
+		return forwarder.bufferCallback(event, payload)
+	}
 
-		/*
-			--- Register Agent checkin ---
-		*/
-		utils.Log(utils.Info, "\t\t\tRegistering new checkin")
+	return writer.Write(func(tx storage.Tx) error {
+		return recordCallbackEvent(tx, event)
+	})
+}
 
-		addCheckinSQL := `
-			INSERT INTO AgentCheckins(agent_uuid, target_ipv4_address, time_unix)
-			VALUES (?, ?, ?)
-		`
-		addCheckinStatement, err := db.Prepare(addCheckinSQL)
-		if utils.CheckError(utils.Error, err, "Could not create AddCheckin statement") {
-			return
+/*
+	Delete callback events older than `callbacks.event_retention`, now and
+	then every hour until stopped, unless it's "0s". Nothing else ever
+	removes or changes an event.
+*/
+func pruneCallbackEvents() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if retention := currentConfig().Callbacks.EventRetention; retention.Duration != 0 {
+			cutoff := time.Now().Add(-retention.Duration).Unix()
+
+			var numDeleted int64
+			err := writer.Write(func(tx storage.Tx) error {
+				var err error
+				numDeleted, err = tx.PruneCallbackEvents(cutoff)
+				return err
+			})
+			if !utils.CheckError(utils.Error, err, "Could not execute PruneCallbackEvents statement") && numDeleted > 0 {
+				utils.Log(utils.Info, "Deleted", fmt.Sprint(numDeleted), "callback events older than", retention.String())
+			}
 		}
 
-		_, err = addCheckinStatement.Exec(agentUUID.String(), remoteIP, time.Now().Unix())
-		if utils.CheckError(utils.Error, err, "Could not execute AddCheckin statement") {
+		select {
+		case <-ticker.C:
+		case <-backgroundStop:
 			return
 		}
+	}
+}
+
+/*
+	Run the central node's loops until `Shutdown()` stops them and waits
+	for them to return.
+*/
+func startBackground(loops ...func()) {
+	backgroundStop = make(chan struct{})
+	for _, loop := range loops {
+		backgroundRunning.Add(1)
+		go func(loop func()) {
+			defer backgroundRunning.Done()
+			loop()
+		}(loop)
+	}
+}
 
-		utils.Log(utils.Done, "\t\t\tAgent checkin registered")
+/*
+	Remember that an Agent called back from a target other than its own, for
+	the admins' binary reuse alerts.
+*/
+func recordAgentReuse(tx storage.Tx, agentUUID string, sourceIP string, seenUnix int64, policy string) error {
+	err := tx.RecordAgentReuse(agentUUID, sourceIP, seenUnix, policy)
+	utils.CheckError(utils.Error, err, "Could not execute RecordAgentReuse statement")
+	return err
+}
 
-		// Let go of db lock
-		addCheckinStatement.Close()
+/*
+	Store the fingerprint sent with a checkin, and update the Agent's current
+	fingerprint. An Agent whose host changes (see `fingerprint.Changes()`) is
+	flagged, it has probably been copied to or reinstalled on another host.
+	The caller runs this in a savepoint, a failure here shouldn't cost the
+	checkin.
+*/
+func recordHostFingerprint(tx storage.Tx, agentUUID string, targetIP string, checkinTime int64, hostFingerprint fingerprint.Fingerprint) error {
+	err := tx.AddCheckinFingerprint(agentUUID, targetIP, checkinTime, hostFingerprint)
+	if utils.CheckError(utils.Error, err, "Could not execute AddCheckinFingerprint statement") {
+		return err
+	}
+
+	previousFingerprint, err := tx.GetAgentFingerprint(agentUUID)
+	firstFingerprint := errors.Is(err, storage.ErrNotFound)
+	if !firstFingerprint && utils.CheckError(utils.Error, err, "Could not execute GetAgentFingerprint statement") {
+		return err
 	}
+
+	err = tx.SaveAgentFingerprint(agentUUID, hostFingerprint, checkinTime)
+	if utils.CheckError(utils.Error, err, "Could not execute SaveAgentFingerprint statement") || firstFingerprint {
+		return err
+	}
+
+	changes := fingerprint.Changes(previousFingerprint, hostFingerprint)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	utils.Log(utils.Warning, "\t\t\tAgent's host changed ("+strings.Join(changes, ", ")+"): was", previousFingerprint.String(), "now", hostFingerprint.String())
+
+	err = tx.FlagAgentFingerprint(agentUUID, checkinTime, changes)
+	utils.CheckError(utils.Error, err, "Could not execute FlagAgentFingerprint statement")
+	return err
 }
 
-// Handle the agent callback
-func listenForCallbacks(listener net.Listener) {
+/*
+	Accept the agent callbacks arriving on one listener and queue them for
+	the workers. Every listener feeds the same database, so an Agent is
+	scored the same no matter which one it calls back to.
+*/
+func listenForCallbacks(listener net.Listener, pending chan<- net.Conn) {
 	for { // infinite listening loop
 		conn, err := listener.Accept()
-		if err != nil {
-			utils.Log(utils.Warning, "Error accepting connection from", conn.RemoteAddr().String())
-			if err := conn.Close(); err != nil {
-				utils.Log(utils.Warning, "Failed to close listener:", err.Error())
-			}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			utils.LogError(utils.Warning, err, "Error accepting connection on", listener.Addr().String())
 			continue // skip the bad connection
 		}
-		utils.Log(utils.List, "Received connection from", conn.RemoteAddr().String())
 
-		// Start a new GoRoutine to handle the connection
-		go handleConnection(conn)
+		// Refused silently, logging every connection of a flood would only help it.
+		// A redirector's connections come from everyone behind it, they're
+		// limited by their real source once a worker has read it.
+		remoteIP, _ := remoteAddress(conn)
+		if !isTrustedRedirector(remoteIP) {
+			if allowed, _ := limiter.AllowConnection(remoteIP, time.Now(), isTargetInScope(remoteIP)); !allowed {
+				connectionsRefused.Add(1)
+				conn.Close()
+				continue
+			}
+		}
+		utils.Log(utils.List, "Received connection from", conn.RemoteAddr().String(), "on", listener.Addr().String())
+
+		select {
+		case pending <- conn:
+		default:
+			dropConnection(conn)
+		}
+	}
+}
+
+/*
+	Turn away a connection because every worker is busy and the queue is
+	full. It's still recorded, unless the database writer is just as busy.
+*/
+func dropConnection(conn net.Conn) {
+	connectionsDropped.Add(1)
+	utils.Log(utils.Warning, "\t\t["+conn.RemoteAddr().String()+"] Server busy, dropping connection")
+
+	event := newCallbackEvent(conn)
+	event.Verdict, event.Reason = utils.VerdictRejected, "server busy, connection dropped"
+	if forwarder != nil {
+		forwarder.bufferCallback(event, "")
+	} else {
+		writer.TryWrite(func(tx storage.Tx) error {
+			return recordCallbackEvent(tx, event)
+		})
+	}
+
+	if err := conn.Close(); err != nil {
+		utils.LogError(utils.Warning, err, "Failed to close connection")
+	}
+}
+
+/*
+	Handle queued connections, one at a time, until the queue is closed.
+	Once the shutdown deadline has passed, whatever is left in the queue is
+	closed without being handled.
+*/
+func handleConnections(pending <-chan net.Conn) {
+	for conn := range pending {
+		select {
+		case <-shutdownExpired:
+			connectionsDropped.Add(1)
+			conn.Close()
+			continue
+		default:
+		}
+
+		connectionsInFlight.Add(1)
+		handleConnection(conn)
+		connectionsInFlight.Add(-1)
+		connectionsHandled.Add(1)
 	}
 }
 
-// Configures and returns the TLS Listener
+/*
+	Configures and returns a TCP Listener. The connections it accepts are
+	wrapped in TLS by `handleConnection()`, once any PROXY protocol header
+	has been read, serving whatever `certificate` currently holds.
+*/
 func setupListener(localAddress string) (net.Listener, error) {
 	utils.Log(utils.Info, "Setting up listener on", localAddress)
 
-	cert, err := tls.LoadX509KeyPair(utils.CurrentDirectory+"/pwnts_cert.pem", utils.CurrentDirectory+"/pwnts_key.pem")
-	if err != nil {
-		utils.LogError(utils.Error, err, "Couldn't load X509 keypair")
-		os.Exit(1)
+	return net.Listen("tcp", localAddress)
+}
+
+// The config as of the last reload. Read it again rather than keeping it around.
+func currentConfig() utils.Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return config
+}
+
+/*
+	Settings that size or bind something at startup, and so can't change
+	without a restart. Returns the name of each one that differs.
+*/
+func restartOnlySettings(oldConfig utils.Config, newConfig utils.Config) (changed []string) {
+	old, new := oldConfig.Callbacks, newConfig.Callbacks
+	if strings.Join(old.Listeners, ",") != strings.Join(new.Listeners, ",") {
+		changed = append(changed, "callbacks.listeners")
+	}
+	if old.Workers != new.Workers {
+		changed = append(changed, "callbacks.workers")
+	}
+	if old.QueueSize != new.QueueSize {
+		changed = append(changed, "callbacks.queue_size")
+	}
+	if old.WriteBatchSize != new.WriteBatchSize {
+		changed = append(changed, "callbacks.write_batch_size")
+	}
+	if old.WriteBatchWait != new.WriteBatchWait {
+		changed = append(changed, "callbacks.write_batch_delay")
+	}
+	if old.MetricsAddress != new.MetricsAddress {
+		changed = append(changed, "callbacks.metrics_address")
+	}
+	if old.Limits.MaxHandshakes != new.Limits.MaxHandshakes {
+		changed = append(changed, "callbacks.limits.max_handshakes")
+	}
+
+	oldCollectors, newCollectors := oldConfig.Collectors, newConfig.Collectors
+	if oldCollectors.IntakeAddress != newCollectors.IntakeAddress {
+		changed = append(changed, "collectors.intake_address")
+	}
+	if oldCollectors.CentralURL != newCollectors.CentralURL {
+		changed = append(changed, "collectors.central_url")
+	}
+	if oldCollectors.CACertificate != newCollectors.CACertificate || oldCollectors.Certificate != newCollectors.Certificate || oldCollectors.Key != newCollectors.Key {
+		changed = append(changed, "collectors.ca_certificate, collectors.certificate or collectors.key")
+	}
+	if oldCollectors.BufferDirectory != newCollectors.BufferDirectory {
+		changed = append(changed, "collectors.buffer_directory")
+	}
+	return
+}
+
+/*
+	Apply a reloaded config and reload the TLS certificates, keeping the
+	current ones if they can't be loaded. The targets in scope are loaded
+	from the database again too; a collector fetches them from the central
+	node every minute instead.
+*/
+func Reload(newConfig utils.Config) {
+	for _, setting := range restartOnlySettings(currentConfig(), newConfig) {
+		utils.Log(utils.Warning, "Changing", setting, "requires a restart")
+	}
+
+	configMutex.Lock()
+	config = newConfig
+	configMutex.Unlock()
+	limiter.SetLimits(newConfig.Callbacks.Limits, newConfig.Callbacks.InScopeLimits)
+	if forwarder == nil {
+		loadTargetsInScope()
 	}
 
-	tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
+	err := certificate.Reload()
+	if !utils.CheckError(utils.Error, err, "Could not reload TLS certificate, keeping the current one") {
+		utils.Log(utils.Done, "Reloaded TLS certificate")
+	}
 
-	return tls.Listen("tcp", localAddress, &tlsConfig)
+	if collectorCertificate != nil {
+		err = collectorCertificate.Reload()
+		if !utils.CheckError(utils.Error, err, "Could not reload the collector TLS certificate, keeping the current one") {
+			utils.Log(utils.Done, "Reloaded collector TLS certificate")
+		}
+	}
 }
 
-func printBanner() {
+func PrintBanner() {
 	pwntsBannerDivider := "============================================="
 	pwntsBanner :=
 		` _______           _       _________ _______ 
@@ -302,56 +960,152 @@ func printBanner() {
 	fmt.Println()
 }
 
-func main() {
-	// Flags, usage visible with `go run server.go --help`.
-	//	 - Actually, I think attempting to use any flag that doesn't exist brings up the usage.
-	// Flags can be used with '--name' or '-name', doesn't matter.
+/*
+	Start listening for callbacks and return once every listener is up.
+	`database` must already be validated. Exits if the server can't start.
+*/
+func Start(database storage.Repository, startConfig utils.Config, options Options) {
+	repository, config = database, startConfig
 
-	// Optionally initialize database by creating tables with the "--init-db" flag
-	var argQuiet bool
-	var argTest bool
-	var argPort int
-	flag.BoolVar(&argQuiet, "quiet", false, "Don't print the banner")
-	flag.BoolVar(&argTest, "test", false, "Listen on localhost instead of the default interface's IP address")
-	flag.IntVar(&argPort, "port", 444, "Port to listen on")
-	flag.Parse()
+	writer = storage.NewBatchWriter(repository, config.Callbacks.QueueSize, config.Callbacks.WriteBatchSize, config.Callbacks.WriteBatchWait.Duration)
+	expvar.Publish("database_writer", expvar.Func(func() interface{} { return writer.Stats() }))
 
-	if !argQuiet {
-		printBanner()
+	limiter = utils.NewSourceLimiter(config.Callbacks.Limits, config.Callbacks.InScopeLimits)
+	restoreCallbackBans()
+	loadTargetsInScope()
+	startBackground(recordCallbackSources, pruneCallbackEvents, refreshTargetsInScope)
+
+	if config.Collectors.IntakeAddress != "" {
+		startIntake()
 	}
 
-	// Open the Sqlite3 database
-	utils.Log(utils.Info, "Opening database file")
+	startListening(options)
+}
 
-	// Open database
-	// make sure you don't use `:=` here as it would define its own locally-scoped variable
-	db = utils.GetDatabaseHandle()
+/*
+	Start listening for callbacks as a collector, which needs no database:
+	callbacks are checked for framing, buffered in
+	`collectors.buffer_directory`, and forwarded to the central node to be
+	scored. Exits if the collector can't start.
+*/
+func StartCollector(startConfig utils.Config, options Options) {
+	config = startConfig
 
-	defer utils.Close(db)
+	err := config.Collectors.ValidateCollector()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_CONFIG, "Can't run as a collector")
 
-	// Validate the database connection and structure
-	utils.ValidateDatabaseExit(db)
+	limiter = utils.NewSourceLimiter(config.Callbacks.Limits, config.Callbacks.InScopeLimits)
+	startForwarder()
 
-	var listenIP net.IP
-	if argTest {
-		listenIP = net.ParseIP("127.0.0.1")
-	} else {
-		listenIP = utils.GetHostIP()
+	startListening(options)
+}
+
+// Set up the listeners and the workers handling what they accept.
+func startListening(options Options) {
+	handshakeSlots = make(chan struct{}, config.Callbacks.Limits.MaxHandshakes)
+
+	var err error
+	certificate, err = utils.LoadReloadableCertificate(utils.CurrentDirectory+"/pwnts_cert.pem", utils.CurrentDirectory+"/pwnts_key.pem")
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't load X509 keypair")
+	tlsConfig = tls.Config{GetCertificate: certificate.GetCertificate}
+
+	listenAddresses := config.Callbacks.Listeners
+	if len(listenAddresses) == 0 {
+		var listenIP net.IP
+		if options.Test {
+			listenIP = net.ParseIP("127.0.0.1")
+		} else {
+			listenIP = utils.GetHostIP()
+		}
+
+		listenAddresses = []string{fmt.Sprintf("%s:%d", listenIP.String(), options.Port)}
 	}
 
-	listenAddress := fmt.Sprintf("%s:%d", listenIP.String(), argPort)
+	// Set up a TLS (encrypted) listener for each address to listen for agent callbacks
+	for _, listenAddress := range listenAddresses {
+		listener, err := setupListener(listenAddress)
+		if err != nil {
+			utils.LogError(utils.Error, err, "Couldn't set up listener on", listenAddress)
+			os.Exit(1)
+		}
 
-	// Set up TLS (encrypted) listener to listen for agent callbacks
-	listener, err := setupListener(listenAddress)
-	if err != nil {
-		utils.LogError(utils.Error, err, "Couldn't set up listener on", listenAddress)
-		os.Exit(1)
+		utils.Log(utils.Done, "Listening on", listenAddress)
+		listeners = append(listeners, listener)
+	}
+
+	pending = make(chan net.Conn, config.Callbacks.QueueSize)
+	shutdownExpired = make(chan struct{})
+	for i := 0; i < config.Callbacks.Workers; i++ {
+		workersRunning.Add(1)
+		go func() {
+			defer workersRunning.Done()
+			handleConnections(pending)
+		}()
+	}
+
+	expvar.Publish("callbacks_queue_depth", expvar.Func(func() interface{} { return len(pending) }))
+	if config.Callbacks.MetricsAddress != "" {
+		// Importing expvar registers its handler at /debug/vars, the site uses its own mux so it never serves them
+		go func() {
+			err := http.ListenAndServe(config.Callbacks.MetricsAddress, nil)
+			utils.CheckError(utils.Error, err, "Metrics server on", config.Callbacks.MetricsAddress, "stopped")
+		}()
+		utils.Log(utils.Done, "Serving metrics on http://"+config.Callbacks.MetricsAddress+"/debug/vars")
 	}
-	defer listener.Close()
 
-	utils.Log(utils.Done, "Listening on", listenAddress)
 	color.New(color.Bold, color.FgBlue).Printf("\n--------------- Listening for Callbacks ---------------\n")
 
 	// Process callbacks
-	listenForCallbacks(listener)
+	for _, listener := range listeners {
+		listenersRunning.Add(1)
+		go func(listener net.Listener) {
+			defer listenersRunning.Done()
+			listenForCallbacks(listener, pending)
+		}(listener)
+	}
+}
+
+/*
+	Stop accepting, give the workers until `shutdown_timeout` to finish
+	what they've already received, then flush everything to the database.
+	The database itself is left open for the caller to close. A collector
+	stops forwarding instead, whatever is left stays buffered on disk.
+*/
+func Shutdown() {
+	for _, listener := range listeners {
+		utils.Close(listener)
+	}
+	intakeStopped := stopIntake()
+	listenersRunning.Wait()
+	close(pending)
+
+	workersDone := make(chan struct{})
+	go func() {
+		workersRunning.Wait()
+		close(workersDone)
+	}()
+
+	shutdownTimeout := currentConfig().ShutdownTimeout
+	utils.Log(utils.Info, "Waiting up to", shutdownTimeout.String(), "for", fmt.Sprint(connectionsInFlight.Value()+int64(len(pending))), "callbacks to finish")
+	select {
+	case <-workersDone:
+	case <-time.After(shutdownTimeout.Duration):
+		utils.Log(utils.Warning, "Callbacks still running after", shutdownTimeout.String()+", dropping", fmt.Sprint(len(pending)), "queued connections")
+		close(shutdownExpired)
+		<-workersDone
+	}
+
+	if forwarder != nil {
+		forwarder.stop()
+		utils.Log(utils.Done, "Handled every callback,", fmt.Sprint(forwarder.buffer.Len()), "still buffered for the central node")
+		return
+	}
+
+	// Nothing else writes once the loops are stopped, so the last changes to the sources are flushed here
+	<-intakeStopped
+	close(backgroundStop)
+	backgroundRunning.Wait()
+	saveCallbackSources()
+	writer.Close()
+	utils.Log(utils.Done, "Handled every callback")
 }
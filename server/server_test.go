@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	--- Test harness ---
+	: A central callback server on a scratch SQLite database, and the
+	  certificates its listeners and the collectors present, all set up in
+	  the package's globals like `Start()` would and torn down after each
+	  test.
+*/
+
+// Signs the certificates of one test, written as PEM files into its temporary directory.
+type testCA struct {
+	directory string
+	path      string
+	cert      *x509.Certificate
+	key       *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate the CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pwnts test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create the CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("Could not parse the CA certificate: %v", err)
+	}
+
+	ca := &testCA{directory: t.TempDir(), cert: cert, key: key}
+	ca.path = filepath.Join(ca.directory, "ca.pem")
+	writePEM(t, ca.path, "CERTIFICATE", certDER)
+	return ca
+}
+
+/*
+	Issue a certificate for 127.0.0.1 with the common name, good for either
+	side of a connection. Returns the paths of its certificate and key.
+*/
+func (ca *testCA) issue(t *testing.T, commonName string) (certPath string, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Could not create the certificate for %s: %v", commonName, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not encode the key for %s: %v", commonName, err)
+	}
+
+	certPath, keyPath = filepath.Join(ca.directory, commonName+".pem"), filepath.Join(ca.directory, commonName+"_key.pem")
+	writePEM(t, certPath, "CERTIFICATE", certDER)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write %s: %v", path, err)
+	}
+}
+
+/*
+	Set up the central callback server's database, writer and limits, with
+	the default config as changed by `configure`.
+*/
+func startTestServer(t *testing.T, configure func(config *utils.Config)) {
+	scratch, err := storage.OpenSQLite(filepath.Join(t.TempDir(), utils.DatabaseFilename))
+	if err != nil {
+		t.Fatalf("Could not open the scratch database: %v", err)
+	}
+	if _, _, err = scratch.Migrate(); err != nil {
+		utils.Close(scratch)
+		t.Fatalf("Could not migrate the scratch database: %v", err)
+	}
+
+	testConfig := utils.DefaultConfig()
+	testConfig.Callbacks.WriteBatchWait = utils.Duration{Duration: time.Millisecond}
+	if configure != nil {
+		configure(&testConfig)
+	}
+
+	repository, config = scratch, testConfig
+	writer = storage.NewBatchWriter(repository, config.Callbacks.QueueSize, config.Callbacks.WriteBatchSize, config.Callbacks.WriteBatchWait.Duration)
+	limiter = utils.NewSourceLimiter(config.Callbacks.Limits, config.Callbacks.InScopeLimits)
+	targetsInScope.replace(nil)
+	handshakeSlots = make(chan struct{}, config.Callbacks.Limits.MaxHandshakes)
+
+	t.Cleanup(func() {
+		writer.Close()
+		utils.Close(repository)
+		repository, writer, limiter, handshakeSlots = nil, nil, nil, nil
+	})
+}
+
+// Register a new team's Agent, and its target if it isn't in scope yet. Returns the Agent's UUID.
+func addTestAgent(t *testing.T, targetIP string) string {
+	teamID, err := repository.AddTeam("team-"+uuid.NewString(), "hash", time.Now().Unix())
+	if err != nil {
+		t.Fatalf("Could not add a team: %v", err)
+	}
+	if _, err = repository.GetTarget(targetIP); err != nil {
+		if err = repository.AddTarget(storage.Target{IP: targetIP, Value: 5}); err != nil {
+			t.Fatalf("Could not add target %s: %v", targetIP, err)
+		}
+		loadTargetsInScope()
+	}
+
+	agentUUID := uuid.NewString()
+	agent := utils.AgentRegistration{AgentUUID: agentUUID, TeamID: teamID, AgentType: utils.AgentTypeBinary, CallbackMinutes: 5}
+	if err = repository.AddAgent(agent, time.Now().Unix()); err != nil {
+		t.Fatalf("Could not add an Agent: %v", err)
+	}
+	return agentUUID
+}
+
+// Wait for the callback server to record `count` callback events, returned newest first.
+func waitForEvents(t *testing.T, count int) []storage.CallbackEvent {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, err := repository.CallbackEvents(storage.CallbackEventFilter{}, count+10)
+		if err != nil {
+			t.Fatalf("Could not get the callback events: %v", err)
+		}
+		if len(events) >= count || time.Now().After(deadline) {
+			if len(events) != count {
+				t.Fatalf("%d callback events recorded, want %d: %+v", len(events), count, events)
+			}
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Shutdown stops the background loops before the writer, and flushes what they'd have saved next.
+func TestShutdownStopsBackgroundLoops(t *testing.T) {
+	startTestServer(t, func(config *utils.Config) {
+		config.Callbacks.Limits.ConnectionsPerMinute, config.Callbacks.Limits.ConnectionBurst = 0.001, 1
+	})
+	pending, shutdownExpired = make(chan net.Conn), make(chan struct{})
+	startBackground(recordCallbackSources, pruneCallbackEvents)
+
+	now := time.Now()
+	limiter.AllowConnection("203.0.113.7", now, false)
+	if allowed, _ := limiter.AllowConnection("203.0.113.7", now, false); allowed {
+		t.Fatal("Connection past the burst allowed")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		Shutdown()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() still waiting for the background loops after 5s")
+	}
+
+	sources, err := repository.CallbackSources(now.Unix(), 10)
+	if err != nil {
+		t.Fatalf("Could not get the callback sources: %v", err)
+	}
+	if len(sources) != 1 || sources[0].SourceIP != "203.0.113.7" || sources[0].Throttled != 1 {
+		t.Errorf("Callback sources are %+v, want 203.0.113.7 throttled once", sources)
+	}
+}
@@ -1,131 +1,62 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"time"
 
+	"github.com/s-christian/pwnts/storage"
 	"github.com/s-christian/pwnts/utils"
 )
 
 type TeamScores struct {
-	Pwnts      int `json:"pwnts"`
-	PwnedHosts int `json:"pwned_hosts"`
+	Pwnts       int            `json:"pwnts"`
+	PwnedHosts  int            `json:"pwned_hosts"`
+	AgentTypes  map[string]int `json:"agent_types"`  // number of live Agents of each type
+	HostOS      map[string]int `json:"host_os"`      // number of live Agents on each OS, by their fingerprints
+	MovedAgents int            `json:"moved_agents"` // number of live Agents whose host has changed
 }
 
 /*
-	Retrieve the last two Agent checkins grouped by team and target IP address
+	Score every team from the host holdings (see `utils.HostHolding`). A
+	team's live Agents on the same target are combined by `hostScoring`, see
+	`utils.CombineHostPoints()`.
 */
-func GetScoreboardData(db *sql.DB) (data []byte, err error) {
-	getLastTwoCallbacksSQL := `
-		SELECT Teams.name, Callbacks.target_ipv4_address, Callbacks.value, Callbacks.time_unix, Callbacks.callback_order
-		FROM (
-			SELECT Agents.team_id, Callbacks.target_ipv4_address, Callbacks.value, Callbacks.time_unix, Callbacks.agent_uuid, row_number() OVER (PARTITION BY Agents.team_id, Callbacks.target_ipv4_address ORDER BY Callbacks.time_unix DESC) AS callback_order
-			FROM (
-				SELECT AgentCheckins.target_ipv4_address, TargetsInScope.value, AgentCheckins.time_unix, AgentCheckins.agent_uuid
-				FROM AgentCheckins
-				JOIN TargetsInScope
-				ON AgentCheckins.target_ipv4_address = TargetsInScope.target_ipv4_address
-			) AS Callbacks
-			JOIN Agents
-			ON Callbacks.agent_uuid = Agents.agent_uuid
-		) AS Callbacks
-		JOIN Teams
-		ON Callbacks.team_id = Teams.team_id
-		WHERE callback_order <= 2
-	`
-	getLastTwoCallbacksStatement, err := db.Prepare(getLastTwoCallbacksSQL)
-	if utils.CheckError(utils.Error, err, "Could not create GetLastTwoCallbacks statement") {
-		return
-	}
+func GetScoreboardData(repository storage.Repository, hostScoring string) (data []byte, err error) {
+	now := time.Now().Unix()
 
-	lastTwoCallbacksRows, err := getLastTwoCallbacksStatement.Query()
-	if utils.CheckError(utils.Error, err, "Could not execute GetLastTwoCallbacks statement") {
+	// one per team and target, only counting live Agents
+	teamHoldings, err := repository.TeamHoldings(now)
+	if utils.CheckError(utils.Error, err, "Could not execute GetTeamHoldings statement") {
 		return
 	}
-	utils.Close(getLastTwoCallbacksStatement)
 
 	/*
-		--- Retrieve all team names and initialize the map ---
+		--- Retrieve all teams and initialize the map ---
 	*/
-	teamNames, err := utils.GetTeamNames(db)
+	teams, err := repository.ListTeams()
 	if utils.CheckError(utils.Error, err, "Could not retrieve list of Team names") {
 		return
 	}
 
-	teamsPointsAndHosts := make(map[string]*TeamScores, len(teamNames))
-	for _, teamName := range teamNames {
-		teamsPointsAndHosts[teamName] = &TeamScores{Pwnts: 0, PwnedHosts: 0}
+	teamsPointsAndHosts := make(map[string]*TeamScores, len(teams))
+	for _, team := range teams {
+		teamsPointsAndHosts[team.Name] = &TeamScores{Pwnts: 0, PwnedHosts: 0, AgentTypes: map[string]int{}, HostOS: map[string]int{}}
 	}
 
-	// Scoring note:
-	// Multiple Agents from the same team on the same host is fine.
-	// We only use the last checkins, grouped by team and IP.
-	var (
-		dbTeamNameLast          string
-		dbTargetValueLast       int
-		dbAgentCallbackUnixLast int
-		agentDead               bool = false
-		singleCallback          bool = false
-	)
-	for lastTwoCallbacksRows.Next() {
-		if utils.CheckError(utils.Error, lastTwoCallbacksRows.Err(), "Could not prepare next db row for scanning GetLastTwoCallbacks rows") {
-			return
-		}
-
-		// team_id, target_ip_address, value, time_unix, callback_order (1 or 2, 1 being first and most recent)
-		// Compare second callback to the most recent one
-		var (
-			dbTeamNameCurrent          string
-			dbTargetIpAddressCurrent   string
-			dbTargetValueCurrent       int
-			dbAgentCallbackUnixCurrent int
-			dbCallbackOrderCurrent     int
-		)
-
-		err = lastTwoCallbacksRows.Scan(&dbTeamNameCurrent, &dbTargetIpAddressCurrent, &dbTargetValueCurrent, &dbAgentCallbackUnixCurrent, &dbCallbackOrderCurrent)
-		if utils.CheckError(utils.Error, err, "Could not scan GetLastTwoCallbacks rows") {
-			return
-		}
+	err = countLiveAgents(repository, now, teamsPointsAndHosts)
+	if err != nil {
+		return
+	}
 
-		if dbCallbackOrderCurrent == 1 {
-			var checkinTimeAgo time.Duration = time.Duration(time.Now().Unix()-int64(dbAgentCallbackUnixCurrent)) * time.Second
-			if checkinTimeAgo.Round(time.Second) > utils.MaxCallbackTime {
-				agentDead = true
-				continue // last callback was too long ago, assume Agent is dead
-			}
-			agentDead = false
-
-			if singleCallback { // last row only had a single callback (the "pair" ended with callbackOrder == 1), add its points
-				teamsPointsAndHosts[dbTeamNameLast].Pwnts += dbTargetValueLast // a single (Agent's first) callback will initially receive the full target value
-				teamsPointsAndHosts[dbTeamNameLast].PwnedHosts++               // increment num of pwned hosts
-				continue
-			}
-
-			dbTeamNameLast = dbTeamNameCurrent
-			dbTargetValueLast = dbTargetValueCurrent
-			dbAgentCallbackUnixLast = dbAgentCallbackUnixCurrent
-			singleCallback = true // set for next iteration
-		} else if dbCallbackOrderCurrent == 2 {
-			singleCallback = false
-			if agentDead { // skip callback pair for dead Agents
-				continue
-			}
-
-			checkinTimeDifference := time.Second * time.Duration(dbAgentCallbackUnixLast-dbAgentCallbackUnixCurrent)
-			teamsPointsAndHosts[dbTeamNameCurrent].Pwnts += utils.CalculateCallbackPoints(checkinTimeDifference, dbTargetValueCurrent)
-			teamsPointsAndHosts[dbTeamNameCurrent].PwnedHosts++
-		} else {
-			fmt.Println("I have no idea what happened:", dbCallbackOrderCurrent)
+	for _, holding := range teamHoldings {
+		teamScores, ok := teamsPointsAndHosts[holding.TeamName]
+		if !ok {
+			continue
 		}
-	}
-	utils.Close(lastTwoCallbacksRows)
 
-	if singleCallback { // account for the very last row being a single callback
-		teamsPointsAndHosts[dbTeamNameLast].Pwnts += dbTargetValueLast
-		teamsPointsAndHosts[dbTeamNameLast].PwnedHosts++
+		teamScores.Pwnts += utils.CombineHostPoints(hostScoring, holding.BestPoints, holding.TotalPoints, holding.TargetValue)
+		teamScores.PwnedHosts++
 	}
 
 	data, err = json.Marshal(teamsPointsAndHosts)
@@ -135,3 +66,32 @@ func GetScoreboardData(db *sql.DB) (data []byte, err error) {
 
 	return
 }
+
+/*
+	Count each team's live Agents (those that still hold a target, see
+	`utils.HostHolding`) by Agent type and by the OS of the host they're on,
+	and count those that have moved hosts.
+*/
+func countLiveAgents(repository storage.Repository, now int64, teamsPointsAndHosts map[string]*TeamScores) error {
+	liveAgents, err := repository.LiveAgents(now)
+	if utils.CheckError(utils.Error, err, "Could not execute GetLiveAgents statement") {
+		return err
+	}
+
+	for _, liveAgent := range liveAgents {
+		teamScores, ok := teamsPointsAndHosts[liveAgent.TeamName]
+		if !ok {
+			continue
+		}
+
+		teamScores.AgentTypes[liveAgent.AgentType]++
+		if liveAgent.HostOS != "" {
+			teamScores.HostOS[liveAgent.HostOS]++
+		}
+		if liveAgent.HostChangedUnix != 0 {
+			teamScores.MovedAgents++
+		}
+	}
+
+	return nil
+}
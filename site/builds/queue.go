@@ -0,0 +1,314 @@
+// Asynchronous Agent build queue with a bounded worker pool.
+package builds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/agent/builder"
+	"github.com/s-christian/pwnts/utils"
+)
+
+type JobStatus string
+
+const (
+	StatusQueued   JobStatus = "queued"
+	StatusBuilding JobStatus = "building"
+	StatusDone     JobStatus = "done"
+	StatusFailed   JobStatus = "failed"
+)
+
+var (
+	ErrQueueFull error = errors.New("the build queue is full, please try again shortly")
+	ErrTeamLimit error = errors.New("your team already has the maximum number of builds in progress")
+	ErrStopped   error = errors.New("the site is shutting down, please try again shortly")
+)
+
+type (
+	/*
+		Everything a worker needs to know to build a single Agent. `Filename`
+		is the name the browser will be offered when downloading it.
+	*/
+	Request struct {
+		TeamID          int
+		AgentUUID       string
+		AgentType       string         // `utils.AgentTypeBinary` or a script type
+		Target          builder.Target // binary Agents only
+		LocalPort       int
+		Endpoints       []agentconfig.Endpoint // callback servers in order of preference, at least one
+		CallbackMinutes int
+		KillDateUnix    int64
+		JitterPercent   int
+		Proxy           string // binary Agents only
+		ServerKeyPin    string // as of when the build was requested
+		TargetIP        string // the in-scope target the Agent is for, empty for any
+		Filename        string
+	}
+
+	/*
+		Produce the Agent described by `request` at `outputPath`, returning
+		any compiler output.
+	*/
+	BuildFunc func(request Request, outputPath string) (output []byte, err error)
+
+	/*
+		Called once a built Agent is stored and its download token issued,
+		before the token is handed out. The Agent can't be downloaded if it
+		fails.
+	*/
+	SuccessFunc func(request Request) error
+
+	// A point-in-time copy of a job, safe to hand out to API handlers.
+	JobInfo struct {
+		ID            string    `json:"id"`
+		Status        JobStatus `json:"status"`
+		Output        string    `json:"output,omitempty"`
+		DownloadToken string    `json:"download_token,omitempty"`
+		Filename      string    `json:"filename"`
+		CreatedDate   time.Time `json:"created"`
+		FinishedDate  time.Time `json:"finished,omitempty"`
+	}
+
+	job struct {
+		request Request
+		info    JobInfo
+	}
+
+	Queue struct {
+		build      BuildFunc
+		onSuccess  SuccessFunc
+		store      *Store
+		maxPerTeam int
+		jobLife    time.Duration
+
+		pending        chan *job
+		workers        sync.WaitGroup
+		deadlinePassed chan struct{} // closed when `Stop()` gives up waiting
+		pruneStop      chan struct{} // closed by `Stop()`
+
+		mutex      sync.Mutex
+		stopped    bool
+		jobs       map[string]*job
+		teamActive map[int]int
+	}
+)
+
+/*
+	Create a build queue and start its workers. Finished Agents are placed in
+	`store`, and `onSuccess` (e.g. Agent registration) runs for every
+	stored Agent before its download token is handed out.
+*/
+func NewQueue(config utils.BuildConfig, store *Store, build BuildFunc, onSuccess SuccessFunc) *Queue {
+	queue := &Queue{
+		build:          build,
+		onSuccess:      onSuccess,
+		store:          store,
+		maxPerTeam:     config.MaxPerTeam,
+		jobLife:        config.JobLifetime.Duration,
+		pending:        make(chan *job, config.QueueSize),
+		deadlinePassed: make(chan struct{}),
+		pruneStop:      make(chan struct{}),
+		jobs:           make(map[string]*job),
+		teamActive:     make(map[int]int),
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		queue.workers.Add(1)
+		go queue.worker()
+	}
+
+	go queue.pruneLoop()
+
+	utils.Log(utils.Done, "Started", fmt.Sprint(config.Workers), "build workers")
+	return queue
+}
+
+/*
+	Add a build to the queue and return its job ID. Fails if the team already
+	has too many builds in progress or the queue is full.
+*/
+func (queue *Queue) Submit(request Request) (string, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.stopped {
+		return "", ErrStopped
+	}
+	if queue.teamActive[request.TeamID] >= queue.maxPerTeam {
+		return "", ErrTeamLimit
+	}
+
+	newJob := &job{
+		request: request,
+		info: JobInfo{
+			ID:          uuid.New().String(),
+			Status:      StatusQueued,
+			Filename:    request.Filename,
+			CreatedDate: time.Now(),
+		},
+	}
+
+	select {
+	case queue.pending <- newJob:
+	default:
+		return "", ErrQueueFull
+	}
+
+	queue.jobs[newJob.info.ID] = newJob
+	queue.teamActive[request.TeamID]++
+
+	return newJob.info.ID, nil
+}
+
+/*
+	Return the current state of a job. Teams can only see their own jobs.
+*/
+func (queue *Queue) Status(jobID string, teamID int) (JobInfo, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	foundJob, ok := queue.jobs[jobID]
+	if !ok || foundJob.request.TeamID != teamID {
+		return JobInfo{}, false
+	}
+
+	return foundJob.info, true
+}
+
+func (queue *Queue) setStatus(currentJob *job, status JobStatus) {
+	queue.mutex.Lock()
+	currentJob.info.Status = status
+	queue.mutex.Unlock()
+}
+
+func (queue *Queue) finish(currentJob *job, status JobStatus, output string, downloadToken string) {
+	queue.mutex.Lock()
+	currentJob.info.Status = status
+	currentJob.info.Output = output
+	currentJob.info.DownloadToken = downloadToken
+	currentJob.info.FinishedDate = time.Now()
+	queue.teamActive[currentJob.request.TeamID]--
+	queue.mutex.Unlock()
+}
+
+func (queue *Queue) worker() {
+	defer queue.workers.Done()
+
+	for currentJob := range queue.pending {
+		select {
+		case <-queue.deadlinePassed:
+			queue.finish(currentJob, StatusFailed, "The site shut down before this Agent could be built. Please try again.", "")
+		default:
+			queue.run(currentJob)
+		}
+	}
+}
+
+/*
+	Stop taking new builds and wait for the queued and running ones to
+	finish, until `ctx` is done. After that, builds still queued fail
+	without running and builds still running are left to finish on their
+	own. Returns whether every build finished in time.
+*/
+func (queue *Queue) Stop(ctx context.Context) bool {
+	queue.mutex.Lock()
+	queue.stopped = true
+	close(queue.pending) // `Submit()` only sends while holding the lock
+	queue.mutex.Unlock()
+	close(queue.pruneStop)
+
+	workersDone := make(chan struct{})
+	go func() {
+		queue.workers.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+		return true
+	case <-ctx.Done():
+		close(queue.deadlinePassed)
+		return false
+	}
+}
+
+func (queue *Queue) run(currentJob *job) {
+	queue.setStatus(currentJob, StatusBuilding)
+	utils.Log(utils.Info, "Building Agent", currentJob.request.AgentUUID, "for Team", fmt.Sprint(currentJob.request.TeamID))
+
+	// Every build gets its own directory so concurrent builds never collide
+	buildDirectory, err := os.MkdirTemp("", "pwnts_build_")
+	if utils.CheckError(utils.Error, err, "Could not create build directory") {
+		queue.finish(currentJob, StatusFailed, "Could not create build directory. Please contact an admin.", "")
+		return
+	}
+	defer os.RemoveAll(buildDirectory)
+
+	outputPath := filepath.Join(buildDirectory, currentJob.request.Filename)
+	output, err := queue.build(currentJob.request, outputPath)
+	if utils.CheckError(utils.Error, err, "Error compiling Agent", currentJob.request.AgentUUID) {
+		queue.finish(currentJob, StatusFailed, string(output), "")
+		return
+	}
+
+	artifactHash, err := queue.store.Put(outputPath)
+	if utils.CheckError(utils.Error, err, "Could not store Agent", currentJob.request.AgentUUID) {
+		queue.finish(currentJob, StatusFailed, "Could not store Agent. Please contact an admin.", "")
+		return
+	}
+
+	downloadToken, err := queue.store.IssueToken(artifactHash, currentJob.request.Filename, currentJob.request.TeamID)
+	if utils.CheckError(utils.Error, err, "Could not issue download token for Agent", currentJob.request.AgentUUID) {
+		queue.finish(currentJob, StatusFailed, "Could not issue download token. Please contact an admin.", "")
+		return
+	}
+
+	// Registered last, so a registered Agent can always be downloaded
+	if queue.onSuccess != nil {
+		err = queue.onSuccess(currentJob.request)
+		if utils.CheckError(utils.Error, err, "Post-build step failed for Agent", currentJob.request.AgentUUID) {
+			queue.store.RevokeToken(downloadToken)
+			queue.finish(currentJob, StatusFailed, "Could not register Agent. Please contact an admin.", "")
+			return
+		}
+	}
+
+	queue.finish(currentJob, StatusDone, string(output), downloadToken)
+	utils.Log(utils.Done, "Built Agent", currentJob.request.AgentUUID, "("+artifactHash+")")
+}
+
+// Prune every minute until the queue is stopped.
+func (queue *Queue) pruneLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			queue.prune()
+		case <-queue.pruneStop:
+			return
+		}
+	}
+}
+
+// Forget old finished jobs and expired artifacts.
+func (queue *Queue) prune() {
+	queue.mutex.Lock()
+	for jobID, oldJob := range queue.jobs {
+		finished := oldJob.info.Status == StatusDone || oldJob.info.Status == StatusFailed
+		if finished && time.Since(oldJob.info.FinishedDate) > queue.jobLife {
+			delete(queue.jobs, jobID)
+		}
+	}
+	queue.mutex.Unlock()
+
+	queue.store.Prune()
+}
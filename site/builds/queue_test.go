@@ -0,0 +1,249 @@
+package builds
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	A builder that writes each Agent as its UUID, once the test lets it.
+	Builds of an Agent UUID in `fail` fail.
+*/
+type fakeBuilder struct {
+	release chan struct{} // every build waits to receive from it
+	fail    map[string]bool
+
+	mutex            sync.Mutex
+	building, maxRan int
+}
+
+func newFakeBuilder() *fakeBuilder {
+	return &fakeBuilder{release: make(chan struct{}), fail: map[string]bool{}}
+}
+
+func (builder *fakeBuilder) build(request Request, outputPath string) ([]byte, error) {
+	builder.mutex.Lock()
+	builder.building++
+	if builder.building > builder.maxRan {
+		builder.maxRan = builder.building
+	}
+	failing := builder.fail[request.AgentUUID]
+	builder.mutex.Unlock()
+
+	<-builder.release
+
+	builder.mutex.Lock()
+	builder.building--
+	builder.mutex.Unlock()
+
+	if failing {
+		return []byte("compile error"), errors.New("exit status 1")
+	}
+	return []byte("built"), os.WriteFile(outputPath, []byte(request.AgentUUID), 0600)
+}
+
+// Let every build waiting now, and any started before the test ends, finish.
+func (builder *fakeBuilder) releaseAll() {
+	close(builder.release)
+}
+
+func newTestQueue(t *testing.T, workers int, queueSize int, maxPerTeam int, build BuildFunc, onSuccess SuccessFunc) *Queue {
+	config := utils.BuildConfig{Workers: workers, QueueSize: queueSize, MaxPerTeam: maxPerTeam, JobLifetime: utils.Duration{Duration: time.Hour}}
+	queue := NewQueue(config, newTestStore(t, time.Hour), build, onSuccess)
+	t.Cleanup(func() {
+		queue.mutex.Lock()
+		stopped := queue.stopped
+		queue.mutex.Unlock()
+		if stopped {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !queue.Stop(ctx) {
+			t.Error("Builds still running 5s after stopping the queue")
+		}
+	})
+	return queue
+}
+
+func submit(t *testing.T, queue *Queue, teamID int, agentUUID string) string {
+	t.Helper()
+	jobID, err := queue.Submit(Request{TeamID: teamID, AgentUUID: agentUUID, Filename: agentUUID + ".exe"})
+	if err != nil {
+		t.Fatalf("Could not submit a build of %s: %v", agentUUID, err)
+	}
+	return jobID
+}
+
+// Wait for the jobs to reach the status, returning their info.
+func waitForStatus(t *testing.T, queue *Queue, teamID int, status JobStatus, jobIDs ...string) []JobInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos, reached := []JobInfo{}, true
+		for _, jobID := range jobIDs {
+			info, ok := queue.Status(jobID, teamID)
+			if !ok {
+				t.Fatalf("Job %s not found", jobID)
+			}
+			infos = append(infos, info)
+			reached = reached && info.Status == status
+		}
+		if reached {
+			return infos
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Jobs are %+v after 5s, want them all %s", infos, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	builder := newFakeBuilder()
+	queue := newTestQueue(t, 2, 2, 10, builder.build, nil)
+
+	// Two build while two wait, the queue holds no more
+	building := []string{submit(t, queue, 1, "a"), submit(t, queue, 1, "b")}
+	waitForStatus(t, queue, 1, StatusBuilding, building...)
+	queued := []string{submit(t, queue, 1, "c"), submit(t, queue, 1, "d")}
+	if _, err := queue.Submit(Request{TeamID: 1, AgentUUID: "e"}); err != ErrQueueFull {
+		t.Errorf("Submit() to a full queue = %v, want %v", err, ErrQueueFull)
+	}
+	for _, info := range waitForStatus(t, queue, 1, StatusQueued, queued...) {
+		if info.Filename == "" || info.CreatedDate.IsZero() {
+			t.Errorf("Queued job is %+v, want its filename and creation date", info)
+		}
+	}
+
+	builder.releaseAll()
+	waitForStatus(t, queue, 1, StatusDone, append(building, queued...)...)
+	if builder.maxRan != 2 {
+		t.Errorf("%d builds ran at once, want the 2 workers", builder.maxRan)
+	}
+}
+
+func TestTeamLimit(t *testing.T) {
+	builder := newFakeBuilder()
+	queue := newTestQueue(t, 4, 8, 2, builder.build, nil)
+
+	first := []string{submit(t, queue, 1, "a"), submit(t, queue, 1, "b")}
+	if _, err := queue.Submit(Request{TeamID: 1, AgentUUID: "c"}); err != ErrTeamLimit {
+		t.Errorf("Submit() past the team's limit = %v, want %v", err, ErrTeamLimit)
+	}
+	other := submit(t, queue, 2, "d")
+
+	// Finished builds no longer count
+	builder.releaseAll()
+	waitForStatus(t, queue, 1, StatusDone, first...)
+	waitForStatus(t, queue, 2, StatusDone, other)
+	waitForStatus(t, queue, 1, StatusDone, submit(t, queue, 1, "c"), submit(t, queue, 1, "e"))
+}
+
+func TestJobStates(t *testing.T) {
+	builder := newFakeBuilder()
+	registered := map[string]bool{}
+	var registeredMutex sync.Mutex
+	queue := newTestQueue(t, 1, 8, 8, builder.build, func(request Request) error {
+		registeredMutex.Lock()
+		defer registeredMutex.Unlock()
+		if request.AgentUUID == "unregistrable" {
+			return errors.New("database is locked")
+		}
+		registered[request.AgentUUID] = true
+		return nil
+	})
+	builder.fail["broken"] = true
+
+	good := submit(t, queue, 1, "good")
+	waitForStatus(t, queue, 1, StatusBuilding, good)
+	broken, unregistrable := submit(t, queue, 1, "broken"), submit(t, queue, 1, "unregistrable")
+	waitForStatus(t, queue, 1, StatusQueued, broken, unregistrable)
+	if _, ok := queue.Status(good, 2); ok {
+		t.Error("Another team can see the job")
+	}
+	builder.releaseAll()
+
+	info := waitForStatus(t, queue, 1, StatusDone, good)[0]
+	if info.DownloadToken == "" || info.Output != "built" || info.FinishedDate.IsZero() {
+		t.Errorf("Finished job is %+v, want its token, output and finish date", info)
+	}
+	filePath, filename, err := queue.store.Redeem(info.DownloadToken, 1)
+	if err != nil || filename != "good.exe" {
+		t.Fatalf("Redeem() = %s, %s, %v, want the build as good.exe", filePath, filename, err)
+	}
+	if contents, err := os.ReadFile(filePath); err != nil || string(contents) != "good" {
+		t.Errorf("Downloaded %q (%v), want the built Agent", contents, err)
+	}
+
+	info = waitForStatus(t, queue, 1, StatusFailed, broken)[0]
+	if info.DownloadToken != "" || info.Output != "compile error" {
+		t.Errorf("Failed build is %+v, want its compiler output and no token", info)
+	}
+
+	info = waitForStatus(t, queue, 1, StatusFailed, unregistrable)[0]
+	if info.DownloadToken != "" || len(queue.store.tokens) != 0 {
+		t.Errorf("Agent that couldn't be registered is %+v with %d tokens, want no token", info, len(queue.store.tokens))
+	}
+	if !registered["good"] || len(registered) != 1 {
+		t.Errorf("Registered %v, want only the good Agent", registered)
+	}
+}
+
+func TestFinishedJobsExpire(t *testing.T) {
+	builder := newFakeBuilder()
+	queue := newTestQueue(t, 1, 8, 8, builder.build, nil)
+	builder.releaseAll()
+
+	old := submit(t, queue, 1, "old")
+	waitForStatus(t, queue, 1, StatusDone, old)
+	queue.mutex.Lock()
+	queue.jobs[old].info.FinishedDate = time.Now().Add(-2 * queue.jobLife)
+	queue.mutex.Unlock()
+	recent := submit(t, queue, 1, "recent")
+	waitForStatus(t, queue, 1, StatusDone, recent)
+
+	queue.prune()
+	if _, ok := queue.Status(old, 1); ok {
+		t.Error("Job finished longer ago than its lifetime is still known")
+	}
+	if _, ok := queue.Status(recent, 1); !ok {
+		t.Error("Job finished just now was forgotten")
+	}
+}
+
+func TestStoppedQueue(t *testing.T) {
+	builder := newFakeBuilder()
+	queue := newTestQueue(t, 1, 8, 8, builder.build, nil)
+
+	running := submit(t, queue, 1, "running")
+	waitForStatus(t, queue, 1, StatusBuilding, running)
+	queued := submit(t, queue, 1, "queued")
+
+	// Gives up waiting for the running build, and fails the queued one without building it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stopped := make(chan bool)
+	go func() { stopped <- queue.Stop(ctx) }()
+	if <-stopped {
+		t.Error("Stop() says every build finished while one was still running")
+	}
+	if _, err := queue.Submit(Request{TeamID: 1, AgentUUID: "late"}); err != ErrStopped {
+		t.Errorf("Submit() to a stopped queue = %v, want %v", err, ErrStopped)
+	}
+
+	builder.releaseAll()
+	waitForStatus(t, queue, 1, StatusDone, running)
+	waitForStatus(t, queue, 1, StatusFailed, queued)
+	if builder.maxRan != 1 {
+		t.Errorf("%d builds ran, want only the one already running", builder.maxRan)
+	}
+}
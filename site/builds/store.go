@@ -0,0 +1,267 @@
+package builds
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s-christian/pwnts/utils"
+)
+
+type (
+	// A single-use token that allows one download of a stored artifact.
+	downloadToken struct {
+		artifactHash string
+		filename     string
+		teamID       int
+		expires      time.Time
+	}
+
+	/*
+		Content-addressed storage for finished Agent builds. Artifacts are
+		named by the SHA-256 hash of their contents and are removed once they
+		are older than the configured lifetime.
+	*/
+	Store struct {
+		directory string
+		lifetime  time.Duration
+
+		mutex  sync.Mutex
+		tokens map[string]downloadToken
+	}
+)
+
+var (
+	ErrTokenInvalid error = errors.New("download token is invalid, expired, or already used")
+)
+
+const partialSuffix string = ".partial" // an artifact still being copied into the store
+
+/*
+	Create the artifact store in `directory`, creating the directory if it
+	doesn't already exist. Artifacts left behind by a previous run are
+	removed, their download tokens died with it.
+*/
+func NewStore(directory string, lifetime time.Duration) (*Store, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{directory: directory, lifetime: lifetime, tokens: make(map[string]downloadToken)}
+	store.Clear()
+	return store, nil
+}
+
+func (store *Store) artifactPath(artifactHash string) string {
+	return filepath.Join(store.directory, artifactHash)
+}
+
+/*
+	Move the file at `filePath` into the store and return its content hash.
+	The original file is removed.
+*/
+func (store *Store) Put(filePath string) (artifactHash string, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	utils.Close(file)
+	if err != nil {
+		return
+	}
+	artifactHash = hex.EncodeToString(hasher.Sum(nil))
+
+	// Identical contents already stored, refresh its lifetime instead
+	if _, statErr := os.Stat(store.artifactPath(artifactHash)); statErr == nil {
+		now := time.Now()
+		err = os.Chtimes(store.artifactPath(artifactHash), now, now)
+		if err == nil {
+			err = os.Remove(filePath)
+		}
+		return
+	}
+
+	err = os.Rename(filePath, store.artifactPath(artifactHash))
+	if err != nil { // different filesystem, fall back to copying
+		// Copied under a temporary name first, so an interrupted copy is
+		// never mistaken for an artifact
+		partialPath := store.artifactPath(artifactHash) + partialSuffix
+		err = copyFile(filePath, partialPath)
+		if err == nil {
+			err = os.Rename(partialPath, store.artifactPath(artifactHash))
+		}
+		if err == nil {
+			err = os.Remove(filePath)
+		} else {
+			os.Remove(partialPath)
+		}
+	}
+
+	return
+}
+
+func copyFile(sourcePath string, destinationPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer utils.Close(source)
+
+	destination, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+/*
+	Issue a single-use download token for a stored artifact, which will be
+	offered to the browser as `filename`. Only the given team may redeem it.
+*/
+func (store *Store) IssueToken(artifactHash string, filename string, teamID int) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	store.mutex.Lock()
+	store.tokens[token] = downloadToken{
+		artifactHash: artifactHash,
+		filename:     filename,
+		teamID:       teamID,
+		expires:      time.Now().Add(store.lifetime),
+	}
+	store.mutex.Unlock()
+
+	return token, nil
+}
+
+// Forget a download token that was never handed out.
+func (store *Store) RevokeToken(token string) {
+	store.mutex.Lock()
+	delete(store.tokens, token)
+	store.mutex.Unlock()
+}
+
+/*
+	Consume a download token, returning the artifact's path and download
+	filename. A token can only ever be redeemed once.
+*/
+func (store *Store) Redeem(token string, teamID int) (filePath string, filename string, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	issued, ok := store.tokens[token]
+	if !ok || issued.teamID != teamID {
+		err = ErrTokenInvalid
+		return
+	}
+	delete(store.tokens, token)
+
+	if time.Now().After(issued.expires) {
+		err = ErrTokenInvalid
+		return
+	}
+
+	filePath = store.artifactPath(issued.artifactHash)
+	if _, err = os.Stat(filePath); err != nil {
+		err = ErrTokenInvalid
+		return
+	}
+
+	return filePath, issued.filename, nil
+}
+
+/*
+	Remove expired tokens and any artifacts older than the store's lifetime.
+*/
+func (store *Store) Prune() {
+	now := time.Now()
+
+	store.mutex.Lock()
+	for token, issued := range store.tokens {
+		if now.After(issued.expires) {
+			delete(store.tokens, token)
+		}
+	}
+	store.mutex.Unlock()
+
+	entries, err := os.ReadDir(store.directory)
+	if utils.CheckError(utils.Warning, err, "Could not list artifact directory '"+store.directory+"'") {
+		return
+	}
+
+	for _, entry := range entries {
+		// Only ever touch files named like a SHA-256 hash
+		if entry.IsDir() || !isArtifactName(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < store.lifetime {
+			continue
+		}
+
+		err = os.Remove(store.artifactPath(entry.Name()))
+		utils.CheckError(utils.Warning, err, "Could not remove expired artifact", entry.Name())
+	}
+}
+
+/*
+	Forget every download token and remove every artifact, including any
+	that were only partly copied in. Used when the site starts and stops,
+	as tokens only ever live in memory.
+*/
+func (store *Store) Clear() {
+	store.mutex.Lock()
+	store.tokens = make(map[string]downloadToken)
+	store.mutex.Unlock()
+
+	entries, err := os.ReadDir(store.directory)
+	if utils.CheckError(utils.Warning, err, "Could not list artifact directory '"+store.directory+"'") {
+		return
+	}
+
+	numRemoved := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !isArtifactName(strings.TrimSuffix(entry.Name(), partialSuffix)) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(store.directory, entry.Name()))
+		if !utils.CheckError(utils.Warning, err, "Could not remove artifact", entry.Name()) {
+			numRemoved++
+		}
+	}
+
+	if numRemoved > 0 {
+		utils.Log(utils.Info, "Removed", fmt.Sprint(numRemoved), "artifacts from '"+store.directory+"'")
+	}
+}
+
+func isArtifactName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -0,0 +1,163 @@
+package builds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, lifetime time.Duration) *Store {
+	store, err := NewStore(filepath.Join(t.TempDir(), "artifacts"), lifetime)
+	if err != nil {
+		t.Fatalf("Could not create the store: %v", err)
+	}
+	return store
+}
+
+// Write a file outside the store, like a finished build, and return its path.
+func writeBuild(t *testing.T, contents string) string {
+	file, err := os.CreateTemp(t.TempDir(), "agent_")
+	if err != nil {
+		t.Fatalf("Could not create a build: %v", err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(contents); err != nil {
+		t.Fatalf("Could not write a build: %v", err)
+	}
+	return file.Name()
+}
+
+func storedArtifacts(t *testing.T, store *Store) (names []string) {
+	entries, err := os.ReadDir(store.directory)
+	if err != nil {
+		t.Fatalf("Could not list the store: %v", err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return
+}
+
+func TestPutIsContentAddressed(t *testing.T) {
+	store := newTestStore(t, time.Hour)
+
+	first, second, other := writeBuild(t, "agent"), writeBuild(t, "agent"), writeBuild(t, "another agent")
+	hashes := make([]string, 3)
+	for i, path := range []string{first, second, other} {
+		hash, err := store.Put(path)
+		if err != nil {
+			t.Fatalf("Could not put %s: %v", path, err)
+		}
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists once put in the store", path)
+		}
+		hashes[i] = hash
+	}
+
+	if hashes[0] != hashes[1] || hashes[0] == hashes[2] {
+		t.Errorf("Hashes are %v, want the same one for identical contents only", hashes)
+	}
+	if !isArtifactName(hashes[0]) {
+		t.Errorf("Hash %q isn't a SHA-256 hash", hashes[0])
+	}
+	if artifacts := storedArtifacts(t, store); len(artifacts) != 2 {
+		t.Errorf("Store holds %v, want one artifact per distinct content", artifacts)
+	}
+	contents, err := os.ReadFile(store.artifactPath(hashes[2]))
+	if err != nil || string(contents) != "another agent" {
+		t.Errorf("Artifact %s holds %q (%v), want what was put", hashes[2], contents, err)
+	}
+}
+
+func TestTokensAreRedeemedOnce(t *testing.T) {
+	store := newTestStore(t, time.Hour)
+	hash, err := store.Put(writeBuild(t, "agent"))
+	if err != nil {
+		t.Fatalf("Could not put a build: %v", err)
+	}
+	token, err := store.IssueToken(hash, "agent.exe", 1)
+	if err != nil {
+		t.Fatalf("Could not issue a token: %v", err)
+	}
+
+	if _, _, err = store.Redeem(token, 2); err != ErrTokenInvalid {
+		t.Errorf("Another team redeemed the token: %v", err)
+	}
+	filePath, filename, err := store.Redeem(token, 1)
+	if err != nil || filePath != store.artifactPath(hash) || filename != "agent.exe" {
+		t.Fatalf("Redeem() = %s, %s, %v, want the artifact as agent.exe", filePath, filename, err)
+	}
+	if _, _, err = store.Redeem(token, 1); err != ErrTokenInvalid {
+		t.Errorf("Token redeemed a second time: %v", err)
+	}
+
+	revoked, err := store.IssueToken(hash, "agent.exe", 1)
+	if err != nil {
+		t.Fatalf("Could not issue a token: %v", err)
+	}
+	store.RevokeToken(revoked)
+	if _, _, err = store.Redeem(revoked, 1); err != ErrTokenInvalid {
+		t.Errorf("Revoked token redeemed: %v", err)
+	}
+}
+
+func TestExpiredTokensAndArtifacts(t *testing.T) {
+	store := newTestStore(t, time.Hour)
+	oldHash, err := store.Put(writeBuild(t, "old agent"))
+	if err != nil {
+		t.Fatalf("Could not put a build: %v", err)
+	}
+	newHash, err := store.Put(writeBuild(t, "new agent"))
+	if err != nil {
+		t.Fatalf("Could not put a build: %v", err)
+	}
+	longAgo := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(store.artifactPath(oldHash), longAgo, longAgo); err != nil {
+		t.Fatalf("Could not age an artifact: %v", err)
+	}
+
+	expired, _ := store.IssueToken(newHash, "agent", 1)
+	store.tokens[expired] = downloadToken{artifactHash: newHash, filename: "agent", teamID: 1, expires: time.Now().Add(-time.Second)}
+	if _, _, err = store.Redeem(expired, 1); err != ErrTokenInvalid {
+		t.Errorf("Expired token redeemed: %v", err)
+	}
+
+	unused, _ := store.IssueToken(newHash, "agent", 1)
+	store.tokens[unused] = downloadToken{artifactHash: newHash, filename: "agent", teamID: 1, expires: time.Now().Add(-time.Second)}
+	store.Prune()
+	if _, ok := store.tokens[unused]; ok {
+		t.Error("Expired token kept after pruning")
+	}
+	if artifacts := storedArtifacts(t, store); len(artifacts) != 1 || artifacts[0] != newHash {
+		t.Errorf("Store holds %v after pruning, want only the new artifact", artifacts)
+	}
+
+	// A token for an artifact that's gone can't be redeemed either
+	gone, _ := store.IssueToken(oldHash, "agent", 1)
+	if _, _, err = store.Redeem(gone, 1); err != ErrTokenInvalid {
+		t.Errorf("Token for a pruned artifact redeemed: %v", err)
+	}
+}
+
+func TestClearOnlyRemovesArtifacts(t *testing.T) {
+	store := newTestStore(t, time.Hour)
+	hash, err := store.Put(writeBuild(t, "agent"))
+	if err != nil {
+		t.Fatalf("Could not put a build: %v", err)
+	}
+	for _, name := range []string{hash[:10] + partialSuffix, hash[1:] + "0" + partialSuffix, "notes.txt"} {
+		if err = os.WriteFile(filepath.Join(store.directory, name), nil, 0600); err != nil {
+			t.Fatalf("Could not write %s: %v", name, err)
+		}
+	}
+	token, _ := store.IssueToken(hash, "agent", 1)
+
+	store.Clear()
+	if artifacts := storedArtifacts(t, store); len(artifacts) != 2 {
+		t.Errorf("Store holds %v after clearing, want only what isn't named like an artifact", artifacts)
+	}
+	if _, _, err = store.Redeem(token, 1); err != ErrTokenInvalid {
+		t.Errorf("Token redeemed after clearing: %v", err)
+	}
+}
@@ -1,4 +1,10 @@
-package main
+/*
+	The web application: the scoreboard, the teams' dashboard for building
+	Agents, and the admin pages. Run by `pwnts serve site` or
+	`pwnts serve all`, see `cmd/pwnts`. Its templates and static files are
+	embedded, so it needs nothing from the source tree but the Agent stubs.
+*/
+package site
 
 /* TODO
 - Build a virtual machine on CyberOps4 for testing and serving Pwnts
@@ -9,46 +15,74 @@ package main
 - Use the W3C validator
 */
 
-/*
-	Flags:
-		--test:				Sets the server's listener to listen on localhost instead of the proper
-							network interface IP address.
-		--port:				Port to listen on.
-*/
-
 import (
 	"bytes"
-	"strings"
-
-	//"crypto/tls"
-	"database/sql"
+	"context"
+	"crypto/tls"
+	"embed"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net"
 	"net/http"
-	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/agent/builder"
+	"github.com/s-christian/pwnts/agent/proxy"
+	"github.com/s-christian/pwnts/agent/scripts"
 	"github.com/s-christian/pwnts/site/api"
+	"github.com/s-christian/pwnts/site/builds"
+	"github.com/s-christian/pwnts/storage"
 	"github.com/s-christian/pwnts/utils"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // var jwtSigningKey = os.Get("MY_JWT_TOKEN")
 // TODO: Read from a `.env` file or similar
 var (
-	db       *sql.DB
-	listenIP net.IP
+	repository  storage.Repository
+	listenIP    net.IP
+	certificate *utils.ReloadableCertificate
+
+	// Replaced on SIGHUP, see `currentConfig()` and `currentAgentSettings()`
+	settingsMutex sync.RWMutex
+	config        utils.Config
+	agents        agentSettings
+
+	buildQueue    *builds.Queue
+	artifactStore *builds.Store
+	server        *http.Server
+
+	certPath       string = utils.CurrentDirectory + "/pwnts_cert.pem"
+	privateKeyPath string = utils.CurrentDirectory + "/pwnts_key.pem"
 )
 
+//go:embed templates static
+var siteFiles embed.FS
+
+// Settings for `Start()` that don't come from the config file.
+type Options struct {
+	Test         bool // listen on localhost
+	Port         int
+	RebuildStubs bool // rebuild every Agent stub, e.g. after changing `agent/agent.go`
+}
+
+// What every Agent is built with.
+type agentSettings struct {
+	builder           *builder.Builder
+	serverKeyPin      string                 // so the Agent only trusts our certificate
+	callbackEndpoints []agentconfig.Endpoint // in order of preference
+}
+
 func serveLayoutTemplate(writer http.ResponseWriter, request *http.Request, functionName string, pageContent map[string]template.HTML) {
-	layoutTemplateFilepath := utils.CurrentDirectory + "/site/templates/layout.html"
-	layoutTemplate, err := template.ParseFiles(layoutTemplateFilepath)
+	layoutTemplate, err := template.ParseFS(siteFiles, "templates/layout.html")
 	if utils.CheckWebError(writer, request, err, functionName+": Can't parse template") {
 		return
 	}
@@ -59,8 +93,7 @@ func serveLayoutTemplate(writer http.ResponseWriter, request *http.Request, func
 }
 
 func returnTemplateHTML(writer http.ResponseWriter, request *http.Request, htmlFilename string, functionName string, pageContent map[string]interface{}) template.HTML {
-	contentTemplateFilepath := utils.CurrentDirectory + "/site/templates/" + htmlFilename
-	contentTemplate, err := template.ParseFiles(contentTemplateFilepath)
+	contentTemplate, err := template.ParseFS(siteFiles, "templates/"+htmlFilename)
 	if utils.CheckWebError(writer, request, err, functionName+": Can't parse template '"+htmlFilename+"'") {
 		return template.HTML(`<p style="color: red; font-weight: bold;">Error constructing page content</p>`)
 	}
@@ -85,7 +118,18 @@ func handleDashboardPage(writer http.ResponseWriter, request *http.Request) {
 	switch request.Method {
 	// *** GET: Display team dashboard with agent generation
 	case http.MethodGet:
-		dashboardContent := map[string]interface{}{"teamName": "Sample Team Name"}
+		targetIPs, err := targetIPsInScope()
+		if utils.CheckWebError(writer, request, err, "Could not retrieve the in-scope targets") {
+			return
+		}
+
+		dashboardContent := map[string]interface{}{
+			"teamName":       "Sample Team Name",
+			"platformGroups": builder.GroupTargets(currentAgentSettings().builder.Targets()),
+			"scriptTypes":    builder.ScriptTypes,
+			"maxJitter":      agentconfig.MaxJitterPercent,
+			"targetIPs":      targetIPs,
+		}
 		dashboardHTML := returnTemplateHTML(writer, request, "dashboard.html", "handleDashboardPage", dashboardContent)
 
 		layoutContent := map[string]template.HTML{"title": "Red Team Dashboard", "pageContent": dashboardHTML}
@@ -98,12 +142,12 @@ func handleDashboardPage(writer http.ResponseWriter, request *http.Request) {
 			- Agent variables:
 				- agentUUID
 				- localPort
-				- serverIP
-				- serverPort
+				- callbackEndpoints (from the config file)
 				- callbackFrequencyMinutes
-			- Environment variables:
-				- GOOS   (the OS to target)
-				- GOARCH (the architecture to target)
+			- Target platform (see `agent/builder/targets.go`):
+				- GOOS          (the OS to target)
+				- GOARCH        (the architecture to target)
+				- GOARM/GOMIPS  (the architecture variant, if any)
 		*/
 
 		tokenClaims, err := utils.GetAuthClaims(writer, request)
@@ -114,18 +158,20 @@ func handleDashboardPage(writer http.ResponseWriter, request *http.Request) {
 		// Go's JSON unmarshalling decodes JSON numbers to type float64
 		var teamID int = int(tokenClaims["teamId"].(float64))
 
-		serverIP := listenIP.String()
-		serverPort := 444
-
 		agentUUID := uuid.New()
+		agents := currentAgentSettings()
 		postedLocalPort := utils.GetFormDataSingle(writer, request, "localPort")
 		postedCallbackFrequencyMinutes := utils.GetFormDataSingle(writer, request, "callbackMins")
-		postedOS := utils.GetFormDataSingle(writer, request, "targetOs")
-		postedArch := utils.GetFormDataSingle(writer, request, "targetArch")
+		postedAgentType := utils.GetFormDataSingle(writer, request, "agentType")
+		postedPlatform := request.PostFormValue("targetPlatform")     // binary Agents only
+		postedKillDate := request.PostFormValue("killDate")           // optional
+		postedJitterPercent := request.PostFormValue("jitterPercent") // optional
+		postedProxy := request.PostFormValue("proxy")                 // optional, binary Agents only
+		postedTargetIP := request.PostFormValue("targetIP")           // optional
 
 		/* --- Logic --- */
 		// Check for the existence of necessary values
-		if postedLocalPort == "" || postedCallbackFrequencyMinutes == "" || postedOS == "" {
+		if postedLocalPort == "" || postedCallbackFrequencyMinutes == "" || postedAgentType == "" {
 			//utils.ReturnStatusUserError(writer, request, "Please provide values for all inputs")
 			utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
 			return
@@ -149,67 +195,247 @@ func handleDashboardPage(writer http.ResponseWriter, request *http.Request) {
 			return
 		}
 
+		// Binary Agents need a supported platform, script Agents a known script type
+		var target builder.Target
+		var agentFilename string
+		if postedAgentType == utils.AgentTypeBinary {
+			target, err = builder.ParseTarget(postedPlatform)
+			if err != nil || !agents.builder.Supports(target) {
+				utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
+				return
+			}
+			agentFilename = target.AgentFilename()
+		} else {
+			scriptType, err := builder.GetScriptType(postedAgentType)
+			if err != nil {
+				utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
+				return
+			}
+			agentFilename = scriptType.Filename
+		}
+
 		if callbackFrequencyMinutes < 1 || callbackFrequencyMinutes > 15 ||
-			localPort < 1 || localPort > 65535 ||
-			(postedOS != "windows" && postedOS != "linux") ||
-			(postedArch != "amd64" && postedArch != "386") {
+			localPort < 1 || localPort > 65535 {
 
 			//utils.ReturnStatusUserError(writer, request, "Invalid input detected")
 			utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
 			return
 		}
 
-		// Generate the Agent
-		agentSource := utils.CurrentDirectory + "/agent/agent.go"
+		// The Agent stops calling back at midnight (server time) on the kill date
+		var killDateUnix int64
+		if postedKillDate != "" {
+			killDate, err := time.ParseInLocation("2006-01-02", postedKillDate, time.Local)
+			if err != nil || killDate.Before(time.Now()) {
+				utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
+				return
+			}
+			killDateUnix = killDate.Unix()
+		}
 
-		newAgentFilename := "agent_" + postedOS + "_" + postedArch + "_" + agentUUID.String()
-		newAgentFilenameTruncated := strings.Join(strings.Split(newAgentFilename, "_")[0:3], "_")
-		if postedOS == "windows" {
-			newAgentFilename = newAgentFilename + ".exe"
-			newAgentFilenameTruncated = newAgentFilenameTruncated + ".exe"
+		var jitterPercent int
+		if postedJitterPercent != "" {
+			_, err = fmt.Sscan(postedJitterPercent, &jitterPercent)
+			if err != nil || jitterPercent < 0 || jitterPercent > agentconfig.MaxJitterPercent {
+				utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
+				return
+			}
 		}
 
-		buildDirectory := utils.CurrentDirectory + "/agent/compiled_agents/"
+		// Script Agents can't use a proxy
+		if postedProxy != "" {
+			if _, err = proxy.Parse(postedProxy); err != nil || postedAgentType != utils.AgentTypeBinary {
+				utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
+				return
+			}
+		}
 
-		// All of the Agent's build variables must be of type string when we pass their values during compilation
-		commandString := fmt.Sprintf(
-			"UUID=%s && LOCAL_PORT=%d && SERVER_IP=%s && SERVER_PORT=%d && MINS=%d && GOOS=%s GOARCH=%s CGO_ENABLED=0 go build -trimpath -ldflags \"-s -w -X main.AgentUUID=$UUID -X main.LocalPortString=$LOCAL_PORT -X main.ServerIP=$SERVER_IP -X main.ServerPortString=$SERVER_PORT -X main.CallbackFrequencyMinutesString=$MINS\" -o %s %s",
-			agentUUID,
-			localPort,
-			serverIP,
-			serverPort,
-			callbackFrequencyMinutes,
-			postedOS,
-			postedArch,
-			buildDirectory+newAgentFilename,
-			agentSource,
-		)
+		// Agents can only be generated for in-scope targets
+		if postedTargetIP != "" {
+			targetIPs, err := targetIPsInScope()
+			if utils.CheckWebError(writer, request, err, "Could not retrieve the in-scope targets") {
+				return
+			}
+			if !isTargetIP(postedTargetIP, targetIPs) {
+				utils.LogIP(utils.Error, request, "Invalid input value(s), request was modified")
+				return
+			}
+		}
 
-		// TODO: This currently only works on Linux. In the future, determine
-		// the host OS and either run "cmd" or "sh" accordingly.
-		err = exec.Command("sh", "-c", commandString).Run()
-		if err != nil {
-			//utils.ReturnStatusUserError(writer, request, "Error compiling agent. Please contact an admin.")
-			utils.LogError(utils.Error, err, utils.GetUserIP(request)+": Error compiling agent")
+		// Builds run asynchronously, the client polls `/api/builds/status`
+		// and downloads the Agent with the one-time token it's given.
+		jobID, err := buildQueue.Submit(builds.Request{
+			TeamID:          teamID,
+			AgentUUID:       agentUUID.String(),
+			AgentType:       postedAgentType,
+			Target:          target,
+			LocalPort:       localPort,
+			Endpoints:       agents.callbackEndpoints,
+			CallbackMinutes: callbackFrequencyMinutes,
+			KillDateUnix:    killDateUnix,
+			JitterPercent:   jitterPercent,
+			Proxy:           postedProxy,
+			ServerKeyPin:    agents.serverKeyPin,
+			TargetIP:        postedTargetIP,
+			Filename:        agentFilename,
+		})
+		if err == builds.ErrStopped {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			utils.ReturnStatusJSON(writer, request, err.Error(), true)
+			return
+		} else if err == builds.ErrQueueFull || err == builds.ErrTeamLimit {
+			writer.WriteHeader(http.StatusTooManyRequests)
+			utils.ReturnStatusJSON(writer, request, err.Error(), true)
+			utils.LogIP(utils.Warning, request, "Agent build rejected:", err.Error())
+			return
+		} else if err != nil {
+			utils.ReturnStatusServerError(writer, request, "Error queueing agent build. Please contact an admin.")
+			utils.LogError(utils.Error, err, utils.GetUserIP(request)+": Error queueing agent build")
 			return
 		}
 
-		utils.RegisterAgent(db, agentUUID.String(), teamID)
+		utils.LogIP(utils.Info, request, "Queued build", jobID, "for Agent", agentUUID.String())
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]string{"job_id": jobID})
+	}
+}
 
-		// Prompt the user's browser to download the file, stripping the UUID
-		// from the filename.
-		utils.PromptFileDownload(writer, request, buildDirectory+newAgentFilename, newAgentFilenameTruncated)
+// The IP addresses of the in-scope targets.
+func targetIPsInScope() ([]string, error) {
+	targets, err := repository.ListTargets()
+	if utils.CheckError(utils.Error, err, "Could not execute GetTargetsInScope statement") {
+		return nil, err
+	}
 
-		err = exec.Command("rm", "-f", buildDirectory+newAgentFilename).Run()
-		if err != nil {
-			//utils.ReturnStatusUserError(writer, request, "Error compiling agent. Please contact an admin.")
-			utils.LogError(utils.Error, err, utils.GetUserIP(request)+": Error removing newly-compiled agent")
+	targetIPs := make([]string, 0, len(targets))
+	for _, target := range targets {
+		targetIPs = append(targetIPs, target.IP)
+	}
+	return targetIPs, nil
+}
+
+// Whether the target is one of the in-scope targets.
+func isTargetIP(targetIP string, targetIPs []string) bool {
+	for _, inScopeIP := range targetIPs {
+		if targetIP == inScopeIP {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Generate an Agent for the build queue. Binary Agents are made by patching
+	their configuration into the target's prebuilt stub, building the stub
+	first if needed, and script Agents are filled in from their templates.
+	Each build writes to its own output path, so any number of these can
+	safely run at once.
+*/
+func buildAgent(buildRequest builds.Request, outputPath string) ([]byte, error) {
+	// The first endpoint is the Agent's primary server, the rest are fallbacks
+	serverIP, serverPortString, err := net.SplitHostPort(buildRequest.Endpoints[0].Address)
+	if err != nil {
+		return nil, err
+	}
+	serverPort, err := strconv.Atoi(serverPortString)
+	if err != nil {
+		return nil, err
+	}
+
+	agentConfig := agentconfig.Config{
+		AgentUUID:       buildRequest.AgentUUID,
+		LocalPort:       buildRequest.LocalPort,
+		ServerIP:        serverIP,
+		ServerPort:      serverPort,
+		Endpoints:       buildRequest.Endpoints[1:],
+		CallbackMinutes: buildRequest.CallbackMinutes,
+		ServerKeyPin:    buildRequest.ServerKeyPin,
+		KillDateUnix:    buildRequest.KillDateUnix,
+		JitterPercent:   buildRequest.JitterPercent,
+		Proxy:           buildRequest.Proxy,
+	}
+
+	if buildRequest.AgentType != utils.AgentTypeBinary {
+		err := builder.GenerateScript(scripts.Templates, buildRequest.AgentType, agentConfig, outputPath)
+		return nil, err
+	}
+
+	return currentAgentSettings().builder.Generate(buildRequest.Target, agentConfig, outputPath)
+}
+
+// Register the Agent only once it has actually been built.
+func registerBuiltAgent(buildRequest builds.Request) error {
+	agent := utils.AgentRegistration{
+		AgentUUID:       buildRequest.AgentUUID,
+		TeamID:          buildRequest.TeamID,
+		AgentType:       buildRequest.AgentType,
+		CallbackMinutes: buildRequest.CallbackMinutes,
+		JitterPercent:   buildRequest.JitterPercent,
+		TargetIP:        buildRequest.TargetIP,
+	}
+
+	// Only binary Agents are built for a known platform. The sh Agent can't
+	// choose its source port.
+	if buildRequest.AgentType == utils.AgentTypeBinary {
+		agent.Platform = buildRequest.Target.String()
+	}
+	if buildRequest.AgentType != utils.AgentTypeSh {
+		agent.LocalPort = buildRequest.LocalPort
+	}
+
+	return storage.RegisterAgent(repository, agent)
+}
+
+func apiBuildStatus(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		tokenClaims, err := utils.GetAuthClaims(writer, request)
+		if err != nil || tokenClaims["teamId"] == nil {
+			return
+		}
+		var teamID int = int(tokenClaims["teamId"].(float64))
+
+		jobInfo, ok := buildQueue.Status(request.URL.Query().Get("id"), teamID)
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			utils.ReturnStatusJSON(writer, request, "Unknown build", true)
 			return
 		}
 
-		//utils.ReturnStatusSuccess(writer, request, "Compiled agent successfully!")
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(jobInfo)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
 	}
+}
 
+func apiBuildDownload(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		tokenClaims, err := utils.GetAuthClaims(writer, request)
+		if err != nil || tokenClaims["teamId"] == nil {
+			return
+		}
+		var teamID int = int(tokenClaims["teamId"].(float64))
+
+		artifactPath, filename, err := artifactStore.Redeem(request.URL.Query().Get("token"), teamID)
+		if err != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			utils.ReturnStatusJSON(writer, request, err.Error(), true)
+			utils.LogIP(utils.Warning, request, "Rejected Agent download:", err.Error())
+			return
+		}
+
+		// Prompt the user's browser to download the file
+		utils.PromptFileDownload(writer, request, artifactPath, filename)
+		utils.LogIP(utils.Done, request, "Downloaded Agent '"+filename+"'")
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
+	}
 }
 
 func handleLoginPage(writer http.ResponseWriter, request *http.Request) {
@@ -235,8 +461,8 @@ func handleLoginPage(writer http.ResponseWriter, request *http.Request) {
 			return
 		}
 
-		teamId, _, passwordHash, _, err := utils.GetUserInfo(db, postedUsername)
-		if err == sql.ErrNoRows {
+		team, err := repository.GetTeamByName(postedUsername)
+		if errors.Is(err, storage.ErrNotFound) {
 			utils.ReturnStatusUserError(writer, request, "Invalid login")
 			return
 		} else if utils.CheckError(utils.Error, err, "Backend error querying database") {
@@ -244,7 +470,7 @@ func handleLoginPage(writer http.ResponseWriter, request *http.Request) {
 			return
 		}
 
-		validLogin := utils.ValidatePasswordHash(postedPassword, passwordHash)
+		validLogin := utils.ValidatePasswordHash(postedPassword, team.PasswordHash)
 
 		// Invalid login: user does not exist or passwords do not match
 		if !validLogin {
@@ -255,7 +481,7 @@ func handleLoginPage(writer http.ResponseWriter, request *http.Request) {
 		// Else, it is a valid login, so continue
 
 		// Set "auth" cookie to a signed JWT
-		newToken, err := utils.GenerateJWT(db, postedUsername, teamId)
+		newToken, err := utils.GenerateJWT(postedUsername, team.TeamID, team.Name, currentConfig().IsAdmin(postedUsername))
 		if utils.CheckError(utils.Error, err, "Could not generate JWT for valid user") {
 			utils.ReturnStatusServerError(writer, request, "Could not generate a JWT. Please contact an administrator.")
 			return
@@ -310,6 +536,30 @@ func isAuthorized(endpoint func(http.ResponseWriter, *http.Request)) http.Handle
 	)
 }
 
+/*
+	Same as `isAuthorized()`, but only for teams listed in the config's
+	`admin.teams`. Everyone else gets a 403.
+*/
+func isAdmin(endpoint func(http.ResponseWriter, *http.Request)) http.Handler {
+	return isAuthorized(
+		func(writer http.ResponseWriter, request *http.Request) {
+			tokenClaims, err := utils.GetAuthClaims(writer, request)
+			if err != nil {
+				return
+			}
+
+			if !currentConfig().IsAdmin(tokenClaims["user"].(string)) {
+				writer.WriteHeader(http.StatusForbidden)
+				utils.ReturnStatusJSON(writer, request, "Admins only", true)
+				utils.LogIP(utils.Warning, request, "Non-admin '"+tokenClaims["user"].(string)+"' requested '"+request.URL.Path+"'")
+				return
+			}
+
+			endpoint(writer, request)
+		},
+	)
+}
+
 func handleHomePage(writer http.ResponseWriter, request *http.Request) {
 	/*
 		Client-side JavaScript will continually update the scoreboard via AJAX,
@@ -319,7 +569,7 @@ func handleHomePage(writer http.ResponseWriter, request *http.Request) {
 	var teamsPointsAndHosts map[string]api.TeamScores
 	var homeContent map[string]interface{}
 
-	scoreboardData, err := api.GetScoreboardData(db)
+	scoreboardData, err := api.GetScoreboardData(repository, currentConfig().Scoring.HostScoring)
 
 	if err == nil {
 		err = json.Unmarshal(scoreboardData, &teamsPointsAndHosts) // convert data back into Go map
@@ -344,7 +594,7 @@ func apiScoreboard(writer http.ResponseWriter, request *http.Request) {
 	case http.MethodGet:
 		jsonEncoder := json.NewEncoder(writer)
 		writer.Header().Add("Content-Type", "application/json")
-		scoreboardData, _ := api.GetScoreboardData(db)
+		scoreboardData, _ := api.GetScoreboardData(repository, currentConfig().Scoring.HostScoring)
 		jsonEncoder.Encode(string(scoreboardData))
 
 	default:
@@ -353,6 +603,147 @@ func apiScoreboard(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// The logged in team's Agents, for the dashboard's inventory
+func apiAgents(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		tokenClaims, err := utils.GetAuthClaims(writer, request)
+		if err != nil || tokenClaims["teamId"] == nil {
+			return
+		}
+		var teamID int = int(tokenClaims["teamId"].(float64))
+
+		inventory, err := repository.AgentInventory(teamID)
+		if utils.CheckError(utils.Error, err, "Could not execute GetAgentInventory statement") {
+			utils.ReturnStatusServerError(writer, request, "Could not retrieve agents. Please contact an admin.")
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(inventory)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
+	}
+}
+
+func handleAdminPage(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		teams, err := repository.ListTeams()
+		if utils.CheckWebError(writer, request, err, "Could not retrieve team names") {
+			return
+		}
+		teamNames := make([]string, 0, len(teams))
+		for _, team := range teams {
+			teamNames = append(teamNames, team.Name)
+		}
+
+		config := currentConfig()
+		adminContent := map[string]interface{}{
+			"reusePolicy":    config.Callbacks.ReusePolicy,
+			"teamNames":      teamNames,
+			"verdicts":       utils.Verdicts,
+			"eventRetention": config.Callbacks.EventRetention.String(),
+			"limits":         config.Callbacks.Limits,
+		}
+		adminHTML := returnTemplateHTML(writer, request, "admin.html", "handleAdminPage", adminContent)
+
+		layoutContent := map[string]template.HTML{"title": "Admin", "pageContent": adminHTML}
+		serveLayoutTemplate(writer, request, "handleAdminPage", layoutContent)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
+	}
+}
+
+// Agents calling back from more than one target, i.e. copied binaries
+func apiAdminReuse(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		alerts, err := repository.ReuseAlerts()
+		if utils.CheckError(utils.Error, err, "Could not execute GetReuseAlerts statement") {
+			utils.ReturnStatusServerError(writer, request, "Could not retrieve reuse alerts")
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(alerts)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
+	}
+}
+
+/*
+	The most recent connections to the callback server, optionally filtered
+	by `team`, `agent` (UUID prefix), `ip`, and `verdict`. At most `limit`
+	events are returned, 200 by default.
+*/
+func apiAdminEvents(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		query := request.URL.Query()
+		filter := storage.CallbackEventFilter{
+			TeamName:  query.Get("team"),
+			AgentUUID: query.Get("agent"),
+			SourceIP:  query.Get("ip"),
+			Verdict:   query.Get("verdict"),
+		}
+
+		limit := 200
+		if query.Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > 1000 {
+				writer.WriteHeader(http.StatusBadRequest)
+				utils.ReturnStatusJSON(writer, request, "limit must be between 1 and 1000", true)
+				return
+			}
+		}
+		if filter.Verdict != "" && !utils.IsVerdict(filter.Verdict) {
+			writer.WriteHeader(http.StatusBadRequest)
+			utils.ReturnStatusJSON(writer, request, "verdict must be one of: "+strings.Join(utils.Verdicts, ", "), true)
+			return
+		}
+
+		events, err := repository.CallbackEvents(filter, limit)
+		if utils.CheckError(utils.Error, err, "Could not execute GetCallbackEvents statement") {
+			utils.ReturnStatusServerError(writer, request, "Could not retrieve callback events")
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(events)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
+	}
+}
+
+// Sources the callback server has throttled or banned, see `callbacks.limits`
+func apiAdminSources(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		sources, err := repository.CallbackSources(time.Now().Unix(), 200)
+		if utils.CheckError(utils.Error, err, "Could not execute GetCallbackSources statement") {
+			utils.ReturnStatusServerError(writer, request, "Could not retrieve callback sources")
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(sources)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		writer.Write([]byte("Method not allowed."))
+	}
+}
+
 /* --- Page handler outline ---
 1. Generate whatever data is needed for input parameters to the HTML templates.
 2. Create parameters mapping for page-specific template.
@@ -361,73 +752,211 @@ func apiScoreboard(writer http.ResponseWriter, request *http.Request) {
 5. Serve the full templated layout page.
 */
 
-func handleRequests() {
+/*
+	Register the page handlers on a mux of our own, the default one also
+	serves the callback server's metrics when both run in one process.
+*/
+func handleRequests() *http.ServeMux {
+	mux := http.NewServeMux()
+
 	// TODO: Add request logging
-	http.HandleFunc("/", handleHomePage)
-	http.HandleFunc("/api/scoreboard", apiScoreboard)
-	http.HandleFunc("/login", handleLoginPage)
-	http.Handle("/dashboard", isAuthorized(handleDashboardPage))
+	mux.HandleFunc("/", handleHomePage)
+	mux.HandleFunc("/api/scoreboard", apiScoreboard)
+	mux.HandleFunc("/login", handleLoginPage)
+	mux.Handle("/dashboard", isAuthorized(handleDashboardPage))
+	mux.Handle("/api/builds/status", isAuthorized(apiBuildStatus))
+	mux.Handle("/api/builds/download", isAuthorized(apiBuildDownload))
+	mux.Handle("/api/agents", isAuthorized(apiAgents))
+	mux.Handle("/admin", isAdmin(handleAdminPage))
+	mux.Handle("/api/admin/reuse", isAdmin(apiAdminReuse))
+	mux.Handle("/api/admin/events", isAdmin(apiAdminEvents))
+	mux.Handle("/api/admin/sources", isAdmin(apiAdminSources))
+
+	// https://pkg.go.dev/net/http#FileServer
+	// Allow the hosting of static files like our images and stylesheets
+	staticFiles, _ := fs.Sub(siteFiles, "static")
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFiles))))
+
+	return mux
+}
+
+// The config as of the last reload. Read it again rather than keeping it around.
+func currentConfig() utils.Config {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+
+	return config
+}
+
+// What Agents are built with as of the last reload.
+func currentAgentSettings() agentSettings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+
+	return agents
+}
+
+/*
+	Work out what Agents are built with from `newConfig` and the certificate
+	being served. `agentBuilder` is kept if given, otherwise the Agent stubs
+	are prepared again.
+*/
+func loadAgentSettings(newConfig utils.Config, agentBuilder *builder.Builder, rebuildStubs bool) (newAgents agentSettings, err error) {
+	if agentBuilder == nil {
+		utils.Log(utils.Info, "Preparing Agent stubs")
+		agentBuilder, err = builder.New(newConfig.Builds.GoBinary, newConfig.Builds.AgentSource, newConfig.Builds.StubDirectory, newConfig.Builds.Targets, rebuildStubs)
+		if err != nil {
+			return
+		}
+	}
+	newAgents.builder = agentBuilder
+
+	newAgents.serverKeyPin, err = certificate.KeyPin()
+	if err != nil {
+		return
+	}
+
+	// Agents call back to the callback server on this host unless told otherwise
+	newAgents.callbackEndpoints = newConfig.Callbacks.Endpoints
+	if len(newAgents.callbackEndpoints) == 0 {
+		newAgents.callbackEndpoints = []agentconfig.Endpoint{{Address: net.JoinHostPort(listenIP.String(), "444"), Transport: agentconfig.TransportTLS}}
+	}
+
+	return
 }
 
-func main() {
-	var argTest bool
-	var argPort int
-	flag.BoolVar(&argTest, "test", false, "Listen on localhost instead of the default interface's IP address")
-	flag.IntVar(&argPort, "port", 443, "Port to listen on")
-	flag.Parse()
-
-	utils.Log(utils.Debug, "----------Initializing----------")
-
-	db = utils.GetDatabaseHandle() // `=` instead of `:=` to set the global variable
-	utils.ValidateDatabase(db)
-	defer utils.Close(db)
-
-	// cert, err := tls.LoadX509KeyPair(utils.CurrentDirectory+"/pwnts.red.pem", utils.CurrentDirectory+"/pwnts_server_key.pem")
-	// if err != nil {
-	// 	utils.Log(utils.Error, "Couldn't load X509 keypair")
-	// 	os.Exit(1)
-	// }
-
-	// tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
-	// listener, err := tls.Listen("tcp", listenPort, &tlsConfig)
-	// if err != nil {
-	// 	utils.Log(utils.Error, "Couldn't set up listener")
-	// 	os.Exit(1)
-	// }
-	// defer listener.Close()
-
-	certPath := utils.CurrentDirectory + "/pwnts_cert.pem"
-	privateKeyPath := utils.CurrentDirectory + "/pwnts_key.pem"
-
-	// cert, err := os.ReadFile(certPath)
-	// utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Cannot read certificate file '"+certPath+"'")
-	// privateKey, err := os.ReadFile(privateKeyPath)
-	// utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Cannot read private key file '"+privateKeyPath+"'")
+/*
+	Settings that size or place something at startup, and so can't change
+	without a restart. Returns the name of each one that differs.
+*/
+func restartOnlySettings(oldConfig utils.Config, newConfig utils.Config) (changed []string) {
+	old, new := oldConfig.Builds, newConfig.Builds
+	if old.Workers != new.Workers {
+		changed = append(changed, "builds.workers")
+	}
+	if old.QueueSize != new.QueueSize {
+		changed = append(changed, "builds.queue_size")
+	}
+	if old.MaxPerTeam != new.MaxPerTeam {
+		changed = append(changed, "builds.max_per_team")
+	}
+	if old.ArtifactDirectory != new.ArtifactDirectory {
+		changed = append(changed, "builds.artifact_directory")
+	}
+	if old.ArtifactLifetime != new.ArtifactLifetime {
+		changed = append(changed, "builds.artifact_lifetime")
+	}
+	if old.JobLifetime != new.JobLifetime {
+		changed = append(changed, "builds.job_status_lifetime")
+	}
+	return
+}
+
+/*
+	Apply a reloaded config and reload the TLS certificate, and with them
+	the build targets, callback endpoints and key pin baked into new Agents.
+	Whatever can't be loaded is kept as it was. Builds already queued finish
+	with the endpoints and key pin they were requested with.
+*/
+func Reload(newConfig utils.Config) {
+	oldConfig := currentConfig()
+	for _, setting := range restartOnlySettings(oldConfig, newConfig) {
+		utils.Log(utils.Warning, "Changing", setting, "requires a restart")
+	}
+
+	err := certificate.Reload()
+	if !utils.CheckError(utils.Error, err, "Could not reload TLS certificate, keeping the current one") {
+		utils.Log(utils.Done, "Reloaded TLS certificate")
+	}
+
+	// Only prepare the stubs again if the targets or where they come from changed
+	agentBuilder := currentAgentSettings().builder
+	if strings.Join(oldConfig.Builds.Targets, ",") != strings.Join(newConfig.Builds.Targets, ",") ||
+		oldConfig.Builds.GoBinary != newConfig.Builds.GoBinary || oldConfig.Builds.StubDirectory != newConfig.Builds.StubDirectory ||
+		oldConfig.Builds.AgentSource != newConfig.Builds.AgentSource {
+		agentBuilder = nil
+	}
+
+	newAgents, err := loadAgentSettings(newConfig, agentBuilder, false)
+	if utils.CheckError(utils.Error, err, "Agent generation could not be reloaded, keeping the current config") {
+		return
+	}
+
+	settingsMutex.Lock()
+	config = newConfig
+	agents = newAgents
+	settingsMutex.Unlock()
+	utils.SetTrustedProxies(newConfig.Site.TrustedProxies)
+	utils.Log(utils.Done, "Agents are now built for", fmt.Sprint(len(newAgents.builder.Targets())), "targets")
+}
+
+/*
+	Start serving the site and return once it's listening. `database` must
+	already be validated. Exits if the site can't start.
+*/
+func Start(database storage.Repository, startConfig utils.Config, options Options) {
+	repository, config = database, startConfig
+	utils.SetTrustedProxies(config.Site.TrustedProxies)
+
+	var err error
+	certificate, err = utils.LoadReloadableCertificate(certPath, privateKeyPath)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not load certificate '"+certPath+"' and private key '"+privateKeyPath+"'")
 
 	/*
 		--- Main site ---
 	*/
-	if argTest {
+	if options.Test {
 		listenIP = net.ParseIP("127.0.0.1")
 	} else {
 		listenIP = utils.GetHostIP()
 	}
 
-	listenAddress := fmt.Sprintf("%s:%d", listenIP.String(), argPort)
+	listenAddress := fmt.Sprintf("%s:%d", listenIP.String(), options.Port)
+
+	/*
+		--- Agent builds ---
+	*/
+	agents, err = loadAgentSettings(config, nil, options.RebuildStubs)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Agent generation is unavailable")
+
+	artifactStore, err = builds.NewStore(config.Builds.ArtifactDirectory, config.Builds.ArtifactLifetime.Duration)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not create artifact store at '"+config.Builds.ArtifactDirectory+"'")
+	buildQueue = builds.NewQueue(config.Builds, artifactStore, buildAgent, registerBuiltAgent)
+
+	// The certificate is looked up on every handshake, so SIGHUP can replace it
+	listener, err := tls.Listen("tcp", listenAddress, &tls.Config{GetCertificate: certificate.GetCertificate})
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't start HTTPS listener at", listenAddress)
+
+	server = &http.Server{Handler: handleRequests()}
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "HTTPS server at", listenAddress, "stopped")
+		}
+	}()
 
 	utils.Log(utils.Done, "Running HTTPS server at", listenAddress)
 	utils.Log(utils.Debug, "----------Activity Logs---------")
+}
 
-	// https://pkg.go.dev/net/http#FileServer
-	// Allow the hosting of static files like our images and stylesheets
-	staticFileServer := http.FileServer(http.Dir(utils.CurrentDirectory + "/site/static"))
-	// TODO: Figure out why the FileServer isn't setting the correct Content-Type header MIME type on JavaScript files.
-	//		 Should be "text/javascript" but is "text/plain"
-	http.Handle("/static/", http.StripPrefix("/static/", staticFileServer))
+/*
+	Stop accepting requests, and give the ones in progress and the queued
+	builds until `shutdown_timeout` to finish. Finished Agents can't be
+	downloaded once the site is gone, so the artifact store is emptied
+	either way. The database itself is left open for the caller to close.
+*/
+func Shutdown() {
+	shutdownTimeout := currentConfig().ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout.Duration)
+	defer cancel()
 
-	// Register page handlers
-	handleRequests()
+	err := server.Shutdown(ctx)
+	utils.CheckError(utils.Warning, err, "Requests still in progress after", shutdownTimeout.String())
 
-	err := http.ListenAndServeTLS(listenAddress, certPath, privateKeyPath, nil)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Couldn't start HTTPS listener at", listenAddress)
+	if !buildQueue.Stop(ctx) {
+		utils.Log(utils.Warning, "Agent builds still running after", shutdownTimeout.String()+", abandoning them")
+	}
+	artifactStore.Clear()
+
+	utils.Log(utils.Done, "Stopped the site")
 }
@@ -0,0 +1,122 @@
+function escapeHTML(text) {
+	let escape = document.createElement("textarea")
+	escape.textContent = text
+	return escape.innerHTML
+}
+
+const formatTime = (unix) => new Date(unix * 1000).toLocaleString()
+
+// Fetch JSON from an admin API and pass it to `display`
+function fetchAdminData(url, display) {
+	const adminRequest = new XMLHttpRequest()
+
+	adminRequest.addEventListener("load", (event) => {
+		let data
+		try {
+			data = JSON.parse(event.target.responseText)
+		} catch(e) {
+			console.error("Failed to parse " + url + " as JSON")
+			return
+		}
+		display(data)
+	})
+
+	adminRequest.open("GET", url)
+	adminRequest.send()
+}
+
+function updateReuseAlerts() {
+	fetchAdminData("/api/admin/reuse", (alerts) => {
+		let newTableData = ""
+		for (let alert of alerts) {
+			let sources = alert.sources.map((source) => {
+				const action = source.policy === "flag" ? "flagged" : "rejected"
+				return `${escapeHTML(source.source_ip)}: ${source.checkins} checkin(s) ${action}, last ${formatTime(source.last_seen)}`
+			}).join("<br>")
+
+			newTableData += `
+				<tr>
+					<td>${escapeHTML(alert.team)}</td>
+					<td>${escapeHTML(alert.agent_uuid)}</td>
+					<td>${escapeHTML(alert.agent_type)}</td>
+					<td>${escapeHTML(alert.bound_target)}</td>
+					<td class="moved">${sources}</td>
+				</tr>
+			`
+		}
+
+		document.getElementById("reuse-alerts").getElementsByTagName("tbody")[0].innerHTML = newTableData
+	})
+}
+
+function updateCallbackSources() {
+	fetchAdminData("/api/admin/sources", (sources) => {
+		let newTableData = ""
+		for (let source of sources) {
+			const lastThrottled = source.last_throttled ? `, last ${formatTime(source.last_throttled)}` : ""
+			newTableData += `
+				<tr>
+					<td>${escapeHTML(source.source_ip)}${source.in_scope ? " (in scope)" : ""}</td>
+					<td>${source.throttled}${lastThrottled}</td>
+					<td>${source.invalid_payloads}</td>
+					<td>${source.bans}</td>
+					<td class="${source.banned_until ? "verdict-rejected" : ""}">${source.banned_until ? formatTime(source.banned_until) : "Not banned"}</td>
+					<td>${formatTime(source.last_seen)}</td>
+				</tr>
+			`
+		}
+
+		document.getElementById("callback-sources").getElementsByTagName("tbody")[0].innerHTML = newTableData
+	})
+}
+
+// Fill the callback events table, filtered by the filter form
+function updateCallbackEvents() {
+	const filters = new URLSearchParams()
+	for (let [name, value] of new FormData(document.forms["event-filters"])) {
+		if (value.trim()) {
+			filters.append(name, value.trim())
+		}
+	}
+
+	fetchAdminData("/api/admin/events?" + filters.toString(), (events) => {
+		if (!Array.isArray(events)) {
+			console.error(events.message)
+			return
+		}
+
+		let newTableData = ""
+		for (let callbackEvent of events) {
+			newTableData += `
+				<tr>
+					<td>${formatTime(callbackEvent.time)}</td>
+					<td>${escapeHTML(callbackEvent.source_ip)}:${callbackEvent.source_port}</td>
+					<td>${escapeHTML(callbackEvent.listener)} (${escapeHTML(callbackEvent.transport)})${callbackEvent.collector ? " via " + escapeHTML(callbackEvent.collector) : ""}</td>
+					<td>${escapeHTML(callbackEvent.team)}</td>
+					<td>${escapeHTML(callbackEvent.agent_uuid)}</td>
+					<td>${escapeHTML(callbackEvent.message_type)}</td>
+					<td class="verdict-${escapeHTML(callbackEvent.verdict)}">${escapeHTML(callbackEvent.verdict)}</td>
+					<td>${escapeHTML(callbackEvent.reason)}</td>
+				</tr>
+			`
+		}
+
+		document.getElementById("callback-events").getElementsByTagName("tbody")[0].innerHTML = newTableData
+	})
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+	document.forms["event-filters"].addEventListener("submit", (event) => {
+		event.preventDefault()
+		updateCallbackEvents()
+	})
+
+	updateReuseAlerts()
+	updateCallbackSources()
+	updateCallbackEvents()
+	setInterval(() => {
+		updateReuseAlerts()
+		updateCallbackSources()
+		updateCallbackEvents()
+	}, 10000)
+})
@@ -1,3 +1,13 @@
+function parseJwt(token) {
+	let base64Url = token.split(".")[1]
+	let base64 = base64Url.replace(/-/g, "+").replace(/_/g, "/")
+	let jsonPayload = decodeURIComponent(atob(base64).split("").map((c) => {
+		return "%" + ("00" + c.charCodeAt(0).toString(16)).slice(-2)
+	}).join(""))
+
+	return JSON.parse(jsonPayload)
+}
+
 // *** Functions for options
 // Enable or disable the scanlines stylesheet
 function disableScanlines() {
@@ -51,6 +61,11 @@ const displayWait = (statusElement, waitMessage) => {
 
 // *** Main content
 document.addEventListener("DOMContentLoaded", () => {
+	/* --- Show the admin link to admins, the server checks access itself --- */
+	if (getCookie("auth") && parseJwt(getCookie("auth")).admin) {
+		document.getElementById("nav-admin").classList.remove("hidden")
+	}
+
 	/* --- Apply user options, read "options" cookie --- */
 	let playAudio = true
 	let options = {}
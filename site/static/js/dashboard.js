@@ -1,13 +1,3 @@
-function parseJwt(token) {
-	let base64Url = token.split(".")[1]
-	let base64 = base64Url.replace(/-/g, "+").replace(/_/g, "/")
-	let jsonPayload = decodeURIComponent(atob(base64).split("").map((c) => {
-		return "%" + ("00" + c.charCodeAt(0).toString(16)).slice(-2)
-	}).join(""))
-
-	return JSON.parse(jsonPayload)
-}
-
 function calculateWeight(minutes) {
 	// Exponential decay in point value
 	// 1.2^(-0.9(x-1))
@@ -19,6 +9,123 @@ function calculateWeight(minutes) {
 	return Math.round(baseValue**(decayValue*(minutes-1)) * 100) / 100
 }
 
+// Escape text so it can't insert arbitrary HTML, see `scoreboard.js`
+function escapeHTML(text) {
+	let escape = document.createElement("textarea")
+	escape.textContent = text
+	return escape.innerHTML
+}
+
+// Poll the build queue until the Agent is ready, then download it
+function pollBuild(jobId, statusElement) {
+	const statusRequest = new XMLHttpRequest()
+
+	statusRequest.addEventListener("load", (event) => {
+		let job
+		try {
+			job = JSON.parse(event.target.responseText)
+		} catch(e) {
+			displayError(statusElement, "Lost track of the agent build")
+			return
+		}
+
+		switch (job.status) {
+			case "queued":
+				displayWait(statusElement, "Agent queued...")
+				setTimeout(() => pollBuild(jobId, statusElement), 1000)
+				break
+			case "building":
+				displayWait(statusElement, "Agent generating...")
+				setTimeout(() => pollBuild(jobId, statusElement), 1000)
+				break
+			case "done":
+				// The download token is single-use, the browser prompts
+				// the download thanks to the Content-Disposition header
+				window.location = "/api/builds/download?token=" + encodeURIComponent(job.download_token)
+				displaySuccess(statusElement, "Agent generated!")
+				updateInventory()
+				break
+			case "failed":
+				displayError(statusElement, "Agent generation failed:<pre>" + escapeHTML(job.output || "") + "</pre>")
+				break
+			default:
+				displayError(statusElement, job.message || "Lost track of the agent build")
+		}
+	})
+
+	statusRequest.addEventListener("error", (event) => {
+		displayError(statusElement, "Oops! Something went wrong...")
+	})
+
+	statusRequest.open("GET", "/api/builds/status?id=" + encodeURIComponent(jobId))
+	statusRequest.send()
+}
+
+// Fill the Agent inventory table with the team's Agents
+function updateInventory() {
+	const inventoryRequest = new XMLHttpRequest()
+
+	inventoryRequest.addEventListener("load", (event) => {
+		let agents
+		try {
+			agents = JSON.parse(event.target.responseText)
+		} catch(e) {
+			console.error("Failed to parse agent inventory as JSON")
+			return
+		}
+
+		const formatTime = (unix) => unix ? new Date(unix * 1000).toLocaleString() : "Never"
+
+		// Everything in a fingerprint comes from the Agent's host, escape it all
+		const formatHost = (agent) => {
+			const host = agent.host
+			if (!host) {
+				return "Unknown"
+			}
+
+			let description = `${escapeHTML(host.hostname)} (${escapeHTML(host.os)} ${escapeHTML(host.arch)})`
+			if (host.os_version) {
+				description += `<br>${escapeHTML(host.os_version)}`
+			}
+			description += `<br>${escapeHTML(host.user)}, PID ${host.pid}`
+			if (host.ips.length) {
+				description += `<br>${host.ips.map(escapeHTML).join(", ")}`
+			}
+			if (agent.host_changed) {
+				description += `<br><span class="moved">Moved ${formatTime(agent.host_changed)} (${agent.host_changed_fields.map(escapeHTML).join(", ")})</span>`
+			}
+			return description
+		}
+
+		const formatTarget = (agent) => {
+			if (!agent.target) {
+				return "Not yet bound"
+			}
+			return escapeHTML(agent.target) + (agent.target_locked ? " (generated for)" : "")
+		}
+
+		let newTableData = ""
+		for (let agent of agents) {
+			newTableData += `
+				<tr>
+					<td>${escapeHTML(agent.agent_uuid)}</td>
+					<td>${escapeHTML(agent.agent_type)}</td>
+					<td>${formatTime(agent.created)}</td>
+					<td>${formatTarget(agent)}</td>
+					<td>${formatTime(agent.last_checkin)}</td>
+					<td>${escapeHTML(agent.last_target)}</td>
+					<td>${formatHost(agent)}</td>
+				</tr>
+			`
+		}
+
+		document.getElementById("agent-inventory").getElementsByTagName("tbody")[0].innerHTML = newTableData
+	})
+
+	inventoryRequest.open("GET", "/api/agents")
+	inventoryRequest.send()
+}
+
 let userJwt = parseJwt(getCookie("auth"))
 
 document.addEventListener("DOMContentLoaded", () => {
@@ -40,6 +147,25 @@ document.addEventListener("DOMContentLoaded", () => {
 	})
 
 
+	// Only binary Agents have a target platform and proxy support
+	let agentType = document.getElementById("agentType")
+	let targetPlatformGroup = document.getElementById("targetPlatformGroup")
+	let proxyGroup = document.getElementById("proxyGroup")
+	agentType.addEventListener("change", (event) => {
+		targetPlatformGroup.classList.toggle("hidden", event.target.value !== "binary")
+		proxyGroup.classList.toggle("hidden", event.target.value !== "binary")
+		if (event.target.value !== "binary") {
+			document.getElementById("proxy").value = ""
+		}
+	})
+
+	// Agents' last checkins change constantly, keep the inventory fresh
+	updateInventory()
+	setInterval(() => {
+		updateInventory()
+	}, 30000)
+
+
 	/* --- Handle agent generation --- */
 	const agentForm = document.forms["agent-form"]
 	const agentFormStatus = document.getElementById("agent-form-status")
@@ -47,11 +173,10 @@ document.addEventListener("DOMContentLoaded", () => {
 	agentForm.addEventListener("submit", (event) => {
 		event.preventDefault()
 		
-		displayWait(agentFormStatus, "Agent generating...")
+		displayWait(agentFormStatus, "Submitting agent build...")
 
 		// Using XMLHttpRequest() over Fetch() for older browser compatibility
 		const agentRequest = new XMLHttpRequest()
-		agentRequest.responseType = "blob" // raw file contents, important
 
 		// Bind the FormData object and the form element
 		const formData = new FormData(agentForm)
@@ -70,16 +195,21 @@ document.addEventListener("DOMContentLoaded", () => {
 	  
 		// Define what happens on successful data submission
 		agentRequest.addEventListener("load", (event) => {
-			// https://medium.com/@drevets/you-cant-prompt-a-file-download-with-the-content-disposition-header-using-axios-xhr-sorry-56577aa706d6
-			// Weird hack since XHR requests don't follow standard download prompts
-			agentResponse = event.target.response
-			const url = window.URL.createObjectURL(new Blob([agentResponse]))
-			const link = document.createElement("a")
-			link.href = url
-			document.body.appendChild(link)
-			link.click()
-			window.URL.revokeObjectURL(url)
-			displaySuccess(agentFormStatus, "Agent generated!")
+			let response
+			try {
+				response = JSON.parse(event.target.responseText)
+			} catch(e) {
+				displayError(agentFormStatus, "Oops! Something went wrong...")
+				return
+			}
+
+			if (event.target.status !== 200 || !response.job_id) {
+				displayError(agentFormStatus, response.message || "Oops! Something went wrong...")
+				return
+			}
+
+			displayWait(agentFormStatus, "Agent queued...")
+			pollBuild(response.job_id, agentFormStatus)
 		})
 	  
 		// Define what happens in case of error
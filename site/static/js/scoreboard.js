@@ -41,11 +41,30 @@ function populateScoreboard(data) {
 		escape.textContent = team
 		escapedTeam = escape.innerHTML
 
+		// Agent types are one of a fixed set of names, but escape them anyway
+		let agentTypes = ""
+		for (let agentType in data[team].agent_types) {
+			escape.textContent = agentType
+			agentTypes += `<span>${data[team].agent_types[agentType]} ${escape.innerHTML}</span> `
+		}
+
+		// OS names come from the Agents themselves, always escape them
+		let hostOS = ""
+		for (let os in data[team].host_os) {
+			escape.textContent = os
+			hostOS += `<span>${data[team].host_os[os]} ${escape.innerHTML}</span> `
+		}
+		if (data[team].moved_agents) {
+			hostOS += `<span class="moved">${data[team].moved_agents} moved</span>`
+		}
+
 		newTableData += `
 			<tr>
 				<td class="tableTeam"><span>${escapedTeam}</span></td>
 				<td class="tablePwnts">${data[team].pwnts}</td>
 				<td class="tablePwns">${data[team].pwned_hosts}</td>
+				<td class="tableAgents">${agentTypes}</td>
+				<td class="tableAgents">${hostOS}</td>
 			</tr>
 		`
 	}
@@ -0,0 +1,583 @@
+package storage_test
+
+/*
+	Check that every storage backend behaves the same: run one suite of
+	checks against each `storage.Repository` implementation, on scratch
+	databases that are thrown away afterwards. SQLite always runs, in
+	temporary files. PostgreSQL runs in new schemas of its own that are
+	dropped afterwards, on the server `PWNTS_POSTGRES_URL` names or else in
+	a throwaway container, see `postgres_test.go`.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/agent/fingerprint"
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+// Create an empty scratch database, returning how to open it.
+type scratchFunc func(t *testing.T) (open func() (storage.Repository, error))
+
+func sqliteScratch(t *testing.T) func() (storage.Repository, error) {
+	path := filepath.Join(t.TempDir(), utils.DatabaseFilename)
+	return func() (storage.Repository, error) {
+		return storage.OpenSQLite(path)
+	}
+}
+
+// Open a repository that's closed once the test is done.
+func openScratch(t *testing.T, open func() (storage.Repository, error)) storage.Repository {
+	repository, err := open()
+	if err != nil {
+		t.Fatalf("Could not open the scratch database: %v", err)
+	}
+	t.Cleanup(func() { utils.Close(repository) })
+	return repository
+}
+
+func check(t *testing.T, ok bool, description string, details ...interface{}) {
+	t.Helper()
+	if ok {
+		return
+	}
+
+	if len(details) == 0 {
+		t.Error(description)
+	} else {
+		t.Errorf("%s: %s", description, fmt.Sprint(details...))
+	}
+}
+
+// Whether `err` is nil, failing the test if it isn't.
+func noError(t *testing.T, err error, description string) bool {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%s: %v", description, err)
+		return false
+	}
+	return true
+}
+
+// `actual` should equal `expected`, field by field.
+func equal(t *testing.T, description string, actual interface{}, expected interface{}) {
+	t.Helper()
+	check(t, reflect.DeepEqual(actual, expected), description, fmt.Sprintf("got %+v, want %+v", actual, expected))
+}
+
+// The checks against one backend, and how many of them failed.
+type suite struct {
+	repository storage.Repository
+
+	// Filled in as the checks go, later ones build on earlier ones
+	now                 int64
+	alphaID, bravoID    int
+	freeUUID, boundUUID string
+	holding             utils.HostHolding
+	hostBefore          fingerprint.Fingerprint
+	hostAfter           fingerprint.Fingerprint
+}
+
+/*
+	--- Checks ---
+*/
+
+func (s *suite) checkSchema(t *testing.T) {
+	migrations, err := s.repository.Migrations()
+	if !noError(t, err, "Could not read the migrations") {
+		return
+	}
+
+	fromVersion, toVersion, err := s.repository.Migrate()
+	if noError(t, err, "Could not migrate an empty database") {
+		equal(t, "Migrating an empty database applies every migration", []int{fromVersion, toVersion}, []int{0, len(migrations)})
+	}
+
+	fromVersion, toVersion, err = s.repository.Migrate()
+	if noError(t, err, "Could not migrate an up to date database") {
+		equal(t, "Migrating an up to date database does nothing", fromVersion, toVersion)
+	}
+
+	version, err := s.repository.ValidateSchema()
+	if noError(t, err, "The migrated schema is invalid") {
+		equal(t, "The schema is at the latest version", version, len(migrations))
+	}
+
+	// PostgreSQL folds the unquoted names to lower case
+	tables, err := s.repository.Tables()
+	if noError(t, err, "Could not list the tables") {
+		for i := range tables {
+			tables[i] = strings.ToLower(tables[i])
+		}
+		sort.Strings(tables)
+		equal(t, "Every table exists", tables, []string{
+			"agentcheckins", "agentfingerprints", "agentreuse", "agents", "callbackevents",
+			"callbacksources", "checkinfingerprints", "hostholdings", "targetsinscope", "teams",
+		})
+	}
+}
+
+func (s *suite) checkTeams(t *testing.T) {
+	var err error
+	s.alphaID, err = s.repository.AddTeam("alpha", "hash-alpha", s.now)
+	noError(t, err, "Could not add team alpha")
+	s.bravoID, err = s.repository.AddTeam("bravo", "hash-bravo", s.now+1)
+	noError(t, err, "Could not add team bravo")
+	check(t, s.bravoID > s.alphaID, "Team IDs increase", s.alphaID, " then ", s.bravoID)
+
+	_, err = s.repository.AddTeam("alpha", "hash-other", s.now)
+	check(t, err != nil, "Team names are unique")
+
+	team, err := s.repository.GetTeam(s.alphaID)
+	if noError(t, err, "Could not get team alpha") {
+		equal(t, "A team reads back as written", team, storage.Team{TeamID: s.alphaID, Name: "alpha", PasswordHash: "hash-alpha", CreatedUnix: s.now})
+	}
+
+	team, err = s.repository.GetTeamByName("bravo")
+	if noError(t, err, "Could not get team bravo by name") {
+		equal(t, "A team is found by name", team.TeamID, s.bravoID)
+	}
+
+	_, err = s.repository.GetTeam(s.bravoID + 100)
+	check(t, errors.Is(err, storage.ErrNotFound), "An unknown team ID is not found", err)
+	_, err = s.repository.GetTeamByName("charlie")
+	check(t, errors.Is(err, storage.ErrNotFound), "An unknown team name is not found", err)
+
+	teams, err := s.repository.ListTeams()
+	if noError(t, err, "Could not list the teams") {
+		names := []string{}
+		for _, team := range teams {
+			names = append(names, team.Name)
+		}
+		equal(t, "Teams are listed by ID", names, []string{"alpha", "bravo"})
+	}
+}
+
+func (s *suite) checkTargets(t *testing.T) {
+	noError(t, s.repository.AddTarget(storage.Target{IP: "10.0.0.1", Value: 5}), "Could not add target 10.0.0.1")
+	noError(t, s.repository.AddTarget(storage.Target{IP: "10.0.0.2", Value: 3}), "Could not add target 10.0.0.2")
+	check(t, s.repository.AddTarget(storage.Target{IP: "10.0.0.1", Value: 1}) != nil, "Targets are unique")
+
+	target, err := s.repository.GetTarget("10.0.0.1")
+	if noError(t, err, "Could not get target 10.0.0.1") {
+		equal(t, "A target reads back as written", target, storage.Target{IP: "10.0.0.1", Value: 5})
+	}
+
+	_, err = s.repository.GetTarget("10.0.0.3")
+	check(t, errors.Is(err, storage.ErrNotFound), "A target not in scope is not found", err)
+
+	targets, err := s.repository.ListTargets()
+	if noError(t, err, "Could not list the targets") {
+		equal(t, "Targets are listed by IP address", targets, []storage.Target{{IP: "10.0.0.1", Value: 5}, {IP: "10.0.0.2", Value: 3}})
+	}
+}
+
+func (s *suite) checkAgents(t *testing.T) {
+	s.freeUUID, s.boundUUID = uuid.NewString(), uuid.NewString()
+	free := utils.AgentRegistration{AgentUUID: s.freeUUID, TeamID: s.alphaID, AgentType: utils.AgentTypeBinary, CallbackMinutes: 5, JitterPercent: 10, LocalPort: 80, Platform: "linux/amd64"}
+	bound := utils.AgentRegistration{AgentUUID: s.boundUUID, TeamID: s.alphaID, AgentType: utils.AgentTypeSh, TargetIP: "10.0.0.2"}
+
+	noError(t, s.repository.AddAgent(free, s.now), "Could not add an Agent")
+	noError(t, s.repository.AddAgent(bound, s.now+1), "Could not add an Agent for a target")
+	check(t, s.repository.AddAgent(free, s.now) != nil, "Agent UUIDs are unique")
+
+	agent, err := s.repository.GetAgent(s.freeUUID)
+	if noError(t, err, "Could not get an Agent") {
+		equal(t, "An Agent reads back as written", agent, storage.Agent{AgentUUID: s.freeUUID, TeamID: s.alphaID, AgentType: utils.AgentTypeBinary, CreatedUnix: s.now,
+			CallbackMinutes: 5, JitterPercent: 10, LocalPort: 80, Platform: "linux/amd64"})
+	}
+
+	agent, err = s.repository.GetAgent(s.boundUUID)
+	if noError(t, err, "Could not get an Agent generated for a target") {
+		equal(t, "An Agent generated for a target is locked to it", []interface{}{agent.BoundTarget, agent.TargetLocked}, []interface{}{"10.0.0.2", true})
+	}
+
+	_, err = s.repository.GetAgent(uuid.NewString())
+	check(t, errors.Is(err, storage.ErrNotFound), "An unknown Agent is not found", err)
+
+	numAgents, err := s.repository.CountAgents()
+	if noError(t, err, "Could not count the Agents") {
+		equal(t, "Agents are counted", numAgents, 2)
+	}
+}
+
+/*
+	Everything the callback server writes, through one transaction like the
+	`BatchWriter` uses.
+*/
+func (s *suite) checkTransactions(t *testing.T) {
+	tx, err := s.repository.Begin()
+	if !noError(t, err, "Could not begin a transaction") {
+		return
+	}
+	defer tx.Rollback() // no-op once committed
+
+	firstCheckin, secondCheckin := s.now, s.now+5*60
+
+	boundTarget, err := tx.BindAgentToTarget(s.freeUUID, "10.0.0.1")
+	if noError(t, err, "Could not bind an Agent") {
+		equal(t, "An Agent is bound to its first target", boundTarget, "10.0.0.1")
+	}
+	boundTarget, err = tx.BindAgentToTarget(s.freeUUID, "10.0.0.2")
+	if noError(t, err, "Could not bind a bound Agent") {
+		equal(t, "A bound Agent stays bound", boundTarget, "10.0.0.1")
+	}
+
+	// Both checkins and the holding they make, as `server.recordCheckin()` records them
+	holding, err := tx.GetHostHolding(s.alphaID, "10.0.0.1", s.freeUUID)
+	if noError(t, err, "Could not get a missing host holding") {
+		equal(t, "A missing host holding is empty", holding, utils.HostHolding{TeamID: s.alphaID, TargetIP: "10.0.0.1", AgentUUID: s.freeUUID})
+	}
+	for _, checkinUnix := range []int64{firstCheckin, secondCheckin} {
+		noError(t, tx.AddCheckin(s.freeUUID, "10.0.0.1", checkinUnix), "Could not add a checkin")
+		holding = utils.NextHostHolding(holding, checkinUnix, 5, 10, 5)
+		noError(t, tx.SaveHostHolding(holding), "Could not save a host holding")
+	}
+	s.holding = holding
+
+	storedHolding, err := tx.GetHostHolding(s.alphaID, "10.0.0.1", s.freeUUID)
+	if noError(t, err, "Could not get a host holding") {
+		equal(t, "A transaction reads its own writes", storedHolding, holding)
+	}
+
+	// A failed write must not take the rest of the transaction with it
+	err = tx.Savepoint(func(tx storage.Tx) error {
+		return tx.AddCheckin(s.freeUUID, "10.0.0.1", firstCheckin)
+	})
+	check(t, err != nil, "Checkins are unique")
+	err = tx.Savepoint(func(tx storage.Tx) error {
+		if err := tx.AddCheckin(s.freeUUID, "10.0.0.1", secondCheckin+60); err != nil {
+			return err
+		}
+		return errors.New("undo")
+	})
+	check(t, err != nil && err.Error() == "undo", "A savepoint returns its write's error", err)
+	noError(t, tx.SetAgentRootDate(s.freeUUID, firstCheckin), "Could not set the root date after a failed savepoint")
+	noError(t, tx.SetAgentRootDate(s.freeUUID, secondCheckin), "Could not set the root date again")
+
+	noError(t, tx.RecordAgentReuse(s.boundUUID, "10.0.0.1", firstCheckin, utils.ReusePolicyFlag), "Could not record Agent reuse")
+	noError(t, tx.RecordAgentReuse(s.boundUUID, "10.0.0.1", secondCheckin, utils.ReusePolicyReject), "Could not record Agent reuse again")
+
+	// Fingerprints, as `server.recordHostFingerprint()` records them
+	s.hostBefore = fingerprint.Fingerprint{Hostname: "web01", OS: "linux", OSVersion: "5.10", Arch: "amd64", MachineID: "m-1", User: "root", IPs: []string{"10.0.0.1", "192.168.1.1"}, PID: 42}
+	s.hostAfter = s.hostBefore
+	s.hostAfter.Hostname, s.hostAfter.PID = "web02", 43
+
+	_, err = tx.GetAgentFingerprint(s.freeUUID)
+	check(t, errors.Is(err, storage.ErrNotFound), "A missing fingerprint is not found", err)
+	noError(t, tx.AddCheckinFingerprint(s.freeUUID, "10.0.0.1", firstCheckin, s.hostBefore), "Could not add a checkin fingerprint")
+	noError(t, tx.SaveAgentFingerprint(s.freeUUID, s.hostBefore, firstCheckin), "Could not add an Agent fingerprint")
+	host, err := tx.GetAgentFingerprint(s.freeUUID)
+	if noError(t, err, "Could not get an Agent fingerprint") {
+		compared := s.hostBefore
+		compared.OSVersion, compared.IPs, compared.PID = "", nil, 0
+		equal(t, "A fingerprint reads back as written", host, compared)
+	}
+	noError(t, tx.AddCheckinFingerprint(s.freeUUID, "10.0.0.1", secondCheckin, s.hostAfter), "Could not add another checkin fingerprint")
+	noError(t, tx.SaveAgentFingerprint(s.freeUUID, s.hostAfter, secondCheckin), "Could not replace an Agent fingerprint")
+	noError(t, tx.FlagAgentFingerprint(s.freeUUID, secondCheckin, fingerprint.Changes(s.hostBefore, s.hostAfter)), "Could not flag an Agent fingerprint")
+
+	if !noError(t, tx.Commit(), "Could not commit") {
+		return
+	}
+
+	numCheckins, err := s.repository.CountCheckins(s.freeUUID)
+	if noError(t, err, "Could not count checkins") {
+		equal(t, "Only the checkins outside failed savepoints are committed", numCheckins, 2)
+	}
+
+	agent, err := s.repository.GetAgent(s.freeUUID)
+	if noError(t, err, "Could not get an Agent") {
+		equal(t, "The bound target and first root date are kept", []interface{}{agent.BoundTarget, agent.RootDateUnix}, []interface{}{"10.0.0.1", firstCheckin})
+	}
+
+	// A rolled back transaction leaves nothing behind
+	tx, err = s.repository.Begin()
+	if noError(t, err, "Could not begin a transaction") {
+		noError(t, tx.AddCheckin(s.freeUUID, "10.0.0.1", secondCheckin+120), "Could not add a checkin")
+		noError(t, tx.Rollback(), "Could not roll back")
+		numCheckins, err = s.repository.CountCheckins(s.freeUUID)
+		if noError(t, err, "Could not count checkins") {
+			equal(t, "A rolled back checkin isn't recorded", numCheckins, 2)
+		}
+	}
+}
+
+// What the admin pages and the dashboard read back.
+func (s *suite) checkInventory(t *testing.T) {
+	secondCheckin := s.now + 5*60
+
+	inventory, err := s.repository.AgentInventory(s.alphaID)
+	if noError(t, err, "Could not get the Agent inventory") && len(inventory) == 2 {
+		equal(t, "The newest Agent is listed first", []string{inventory[0].AgentUUID, inventory[1].AgentUUID}, []string{s.boundUUID, s.freeUUID})
+
+		bound := inventory[0]
+		equal(t, "An Agent without checkins has none", []interface{}{bound.TargetIP, bound.TargetLocked, bound.LastCheckinUnix, bound.LastTargetIP, bound.Host},
+			[]interface{}{"10.0.0.2", true, int64(0), "", (*fingerprint.Fingerprint)(nil)})
+
+		free := inventory[1]
+		equal(t, "An Agent's latest checkin is listed", []interface{}{free.TargetIP, free.TargetLocked, free.LastCheckinUnix, free.LastTargetIP},
+			[]interface{}{"10.0.0.1", false, secondCheckin, "10.0.0.1"})
+		check(t, free.Host != nil && reflect.DeepEqual(*free.Host, s.hostAfter), "An Agent's latest fingerprint is listed", fmt.Sprintf("got %+v", free.Host))
+		equal(t, "An Agent's host change is listed", []interface{}{free.HostChangedUnix, free.HostChanges}, []interface{}{secondCheckin, []string{"hostname"}})
+	} else if err == nil {
+		check(t, false, "Every Agent of the team is listed", len(inventory), " Agents")
+	}
+
+	inventory, err = s.repository.AgentInventory(s.bravoID)
+	if noError(t, err, "Could not get an empty Agent inventory") {
+		equal(t, "A team without Agents has an empty inventory", inventory, []storage.AgentInventoryEntry{})
+	}
+
+	alerts, err := s.repository.ReuseAlerts()
+	if noError(t, err, "Could not get the reuse alerts") {
+		equal(t, "Reuse is counted per Agent and source", alerts, []storage.ReuseAlert{{
+			AgentUUID: s.boundUUID, TeamName: "alpha", AgentType: utils.AgentTypeSh, BoundTarget: "10.0.0.2",
+			Sources: []storage.ReuseSource{{SourceIP: "10.0.0.1", FirstSeenUnix: s.now, LastSeenUnix: secondCheckin, Checkins: 2, Policy: utils.ReusePolicyReject}},
+		}})
+	}
+}
+
+func (s *suite) checkHoldings(t *testing.T) {
+	checkins, err := s.repository.ScoredCheckins()
+	if noError(t, err, "Could not get the scored checkins") {
+		expected := []storage.ScoredCheckin{}
+		for _, checkinUnix := range []int64{s.now, s.now + 5*60} {
+			expected = append(expected, storage.ScoredCheckin{TeamID: s.alphaID, TargetIP: "10.0.0.1", AgentUUID: s.freeUUID, TimeUnix: checkinUnix, CallbackMinutes: 5, JitterPercent: 10, TargetValue: 5})
+		}
+		equal(t, "Checkins are scored oldest first", checkins, expected)
+	}
+
+	key := utils.HostHoldingKey(s.freeUUID, "10.0.0.1")
+	holdings, err := s.repository.HostHoldings()
+	if noError(t, err, "Could not get the host holdings") {
+		equal(t, "Host holdings read back as written", holdings, map[string]utils.HostHolding{key: s.holding})
+	}
+
+	replaced := s.holding
+	replaced.Points, replaced.Streak = 1, 1
+	if noError(t, s.repository.ReplaceHostHoldings(map[string]utils.HostHolding{key: replaced}), "Could not replace the host holdings") {
+		holdings, err = s.repository.HostHoldings()
+		if noError(t, err, "Could not get the replaced host holdings") {
+			equal(t, "Host holdings are replaced", holdings, map[string]utils.HostHolding{key: replaced})
+		}
+	}
+	noError(t, s.repository.ReplaceHostHoldings(map[string]utils.HostHolding{key: s.holding}), "Could not restore the host holdings")
+
+	alive := s.holding.LatestUnix
+	teamHoldings, err := s.repository.TeamHoldings(alive)
+	if noError(t, err, "Could not get the team holdings") {
+		equal(t, "Live Agents hold their targets", teamHoldings, []storage.TeamHolding{{TeamName: "alpha", TargetValue: 5, BestPoints: s.holding.Points, TotalPoints: s.holding.Points}})
+	}
+	teamHoldings, err = s.repository.TeamHoldings(s.holding.DeadAfterUnix + 1)
+	if noError(t, err, "Could not get the team holdings") {
+		equal(t, "Dead Agents hold nothing", teamHoldings, []storage.TeamHolding{})
+	}
+
+	liveAgents, err := s.repository.LiveAgents(alive)
+	if noError(t, err, "Could not get the live Agents") {
+		equal(t, "Live Agents are listed with their host", liveAgents, []storage.LiveAgent{{TeamName: "alpha", AgentType: utils.AgentTypeBinary, HostOS: "linux", HostChangedUnix: s.now + 5*60}})
+	}
+}
+
+func (s *suite) checkEvents(t *testing.T) {
+	events := []storage.CallbackEvent{
+		{TimeUnix: s.now, SourceIP: "10.0.0.1", SourcePort: 80, Listener: "127.0.0.1:444", Transport: agentconfig.TransportTLS, AgentUUID: s.freeUUID,
+			MessageType: utils.MessageCheckin, Verdict: utils.VerdictAccepted},
+		{TimeUnix: s.now + 1, SourceIP: "203.0.113.7", SourcePort: 50000, Listener: "192.0.2.10:444", Transport: agentconfig.TransportTLS, CollectorID: "dmz-1",
+			ForwardedID: "c0ffee", MessageType: utils.MessageUnknown, Verdict: utils.VerdictInvalid, Reason: "no agent UUID"},
+		{TimeUnix: s.now + 2, SourceIP: "10.0.0.1", SourcePort: 50001, Listener: "127.0.0.1:444", Transport: agentconfig.TransportTLS, AgentUUID: s.boundUUID,
+			MessageType: utils.MessageCheckin, Verdict: utils.VerdictRejected, Reason: "agent was generated for target 10.0.0.2"},
+	}
+
+	bannedUntil := time.Now().Unix() + 600
+	tx, err := s.repository.Begin()
+	if !noError(t, err, "Could not begin a transaction") {
+		return
+	}
+	for _, event := range events {
+		noError(t, tx.AddCallbackEvent(event), "Could not add a callback event")
+	}
+	noError(t, tx.RecordCallbackSource(utils.SourceChange{SourceIP: "203.0.113.7", Throttled: 2, LastThrottledUnix: s.now, InvalidPayloads: 3, Bans: 1, BannedUntilUnix: bannedUntil}, s.now),
+		"Could not record a callback source")
+	noError(t, tx.RecordCallbackSource(utils.SourceChange{SourceIP: "203.0.113.7", Throttled: 1, LastThrottledUnix: s.now - 10, InvalidPayloads: 1, BannedUntilUnix: bannedUntil}, s.now+5),
+		"Could not record a callback source again")
+	noError(t, tx.RecordCallbackSource(utils.SourceChange{SourceIP: "10.0.0.1", Throttled: 1, LastThrottledUnix: s.now}, s.now+10), "Could not record another callback source")
+	if !noError(t, tx.Commit(), "Could not commit") {
+		return
+	}
+
+	// A forwarded callback is only ever recorded once
+	tx, err = s.repository.Begin()
+	if !noError(t, err, "Could not begin a transaction") {
+		return
+	}
+	recorded, err := tx.ForwardedCallbackRecorded("c0ffee")
+	if noError(t, err, "Could not look up a forwarded callback") {
+		check(t, recorded, "A forwarded callback is found by its ID")
+	}
+	recorded, err = tx.ForwardedCallbackRecorded("decaf")
+	if noError(t, err, "Could not look up a forwarded callback") {
+		check(t, !recorded, "A forwarded callback never recorded isn't found")
+	}
+	check(t, tx.AddCallbackEvent(events[1]) != nil, "A forwarded callback can't be recorded twice")
+	noError(t, tx.Rollback(), "Could not roll back")
+	events[1].ForwardedID = "" // never read back
+
+	// The team is filled in from the Agent, the ID by the database
+	stored, err := s.repository.CallbackEvents(storage.CallbackEventFilter{}, 10)
+	if noError(t, err, "Could not get the callback events") && len(stored) == len(events) {
+		check(t, stored[0].EventID > stored[1].EventID && stored[1].EventID > stored[2].EventID, "Events are listed newest first")
+		for i, teamName := range []string{"alpha", "", "alpha"} {
+			events[i].TeamName = teamName
+			events[i].EventID = stored[len(stored)-1-i].EventID
+		}
+		equal(t, "Events read back as written", stored, []storage.CallbackEvent{events[2], events[1], events[0]})
+	} else if err == nil {
+		check(t, false, "Every event is listed", len(stored), " events")
+	}
+
+	filters := []struct {
+		description string
+		filter      storage.CallbackEventFilter
+		limit       int
+		expected    []storage.CallbackEvent
+	}{
+		{"Events are filtered by team", storage.CallbackEventFilter{TeamName: "alpha"}, 10, []storage.CallbackEvent{events[2], events[0]}},
+		{"Events are filtered by UUID prefix", storage.CallbackEventFilter{AgentUUID: s.freeUUID[:8]}, 10, []storage.CallbackEvent{events[0]}},
+		{"Events are filtered by source IP", storage.CallbackEventFilter{SourceIP: "203.0.113.7"}, 10, []storage.CallbackEvent{events[1]}},
+		{"Events are filtered by verdict", storage.CallbackEventFilter{Verdict: utils.VerdictRejected}, 10, []storage.CallbackEvent{events[2]}},
+		{"Events are limited", storage.CallbackEventFilter{}, 1, []storage.CallbackEvent{events[2]}},
+	}
+	for _, filter := range filters {
+		filtered, err := s.repository.CallbackEvents(filter.filter, filter.limit)
+		if noError(t, err, "Could not get the filtered callback events") {
+			equal(t, filter.description, filtered, filter.expected)
+		}
+	}
+
+	verdicts, err := s.repository.CountVerdicts()
+	if noError(t, err, "Could not count the verdicts") {
+		equal(t, "Verdicts are counted", verdicts, map[string]int{utils.VerdictAccepted: 1, utils.VerdictInvalid: 1, utils.VerdictRejected: 1})
+	}
+
+	sources, err := s.repository.CallbackSources(time.Now().Unix(), 10)
+	if noError(t, err, "Could not get the callback sources") {
+		equal(t, "Sources add up, banned ones first", sources, []storage.CallbackSource{
+			{SourceIP: "203.0.113.7", Throttled: 3, LastThrottledUnix: s.now, InvalidPayloads: 4, Bans: 1, BannedUntilUnix: bannedUntil, LastSeenUnix: s.now + 5},
+			{SourceIP: "10.0.0.1", InScope: true, Throttled: 1, LastThrottledUnix: s.now, LastSeenUnix: s.now + 10},
+		})
+	}
+
+	bans, err := s.repository.CallbackBans(time.Now().Unix())
+	if noError(t, err, "Could not get the callback bans") {
+		equal(t, "Banned sources are listed", bans, map[string]int64{"203.0.113.7": bannedUntil})
+	}
+	bans, err = s.repository.CallbackBans(bannedUntil)
+	if noError(t, err, "Could not get the expired callback bans") {
+		equal(t, "Expired bans aren't listed", bans, map[string]int64{})
+	}
+
+	tx, err = s.repository.Begin()
+	if noError(t, err, "Could not begin a transaction") {
+		numDeleted, err := tx.PruneCallbackEvents(s.now + 2)
+		if noError(t, err, "Could not prune the callback events") && noError(t, tx.Commit(), "Could not commit") {
+			stored, err = s.repository.CallbackEvents(storage.CallbackEventFilter{}, 10)
+			noError(t, err, "Could not get the pruned callback events")
+			equal(t, "Old events are pruned", []interface{}{numDeleted, stored}, []interface{}{int64(2), []storage.CallbackEvent{events[2]}})
+		}
+	}
+}
+
+/*
+	Several processes migrating the same empty database at once, like
+	callback servers and the site started together. A migration applied
+	twice would fail on the tables it already created, so none of them may
+	fail, and every process must end up at the latest version.
+*/
+func checkConcurrentMigrations(t *testing.T, open func() (storage.Repository, error)) {
+	const numProcesses = 4
+
+	repositories := make([]storage.Repository, numProcesses)
+	for i := range repositories {
+		repositories[i] = openScratch(t, open)
+	}
+	migrations, err := repositories[0].Migrations()
+	if !noError(t, err, "Could not read the migrations") {
+		return
+	}
+
+	var wg sync.WaitGroup
+	toVersions, errs := make([]int, numProcesses), make([]error, numProcesses)
+	for i, repository := range repositories {
+		wg.Add(1)
+		go func(i int, repository storage.Repository) {
+			defer wg.Done()
+			_, toVersions[i], errs[i] = repository.Migrate()
+		}(i, repository)
+	}
+	wg.Wait()
+
+	for i := range repositories {
+		if noError(t, errs[i], "Could not migrate alongside other processes") {
+			equal(t, "Every process ends up at the latest version", toVersions[i], len(migrations))
+		}
+	}
+
+	version, err := repositories[0].ValidateSchema()
+	if noError(t, err, "The concurrently migrated schema is invalid") {
+		equal(t, "The schema is at the latest version", version, len(migrations))
+	}
+}
+
+// Run every check against a new scratch database from `scratch`.
+func runConformance(t *testing.T, scratch scratchFunc) {
+	t.Run("concurrent migrations", func(t *testing.T) {
+		checkConcurrentMigrations(t, scratch(t))
+	})
+
+	// An hour ago, so every checkin is in the past
+	s := &suite{repository: openScratch(t, scratch(t)), now: time.Now().Unix() - 3600}
+
+	// Later checks build on earlier ones, there's no point going on once one fails
+	checks := []struct {
+		name  string
+		check func(t *testing.T)
+	}{
+		{"schema", s.checkSchema},
+		{"teams", s.checkTeams},
+		{"targets", s.checkTargets},
+		{"agents", s.checkAgents},
+		{"transactions", s.checkTransactions},
+		{"inventory", s.checkInventory},
+		{"holdings", s.checkHoldings},
+		{"events", s.checkEvents},
+	}
+	for _, check := range checks {
+		if !t.Run(check.name, check.check) {
+			return
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	t.Run(utils.DatabaseSQLite, func(t *testing.T) {
+		runConformance(t, sqliteScratch)
+	})
+
+	t.Run(utils.DatabasePostgres, func(t *testing.T) {
+		runConformance(t, postgresScratch(postgresServer(t)))
+	})
+}
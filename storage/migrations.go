@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	Schema migrations, applied in order of their version. Each backend has
+	its own directory in `migrations/`, holding a file per migration named
+	"<version>_<name>.sql", e.g. "0002_add_notes.sql". Both backends must
+	have the same migrations. Versions start at 1 and leave no gaps. A
+	migration must never change once it has been released, add another one
+	instead.
+*/
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+var (
+	ErrSchemaNewer   error = errors.New("the database was migrated by a newer version of Pwnts")
+	ErrSchemaUnknown error = errors.New("the database has a schema this version of Pwnts doesn't know")
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// The tables and their column names, as found in a database.
+type schema map[string][]string
+
+/*
+	Every embedded migration in `directory`, in order. Fails if a file is
+	misnamed or a version is missing or repeated, which can only be a
+	mistake in the build.
+*/
+func loadMigrations(directory string) (migrations []Migration, err error) {
+	filenames, err := fs.Glob(migrationFiles, directory+"/*.sql")
+	if err != nil {
+		return
+	}
+
+	for _, filename := range filenames {
+		base := strings.TrimSuffix(path.Base(filename), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, parseErr := strconv.Atoi(parts[0])
+		if len(parts) != 2 || parseErr != nil || parts[1] == "" {
+			return nil, errors.New("migration '" + filename + "' is not named \"<version>_<name>.sql\"")
+		}
+
+		contents, err := migrationFiles.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: parts[1], SQL: string(contents)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration version %d is missing or repeated", i+1)
+		}
+	}
+
+	return
+}
+
+func (store *sqlStore) Migrations() ([]Migration, error) {
+	return loadMigrations(store.dialect.migrationsDirectory())
+}
+
+// Run every statement of each migration, in order.
+func applyMigrations(q querier, migrations []Migration) error {
+	for _, migration := range migrations {
+		if _, err := q.Exec(migration.SQL); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// Run a query returning a single column of strings.
+func queryStrings(q querier, query string, args ...interface{}) (values []string, err error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer utils.Close(rows)
+
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return
+		}
+		values = append(values, value)
+	}
+	err = rows.Err()
+
+	return
+}
+
+// Every table but `schema_migrations`, by name.
+func (store *sqlStore) Tables() (tableNames []string, err error) {
+	allTableNames, err := store.dialect.tableNames(store.db)
+	for _, tableName := range allTableNames {
+		if tableName != "schema_migrations" {
+			tableNames = append(tableNames, tableName)
+		}
+	}
+	return
+}
+
+// Read the tables and their column names, leaving out `schema_migrations`.
+func readSchema(dialect dialect, q querier) (schema, error) {
+	tableNames, err := dialect.tableNames(q)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := schema{}
+	for _, tableName := range tableNames {
+		if tableName == "schema_migrations" {
+			continue
+		}
+		if tables[tableName], err = dialect.columnNames(q, tableName); err != nil {
+			return nil, err
+		}
+	}
+
+	return tables, nil
+}
+
+/*
+	The schema version the database is at, and the name of each migration
+	applied to it. A database without a `schema_migrations` table is at
+	version 0.
+*/
+func (store *sqlStore) schemaVersion(q querier) (version int, applied map[int]string, err error) {
+	applied = map[int]string{}
+
+	tableNames, err := store.dialect.tableNames(q)
+	if err != nil || !containsString(tableNames, "schema_migrations") {
+		return
+	}
+
+	migrationRows, err := q.Query("SELECT version, name FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return
+	}
+	defer utils.Close(migrationRows)
+
+	for migrationRows.Next() {
+		var dbVersion int
+		var dbName string
+		if err = migrationRows.Scan(&dbVersion, &dbName); err != nil {
+			return
+		}
+		applied[dbVersion] = dbName
+		version = dbVersion
+	}
+	err = migrationRows.Err()
+
+	return
+}
+
+/*
+	Describe every table and column that differs between the two schemas,
+	empty if they match.
+*/
+func compareSchemas(expected schema, actual schema) (differences []string) {
+	for tableName, expectedColumns := range expected {
+		actualColumns, ok := actual[tableName]
+		if !ok {
+			differences = append(differences, "missing table "+tableName)
+			continue
+		}
+
+		for _, column := range expectedColumns {
+			if !containsString(actualColumns, column) {
+				differences = append(differences, "missing column "+tableName+"."+column)
+			}
+		}
+		for _, column := range actualColumns {
+			if !containsString(expectedColumns, column) {
+				differences = append(differences, "unexpected column "+tableName+"."+column)
+			}
+		}
+	}
+	for tableName := range actual {
+		if _, ok := expected[tableName]; !ok {
+			differences = append(differences, "unexpected table "+tableName)
+		}
+	}
+
+	sort.Strings(differences)
+	return
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Check the database's tables and columns against the ones its schema
+	version should have. Fails with `ErrSchemaNewer` for a database migrated
+	by a newer version of Pwnts, and with `ErrSchemaUnknown` for migrations
+	or a schema we don't know.
+*/
+func (store *sqlStore) ValidateSchema() (version int, err error) {
+	migrations, err := store.Migrations()
+	if err != nil {
+		return
+	}
+	version, err = store.validateSchema(store.db)
+	if err != nil {
+		return
+	}
+
+	// Only the latest schema has every table the statements use
+	if version == len(migrations) {
+		err = store.prepareStatements()
+	}
+	return
+}
+
+// `ValidateSchema()`, reading the database through `q`.
+func (store *sqlStore) validateSchema(q querier) (version int, err error) {
+	migrations, err := store.Migrations()
+	if err != nil {
+		return
+	}
+
+	version, applied, err := store.schemaVersion(q)
+	if err != nil {
+		return
+	}
+	if version > len(migrations) {
+		return version, fmt.Errorf("%w (schema version %d, this one only knows up to %d)", ErrSchemaNewer, version, len(migrations))
+	}
+	for appliedVersion, name := range applied {
+		if migrations[appliedVersion-1].Name != name {
+			return version, fmt.Errorf("%w (migration %d is \"%s\", expected \"%s\")", ErrSchemaUnknown, appliedVersion, name, migrations[appliedVersion-1].Name)
+		}
+	}
+
+	expected, err := store.dialect.expectedSchema(migrations, version)
+	if err != nil {
+		return
+	}
+	actual, err := readSchema(store.dialect, q)
+	if err != nil {
+		return
+	}
+
+	if differences := compareSchemas(expected, actual); len(differences) != 0 {
+		return version, fmt.Errorf("%w at version %d: %s", ErrSchemaUnknown, version, strings.Join(differences, ", "))
+	}
+	return version, nil
+}
+
+/*
+	Bring the database up to the latest schema, applying each pending
+	migration in its own transaction along with its `schema_migrations` row,
+	so a failed migration leaves the database as it was before it. Returns
+	the schema version before and after. Processes migrating at once take
+	turns, see `lockMigrations()`.
+
+	A database created before migrations existed is adopted as version 1,
+	if its schema is exactly what the first migration creates.
+*/
+func (store *sqlStore) Migrate() (fromVersion int, toVersion int, err error) {
+	migrations, err := store.Migrations()
+	if err != nil {
+		return
+	}
+
+	fromVersion, err = store.startMigrating(migrations)
+	if err != nil {
+		return fromVersion, fromVersion, err
+	}
+
+	toVersion = fromVersion
+	for _, migration := range migrations[fromVersion:] {
+		if err = store.applyMigration(migration); err != nil {
+			return fromVersion, toVersion, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		toVersion = migration.Version
+	}
+
+	err = store.prepareStatements()
+	return
+}
+
+/*
+	Find the version to migrate from, creating `schema_migrations` or
+	adopting a database from before migrations if need be. Holds the
+	migration lock throughout, so another process's migration is never
+	seen halfway.
+*/
+func (store *sqlStore) startMigrating(migrations []Migration) (fromVersion int, err error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err = store.dialect.lockMigrations(tx); err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version	INTEGER NOT NULL,
+			name	TEXT NOT NULL,
+			applied_unix	BIGINT NOT NULL,
+			PRIMARY KEY(version)
+		)
+	`)
+	if err != nil {
+		return
+	}
+
+	fromVersion, err = store.validateSchema(tx)
+	if errors.Is(err, ErrSchemaUnknown) && fromVersion == 0 {
+		// No migrations recorded, but the tables may already be there
+		baseline, expectErr := store.dialect.expectedSchema(migrations, 1)
+		if expectErr != nil {
+			return fromVersion, expectErr
+		}
+		actual, readErr := readSchema(store.dialect, tx)
+		if readErr != nil {
+			return fromVersion, readErr
+		}
+		if differences := compareSchemas(baseline, actual); len(differences) != 0 {
+			return fromVersion, fmt.Errorf("%w, and it isn't the one from before migrations either: %s", ErrSchemaUnknown, strings.Join(differences, ", "))
+		}
+
+		_, err = tx.Exec(store.rebind("INSERT INTO schema_migrations(version, name, applied_unix) VALUES (?, ?, ?)"), 1, migrations[0].Name, time.Now().Unix())
+		if err != nil {
+			return
+		}
+		utils.Log(utils.Done, "Adopted the existing database as schema version 1")
+		fromVersion, err = 1, nil
+	}
+	if err != nil {
+		return
+	}
+
+	return fromVersion, tx.Commit()
+}
+
+// Apply a migration, unless another process got to it first.
+func (store *sqlStore) applyMigration(migration Migration) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err = store.dialect.lockMigrations(tx); err != nil {
+		return err
+	}
+
+	var numApplied int
+	err = tx.QueryRow(store.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), migration.Version).Scan(&numApplied)
+	if err != nil || numApplied != 0 {
+		return err
+	}
+
+	utils.Log(utils.Info, "Applying migration", fmt.Sprint(migration.Version), "("+migration.Name+")")
+	if _, err = tx.Exec(migration.SQL); err != nil {
+		return err
+	}
+	_, err = tx.Exec(store.rebind("INSERT INTO schema_migrations(version, name, applied_unix) VALUES (?, ?, ?)"), migration.Version, migration.Name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+	--- Startup checks ---
+*/
+
+/*
+	Check that the database is at the latest schema version, and that its
+	tables and columns are the ones that version should have.
+*/
+func Validate(repository Repository) bool {
+	utils.Log(utils.Info, "Validating database")
+
+	version, err := repository.ValidateSchema()
+	if errors.Is(err, ErrSchemaNewer) {
+		utils.Log(utils.Error, "Database is newer than this binary, please upgrade Pwnts:", err.Error())
+		return false
+	} else if errors.Is(err, ErrSchemaUnknown) && version == 0 {
+		utils.Log(utils.Error, "Database has no schema version, if it predates migrations please run `pwnts db migrate`")
+		return false
+	} else if utils.CheckError(utils.Error, err, "Database schema is invalid") {
+		return false
+	}
+
+	migrations, err := repository.Migrations()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_DATABASE_INVALID, "Could not read the embedded migrations")
+	if version == 0 {
+		utils.Log(utils.Error, "Database is empty, please run `pwnts db init` first")
+		return false
+	} else if version < len(migrations) {
+		utils.Log(utils.Error, "Database is at schema version", fmt.Sprint(version), "of", fmt.Sprint(len(migrations))+", please run `pwnts db migrate`")
+		return false
+	}
+
+	tableNames, err := repository.Tables()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Unable to query for table names")
+
+	utils.Log(utils.Info, "Printing tables:")
+	for _, tableName := range tableNames {
+		color.Yellow("\t\t\t\t\t\t" + tableName)
+	}
+
+	utils.Log(utils.Done, "Database validated at schema version", fmt.Sprint(version))
+	return true
+}
+
+/*
+	Same as `Validate(repository)`, but exit when invalid.
+*/
+func ValidateExit(repository Repository) {
+	if !Validate(repository) {
+		os.Exit(utils.ERR_DATABASE_INVALID)
+	}
+}
+
+/*
+	Apply any pending migrations, then exit unless the database is valid.
+	Used on startup, so an upgraded binary brings its database along.
+*/
+func MigrateExit(repository Repository) {
+	fromVersion, toVersion, err := repository.Migrate()
+	if errors.Is(err, ErrSchemaNewer) {
+		utils.LogPlainExit(utils.Error, utils.ERR_DATABASE_INVALID, "Database is newer than this binary, please upgrade Pwnts: "+err.Error())
+	}
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_DATABASE_INVALID, "Could not migrate the database")
+	if toVersion != fromVersion {
+		utils.Log(utils.Done, "Migrated database from schema version", fmt.Sprint(fromVersion), "to", fmt.Sprint(toVersion))
+	}
+
+	ValidateExit(repository)
+}
@@ -0,0 +1,119 @@
+-- The same schema as `migrations/sqlite/0001_initial.sql`. Identifiers are
+-- left unquoted so PostgreSQL folds them to lower case, which lets the
+-- queries spell them the same way for both backends.
+
+CREATE TABLE Teams (
+	team_id	SERIAL PRIMARY KEY,
+	name	TEXT NOT NULL UNIQUE,
+	password_hash	TEXT NOT NULL,
+	created_date_unix	BIGINT NOT NULL
+);
+
+CREATE TABLE TargetsInScope (
+	target_ipv4_address	TEXT PRIMARY KEY,
+	value	INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE TABLE Agents (
+	agent_uuid	TEXT PRIMARY KEY,
+	team_id	INTEGER NOT NULL REFERENCES Teams(team_id),
+	server_private_key	TEXT NOT NULL UNIQUE,
+	agent_public_key	TEXT NOT NULL UNIQUE,
+	created_date_unix	BIGINT NOT NULL,
+	root_date_unix	BIGINT,
+	agent_type	TEXT NOT NULL DEFAULT 'binary',
+	callback_minutes	INTEGER NOT NULL DEFAULT 0,
+	jitter_percent	INTEGER NOT NULL DEFAULT 0,
+	local_port	INTEGER NOT NULL DEFAULT 0,
+	platform	TEXT NOT NULL DEFAULT '',
+	bound_target_ipv4_address	TEXT NOT NULL DEFAULT '',
+	target_locked	BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE AgentCheckins (
+	agent_uuid	TEXT NOT NULL REFERENCES Agents(agent_uuid),
+	target_ipv4_address	TEXT NOT NULL REFERENCES TargetsInScope(target_ipv4_address) ON UPDATE CASCADE,
+	time_unix	BIGINT NOT NULL,
+	PRIMARY KEY(agent_uuid, target_ipv4_address, time_unix)
+);
+
+CREATE TABLE AgentFingerprints (
+	agent_uuid	TEXT PRIMARY KEY REFERENCES Agents(agent_uuid),
+	hostname	TEXT NOT NULL DEFAULT '',
+	os	TEXT NOT NULL DEFAULT '',
+	os_version	TEXT NOT NULL DEFAULT '',
+	arch	TEXT NOT NULL DEFAULT '',
+	machine_id	TEXT NOT NULL DEFAULT '',
+	username	TEXT NOT NULL DEFAULT '',
+	ip_addresses	TEXT NOT NULL DEFAULT '',
+	pid	INTEGER NOT NULL DEFAULT 0,
+	first_seen_unix	BIGINT NOT NULL,
+	last_seen_unix	BIGINT NOT NULL,
+	changed_date_unix	BIGINT NOT NULL DEFAULT 0,
+	changed_fields	TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE AgentReuse (
+	agent_uuid	TEXT NOT NULL REFERENCES Agents(agent_uuid),
+	source_ipv4_address	TEXT NOT NULL,
+	first_seen_unix	BIGINT NOT NULL,
+	last_seen_unix	BIGINT NOT NULL,
+	checkins	INTEGER NOT NULL DEFAULT 1,
+	policy	TEXT NOT NULL,
+	PRIMARY KEY(agent_uuid, source_ipv4_address)
+);
+
+CREATE TABLE CallbackEvents (
+	event_id	BIGSERIAL PRIMARY KEY,
+	time_unix	BIGINT NOT NULL,
+	source_ipv4_address	TEXT NOT NULL,
+	source_port	INTEGER NOT NULL,
+	listener_address	TEXT NOT NULL,
+	transport	TEXT NOT NULL,
+	agent_uuid	TEXT NOT NULL DEFAULT '',
+	message_type	TEXT NOT NULL,
+	verdict	TEXT NOT NULL,
+	reason	TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX CallbackEventsByTime ON CallbackEvents (time_unix);
+
+CREATE TABLE CallbackSources (
+	source_ipv4_address	TEXT PRIMARY KEY,
+	throttled	INTEGER NOT NULL DEFAULT 0,
+	last_throttled_unix	BIGINT NOT NULL DEFAULT 0,
+	invalid_payloads	INTEGER NOT NULL DEFAULT 0,
+	bans	INTEGER NOT NULL DEFAULT 0,
+	banned_until_unix	BIGINT NOT NULL DEFAULT 0,
+	last_seen_unix	BIGINT NOT NULL
+);
+
+CREATE TABLE CheckinFingerprints (
+	agent_uuid	TEXT NOT NULL,
+	target_ipv4_address	TEXT NOT NULL,
+	time_unix	BIGINT NOT NULL,
+	hostname	TEXT NOT NULL DEFAULT '',
+	os	TEXT NOT NULL DEFAULT '',
+	os_version	TEXT NOT NULL DEFAULT '',
+	arch	TEXT NOT NULL DEFAULT '',
+	machine_id	TEXT NOT NULL DEFAULT '',
+	username	TEXT NOT NULL DEFAULT '',
+	ip_addresses	TEXT NOT NULL DEFAULT '',
+	pid	INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY(agent_uuid, target_ipv4_address, time_unix),
+	FOREIGN KEY(agent_uuid, target_ipv4_address, time_unix) REFERENCES AgentCheckins(agent_uuid, target_ipv4_address, time_unix)
+);
+
+CREATE TABLE HostHoldings (
+	team_id	INTEGER NOT NULL REFERENCES Teams(team_id),
+	target_ipv4_address	TEXT NOT NULL REFERENCES TargetsInScope(target_ipv4_address) ON UPDATE CASCADE,
+	agent_uuid	TEXT NOT NULL REFERENCES Agents(agent_uuid),
+	latest_checkin_unix	BIGINT NOT NULL,
+	previous_checkin_unix	BIGINT NOT NULL DEFAULT 0,
+	points	INTEGER NOT NULL,
+	streak	INTEGER NOT NULL DEFAULT 1,
+	dead_after_unix	BIGINT NOT NULL,
+	PRIMARY KEY(agent_uuid, target_ipv4_address)
+);
+
+CREATE INDEX HostHoldingsByTeamAndTarget ON HostHoldings (team_id, target_ipv4_address);
@@ -0,0 +1,3 @@
+-- The collector that received a callback, empty if it arrived directly.
+
+ALTER TABLE CallbackEvents ADD COLUMN collector_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- The ID a collector gave a forwarded callback, so it's only recorded once
+-- however often it's sent. NULL if the callback arrived directly.
+
+ALTER TABLE CallbackEvents ADD COLUMN forwarded_id TEXT;
+CREATE UNIQUE INDEX CallbackEventsByForwardedID ON CallbackEvents (forwarded_id);
@@ -0,0 +1,131 @@
+-- The schema as it was before migrations, created by `create_tables.sql`.
+
+CREATE TABLE "AgentCheckins" (
+	"agent_uuid"	TEXT NOT NULL,
+	"target_ipv4_address"	TEXT NOT NULL,
+	"time_unix"	INTEGER NOT NULL,
+	PRIMARY KEY("agent_uuid","target_ipv4_address","time_unix"),
+	FOREIGN KEY("agent_uuid") REFERENCES "Agents"("agent_uuid"),
+	FOREIGN KEY("target_ipv4_address") REFERENCES "TargetsInScope"("target_ipv4_address") ON UPDATE CASCADE
+);
+
+CREATE TABLE "AgentFingerprints" (
+	"agent_uuid"	TEXT NOT NULL UNIQUE,
+	"hostname"	TEXT NOT NULL DEFAULT '',
+	"os"	TEXT NOT NULL DEFAULT '',
+	"os_version"	TEXT NOT NULL DEFAULT '',
+	"arch"	TEXT NOT NULL DEFAULT '',
+	"machine_id"	TEXT NOT NULL DEFAULT '',
+	"username"	TEXT NOT NULL DEFAULT '',
+	"ip_addresses"	TEXT NOT NULL DEFAULT '',
+	"pid"	INTEGER NOT NULL DEFAULT 0,
+	"first_seen_unix"	INTEGER NOT NULL,
+	"last_seen_unix"	INTEGER NOT NULL,
+	"changed_date_unix"	INTEGER NOT NULL DEFAULT 0,
+	"changed_fields"	TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY("agent_uuid") REFERENCES "Agents"("agent_uuid"),
+	PRIMARY KEY("agent_uuid")
+);
+
+CREATE TABLE "AgentReuse" (
+	"agent_uuid"	TEXT NOT NULL,
+	"source_ipv4_address"	TEXT NOT NULL,
+	"first_seen_unix"	INTEGER NOT NULL,
+	"last_seen_unix"	INTEGER NOT NULL,
+	"checkins"	INTEGER NOT NULL DEFAULT 1,
+	"policy"	TEXT NOT NULL,
+	PRIMARY KEY("agent_uuid","source_ipv4_address"),
+	FOREIGN KEY("agent_uuid") REFERENCES "Agents"("agent_uuid")
+);
+
+CREATE TABLE "Agents" (
+	"agent_uuid"	TEXT NOT NULL UNIQUE,
+	"team_id"	INTEGER NOT NULL,
+	"server_private_key"	TEXT NOT NULL UNIQUE,
+	"agent_public_key"	TEXT NOT NULL UNIQUE,
+	"created_date_unix"	INTEGER NOT NULL,
+	"root_date_unix"	INTEGER,
+	"agent_type"	TEXT NOT NULL DEFAULT 'binary',
+	"callback_minutes"	INTEGER NOT NULL DEFAULT 0,
+	"jitter_percent"	INTEGER NOT NULL DEFAULT 0,
+	"local_port"	INTEGER NOT NULL DEFAULT 0,
+	"platform"	TEXT NOT NULL DEFAULT '',
+	"bound_target_ipv4_address"	TEXT NOT NULL DEFAULT '',
+	"target_locked"	INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY("team_id") REFERENCES "Teams"("team_id"),
+	PRIMARY KEY("agent_uuid")
+);
+
+CREATE TABLE "CallbackEvents" (
+	"event_id"	INTEGER NOT NULL UNIQUE,
+	"time_unix"	INTEGER NOT NULL,
+	"source_ipv4_address"	TEXT NOT NULL,
+	"source_port"	INTEGER NOT NULL,
+	"listener_address"	TEXT NOT NULL,
+	"transport"	TEXT NOT NULL,
+	"agent_uuid"	TEXT NOT NULL DEFAULT '',
+	"message_type"	TEXT NOT NULL,
+	"verdict"	TEXT NOT NULL,
+	"reason"	TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY("event_id" AUTOINCREMENT)
+);
+
+CREATE INDEX "CallbackEventsByTime" ON "CallbackEvents" ("time_unix");
+
+CREATE TABLE "CallbackSources" (
+	"source_ipv4_address"	TEXT NOT NULL UNIQUE,
+	"throttled"	INTEGER NOT NULL DEFAULT 0,
+	"last_throttled_unix"	INTEGER NOT NULL DEFAULT 0,
+	"invalid_payloads"	INTEGER NOT NULL DEFAULT 0,
+	"bans"	INTEGER NOT NULL DEFAULT 0,
+	"banned_until_unix"	INTEGER NOT NULL DEFAULT 0,
+	"last_seen_unix"	INTEGER NOT NULL,
+	PRIMARY KEY("source_ipv4_address")
+);
+
+CREATE TABLE "CheckinFingerprints" (
+	"agent_uuid"	TEXT NOT NULL,
+	"target_ipv4_address"	TEXT NOT NULL,
+	"time_unix"	INTEGER NOT NULL,
+	"hostname"	TEXT NOT NULL DEFAULT '',
+	"os"	TEXT NOT NULL DEFAULT '',
+	"os_version"	TEXT NOT NULL DEFAULT '',
+	"arch"	TEXT NOT NULL DEFAULT '',
+	"machine_id"	TEXT NOT NULL DEFAULT '',
+	"username"	TEXT NOT NULL DEFAULT '',
+	"ip_addresses"	TEXT NOT NULL DEFAULT '',
+	"pid"	INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY("agent_uuid","target_ipv4_address","time_unix"),
+	FOREIGN KEY("agent_uuid","target_ipv4_address","time_unix") REFERENCES "AgentCheckins"("agent_uuid","target_ipv4_address","time_unix")
+);
+
+CREATE TABLE "HostHoldings" (
+	"team_id"	INTEGER NOT NULL,
+	"target_ipv4_address"	TEXT NOT NULL,
+	"agent_uuid"	TEXT NOT NULL,
+	"latest_checkin_unix"	INTEGER NOT NULL,
+	"previous_checkin_unix"	INTEGER NOT NULL DEFAULT 0,
+	"points"	INTEGER NOT NULL,
+	"streak"	INTEGER NOT NULL DEFAULT 1,
+	"dead_after_unix"	INTEGER NOT NULL,
+	PRIMARY KEY("agent_uuid","target_ipv4_address"),
+	FOREIGN KEY("team_id") REFERENCES "Teams"("team_id"),
+	FOREIGN KEY("agent_uuid") REFERENCES "Agents"("agent_uuid"),
+	FOREIGN KEY("target_ipv4_address") REFERENCES "TargetsInScope"("target_ipv4_address") ON UPDATE CASCADE
+);
+
+CREATE INDEX "HostHoldingsByTeamAndTarget" ON "HostHoldings" ("team_id", "target_ipv4_address");
+
+CREATE TABLE "TargetsInScope" (
+	"target_ipv4_address"	TEXT NOT NULL UNIQUE,
+	"value"	INTEGER NOT NULL DEFAULT 1,
+	PRIMARY KEY("target_ipv4_address")
+);
+
+CREATE TABLE "Teams" (
+	"team_id"	INTEGER	NOT NULL UNIQUE,
+	"name"	TEXT NOT NULL UNIQUE,
+	"password_hash"	TEXT NOT NULL,
+	"created_date_unix"	INTEGER NOT NULL,
+	PRIMARY KEY("team_id" AUTOINCREMENT)
+);
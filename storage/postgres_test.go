@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	--- PostgreSQL for the tests ---
+	: The server `PWNTS_POSTGRES_URL` names, or else a throwaway `postgres`
+	  container if Docker is available. Without either the PostgreSQL
+	  checks are skipped, unless `PWNTS_REQUIRE_POSTGRES` is set, as CI
+	  does (see `.github/workflows/test.yml`), which fails them instead.
+*/
+
+const (
+	postgresURLVariable     string = "PWNTS_POSTGRES_URL"
+	requirePostgresVariable string = "PWNTS_REQUIRE_POSTGRES"
+	postgresImage           string = "postgres:15"
+)
+
+// The URL of a PostgreSQL server for the test, skipping it if there's none.
+func postgresServer(t *testing.T) string {
+	t.Helper()
+
+	if url := os.Getenv(postgresURLVariable); url != "" {
+		return url
+	}
+
+	url, err := startPostgresContainer(t)
+	if err == nil {
+		return url
+	}
+	if os.Getenv(requirePostgresVariable) != "" {
+		t.Fatalf("No %s given, and could not start a PostgreSQL container: %v", postgresURLVariable, err)
+	}
+	t.Skipf("No %s given, and could not start a PostgreSQL container (%v), skipped the postgres backend", postgresURLVariable, err)
+	return ""
+}
+
+/*
+	Start a PostgreSQL container on a free port of the loopback interface,
+	removed once the test is done, and wait for it to accept connections.
+*/
+func startPostgresContainer(t *testing.T) (url string, err error) {
+	if _, err = exec.LookPath("docker"); err != nil {
+		return
+	}
+
+	output, err := exec.Command("docker", "run", "--detach", "--rm", "--env", "POSTGRES_PASSWORD=pwnts", "--publish", "127.0.0.1::5432", postgresImage).Output()
+	if err != nil {
+		return "", fmt.Errorf("docker run: %w", err)
+	}
+	containerID := strings.TrimSpace(string(output))
+	t.Cleanup(func() {
+		if err := exec.Command("docker", "stop", containerID).Run(); err != nil {
+			t.Errorf("Could not stop the PostgreSQL container %s: %v", containerID, err)
+		}
+	})
+
+	output, err = exec.Command("docker", "port", containerID, "5432/tcp").Output()
+	if err != nil {
+		return "", fmt.Errorf("docker port: %w", err)
+	}
+	address := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	url = "postgres://postgres:pwnts@" + address + "/postgres?sslmode=disable"
+
+	// The server restarts once it has initialized the database, but only listens on TCP after that
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return
+	}
+	defer utils.Close(db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for {
+		if err = db.PingContext(ctx); err == nil {
+			return url, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("PostgreSQL container never accepted connections: %w", err)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func postgresScratch(url string) scratchFunc {
+	return func(t *testing.T) func() (storage.Repository, error) {
+		scratchURL, drop, err := createPostgresScratch(url)
+		if err != nil {
+			t.Fatalf("Could not create a scratch PostgreSQL schema: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := drop(); err != nil {
+				t.Errorf("Could not drop the scratch PostgreSQL schema: %v", err)
+			}
+		})
+		return func() (storage.Repository, error) {
+			return storage.OpenPostgres(scratchURL)
+		}
+	}
+}
+
+/*
+	Create a new, empty schema in the PostgreSQL database at `url`, which
+	must be a "postgres://" URL, and return a URL that only sees it. `drop`
+	drops the schema with everything in it, once every store opened on it
+	is closed.
+*/
+func createPostgresScratch(url string) (scratchURL string, drop func() error, err error) {
+	parsedURL, err := neturl.Parse(url)
+	if err != nil {
+		return "", nil, err
+	}
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		return "", nil, err
+	}
+
+	schemaName := fmt.Sprintf("pwnts_scratch_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schemaName); err != nil {
+		utils.Close(admin)
+		return "", nil, err
+	}
+	drop = func() error {
+		defer utils.Close(admin)
+		_, err := admin.Exec("DROP SCHEMA " + schemaName + " CASCADE")
+		return err
+	}
+
+	// Every connection only sees the scratch schema
+	query := parsedURL.Query()
+	query.Set("search_path", schemaName)
+	parsedURL.RawQuery = query.Encode()
+	return parsedURL.String(), drop, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	Register a new Team by its name and password hash, unless the name is
+	too long or too similar to an existing team's.
+*/
+func RegisterTeam(repository Repository, teamName string, teamPasswordHash string) error {
+	utils.Log(utils.List, "Registering new Team")
+
+	var err error
+
+	// Check that team name <= maxTeamNameLength
+	if len(teamName) > utils.MaxTeamNameLength {
+		return errors.New("error registering team: team name can't be longer than " + fmt.Sprint(utils.MaxTeamNameLength) + " characters")
+	}
+
+	// Check that new team name doesn't match pre-existing team name, stripping special characters for the comparison
+	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		return err
+	}
+
+	dbTeams, err := repository.ListTeams()
+	if err != nil {
+		return err
+	}
+	for _, dbTeam := range dbTeams {
+		if strings.EqualFold(reg.ReplaceAllLiteralString(teamName, ""), reg.ReplaceAllLiteralString(dbTeam.Name, "")) {
+			return errors.New("error registering team: new team name is too similar to a pre-existing team name")
+		}
+	}
+
+	// Register Team
+	newTeamID, err := repository.AddTeam(teamName, teamPasswordHash, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	utils.Log(utils.Done, fmt.Sprintf("Team '%s' (ID: %d) has been registered", teamName, newTeamID))
+	return nil
+}
+
+/*
+	Register a new Agent, unless its registration is invalid or its target
+	isn't in scope.
+*/
+func RegisterAgent(repository Repository, agent utils.AgentRegistration) error {
+	utils.Log(utils.Info, "Registering Agent", agent.AgentUUID, "("+agent.AgentType+")")
+
+	// Check if the provided string is a valid UUID format
+	if _, err := uuid.Parse(agent.AgentUUID); err != nil {
+		return errors.New("error registering agent: '" + agent.AgentUUID + "' is not a valid UUID")
+	}
+
+	if !utils.IsAgentType(agent.AgentType) {
+		return errors.New("error registering agent: unknown agent type '" + agent.AgentType + "', must be one of: " + strings.Join(utils.AgentTypes, ", "))
+	}
+
+	if agent.CallbackMinutes < 0 || agent.CallbackMinutes > int(utils.MaxCallbackTime/time.Minute) || agent.JitterPercent < 0 || agent.JitterPercent > 100 {
+		return errors.New("error registering agent: invalid callback frequency or jitter")
+	}
+
+	if agent.LocalPort < 0 || agent.LocalPort > 65535 {
+		return errors.New("error registering agent: invalid local port")
+	}
+
+	// An Agent generated for a target is bound to it from the start
+	if agent.TargetIP != "" {
+		_, err := repository.GetTarget(agent.TargetIP)
+		if errors.Is(err, ErrNotFound) {
+			return errors.New("error registering agent: target '" + agent.TargetIP + "' is not in scope")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	err := repository.AddAgent(agent, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	// Count total Agents
+	numAgents, err := repository.CountAgents()
+	if err != nil {
+		return err
+	}
+
+	utils.Log(utils.Done, "\tRegistered Agent", agent.AgentUUID)
+	utils.Log(utils.Done, "\tThere are now", fmt.Sprint(numAgents), "registered Agents")
+	return nil
+}
@@ -0,0 +1,1018 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/agent/fingerprint"
+	"github.com/s-christian/pwnts/utils"
+)
+
+/*
+	What differs between the backends. Everything else is plain SQL shared
+	by both in `sqlStore`, written with "?" placeholders.
+*/
+type dialect interface {
+	Backend() string
+	placeholder(n int) string // the n-th (from 1) placeholder of a query
+	migrationsDirectory() string
+
+	// Schema introspection, leaving out the backend's own tables, see `migrations.go`
+	tableNames(q querier) ([]string, error)
+	columnNames(q querier, tableName string) ([]string, error)
+	expectedSchema(migrations []Migration, version int) (schema, error)
+	lockMigrations(tx *sql.Tx) error // keep two processes from migrating at once
+}
+
+// Either a *sql.DB or a *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+/*
+	The `Repository` both backends share. Every statement is prepared once,
+	as soon as the schema is known to be current (see `ValidateSchema()`
+	and `Migrate()`, run right after opening the database), and kept until
+	`close()`. Transactions use them through `Tx.Stmt()`.
+*/
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+
+	statementsMutex sync.RWMutex
+	statements      map[string]*sql.Stmt // by query, as written with "?" placeholders
+}
+
+// Every query the repository runs, prepared by `prepareStatements()`.
+var statementQueries []string = []string{
+	addTeamSQL,
+	getTeamSQL,
+	getTeamByNameSQL,
+	listTeamsSQL,
+	addTargetSQL,
+	getTargetSQL,
+	listTargetsSQL,
+	addAgentSQL,
+	getAgentSQL,
+	countAgentsSQL,
+	agentInventorySQL,
+	reuseAlertsSQL,
+	countCheckinsSQL,
+	scoredCheckinsSQL,
+	saveHostHoldingSQL,
+	hostHoldingsSQL,
+	teamHoldingsSQL,
+	liveAgentsSQL,
+	callbackEventsSQL,
+	countVerdictsSQL,
+	callbackSourcesSQL,
+	callbackBansSQL,
+	bindAgentToTargetSQL,
+	getBoundTargetSQL,
+	addCheckinSQL,
+	setAgentRootDateSQL,
+	recordAgentReuseSQL,
+	addCheckinFingerprintSQL,
+	getAgentFingerprintSQL,
+	saveAgentFingerprintSQL,
+	flagAgentFingerprintSQL,
+	getHostHoldingSQL,
+	addCallbackEventSQL,
+	forwardedCallbackRecordedSQL,
+	pruneCallbackEventsSQL,
+	recordCallbackSourceSQL,
+}
+
+var errNotPrepared error = errors.New("database statements are not prepared yet, the schema must be validated or migrated first")
+
+func newSQLStore(db *sql.DB, dialect dialect) *sqlStore {
+	return &sqlStore{db: db, dialect: dialect, statements: map[string]*sql.Stmt{}}
+}
+
+// Replace the "?" placeholders of a query with the dialect's.
+func (store *sqlStore) rebind(query string) string {
+	if store.dialect.placeholder(1) == "?" {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, character := range query {
+		if character == '?' {
+			n++
+			rebound.WriteString(store.dialect.placeholder(n))
+		} else {
+			rebound.WriteRune(character)
+		}
+	}
+	return rebound.String()
+}
+
+/*
+	Prepare every statement in `statementQueries`, replacing any prepared
+	before. Nothing is replaced if one of them can't be.
+*/
+func (store *sqlStore) prepareStatements() error {
+	statements := make(map[string]*sql.Stmt, len(statementQueries))
+	for _, query := range statementQueries {
+		statement, err := store.db.Prepare(store.rebind(query))
+		if err != nil {
+			for _, prepared := range statements {
+				utils.Close(prepared)
+			}
+			return fmt.Errorf("could not prepare statement: %w", err)
+		}
+		statements[query] = statement
+	}
+
+	store.statementsMutex.Lock()
+	oldStatements := store.statements
+	store.statements = statements
+	store.statementsMutex.Unlock()
+
+	for _, statement := range oldStatements {
+		utils.Close(statement)
+	}
+	return nil
+}
+
+func (store *sqlStore) statement(query string) (*sql.Stmt, error) {
+	store.statementsMutex.RLock()
+	defer store.statementsMutex.RUnlock()
+
+	statement, ok := store.statements[query]
+	if !ok {
+		return nil, errNotPrepared
+	}
+	return statement, nil
+}
+
+func (store *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	statement, err := store.statement(query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.Exec(args...)
+}
+
+func (store *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	statement, err := store.statement(query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.Query(args...)
+}
+
+// Scan a single row, `ErrNotFound` if there is none.
+func (store *sqlStore) queryRow(query string, args []interface{}, destinations ...interface{}) error {
+	statement, err := store.statement(query)
+	if err != nil {
+		return err
+	}
+	return notFound(statement.QueryRow(args...).Scan(destinations...))
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (store *sqlStore) close() error {
+	store.statementsMutex.Lock()
+	for _, statement := range store.statements {
+		utils.Close(statement)
+	}
+	store.statements = map[string]*sql.Stmt{}
+	store.statementsMutex.Unlock()
+
+	return store.db.Close()
+}
+
+/*
+	--- Teams ---
+*/
+
+const addTeamSQL string = `
+	INSERT INTO Teams(name, password_hash, created_date_unix)
+	VALUES (?, ?, ?)
+	RETURNING team_id
+`
+
+func (store *sqlStore) AddTeam(name string, passwordHash string, createdUnix int64) (teamID int, err error) {
+	err = store.queryRow(addTeamSQL, []interface{}{name, passwordHash, createdUnix}, &teamID)
+	return
+}
+
+const getTeamSQL string = `
+	SELECT team_id, name, password_hash, created_date_unix
+	FROM Teams
+	WHERE team_id = ?
+`
+
+func (store *sqlStore) GetTeam(teamID int) (team Team, err error) {
+	err = store.queryRow(getTeamSQL, []interface{}{teamID}, &team.TeamID, &team.Name, &team.PasswordHash, &team.CreatedUnix)
+	return
+}
+
+const getTeamByNameSQL string = `
+	SELECT team_id, name, password_hash, created_date_unix
+	FROM Teams
+	WHERE name = ?
+`
+
+func (store *sqlStore) GetTeamByName(name string) (team Team, err error) {
+	err = store.queryRow(getTeamByNameSQL, []interface{}{name}, &team.TeamID, &team.Name, &team.PasswordHash, &team.CreatedUnix)
+	return
+}
+
+const listTeamsSQL string = `
+	SELECT team_id, name, password_hash, created_date_unix
+	FROM Teams
+	ORDER BY team_id
+`
+
+func (store *sqlStore) ListTeams() (teams []Team, err error) {
+	teamsRows, err := store.query(listTeamsSQL)
+	if err != nil {
+		return
+	}
+	defer utils.Close(teamsRows)
+
+	teams = []Team{}
+	for teamsRows.Next() {
+		var team Team
+		if err = teamsRows.Scan(&team.TeamID, &team.Name, &team.PasswordHash, &team.CreatedUnix); err != nil {
+			return
+		}
+		teams = append(teams, team)
+	}
+	err = teamsRows.Err()
+
+	return
+}
+
+/*
+	--- Targets ---
+*/
+
+const addTargetSQL string = `
+	INSERT INTO TargetsInScope(target_ipv4_address, value)
+	VALUES (?, ?)
+`
+
+func (store *sqlStore) AddTarget(target Target) error {
+	_, err := store.exec(addTargetSQL, target.IP, target.Value)
+	return err
+}
+
+const getTargetSQL string = `
+	SELECT target_ipv4_address, value
+	FROM TargetsInScope
+	WHERE target_ipv4_address = ?
+`
+
+func (store *sqlStore) GetTarget(targetIP string) (target Target, err error) {
+	err = store.queryRow(getTargetSQL, []interface{}{targetIP}, &target.IP, &target.Value)
+	return
+}
+
+const listTargetsSQL string = `
+	SELECT target_ipv4_address, value
+	FROM TargetsInScope
+	ORDER BY target_ipv4_address
+`
+
+func (store *sqlStore) ListTargets() (targets []Target, err error) {
+	targetsRows, err := store.query(listTargetsSQL)
+	if err != nil {
+		return
+	}
+	defer utils.Close(targetsRows)
+
+	targets = []Target{}
+	for targetsRows.Next() {
+		var target Target
+		if err = targetsRows.Scan(&target.IP, &target.Value); err != nil {
+			return
+		}
+		targets = append(targets, target)
+	}
+	err = targetsRows.Err()
+
+	return
+}
+
+/*
+	--- Agents ---
+*/
+
+const addAgentSQL string = `
+	INSERT INTO Agents(agent_uuid, team_id, server_private_key, agent_public_key, created_date_unix, root_date_unix, agent_type, callback_minutes, jitter_percent, local_port, platform,
+		bound_target_ipv4_address, target_locked)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+func (store *sqlStore) AddAgent(agent utils.AgentRegistration, createdUnix int64) error {
+	// TODO: Randomly generate this crypto keypair
+	// Temporary random values to satisfy the unique constraint, random
+	// numbers below 1000 collided once there were a few dozen Agents
+	// TODO: Actually use the crypto keypair. The field currently only exists
+	// for future use and is not yet used. Should be used for encrypting
+	// communications.
+	serverPrivateKey := uuid.NewString()
+	agentPublicKey := uuid.NewString()
+
+	rootDate := 0 // no agents have root status until proven by their first callback
+
+	_, err := store.exec(addAgentSQL, agent.AgentUUID, agent.TeamID, serverPrivateKey, agentPublicKey, createdUnix, rootDate, agent.AgentType, agent.CallbackMinutes, agent.JitterPercent, agent.LocalPort, agent.Platform,
+		agent.TargetIP, agent.TargetIP != "")
+	return err
+}
+
+const getAgentSQL string = `
+	SELECT agent_uuid, team_id, agent_type, created_date_unix, COALESCE(root_date_unix, 0), callback_minutes, jitter_percent, local_port, platform,
+		bound_target_ipv4_address, target_locked
+	FROM Agents
+	WHERE agent_uuid = ?
+`
+
+func (store *sqlStore) GetAgent(agentUUID string) (agent Agent, err error) {
+	err = store.queryRow(getAgentSQL, []interface{}{agentUUID}, &agent.AgentUUID, &agent.TeamID, &agent.AgentType, &agent.CreatedUnix, &agent.RootDateUnix, &agent.CallbackMinutes, &agent.JitterPercent,
+		&agent.LocalPort, &agent.Platform, &agent.BoundTarget, &agent.TargetLocked)
+	return
+}
+
+const countAgentsSQL string = "SELECT COUNT(*) FROM Agents"
+
+func (store *sqlStore) CountAgents() (numAgents int, err error) {
+	err = store.queryRow(countAgentsSQL, nil, &numAgents)
+	return
+}
+
+const agentInventorySQL string = `
+	SELECT Agents.agent_uuid, Agents.agent_type, Agents.created_date_unix, Agents.bound_target_ipv4_address, Agents.target_locked,
+		COALESCE(LastCheckins.time_unix, 0), COALESCE(LastCheckins.target_ipv4_address, ''),
+		AgentFingerprints.hostname, AgentFingerprints.os, AgentFingerprints.os_version, AgentFingerprints.arch, AgentFingerprints.machine_id,
+		AgentFingerprints.username, AgentFingerprints.ip_addresses, AgentFingerprints.pid, AgentFingerprints.changed_date_unix, AgentFingerprints.changed_fields
+	FROM Agents
+	LEFT JOIN (
+		SELECT agent_uuid, target_ipv4_address, time_unix, row_number() OVER (PARTITION BY agent_uuid ORDER BY time_unix DESC) AS checkin_order
+		FROM AgentCheckins
+	) AS LastCheckins
+	ON Agents.agent_uuid = LastCheckins.agent_uuid AND LastCheckins.checkin_order = 1
+	LEFT JOIN AgentFingerprints
+	ON Agents.agent_uuid = AgentFingerprints.agent_uuid
+	WHERE Agents.team_id = ?
+	ORDER BY Agents.created_date_unix DESC
+`
+
+/*
+	Every Agent registered to a team along with its most recent checkin and
+	host fingerprint, newest Agents first.
+*/
+func (store *sqlStore) AgentInventory(teamID int) (inventory []AgentInventoryEntry, err error) {
+	agentInventoryRows, err := store.query(agentInventorySQL, teamID)
+	if err != nil {
+		return
+	}
+	defer utils.Close(agentInventoryRows)
+
+	inventory = []AgentInventoryEntry{}
+	for agentInventoryRows.Next() {
+		var (
+			entry                                                  AgentInventoryEntry
+			hostname, hostOS, osVersion, arch, machineID, username sql.NullString
+			ipAddresses, changedFields                             sql.NullString
+			pid, changedDateUnix                                   sql.NullInt64
+		)
+		err = agentInventoryRows.Scan(&entry.AgentUUID, &entry.AgentType, &entry.CreatedUnix, &entry.TargetIP, &entry.TargetLocked, &entry.LastCheckinUnix, &entry.LastTargetIP,
+			&hostname, &hostOS, &osVersion, &arch, &machineID, &username, &ipAddresses, &pid, &changedDateUnix, &changedFields)
+		if err != nil {
+			return
+		}
+
+		// NULL if the Agent has never sent a fingerprint
+		if hostname.Valid {
+			entry.Host = &fingerprint.Fingerprint{
+				Hostname:  hostname.String,
+				OS:        hostOS.String,
+				OSVersion: osVersion.String,
+				Arch:      arch.String,
+				MachineID: machineID.String,
+				User:      username.String,
+				IPs:       splitNonEmpty(ipAddresses.String),
+				PID:       int(pid.Int64),
+			}
+			entry.HostChangedUnix = changedDateUnix.Int64
+			entry.HostChanges = splitNonEmpty(changedFields.String)
+		}
+
+		inventory = append(inventory, entry)
+	}
+	err = agentInventoryRows.Err()
+
+	return
+}
+
+// Split a comma-separated column, empty if the column is.
+func splitNonEmpty(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+const reuseAlertsSQL string = `
+	SELECT AgentReuse.agent_uuid, Teams.name, Agents.agent_type, Agents.bound_target_ipv4_address,
+		AgentReuse.source_ipv4_address, AgentReuse.first_seen_unix, AgentReuse.last_seen_unix, AgentReuse.checkins, AgentReuse.policy
+	FROM AgentReuse
+	JOIN Agents
+	ON AgentReuse.agent_uuid = Agents.agent_uuid
+	JOIN Teams
+	ON Agents.team_id = Teams.team_id
+	ORDER BY MAX(AgentReuse.last_seen_unix) OVER (PARTITION BY AgentReuse.agent_uuid) DESC, AgentReuse.agent_uuid, AgentReuse.last_seen_unix DESC
+`
+
+/*
+	Every Agent suspected of having its binary copied to other hosts, most
+	recently seen first.
+*/
+func (store *sqlStore) ReuseAlerts() (alerts []ReuseAlert, err error) {
+	reuseAlertsRows, err := store.query(reuseAlertsSQL)
+	if err != nil {
+		return
+	}
+	defer utils.Close(reuseAlertsRows)
+
+	// Rows are grouped by Agent, start a new alert whenever the Agent changes
+	alerts = []ReuseAlert{}
+	for reuseAlertsRows.Next() {
+		var alert ReuseAlert
+		var source ReuseSource
+		err = reuseAlertsRows.Scan(&alert.AgentUUID, &alert.TeamName, &alert.AgentType, &alert.BoundTarget,
+			&source.SourceIP, &source.FirstSeenUnix, &source.LastSeenUnix, &source.Checkins, &source.Policy)
+		if err != nil {
+			return
+		}
+
+		if len(alerts) == 0 || alerts[len(alerts)-1].AgentUUID != alert.AgentUUID {
+			alert.Sources = []ReuseSource{}
+			alerts = append(alerts, alert)
+		}
+		lastAlert := &alerts[len(alerts)-1]
+		lastAlert.Sources = append(lastAlert.Sources, source)
+	}
+	err = reuseAlertsRows.Err()
+
+	return
+}
+
+/*
+	--- Checkins and host holdings ---
+*/
+
+const countCheckinsSQL string = "SELECT COUNT(*) FROM AgentCheckins WHERE agent_uuid = ?"
+
+func (store *sqlStore) CountCheckins(agentUUID string) (numCheckins int, err error) {
+	err = store.queryRow(countCheckinsSQL, []interface{}{agentUUID}, &numCheckins)
+	return
+}
+
+const scoredCheckinsSQL string = `
+	SELECT Agents.team_id, AgentCheckins.target_ipv4_address, AgentCheckins.agent_uuid, AgentCheckins.time_unix,
+		Agents.callback_minutes, Agents.jitter_percent, TargetsInScope.value
+	FROM AgentCheckins
+	JOIN Agents
+	ON AgentCheckins.agent_uuid = Agents.agent_uuid
+	JOIN TargetsInScope
+	ON AgentCheckins.target_ipv4_address = TargetsInScope.target_ipv4_address
+	ORDER BY AgentCheckins.time_unix
+`
+
+func (store *sqlStore) ScoredCheckins() (checkins []ScoredCheckin, err error) {
+	checkinsRows, err := store.query(scoredCheckinsSQL)
+	if err != nil {
+		return
+	}
+	defer utils.Close(checkinsRows)
+
+	checkins = []ScoredCheckin{}
+	for checkinsRows.Next() {
+		var checkin ScoredCheckin
+		err = checkinsRows.Scan(&checkin.TeamID, &checkin.TargetIP, &checkin.AgentUUID, &checkin.TimeUnix, &checkin.CallbackMinutes, &checkin.JitterPercent, &checkin.TargetValue)
+		if err != nil {
+			return
+		}
+		checkins = append(checkins, checkin)
+	}
+	err = checkinsRows.Err()
+
+	return
+}
+
+const saveHostHoldingSQL string = `
+	INSERT INTO HostHoldings(team_id, target_ipv4_address, agent_uuid, latest_checkin_unix, previous_checkin_unix, points, streak, dead_after_unix)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(agent_uuid, target_ipv4_address) DO UPDATE
+	SET latest_checkin_unix = excluded.latest_checkin_unix, previous_checkin_unix = excluded.previous_checkin_unix,
+		points = excluded.points, streak = excluded.streak, dead_after_unix = excluded.dead_after_unix
+`
+
+const hostHoldingsSQL string = `
+	SELECT team_id, target_ipv4_address, agent_uuid, latest_checkin_unix, previous_checkin_unix, points, streak, dead_after_unix
+	FROM HostHoldings
+`
+
+// Every stored holding, by Agent and target (see `utils.HostHoldingKey()`).
+func (store *sqlStore) HostHoldings() (holdings map[string]utils.HostHolding, err error) {
+	holdings = map[string]utils.HostHolding{}
+
+	holdingsRows, err := store.query(hostHoldingsSQL)
+	if err != nil {
+		return
+	}
+	defer utils.Close(holdingsRows)
+
+	for holdingsRows.Next() {
+		var holding utils.HostHolding
+		err = holdingsRows.Scan(&holding.TeamID, &holding.TargetIP, &holding.AgentUUID, &holding.LatestUnix, &holding.PreviousUnix, &holding.Points, &holding.Streak, &holding.DeadAfterUnix)
+		if err != nil {
+			return
+		}
+
+		holdings[utils.HostHoldingKey(holding.AgentUUID, holding.TargetIP)] = holding
+	}
+	err = holdingsRows.Err()
+
+	return
+}
+
+// Replace every stored holding with `holdings`, all at once.
+func (store *sqlStore) ReplaceHostHoldings(holdings map[string]utils.HostHolding) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if _, err = tx.Exec("DELETE FROM HostHoldings"); err != nil {
+		return err
+	}
+
+	saveHostHoldingStatement, err := store.statement(saveHostHoldingSQL)
+	if err != nil {
+		return err
+	}
+	saveHostHoldingStatement = tx.Stmt(saveHostHoldingStatement)
+	defer utils.Close(saveHostHoldingStatement)
+
+	for _, holding := range holdings {
+		_, err = saveHostHoldingStatement.Exec(holding.TeamID, holding.TargetIP, holding.AgentUUID, holding.LatestUnix, holding.PreviousUnix, holding.Points, holding.Streak, holding.DeadAfterUnix)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const teamHoldingsSQL string = `
+	SELECT Teams.name, TargetsInScope.value, MAX(HostHoldings.points), SUM(HostHoldings.points)
+	FROM HostHoldings
+	JOIN Teams
+	ON HostHoldings.team_id = Teams.team_id
+	JOIN TargetsInScope
+	ON HostHoldings.target_ipv4_address = TargetsInScope.target_ipv4_address
+	WHERE HostHoldings.dead_after_unix >= ?
+	GROUP BY Teams.team_id, Teams.name, TargetsInScope.target_ipv4_address, TargetsInScope.value
+`
+
+// One row per team and target, only counting live Agents.
+func (store *sqlStore) TeamHoldings(nowUnix int64) (teamHoldings []TeamHolding, err error) {
+	teamHoldingsRows, err := store.query(teamHoldingsSQL, nowUnix)
+	if err != nil {
+		return
+	}
+	defer utils.Close(teamHoldingsRows)
+
+	teamHoldings = []TeamHolding{}
+	for teamHoldingsRows.Next() {
+		var teamHolding TeamHolding
+		if err = teamHoldingsRows.Scan(&teamHolding.TeamName, &teamHolding.TargetValue, &teamHolding.BestPoints, &teamHolding.TotalPoints); err != nil {
+			return
+		}
+		teamHoldings = append(teamHoldings, teamHolding)
+	}
+	err = teamHoldingsRows.Err()
+
+	return
+}
+
+const liveAgentsSQL string = `
+	SELECT Teams.name, Agents.agent_type, COALESCE(AgentFingerprints.os, ''), COALESCE(AgentFingerprints.changed_date_unix, 0)
+	FROM Agents
+	JOIN Teams
+	ON Agents.team_id = Teams.team_id
+	LEFT JOIN AgentFingerprints
+	ON Agents.agent_uuid = AgentFingerprints.agent_uuid
+	WHERE Agents.agent_uuid IN (
+		SELECT agent_uuid FROM HostHoldings
+		WHERE dead_after_unix >= ?
+	)
+`
+
+func (store *sqlStore) LiveAgents(nowUnix int64) (liveAgents []LiveAgent, err error) {
+	liveAgentsRows, err := store.query(liveAgentsSQL, nowUnix)
+	if err != nil {
+		return
+	}
+	defer utils.Close(liveAgentsRows)
+
+	liveAgents = []LiveAgent{}
+	for liveAgentsRows.Next() {
+		var liveAgent LiveAgent
+		if err = liveAgentsRows.Scan(&liveAgent.TeamName, &liveAgent.AgentType, &liveAgent.HostOS, &liveAgent.HostChangedUnix); err != nil {
+			return
+		}
+		liveAgents = append(liveAgents, liveAgent)
+	}
+	err = liveAgentsRows.Err()
+
+	return
+}
+
+/*
+	--- Callback events and sources ---
+*/
+
+const callbackEventsSQL string = `
+	SELECT CallbackEvents.event_id, CallbackEvents.time_unix, CallbackEvents.source_ipv4_address, CallbackEvents.source_port,
+		CallbackEvents.listener_address, CallbackEvents.transport, CallbackEvents.collector_id, CallbackEvents.agent_uuid, COALESCE(Teams.name, ''),
+		CallbackEvents.message_type, CallbackEvents.verdict, CallbackEvents.reason
+	FROM CallbackEvents
+	LEFT JOIN Agents
+	ON CallbackEvents.agent_uuid = Agents.agent_uuid
+	LEFT JOIN Teams
+	ON Agents.team_id = Teams.team_id
+	WHERE (CAST(? AS TEXT) = '' OR Teams.name = ?)
+		AND (CAST(? AS TEXT) = '' OR CallbackEvents.agent_uuid LIKE CAST(? AS TEXT) || '%')
+		AND (CAST(? AS TEXT) = '' OR CallbackEvents.source_ipv4_address = ?)
+		AND (CAST(? AS TEXT) = '' OR CallbackEvents.verdict = ?)
+	ORDER BY CallbackEvents.event_id DESC
+	LIMIT ?
+`
+
+func (store *sqlStore) CallbackEvents(filter CallbackEventFilter, limit int) (events []CallbackEvent, err error) {
+	callbackEventsRows, err := store.query(callbackEventsSQL, filter.TeamName, filter.TeamName, filter.AgentUUID, filter.AgentUUID,
+		filter.SourceIP, filter.SourceIP, filter.Verdict, filter.Verdict, limit)
+	if err != nil {
+		return
+	}
+	defer utils.Close(callbackEventsRows)
+
+	events = []CallbackEvent{}
+	for callbackEventsRows.Next() {
+		var event CallbackEvent
+		err = callbackEventsRows.Scan(&event.EventID, &event.TimeUnix, &event.SourceIP, &event.SourcePort, &event.Listener, &event.Transport,
+			&event.CollectorID, &event.AgentUUID, &event.TeamName, &event.MessageType, &event.Verdict, &event.Reason)
+		if err != nil {
+			return
+		}
+		events = append(events, event)
+	}
+	err = callbackEventsRows.Err()
+
+	return
+}
+
+const countVerdictsSQL string = "SELECT verdict, COUNT(*) FROM CallbackEvents GROUP BY verdict"
+
+// The number of callback events with each verdict.
+func (store *sqlStore) CountVerdicts() (verdicts map[string]int, err error) {
+	verdictsRows, err := store.query(countVerdictsSQL)
+	if err != nil {
+		return
+	}
+	defer utils.Close(verdictsRows)
+
+	verdicts = map[string]int{}
+	for verdictsRows.Next() {
+		var verdict string
+		var count int
+		if err = verdictsRows.Scan(&verdict, &count); err != nil {
+			return
+		}
+		verdicts[verdict] = count
+	}
+	err = verdictsRows.Err()
+
+	return
+}
+
+const callbackSourcesSQL string = `
+	SELECT CallbackSources.source_ipv4_address, TargetsInScope.target_ipv4_address IS NOT NULL, CallbackSources.throttled,
+		CallbackSources.last_throttled_unix, CallbackSources.invalid_payloads, CallbackSources.bans,
+		CASE WHEN CallbackSources.banned_until_unix > ? THEN CallbackSources.banned_until_unix ELSE 0 END,
+		CallbackSources.last_seen_unix
+	FROM CallbackSources
+	LEFT JOIN TargetsInScope
+	ON CallbackSources.source_ipv4_address = TargetsInScope.target_ipv4_address
+	ORDER BY CallbackSources.banned_until_unix > ? DESC, CallbackSources.last_seen_unix DESC
+	LIMIT ?
+`
+
+func (store *sqlStore) CallbackSources(nowUnix int64, limit int) (sources []CallbackSource, err error) {
+	callbackSourcesRows, err := store.query(callbackSourcesSQL, nowUnix, nowUnix, limit)
+	if err != nil {
+		return
+	}
+	defer utils.Close(callbackSourcesRows)
+
+	sources = []CallbackSource{}
+	for callbackSourcesRows.Next() {
+		var source CallbackSource
+		err = callbackSourcesRows.Scan(&source.SourceIP, &source.InScope, &source.Throttled, &source.LastThrottledUnix,
+			&source.InvalidPayloads, &source.Bans, &source.BannedUntilUnix, &source.LastSeenUnix)
+		if err != nil {
+			return
+		}
+		sources = append(sources, source)
+	}
+	err = callbackSourcesRows.Err()
+
+	return
+}
+
+const callbackBansSQL string = "SELECT source_ipv4_address, banned_until_unix FROM CallbackSources WHERE banned_until_unix > ?"
+
+func (store *sqlStore) CallbackBans(nowUnix int64) (bans map[string]int64, err error) {
+	bansRows, err := store.query(callbackBansSQL, nowUnix)
+	if err != nil {
+		return
+	}
+	defer utils.Close(bansRows)
+
+	bans = map[string]int64{}
+	for bansRows.Next() {
+		var sourceIP string
+		var bannedUntilUnix int64
+		if err = bansRows.Scan(&sourceIP, &bannedUntilUnix); err != nil {
+			return
+		}
+		bans[sourceIP] = bannedUntilUnix
+	}
+	err = bansRows.Err()
+
+	return
+}
+
+/*
+	--- Transactions ---
+*/
+
+func (store *sqlStore) Begin() (Tx, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{store: store, tx: tx}, nil
+}
+
+type sqlTx struct {
+	store      *sqlStore
+	tx         *sql.Tx
+	savepoints int // for unique savepoint names
+}
+
+func (tx *sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	statement, err := tx.store.statement(query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.tx.Stmt(statement).Exec(args...)
+}
+
+// Scan a single row, `ErrNotFound` if there is none.
+func (tx *sqlTx) queryRow(query string, args []interface{}, destinations ...interface{}) error {
+	statement, err := tx.store.statement(query)
+	if err != nil {
+		return err
+	}
+	return notFound(tx.tx.Stmt(statement).QueryRow(args...).Scan(destinations...))
+}
+
+const bindAgentToTargetSQL string = `
+	UPDATE Agents SET bound_target_ipv4_address = ?
+	WHERE agent_uuid = ? AND bound_target_ipv4_address = ''
+`
+
+const getBoundTargetSQL string = `
+	SELECT bound_target_ipv4_address FROM Agents
+	WHERE agent_uuid = ?
+`
+
+/*
+	An Agent is bound to the first target it calls back from, unless
+	another callback got there first.
+*/
+func (tx *sqlTx) BindAgentToTarget(agentUUID string, targetIP string) (boundTarget string, err error) {
+	_, err = tx.exec(bindAgentToTargetSQL, targetIP, agentUUID)
+	if err != nil {
+		return
+	}
+
+	err = tx.queryRow(getBoundTargetSQL, []interface{}{agentUUID}, &boundTarget)
+	return
+}
+
+const addCheckinSQL string = `
+	INSERT INTO AgentCheckins(agent_uuid, target_ipv4_address, time_unix)
+	VALUES (?, ?, ?)
+`
+
+func (tx *sqlTx) AddCheckin(agentUUID string, targetIP string, timeUnix int64) error {
+	_, err := tx.exec(addCheckinSQL, agentUUID, targetIP, timeUnix)
+	return err
+}
+
+const setAgentRootDateSQL string = `
+	UPDATE Agents SET root_date_unix = ?
+	WHERE agent_uuid = ? AND root_date_unix = 0
+`
+
+func (tx *sqlTx) SetAgentRootDate(agentUUID string, rootUnix int64) error {
+	_, err := tx.exec(setAgentRootDateSQL, rootUnix, agentUUID)
+	return err
+}
+
+const recordAgentReuseSQL string = `
+	INSERT INTO AgentReuse(agent_uuid, source_ipv4_address, first_seen_unix, last_seen_unix, policy)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(agent_uuid, source_ipv4_address) DO UPDATE
+	SET last_seen_unix = excluded.last_seen_unix, checkins = AgentReuse.checkins + 1, policy = excluded.policy
+`
+
+func (tx *sqlTx) RecordAgentReuse(agentUUID string, sourceIP string, seenUnix int64, policy string) error {
+	_, err := tx.exec(recordAgentReuseSQL, agentUUID, sourceIP, seenUnix, seenUnix, policy)
+	return err
+}
+
+const addCheckinFingerprintSQL string = `
+	INSERT INTO CheckinFingerprints(agent_uuid, target_ipv4_address, time_unix, hostname, os, os_version, arch, machine_id, username, ip_addresses, pid)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+func (tx *sqlTx) AddCheckinFingerprint(agentUUID string, targetIP string, timeUnix int64, host fingerprint.Fingerprint) error {
+	_, err := tx.exec(addCheckinFingerprintSQL, agentUUID, targetIP, timeUnix, host.Hostname, host.OS, host.OSVersion, host.Arch, host.MachineID, host.User, strings.Join(host.IPs, ","), host.PID)
+	return err
+}
+
+const getAgentFingerprintSQL string = `
+	SELECT hostname, os, arch, machine_id, username
+	FROM AgentFingerprints
+	WHERE agent_uuid = ?
+`
+
+// Only the fields `fingerprint.Changes()` compares are read back.
+func (tx *sqlTx) GetAgentFingerprint(agentUUID string) (host fingerprint.Fingerprint, err error) {
+	err = tx.queryRow(getAgentFingerprintSQL, []interface{}{agentUUID}, &host.Hostname, &host.OS, &host.Arch, &host.MachineID, &host.User)
+	return
+}
+
+const saveAgentFingerprintSQL string = `
+	INSERT INTO AgentFingerprints(agent_uuid, hostname, os, os_version, arch, machine_id, username, ip_addresses, pid, first_seen_unix, last_seen_unix)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(agent_uuid) DO UPDATE
+	SET hostname = excluded.hostname, os = excluded.os, os_version = excluded.os_version, arch = excluded.arch, machine_id = excluded.machine_id,
+		username = excluded.username, ip_addresses = excluded.ip_addresses, pid = excluded.pid, last_seen_unix = excluded.last_seen_unix
+`
+
+// Replace the Agent's current fingerprint, keeping when it was first seen.
+func (tx *sqlTx) SaveAgentFingerprint(agentUUID string, host fingerprint.Fingerprint, seenUnix int64) error {
+	_, err := tx.exec(saveAgentFingerprintSQL, agentUUID, host.Hostname, host.OS, host.OSVersion, host.Arch, host.MachineID, host.User, strings.Join(host.IPs, ","), host.PID, seenUnix, seenUnix)
+	return err
+}
+
+const flagAgentFingerprintSQL string = `
+	UPDATE AgentFingerprints
+	SET changed_date_unix = ?, changed_fields = ?
+	WHERE agent_uuid = ?
+`
+
+func (tx *sqlTx) FlagAgentFingerprint(agentUUID string, changedUnix int64, changes []string) error {
+	_, err := tx.exec(flagAgentFingerprintSQL, changedUnix, strings.Join(changes, ","), agentUUID)
+	return err
+}
+
+const getHostHoldingSQL string = `
+	SELECT latest_checkin_unix, previous_checkin_unix, points, streak, dead_after_unix
+	FROM HostHoldings
+	WHERE agent_uuid = ? AND target_ipv4_address = ?
+`
+
+func (tx *sqlTx) GetHostHolding(teamID int, targetIP string, agentUUID string) (utils.HostHolding, error) {
+	holding := utils.HostHolding{TeamID: teamID, TargetIP: targetIP, AgentUUID: agentUUID}
+
+	err := tx.queryRow(getHostHoldingSQL, []interface{}{agentUUID, targetIP}, &holding.LatestUnix, &holding.PreviousUnix, &holding.Points, &holding.Streak, &holding.DeadAfterUnix)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return holding, err
+}
+
+func (tx *sqlTx) SaveHostHolding(holding utils.HostHolding) error {
+	_, err := tx.exec(saveHostHoldingSQL, holding.TeamID, holding.TargetIP, holding.AgentUUID, holding.LatestUnix, holding.PreviousUnix, holding.Points, holding.Streak, holding.DeadAfterUnix)
+	return err
+}
+
+const addCallbackEventSQL string = `
+	INSERT INTO CallbackEvents(time_unix, source_ipv4_address, source_port, listener_address, transport, collector_id, forwarded_id, agent_uuid, message_type, verdict, reason)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+func (tx *sqlTx) AddCallbackEvent(event CallbackEvent) error {
+	forwardedID := sql.NullString{String: event.ForwardedID, Valid: event.ForwardedID != ""}
+	_, err := tx.exec(addCallbackEventSQL, event.TimeUnix, event.SourceIP, event.SourcePort, event.Listener, event.Transport, event.CollectorID, forwardedID,
+		event.AgentUUID, event.MessageType, event.Verdict, event.Reason)
+	return err
+}
+
+const forwardedCallbackRecordedSQL string = "SELECT COUNT(*) FROM CallbackEvents WHERE forwarded_id = ?"
+
+func (tx *sqlTx) ForwardedCallbackRecorded(forwardedID string) (recorded bool, err error) {
+	var numEvents int
+	err = tx.queryRow(forwardedCallbackRecordedSQL, []interface{}{forwardedID}, &numEvents)
+	return numEvents > 0, err
+}
+
+const pruneCallbackEventsSQL string = "DELETE FROM CallbackEvents WHERE time_unix < ?"
+
+func (tx *sqlTx) PruneCallbackEvents(beforeUnix int64) (numDeleted int64, err error) {
+	result, err := tx.exec(pruneCallbackEventsSQL, beforeUnix)
+	if err == nil {
+		numDeleted, err = result.RowsAffected()
+	}
+	return
+}
+
+const recordCallbackSourceSQL string = `
+	INSERT INTO CallbackSources(source_ipv4_address, throttled, last_throttled_unix, invalid_payloads, bans, banned_until_unix, last_seen_unix)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(source_ipv4_address) DO UPDATE
+	SET throttled = CallbackSources.throttled + excluded.throttled,
+		last_throttled_unix = CASE WHEN excluded.last_throttled_unix > CallbackSources.last_throttled_unix
+			THEN excluded.last_throttled_unix ELSE CallbackSources.last_throttled_unix END,
+		invalid_payloads = CallbackSources.invalid_payloads + excluded.invalid_payloads, bans = CallbackSources.bans + excluded.bans,
+		banned_until_unix = excluded.banned_until_unix, last_seen_unix = excluded.last_seen_unix
+`
+
+// Add to what was already recorded for the source.
+func (tx *sqlTx) RecordCallbackSource(change utils.SourceChange, seenUnix int64) error {
+	_, err := tx.exec(recordCallbackSourceSQL, change.SourceIP, change.Throttled, change.LastThrottledUnix, change.InvalidPayloads, change.Bans, change.BannedUntilUnix, seenUnix)
+	return err
+}
+
+/*
+	PostgreSQL aborts the whole transaction when a statement fails, until
+	it's rolled back to a savepoint, so anything allowed to fail without
+	losing the rest of the transaction must run in one.
+*/
+func (tx *sqlTx) Savepoint(write func(tx Tx) error) error {
+	tx.savepoints++
+	name := fmt.Sprintf("write_%d", tx.savepoints)
+
+	if _, err := tx.tx.Exec("SAVEPOINT " + name); err != nil {
+		return err
+	}
+
+	err := write(tx)
+	if err == nil {
+		_, err = tx.tx.Exec("RELEASE " + name)
+	}
+	if err != nil {
+		tx.tx.Exec("ROLLBACK TO " + name)
+		tx.tx.Exec("RELEASE " + name)
+	}
+	return err
+}
+
+func (tx *sqlTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *sqlTx) Rollback() error {
+	err := tx.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
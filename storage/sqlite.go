@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/s-christian/pwnts/utils"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The default backend, a single database file.
+type SQLite struct {
+	*sqlStore
+	path string
+}
+
+/*
+	Open the SQLite database file at `path`, creating it if it doesn't
+	exist yet.
+
+	The database is opened in WAL mode so the site can read while the
+	callback server writes, and waits on a locked database instead of
+	failing right away. Transactions take the write lock as soon as they
+	begin, rather than failing to upgrade a read lock halfway through.
+*/
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		utils.Close(db)
+		return nil, err
+	}
+
+	store := &SQLite{path: path}
+	store.sqlStore = newSQLStore(db, store)
+	return store, nil
+}
+
+func (store *SQLite) Backend() string {
+	return utils.DatabaseSQLite
+}
+
+func (store *SQLite) placeholder(n int) string {
+	return "?"
+}
+
+func (store *SQLite) migrationsDirectory() string {
+	return "migrations/sqlite"
+}
+
+func (store *SQLite) tableNames(q querier) ([]string, error) {
+	return queryStrings(q, `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+		ORDER BY name
+	`)
+}
+
+func (store *SQLite) columnNames(q querier, tableName string) ([]string, error) {
+	return queryStrings(q, "SELECT name FROM pragma_table_info(?) ORDER BY name", tableName)
+}
+
+/*
+	The schema the migrations up to `version` produce, found by applying
+	them to an empty in-memory database.
+*/
+func (store *SQLite) expectedSchema(migrations []Migration, version int) (schema, error) {
+	scratch, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Close(scratch)
+	scratch.SetMaxOpenConns(1) // every connection would get its own empty database
+
+	if err = applyMigrations(scratch, migrations[:version]); err != nil {
+		return nil, err
+	}
+	return readSchema(store, scratch)
+}
+
+// Transactions already take the write lock as they begin, see `OpenSQLite()`.
+func (store *SQLite) lockMigrations(tx *sql.Tx) error {
+	return nil
+}
+
+/*
+	Fold the write-ahead log back into the database file and close it, so a
+	stopped server leaves a single self-contained database behind.
+*/
+func (store *SQLite) Close() error {
+	_, err := store.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	utils.CheckError(utils.Warning, err, "Could not checkpoint the database")
+	return store.close()
+}
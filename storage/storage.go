@@ -0,0 +1,249 @@
+/*
+	Everything Pwnts keeps in its database, behind the `Repository`
+	interface: teams, targets, Agents, their checkins and host holdings, and
+	the callback events. Nothing outside this package writes SQL.
+
+	Two backends implement it, chosen by the config's `database.backend`:
+	SQLite (the default, a file next to the callback server) and PostgreSQL,
+	so the database can live on another host than the callback server and
+	the scoreboard. `conformance_test.go` checks that they behave the same.
+*/
+package storage
+
+import (
+	"errors"
+
+	"github.com/s-christian/pwnts/agent/fingerprint"
+	"github.com/s-christian/pwnts/utils"
+)
+
+// Returned when the team, target, Agent, or fingerprint asked for doesn't exist.
+var ErrNotFound error = errors.New("not found")
+
+type Team struct {
+	TeamID       int
+	Name         string
+	PasswordHash string
+	CreatedUnix  int64
+}
+
+type Target struct {
+	IP    string
+	Value int
+}
+
+// A registered Agent, as the callback server needs it to score a checkin.
+type Agent struct {
+	AgentUUID       string
+	TeamID          int
+	AgentType       string
+	CreatedUnix     int64
+	RootDateUnix    int64 // 0 until the Agent proves it has root, see `utils.HasRootSignal()`
+	CallbackMinutes int
+	JitterPercent   int
+	LocalPort       int
+	Platform        string
+	BoundTarget     string // empty until its first checkin, unless it was generated for a target
+	TargetLocked    bool   // whether it was generated for `BoundTarget`
+}
+
+type AgentInventoryEntry struct {
+	AgentUUID       string                   `json:"agent_uuid"`
+	AgentType       string                   `json:"agent_type"`
+	CreatedUnix     int64                    `json:"created"`
+	TargetIP        string                   `json:"target"`        // the target it's bound to, empty until its first checkin
+	TargetLocked    bool                     `json:"target_locked"` // whether it was generated for that target
+	LastCheckinUnix int64                    `json:"last_checkin"`  // 0 if the Agent has never called back
+	LastTargetIP    string                   `json:"last_target"`
+	Host            *fingerprint.Fingerprint `json:"host"`                // the latest fingerprint, nil if the Agent has never sent one
+	HostChangedUnix int64                    `json:"host_changed"`        // 0 if the Agent has never changed hosts
+	HostChanges     []string                 `json:"host_changed_fields"` // what changed the last time it did
+}
+
+type ReuseSource struct {
+	SourceIP      string `json:"source_ip"`
+	FirstSeenUnix int64  `json:"first_seen"`
+	LastSeenUnix  int64  `json:"last_seen"`
+	Checkins      int    `json:"checkins"`
+	Policy        string `json:"policy"` // what was done with its most recent checkin, see `utils.ReusePolicyReject`
+}
+
+// An Agent that has called back from targets other than the one it's bound to.
+type ReuseAlert struct {
+	AgentUUID   string        `json:"agent_uuid"`
+	TeamName    string        `json:"team"`
+	AgentType   string        `json:"agent_type"`
+	BoundTarget string        `json:"bound_target"`
+	Sources     []ReuseSource `json:"sources"` // most recently seen first
+}
+
+// A checkin along with what's needed to score it, see `utils.NextHostHolding()`.
+type ScoredCheckin struct {
+	TeamID          int
+	TargetIP        string
+	AgentUUID       string
+	TimeUnix        int64
+	CallbackMinutes int
+	JitterPercent   int
+	TargetValue     int
+}
+
+// The live Agents of one team on one target, see `utils.CombineHostPoints()`.
+type TeamHolding struct {
+	TeamName    string
+	TargetValue int
+	BestPoints  int
+	TotalPoints int
+}
+
+// An Agent that still holds a target.
+type LiveAgent struct {
+	TeamName        string
+	AgentType       string
+	HostOS          string // empty if the Agent has never sent a fingerprint
+	HostChangedUnix int64  // 0 if the Agent has never changed hosts
+}
+
+// One connection to the callback server, as recorded in the audit log.
+type CallbackEvent struct {
+	EventID     int64  `json:"id"` // set by the database
+	TimeUnix    int64  `json:"time"`
+	SourceIP    string `json:"source_ip"`
+	SourcePort  int    `json:"source_port"`
+	Listener    string `json:"listener"` // the local address the connection arrived on
+	Transport   string `json:"transport"`
+	CollectorID string `json:"collector"`  // the collector that received it, empty if it came straight to us
+	ForwardedID string `json:"-"`          // the collector's ID for it, only written, see `Tx.ForwardedCallbackRecorded()`
+	AgentUUID   string `json:"agent_uuid"` // as claimed, empty if no valid UUID was sent
+	TeamName    string `json:"team"`       // empty if the Agent is unknown, only set when read back
+	MessageType string `json:"message_type"`
+	Verdict     string `json:"verdict"`
+	Reason      string `json:"reason"`
+}
+
+// Which callback events to retrieve, empty fields match everything.
+type CallbackEventFilter struct {
+	TeamName  string
+	AgentUUID string // matches any UUID starting with it
+	SourceIP  string
+	Verdict   string
+}
+
+// A source IP the callback server has throttled, banned, or received invalid payloads from.
+type CallbackSource struct {
+	SourceIP          string `json:"source_ip"`
+	InScope           bool   `json:"in_scope"` // targets in scope have their own limits
+	Throttled         int64  `json:"throttled"`
+	LastThrottledUnix int64  `json:"last_throttled"` // 0 if never throttled
+	InvalidPayloads   int64  `json:"invalid_payloads"`
+	Bans              int64  `json:"bans"`
+	BannedUntilUnix   int64  `json:"banned_until"` // 0 if not banned
+	LastSeenUnix      int64  `json:"last_seen"`
+}
+
+/*
+	The database. Reads go straight to it, the callback server's writes go
+	through a `BatchWriter` as `Tx`s. Every method is safe to call from
+	several goroutines.
+*/
+type Repository interface {
+	// Teams
+	AddTeam(name string, passwordHash string, createdUnix int64) (teamID int, err error)
+	GetTeam(teamID int) (Team, error)
+	GetTeamByName(name string) (Team, error)
+	ListTeams() ([]Team, error) // by ID
+
+	// Targets
+	AddTarget(target Target) error
+	GetTarget(targetIP string) (Target, error)
+	ListTargets() ([]Target, error) // by IP address
+
+	// Agents
+	AddAgent(agent utils.AgentRegistration, createdUnix int64) error
+	GetAgent(agentUUID string) (Agent, error)
+	CountAgents() (int, error)
+	AgentInventory(teamID int) ([]AgentInventoryEntry, error) // newest Agents first
+	ReuseAlerts() ([]ReuseAlert, error)                       // most recently seen first
+
+	// Checkins and the host holdings built from them, see `utils.HostHolding`
+	CountCheckins(agentUUID string) (int, error)
+	ScoredCheckins() ([]ScoredCheckin, error) // oldest first
+	HostHoldings() (map[string]utils.HostHolding, error)
+	ReplaceHostHoldings(holdings map[string]utils.HostHolding) error
+	TeamHoldings(nowUnix int64) ([]TeamHolding, error) // only live Agents
+	LiveAgents(nowUnix int64) ([]LiveAgent, error)
+
+	// Callback events and sources
+	CallbackEvents(filter CallbackEventFilter, limit int) ([]CallbackEvent, error) // newest first
+	CountVerdicts() (map[string]int, error)
+	CallbackSources(nowUnix int64, limit int) ([]CallbackSource, error) // banned ones first, then most recently seen
+	CallbackBans(nowUnix int64) (map[string]int64, error)               // sources still banned, and until when
+
+	// Start a transaction for the callback server's writes, see `BatchWriter`
+	Begin() (Tx, error)
+
+	// Schema, see `migrations.go`
+	Migrate() (fromVersion int, toVersion int, err error)
+	ValidateSchema() (version int, err error)
+	Migrations() ([]Migration, error)
+	Tables() ([]string, error)
+
+	Backend() string // utils.DatabaseSQLite or utils.DatabasePostgres
+	Close() error
+}
+
+/*
+	The callback server's writes, in one transaction. Reads through a `Tx`
+	see its own writes.
+*/
+type Tx interface {
+	// Bind an Agent to a target unless it already is, returning the target it's bound to
+	BindAgentToTarget(agentUUID string, targetIP string) (boundTarget string, err error)
+	AddCheckin(agentUUID string, targetIP string, timeUnix int64) error
+	SetAgentRootDate(agentUUID string, rootUnix int64) error // unless it's already set
+	RecordAgentReuse(agentUUID string, sourceIP string, seenUnix int64, policy string) error
+
+	AddCheckinFingerprint(agentUUID string, targetIP string, timeUnix int64, host fingerprint.Fingerprint) error
+	GetAgentFingerprint(agentUUID string) (fingerprint.Fingerprint, error)
+	SaveAgentFingerprint(agentUUID string, host fingerprint.Fingerprint, seenUnix int64) error
+	FlagAgentFingerprint(agentUUID string, changedUnix int64, changes []string) error
+
+	// The zero value (with the IDs filled in) if the Agent has never called back from the target
+	GetHostHolding(teamID int, targetIP string, agentUUID string) (utils.HostHolding, error)
+	SaveHostHolding(holding utils.HostHolding) error
+
+	AddCallbackEvent(event CallbackEvent) error // fails if another event has the same `ForwardedID`
+	ForwardedCallbackRecorded(forwardedID string) (bool, error)
+	PruneCallbackEvents(beforeUnix int64) (numDeleted int64, err error)
+	RecordCallbackSource(change utils.SourceChange, seenUnix int64) error
+
+	// Run `write`, undoing only what it did if it fails
+	Savepoint(write func(tx Tx) error) error
+	Commit() error
+	Rollback() error
+}
+
+/*
+	Open the database the config asks for. `sqlitePath` is the database
+	file, used by the SQLite backend only.
+*/
+func Open(config utils.DatabaseConfig, sqlitePath string) (Repository, error) {
+	if config.Backend == utils.DatabasePostgres {
+		return OpenPostgres(config.PostgresURL)
+	}
+	return OpenSQLite(sqlitePath)
+}
+
+// Same as `Open()`, but exit on error.
+func OpenExit(config utils.DatabaseConfig, sqlitePath string) Repository {
+	repository, err := Open(config, sqlitePath)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_CONNECTION, "Could not open the "+config.Backend+" database")
+	utils.Log(utils.Done, "Opened", repository.Backend(), "database")
+	return repository
+}
+
+// Close the database once nothing uses it anymore, e.g. when the server stops.
+func Close(repository Repository) {
+	utils.Close(repository)
+	utils.Log(utils.Done, "Closed", repository.Backend(), "database")
+}
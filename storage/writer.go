@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/s-christian/pwnts/utils"
+)
+
+var ErrWriterClosed error = errors.New("database writer is closed")
+
+type writeJob struct {
+	write func(tx Tx) error
+	done  chan error // nil if nobody is waiting for the result
+}
+
+/*
+	Funnels database writes through a single goroutine, which commits them
+	in batches: one transaction for up to `batchSize` writes, or for however
+	many arrive within `batchDelay` of the first. SQLite only allows one
+	writer at a time, so this keeps concurrent callbacks from fighting over
+	the lock, and batching spreads the cost of each commit, which matters
+	even more when the database is on another host.
+
+	Each write runs in its own savepoint, so a failed write is rolled back
+	without affecting the rest of its batch.
+*/
+type BatchWriter struct {
+	repository Repository
+	jobs       chan writeJob
+	batchSize  int
+	batchDelay time.Duration
+	stopped    chan struct{}
+
+	// Held for reading while sending on `jobs`, so `Close()` never closes it under a sender
+	closeMutex sync.RWMutex
+	closed     bool
+
+	// Counters, see `Stats()`
+	batches int64
+	writes  int64
+	failed  int64
+	dropped int64
+}
+
+// Start a writer that queues up to `queueSize` writes before `Write()` blocks.
+func NewBatchWriter(repository Repository, queueSize int, batchSize int, batchDelay time.Duration) *BatchWriter {
+	writer := &BatchWriter{
+		repository: repository,
+		jobs:       make(chan writeJob, queueSize),
+		batchSize:  batchSize,
+		batchDelay: batchDelay,
+		stopped:    make(chan struct{}),
+	}
+	go writer.run()
+	return writer
+}
+
+// Run `write` in the writer's next transaction and wait for it to commit.
+func (writer *BatchWriter) Write(write func(tx Tx) error) error {
+	done := make(chan error, 1)
+
+	writer.closeMutex.RLock()
+	if writer.closed {
+		writer.closeMutex.RUnlock()
+		return ErrWriterClosed
+	}
+	writer.jobs <- writeJob{write: write, done: done}
+	writer.closeMutex.RUnlock()
+
+	return <-done
+}
+
+/*
+	Queue `write` without waiting for it, unless the queue is full, in which
+	case it's dropped and counted. Returns whether it was queued, which it
+	never is once the writer is closed.
+*/
+func (writer *BatchWriter) TryWrite(write func(tx Tx) error) bool {
+	writer.closeMutex.RLock()
+	defer writer.closeMutex.RUnlock()
+
+	if writer.closed {
+		return false
+	}
+
+	select {
+	case writer.jobs <- writeJob{write: write}:
+		return true
+	default:
+		atomic.AddInt64(&writer.dropped, 1)
+		return false
+	}
+}
+
+/*
+	Stop accepting writes, and wait for the ones already queued to be
+	committed. Writes after this return ErrWriterClosed.
+*/
+func (writer *BatchWriter) Close() {
+	writer.closeMutex.Lock()
+	if !writer.closed {
+		writer.closed = true
+		close(writer.jobs)
+	}
+	writer.closeMutex.Unlock()
+
+	<-writer.stopped
+}
+
+// A point-in-time copy of a writer's counters, for metrics.
+type BatchWriterStats struct {
+	QueueDepth int   `json:"queue_depth"` // writes waiting for the next batch
+	Batches    int64 `json:"batches"`     // transactions committed or attempted
+	Writes     int64 `json:"writes"`
+	Failed     int64 `json:"failed"`
+	Dropped    int64 `json:"dropped"` // by `TryWrite()` because the queue was full
+}
+
+func (writer *BatchWriter) Stats() BatchWriterStats {
+	return BatchWriterStats{
+		QueueDepth: len(writer.jobs),
+		Batches:    atomic.LoadInt64(&writer.batches),
+		Writes:     atomic.LoadInt64(&writer.writes),
+		Failed:     atomic.LoadInt64(&writer.failed),
+		Dropped:    atomic.LoadInt64(&writer.dropped),
+	}
+}
+
+func (writer *BatchWriter) run() {
+	defer close(writer.stopped)
+
+	for job := range writer.jobs {
+		batch := []writeJob{job}
+
+		// Give other writes a moment to join the batch
+		timer := time.NewTimer(writer.batchDelay)
+	collect:
+		for len(batch) < writer.batchSize {
+			select {
+			case job, ok := <-writer.jobs:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, job)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		writer.commit(batch)
+	}
+}
+
+func (writer *BatchWriter) commit(batch []writeJob) {
+	results := make([]error, len(batch))
+
+	tx, err := writer.repository.Begin()
+	if err == nil {
+		for i, job := range batch {
+			results[i] = tx.Savepoint(job.write)
+		}
+		err = tx.Commit()
+	}
+
+	atomic.AddInt64(&writer.batches, 1)
+	for i, job := range batch {
+		// Nothing was written if the transaction itself failed
+		if err != nil {
+			results[i] = err
+		}
+
+		atomic.AddInt64(&writer.writes, 1)
+		if results[i] != nil {
+			atomic.AddInt64(&writer.failed, 1)
+			if job.done == nil {
+				utils.CheckError(utils.Error, results[i], "Queued database write failed")
+			}
+		}
+		if job.done != nil {
+			job.done <- results[i]
+		}
+	}
+}
@@ -1,72 +1,50 @@
-package main
-
 /*
-	Flags:
-		--init-db:			Initialize the database by creating the Teams and Agents Sqlite3 tables.
-		--register-targets:	Add targets by their IP address and point value. Targets are defined
-							in the file "targets.txt" in the CSV format "ip,point_value".
-		--register-team:	Create a team with --team-name and --team-password.
-			--team-name:		The name of the team.
-			--team-password:	The plaintext password for the team (to be hashed with bcrypt).
-		--register-agent:	Register an Agent UUID.
+	Database administration: creating the tables, registering teams,
+	targets and Agents, and checking the host holdings. Run through the
+	`pwnts db`, `pwnts team`, `pwnts target` and `pwnts agent` commands,
+	see `cmd/pwnts`.
 */
+package tools
 
 import (
 	"bufio"
-	"database/sql"
-	"flag"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/s-christian/pwnts/storage"
 	"github.com/s-christian/pwnts/utils"
 )
 
-// Helper function called before registerAgent()
-func validateTeamID(db *sql.DB, teamID int) {
+// Exit unless the team exists, called before registering an Agent.
+func ValidateTeamID(repository storage.Repository, teamID int) {
 	utils.Log(utils.Info, "Validating Team ID")
 
-	validateTeamIDSQL := `
-		SELECT team_id, name, created_date_unix
-		FROM Teams
-		WHERE team_id = ?
-	`
-	validateTeamIDStatement, err := db.Prepare(validateTeamIDSQL)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_STATEMENT, "[!] Could not create ValidateTeamID statement")
-	defer utils.Close(validateTeamIDStatement)
-
-	var dbTeamID int
-	var dbTeamName string
-	var dbTeamCreatedDate int // stored as UNIX time, seconds since epoch, not a time.Duration
-	err = validateTeamIDStatement.QueryRow(teamID).Scan(&dbTeamID, &dbTeamName, &dbTeamCreatedDate)
-	if err == sql.ErrNoRows { // invalid Team ID (doesn't exist)
+	team, err := repository.GetTeam(teamID)
+	if errors.Is(err, storage.ErrNotFound) { // invalid Team ID (doesn't exist)
 		utils.CheckErrorExit(utils.Error, err, utils.ERR_INPUT, "Team ID", fmt.Sprint(teamID), "does not exist")
 	}
 	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not execute ValidateTeamID statement") // genuine db error
 
-	utils.Log(utils.Done, "Team '"+dbTeamName+"' (ID "+fmt.Sprint(teamID)+", created "+time.Unix(int64(dbTeamCreatedDate), 0).Format(time.RFC3339)+") is valid")
+	utils.Log(utils.Done, "Team '"+team.Name+"' (ID "+fmt.Sprint(teamID)+", created "+time.Unix(team.CreatedUnix, 0).Format(time.RFC3339)+") is valid")
 }
 
-// Flag: --register-targets
-func registerTargetsFromFile(db *sql.DB, filename string) {
+/*
+	`pwnts target import`: add the targets in `filePath`, one "ip,value" per
+	line, e.g. `tools/targets.txt`.
+*/
+func RegisterTargetsFromFile(repository storage.Repository, filePath string) {
 	utils.Log(utils.Info, "Registering targets:")
 
-	fullFilePath := utils.CurrentDirectory + filename
-	targetsFile, err := os.Open(fullFilePath)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Cannot open file '"+fullFilePath+"'")
+	targetsFile, err := os.Open(filePath)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Cannot open file '"+filePath+"'")
 	defer utils.Close(targetsFile)
 
-	addTargetSQL := `
-		INSERT INTO TargetsInScope(target_ipv4_address, value)
-		VALUES (?, ?)
-	`
-	addTargetStatement, err := db.Prepare(addTargetSQL)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not create AddTarget statement")
-	defer utils.Close(addTargetStatement)
-
 	scanner := bufio.NewScanner(targetsFile)
 	addedCounter, lineCounter := 0, 0
 	for scanner.Scan() {
@@ -93,7 +71,7 @@ func registerTargetsFromFile(db *sql.DB, filename string) {
 
 		utils.Log(utils.List, "Target IP: "+targetIP.String()+",\tValue: "+fmt.Sprint(targetValue))
 
-		_, err := addTargetStatement.Exec(targetIP.String(), targetValue)
+		err := repository.AddTarget(storage.Target{IP: targetIP.String(), Value: targetValue})
 
 		if utils.CheckError(utils.Warning, err, "\tCould not add target (already exists?)") {
 			continue
@@ -104,132 +82,197 @@ func registerTargetsFromFile(db *sql.DB, filename string) {
 		addedCounter++
 	}
 
-	targetsCount := db.QueryRow("SELECT COUNT(*) FROM TargetsInScope")
-	var numTargets int
-	targetsCount.Scan(&numTargets)
+	targets, err := repository.ListTargets()
+	utils.CheckError(utils.Warning, err, "Could not count targets")
+	numTargets := len(targets)
 
 	utils.Log(utils.Done, "Registered", fmt.Sprintf("%d/%d", addedCounter, lineCounter), "targets")
 	utils.Log(utils.Done, "There are now a total of", fmt.Sprint(numTargets), "targets in scope")
 }
 
-// Flag: --init-db
-func initializeDatabase() {
-	utils.Log(utils.Info, "Initializing database")
-	utils.Log(utils.Debug, "If recreating the entire database, please manually remove the database file")
-
-	// Create database file if it doesn't exist
-	if _, err := os.Stat(utils.DatabaseFilepath); os.IsNotExist(err) {
-		dbFile, err := os.Create(utils.DatabaseFilepath)
-		utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not create database file")
+/*
+	Replay every checkin, oldest first, to find what the host holdings
+	should be.
+*/
+func computeHostHoldings(repository storage.Repository) (map[string]utils.HostHolding, error) {
+	holdings := map[string]utils.HostHolding{}
 
-		utils.Log(utils.Done, "Created database file \""+utils.DatabaseFilename+"\"")
-		dbFile.Close()
+	checkins, err := repository.ScoredCheckins()
+	if err != nil {
+		return holdings, err
 	}
 
-	// Open database (file exists)
-	db := utils.GetDatabaseHandle()
-	defer utils.Close(db)
-	if utils.ValidateDatabase(db) { // no need to initialize database if it's already valid
-		utils.Log(utils.Done, "No need to initialize database")
-		return
+	for _, checkin := range checkins {
+		key := utils.HostHoldingKey(checkin.AgentUUID, checkin.TargetIP)
+		holding, ok := holdings[key]
+		if !ok {
+			holding = utils.HostHolding{TeamID: checkin.TeamID, TargetIP: checkin.TargetIP, AgentUUID: checkin.AgentUUID}
+		}
+		holdings[key] = utils.NextHostHolding(holding, checkin.TimeUnix, checkin.CallbackMinutes, checkin.JitterPercent, checkin.TargetValue)
 	}
 
-	const createTablesFile string = "/tools/create_tables.sql" // default
-	createTablesFileContents, err := os.ReadFile(utils.CurrentDirectory + createTablesFile)
-	utils.CheckErrorExit(utils.Error, err, utils.ERR_FILE_READ, "Could not read file \""+createTablesFile+"\"")
+	return holdings, nil
+}
 
-	createTablesCommands := strings.Split(string(createTablesFileContents), ";")
+/*
+	Log every difference between the stored host holdings and the computed
+	ones, returning how many there are.
+*/
+func compareHostHoldings(stored map[string]utils.HostHolding, computed map[string]utils.HostHolding) int {
+	keys := []string{}
+	for key := range computed {
+		keys = append(keys, key)
+	}
+	for key := range stored {
+		if _, ok := computed[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
 
-	for i, command := range createTablesCommands {
-		statement, err := db.Prepare(command)
-		defer utils.Close(statement)
-		if utils.CheckError(utils.Error, err, "Could not create statement for table #"+fmt.Sprint(i+1)) {
+	differences := 0
+	for _, key := range keys {
+		storedHolding, isStored := stored[key]
+		computedHolding, isComputed := computed[key]
+		if isStored && isComputed && storedHolding == computedHolding {
 			continue
 		}
 
-		_, err = statement.Exec()
-		if err != nil {
-			utils.LogError(utils.Error, err, "Could not create tables")
-			os.Exit(utils.ERR_GENERIC)
+		differences++
+		if !isStored {
+			utils.Log(utils.List, "\tMissing holding for "+key+": should be", fmt.Sprintf("%+v", computedHolding))
+		} else if !isComputed {
+			utils.Log(utils.List, "\tHolding for "+key+" has no checkins:", fmt.Sprintf("%+v", storedHolding))
+		} else {
+			utils.Log(utils.List, "\tHolding for "+key+" is", fmt.Sprintf("%+v", storedHolding), "but should be", fmt.Sprintf("%+v", computedHolding))
 		}
 	}
 
-	utils.Log(utils.Done, "Database initialized")
+	return differences
 }
 
-func main() {
-
-	// Flags can be used with '--name' or '-name', doesn't matter.
-	var argInitDB bool
-	var argRegisterTargetsFromFile string
-	var argRegisterTeam bool
-	var argRegisterTeamName string
-	var argRegisterTeamPassword string
-	var argRegisterAgentUUID string
-	var argTeamID int
-
-	flag.BoolVar(&argInitDB, "init-db", false, "Initialize the database by creating the Teams and Agents Sqlite3 tables")
-	flag.StringVar(&argRegisterTargetsFromFile, "register-targets", "", "Add targets by their IP address and point value. Targets are defined in the file \"targets.txt\" in the CSV format \"ip,point_value\".")
-	flag.BoolVar(&argRegisterTeam, "register-team", false, "Create a team with --team-name and --team-password.")
-	flag.StringVar(&argRegisterTeamName, "team-name", "", "The name of the team.")
-	flag.StringVar(&argRegisterTeamPassword, "team-password", "", "The plaintext password for the team (to be hashed with bcrypt).")
-	flag.StringVar(&argRegisterAgentUUID, "register-agent", "", "Register an Agent UUID.")
-	flag.IntVar(&argTeamID, "team-id", -1, "The Team ID the Agent should belong to. (Required if using the `--register-agent` flag)")
-
-	flag.Parse()
-
-	// Flag: --init-db
-	if argInitDB {
-		initializeDatabase()
-		os.Exit(utils.EXIT_SUCCESS)
-	}
+// `pwnts db verify-holdings`
+func VerifyHostHoldings(repository storage.Repository) bool {
+	utils.Log(utils.Info, "Verifying host holdings against every checkin")
 
-	db := utils.GetDatabaseHandle()
-	utils.ValidateDatabaseExit(db)
-	defer utils.Close(db)
+	computed, err := computeHostHoldings(repository)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not compute host holdings")
+	stored, err := repository.HostHoldings()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not retrieve host holdings")
 
-	// Flag: --register-targets
-	if argRegisterTargetsFromFile != "" {
-		registerTargetsFromFile(db, argRegisterTargetsFromFile)
-		os.Exit(utils.EXIT_SUCCESS)
+	differences := compareHostHoldings(stored, computed)
+	if differences != 0 {
+		utils.Log(utils.Error, fmt.Sprint(differences), "of", fmt.Sprint(len(computed)), "host holdings differ, run `pwnts db rebuild-holdings`")
+		return false
 	}
 
-	// Flag: --register-team
-	if argRegisterTeam {
-		if argRegisterTeamName == "" || argRegisterTeamPassword == "" {
-			utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "A `--team-name` and `--team-password` must be provided")
-		}
+	utils.Log(utils.Done, "All", fmt.Sprint(len(computed)), "host holdings match")
+	return true
+}
 
-		passwordHash, err := utils.HashPassword(argRegisterTeamPassword)
-		if err != nil {
-			os.Exit(utils.ERR_INPUT)
-		}
+// `pwnts db rebuild-holdings`
+func RebuildHostHoldings(repository storage.Repository) {
+	utils.Log(utils.Info, "Rebuilding host holdings from every checkin")
+
+	computed, err := computeHostHoldings(repository)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not compute host holdings")
+	stored, err := repository.HostHoldings()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not retrieve host holdings")
 
-		err = utils.RegisterTeam(db, argRegisterTeamName, passwordHash)
-		if utils.CheckError(utils.Error, err, "Could not register Team") {
-			os.Exit(utils.ERR_QUERY)
+	differences := compareHostHoldings(stored, computed)
+	utils.Log(utils.Info, fmt.Sprint(differences), "of", fmt.Sprint(len(computed)), "host holdings were out of date")
+
+	err = repository.ReplaceHostHoldings(computed)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not replace host holdings")
+
+	utils.Log(utils.Done, "Rebuilt", fmt.Sprint(len(computed)), "host holdings")
+}
+
+/*
+	`pwnts db init`: create the tables, or bring them up to date. A SQLite
+	database file is created if it doesn't exist, a PostgreSQL database
+	must already exist.
+*/
+func InitializeDatabase(config utils.DatabaseConfig) {
+	utils.Log(utils.Info, "Initializing database")
+
+	// Create database file if it doesn't exist
+	if config.Backend == utils.DatabaseSQLite {
+		utils.Log(utils.Debug, "If recreating the entire database, please manually remove the database file")
+
+		if _, err := os.Stat(utils.DatabaseFilepath); os.IsNotExist(err) {
+			dbFile, err := os.Create(utils.DatabaseFilepath)
+			utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not create database file")
+
+			utils.Log(utils.Done, "Created database file \""+utils.DatabaseFilename+"\"")
+			dbFile.Close()
 		}
-		os.Exit(utils.EXIT_SUCCESS)
 	}
 
-	// Flag: --register-agent
-	if argRegisterAgentUUID != "" {
-		if argTeamID == -1 {
-			utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "Please specify a `--team-id <integer>`")
-		}
+	repository := storage.OpenExit(config, utils.DatabaseFilepath)
+	defer utils.Close(repository)
+	storage.MigrateExit(repository) // a no-op if it's already initialized and up to date
+
+	utils.Log(utils.Done, "Database initialized")
+}
 
-		validateTeamID(db, argTeamID)
+// `pwnts team add`
+func RegisterTeam(repository storage.Repository, teamName string, teamPassword string) {
+	passwordHash, err := utils.HashPassword(teamPassword)
+	if err != nil {
+		os.Exit(utils.ERR_INPUT)
+	}
+
+	err = storage.RegisterTeam(repository, teamName, passwordHash)
+	if utils.CheckError(utils.Error, err, "Could not register Team") {
+		os.Exit(utils.ERR_QUERY)
+	}
+}
+
+/*
+	`pwnts agent list`: print every Agent of the team, or of every team if
+	`teamID` is -1, with where and when it last called back.
+*/
+func ListAgents(repository storage.Repository, teamID int) {
+	teams, err := repository.ListTeams()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not execute GetTeams statement")
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TEAM\tAGENT\tTYPE\tTARGET\tLAST CHECKIN\tHOST")
 
-		if !utils.RegisterAgent(db, argRegisterAgentUUID, argTeamID) {
-			os.Exit(utils.ERR_GENERIC)
+	numTeams, numAgents := 0, 0
+	for _, team := range teams {
+		if teamID != -1 && team.TeamID != teamID {
+			continue
 		}
-		os.Exit(utils.EXIT_SUCCESS)
+		numTeams++
+
+		inventory, err := repository.AgentInventory(team.TeamID)
+		utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not retrieve the Agents of Team", team.Name)
+
+		for _, entry := range inventory {
+			target, lastCheckin, host := entry.TargetIP, "never", ""
+			if target == "" {
+				target = "-"
+			} else if entry.TargetLocked {
+				target += " (locked)"
+			}
+			if entry.LastCheckinUnix != 0 {
+				lastCheckin = time.Unix(entry.LastCheckinUnix, 0).Format(time.RFC3339) + " from " + entry.LastTargetIP
+			}
+			if entry.Host != nil {
+				host = entry.Host.Hostname + " (" + entry.Host.OS + "/" + entry.Host.Arch + ")"
+			}
+
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", team.Name, entry.AgentUUID, entry.AgentType, target, lastCheckin, host)
+			numAgents++
+		}
+	}
+
+	if numTeams == 0 && teamID != -1 {
+		utils.LogPlainExit(utils.Error, utils.ERR_INPUT, "Team ID "+fmt.Sprint(teamID)+" does not exist")
 	}
 
-	// If this is reached, no command-line flag (action) has been specified.
-	// Print usage
-	utils.LogPlain(utils.Warning, "Please specify an action")
-	utils.MapTypesToColor[utils.Debug].Println("------------------------------------------------------------")
-	flag.Usage()
-	utils.MapTypesToColor[utils.Debug].Println("------------------------------------------------------------")
+	table.Flush()
+	utils.Log(utils.Done, fmt.Sprint(numAgents), "Agents registered to", fmt.Sprint(numTeams), "teams")
 }
@@ -0,0 +1,726 @@
+package main
+
+/*
+	Rehearse an event without any real targets: register fake teams, targets,
+	and Agents in a scratch database, run the Agents as goroutines speaking
+	the real callback protocol to a local callback server, then compare the
+	scoreboard the server produced with the one we expected.
+
+	Each target needs its own local address for its Agents to call back
+	from. By default targets are loopback addresses (127.0.1.1, 127.0.1.2,
+	...), which Linux routes without any setup; on macOS and the BSDs, add
+	them first with `ifconfig lo0 alias 127.0.1.1 up`. With --source-ips,
+	targets are mapped onto any local addresses of your choosing instead.
+
+	Flags:
+		--teams:			Number of teams.
+		--targets:			Number of targets.
+		--agents:			Number of Agents per team, spread over the targets.
+		--target-value:		Point value of each target.
+		--callback-mins:	Every Agent's callback frequency in minutes.
+		--jitter:			Every Agent's callback jitter percentage.
+		--duration:			How long to run the Agents for.
+		--behaviors:		Weights of each Agent behavior, e.g. "steady=4,flaky=2,killed=1,reinfected=1":
+							steady:		calls back on time, every time.
+							flaky:		misses each callback with a probability of --flaky-rate.
+							killed:		calls back on time until --kill-at, then never again.
+							reinfected:	killed at --kill-at, back again from --reinfect-at.
+		--source-ips:		Comma-separated local addresses to use as targets, instead of loopback addresses.
+		--server:			Address of the callback server.
+		--proxy-protocol:	"v1" or "v2" to call back through a redirector run by the simulator, which
+							connects to the server from 127.0.0.1 and sends a PROXY protocol header.
+							The started server trusts it, see `callbacks.trusted_redirectors`.
+		--start-server:		Build and start a callback server on the scratch database. Otherwise one
+							must already be running with `--database` pointing at it.
+		--config:			JSON config file for the started server, whose listeners are replaced
+							by --server. Its `scoring.host_scoring` is used for the expected scoreboard.
+		--database:			Path of the scratch database, a new temporary file by default.
+		--seed:				Random seed, for repeatable runs.
+*/
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/s-christian/pwnts/agent/agentconfig"
+	"github.com/s-christian/pwnts/agent/fingerprint"
+	"github.com/s-christian/pwnts/site/api"
+	"github.com/s-christian/pwnts/storage"
+	"github.com/s-christian/pwnts/utils"
+)
+
+const (
+	BehaviorSteady     string = "steady"
+	BehaviorFlaky      string = "flaky"
+	BehaviorKilled     string = "killed"
+	BehaviorReinfected string = "reinfected"
+)
+
+var (
+	Behaviors []string = []string{BehaviorSteady, BehaviorFlaky, BehaviorKilled, BehaviorReinfected}
+
+	// The scratch server's certificate is self-signed, as is the real one
+	tlsConfig tls.Config = tls.Config{InsecureSkipVerify: true}
+)
+
+type simulatedTarget struct {
+	IP    string
+	Value int
+}
+
+type simulatedAgent struct {
+	UUID     string
+	TeamID   int
+	TeamName string
+	Target   simulatedTarget
+	Behavior string
+	Config   agentconfig.Config // only the callback frequency and jitter are used
+
+	// Unix times of the callbacks the server received, and of failed attempts
+	mutex    sync.Mutex
+	Checkins []int64
+	Failures int
+}
+
+type simulation struct {
+	Targets    []simulatedTarget
+	Agents     []*simulatedAgent
+	Server     string
+	Start      time.Time
+	KillAt     time.Time
+	ReinfectAt time.Time
+	End        time.Time
+	FlakyRate  float64
+}
+
+/*
+	Parse behavior weights such as "steady=4,flaky=2" into the list of
+	behaviors to hand out, each repeated by its weight.
+*/
+func parseBehaviors(weights string) ([]string, error) {
+	var behaviors []string
+	for _, weight := range strings.Split(weights, ",") {
+		weightSplit := strings.SplitN(strings.TrimSpace(weight), "=", 2)
+		if len(weightSplit) != 2 {
+			return nil, errors.New("behavior weights must look like \"steady=4,flaky=2\"")
+		}
+
+		known := false
+		for _, behavior := range Behaviors {
+			known = known || behavior == weightSplit[0]
+		}
+		if !known {
+			return nil, errors.New("unknown behavior '" + weightSplit[0] + "', must be one of: " + strings.Join(Behaviors, ", "))
+		}
+
+		var count int
+		if _, err := fmt.Sscan(weightSplit[1], &count); err != nil || count < 0 {
+			return nil, errors.New("the weight of '" + weightSplit[0] + "' must be a non-negative integer")
+		}
+		for i := 0; i < count; i++ {
+			behaviors = append(behaviors, weightSplit[0])
+		}
+	}
+
+	if len(behaviors) == 0 {
+		return nil, errors.New("at least one behavior must have a weight above 0")
+	}
+	return behaviors, nil
+}
+
+/*
+	The local addresses targets call back from: the given ones, or
+	consecutive loopback addresses. Every one of them must be bindable.
+*/
+func targetIPs(numTargets int, sourceIPs string) ([]string, error) {
+	var ips []string
+	if sourceIPs != "" {
+		for _, sourceIP := range strings.Split(sourceIPs, ",") {
+			ips = append(ips, strings.TrimSpace(sourceIP))
+		}
+		if len(ips) < numTargets {
+			return nil, fmt.Errorf("%d targets need at least as many --source-ips, got %d", numTargets, len(ips))
+		}
+		ips = ips[:numTargets]
+	} else {
+		if numTargets > 254 {
+			return nil, errors.New("at most 254 loopback targets are supported, use --source-ips for more")
+		}
+		for i := 1; i <= numTargets; i++ {
+			ips = append(ips, fmt.Sprintf("127.0.1.%d", i))
+		}
+	}
+
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return nil, errors.New("'" + ip + "' is not a valid IP address")
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			return nil, fmt.Errorf("can't use %s as a source address (add it as a loopback alias?): %w", ip, err)
+		}
+		listener.Close()
+	}
+
+	return ips, nil
+}
+
+// Register the teams, targets, and Agents of the simulation.
+func registerSimulation(repository storage.Repository, sim *simulation, numTeams int, agentsPerTeam int, behaviors []string, random *rand.Rand, agentConfig agentconfig.Config) error {
+	passwordHash, err := utils.HashPassword("simulate")
+	if err != nil {
+		return err
+	}
+
+	for _, target := range sim.Targets {
+		err = repository.AddTarget(storage.Target{IP: target.IP, Value: target.Value})
+		if err != nil {
+			return err
+		}
+	}
+
+	for team := 1; team <= numTeams; team++ {
+		teamName := fmt.Sprintf("sim-team-%d", team)
+		if err = storage.RegisterTeam(repository, teamName, passwordHash); err != nil {
+			return err
+		}
+
+		dbTeam, err := repository.GetTeamByName(teamName)
+		if err != nil {
+			return err
+		}
+		teamID := dbTeam.TeamID
+
+		for i := 0; i < agentsPerTeam; i++ {
+			agent := &simulatedAgent{
+				UUID:     uuid.NewString(),
+				TeamID:   teamID,
+				TeamName: teamName,
+				Target:   sim.Targets[(team+i)%len(sim.Targets)], // teams start on different targets
+				Behavior: behaviors[random.Intn(len(behaviors))],
+				Config:   agentConfig,
+			}
+			agent.Config.AgentUUID = agent.UUID
+
+			registration := utils.AgentRegistration{
+				AgentUUID:       agent.UUID,
+				TeamID:          teamID,
+				AgentType:       utils.AgentTypeBinary,
+				CallbackMinutes: agentConfig.CallbackMinutes,
+				JitterPercent:   agentConfig.JitterPercent,
+				Platform:        "linux/amd64",
+			}
+			if err := storage.RegisterAgent(repository, registration); err != nil {
+				return err
+			}
+
+			sim.Agents = append(sim.Agents, agent)
+		}
+	}
+
+	return nil
+}
+
+// The fingerprint of a simulated target's host.
+func targetFingerprint(target simulatedTarget, pid int) fingerprint.Fingerprint {
+	return fingerprint.Fingerprint{
+		Hostname:  "sim-" + strings.ReplaceAll(target.IP, ".", "-"),
+		OS:        "linux",
+		OSVersion: "Simulated Linux",
+		Arch:      "amd64",
+		MachineID: fmt.Sprintf("%x", []byte(target.IP)),
+		User:      "root",
+		IPs:       []string{target.IP},
+		PID:       pid,
+	}
+}
+
+// Call back once, from the Agent's target, as a real Agent would.
+func sendCheckin(serverAddress string, sourceIP string, message string) error {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(sourceIP)}, Timeout: 10 * time.Second}
+	rawConn, err := dialer.Dial("tcp", serverAddress)
+	if err != nil {
+		return err
+	}
+	defer rawConn.Close()
+
+	conn := tls.Client(rawConn, &tlsConfig)
+	if err = conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	if err = conn.Handshake(); err != nil {
+		return err
+	}
+
+	_, err = conn.Write([]byte(message))
+	return err
+}
+
+/*
+	Run one Agent according to its behavior until the end of the simulation.
+	The first callback is staggered over a few seconds so every Agent
+	doesn't start at the same instant.
+*/
+func runAgent(sim *simulation, agent *simulatedAgent, random *rand.Rand) {
+	pid := 1000 + random.Intn(30000)
+	next := sim.Start.Add(time.Duration(random.Int63n(int64(5 * time.Second))))
+
+	for next.Before(sim.End) {
+		time.Sleep(time.Until(next))
+		now := time.Now()
+
+		killed := (agent.Behavior == BehaviorKilled && !now.Before(sim.KillAt)) ||
+			(agent.Behavior == BehaviorReinfected && !now.Before(sim.KillAt) && now.Before(sim.ReinfectAt))
+		if agent.Behavior == BehaviorKilled && killed {
+			return
+		}
+		if agent.Behavior == BehaviorReinfected && killed {
+			// Reinfected by the same binary, in a new process
+			next = sim.ReinfectAt
+			pid = 1000 + random.Intn(30000)
+			continue
+		}
+
+		skipped := agent.Behavior == BehaviorFlaky && random.Float64() < sim.FlakyRate
+		if !skipped {
+			message := agent.UUID + " " + targetFingerprint(agent.Target, pid).Encode()
+			err := sendCheckin(sim.Server, agent.Target.IP, message)
+
+			agent.mutex.Lock()
+			if err != nil {
+				agent.Failures++
+				utils.LogError(utils.Warning, err, "Agent", agent.UUID, "could not call back")
+			} else {
+				agent.Checkins = append(agent.Checkins, now.Unix())
+			}
+			agent.mutex.Unlock()
+		}
+
+		next = next.Add(agent.Config.CallbackDelay(random.Float64()))
+	}
+}
+
+/*
+	--- Redirector ---
+	: Teams often put a redirector in front of the callback server. This one
+	  speaks the PROXY protocol, so the server still sees each Agent's own
+	  address rather than the redirector's.
+*/
+
+// Where the redirector connects to the callback server from.
+const redirectorIP string = "127.0.0.1"
+
+/*
+	Start a redirector forwarding every connection to the callback server
+	with a PROXY protocol header of the given version ("v1" or "v2").
+	Returns the address Agents should call back to instead.
+*/
+func startRedirector(serverAddress string, version string) (string, error) {
+	listener, err := net.Listen("tcp", redirectorIP+":0")
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		for {
+			agentConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go redirect(agentConn, serverAddress, version)
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
+
+func redirect(agentConn net.Conn, serverAddress string, version string) {
+	defer agentConn.Close()
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(redirectorIP)}, Timeout: 10 * time.Second}
+	serverConn, err := dialer.Dial("tcp", serverAddress)
+	if utils.CheckError(utils.Warning, err, "Redirector could not reach the callback server") {
+		return
+	}
+	defer serverConn.Close()
+
+	header := proxyHeader(version, agentConn.RemoteAddr().(*net.TCPAddr), agentConn.LocalAddr().(*net.TCPAddr))
+	if _, err = serverConn.Write(header); utils.CheckError(utils.Warning, err, "Redirector could not send the PROXY protocol header") {
+		return
+	}
+
+	go io.Copy(serverConn, agentConn)
+	io.Copy(agentConn, serverConn)
+}
+
+// The PROXY protocol header for a TCP connection over IPv4.
+func proxyHeader(version string, source *net.TCPAddr, destination *net.TCPAddr) []byte {
+	if version == "v1" {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", source.IP, destination.IP, source.Port, destination.Port))
+	}
+
+	// Signature, version 2 PROXY command, TCP over IPv4, 12 bytes of addresses
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12)
+	header = append(header, source.IP.To4()...)
+	header = append(header, destination.IP.To4()...)
+	return append(header, byte(source.Port>>8), byte(source.Port), byte(destination.Port>>8), byte(destination.Port))
+}
+
+// Build the callback server and start it on the scratch database.
+func startServer(scratchDirectory string, databasePath string, config utils.Config) (*exec.Cmd, error) {
+	serverBinary := filepath.Join(scratchDirectory, "pwnts")
+	build := exec.Command(config.Builds.GoBinary, "build", "-o", serverBinary, "./cmd/pwnts")
+	build.Dir = utils.CurrentDirectory
+	if output, err := build.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("could not build the callback server: %w\n%s", err, output)
+	}
+
+	configPath := filepath.Join(scratchDirectory, "pwnts.json")
+	configContents, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(configPath, configContents, 0600); err != nil {
+		return nil, err
+	}
+
+	logPath := filepath.Join(scratchDirectory, "server.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run from the repository, where the server's certificate is
+	server := exec.Command(serverBinary, "serve", "callbacks", "--quiet", "--config", configPath, "--database", databasePath)
+	server.Dir = utils.CurrentDirectory
+	server.Stdout, server.Stderr = logFile, logFile
+	if err = server.Start(); err != nil {
+		return nil, err
+	}
+	utils.Log(utils.Done, "Started callback server, logging to", logPath)
+
+	// Wait for it to listen, without connecting: that would count as an invalid payload
+	for i := 0; i < 100; i++ {
+		time.Sleep(100 * time.Millisecond)
+		serverLog, _ := os.ReadFile(logPath)
+		if strings.Contains(string(serverLog), "Listening for Callbacks") {
+			return server, nil
+		}
+	}
+
+	server.Process.Kill()
+	return nil, errors.New("callback server did not start, see " + logPath)
+}
+
+type teamResult struct {
+	ExpectedPwnts, ActualPwnts int
+	ExpectedHosts, ActualHosts int
+}
+
+/*
+	The scoreboard the server should show at `now`, from the callbacks we
+	know it received, scored the same way as `api.GetScoreboardData()`.
+*/
+func expectedScores(sim *simulation, hostScoring string, now time.Time) map[string]*teamResult {
+	results := map[string]*teamResult{}
+
+	type hostPoints struct {
+		best, total, value int
+	}
+	hosts := map[string]map[string]*hostPoints{} // by team, then target
+
+	for _, agent := range sim.Agents {
+		if _, ok := results[agent.TeamName]; !ok {
+			results[agent.TeamName] = &teamResult{}
+			hosts[agent.TeamName] = map[string]*hostPoints{}
+		}
+
+		holding := utils.HostHolding{TeamID: agent.TeamID, TargetIP: agent.Target.IP, AgentUUID: agent.UUID}
+		for _, checkinUnix := range agent.Checkins {
+			holding = utils.NextHostHolding(holding, checkinUnix, agent.Config.CallbackMinutes, agent.Config.JitterPercent, agent.Target.Value)
+		}
+		if holding.LatestUnix == 0 || holding.DeadAfterUnix < now.Unix() {
+			continue
+		}
+
+		host, ok := hosts[agent.TeamName][agent.Target.IP]
+		if !ok {
+			host = &hostPoints{value: agent.Target.Value}
+			hosts[agent.TeamName][agent.Target.IP] = host
+		}
+		if holding.Points > host.best {
+			host.best = holding.Points
+		}
+		host.total += holding.Points
+	}
+
+	for teamName, teamHosts := range hosts {
+		for _, host := range teamHosts {
+			results[teamName].ExpectedPwnts += utils.CombineHostPoints(hostScoring, host.best, host.total, host.value)
+			results[teamName].ExpectedHosts++
+		}
+	}
+
+	return results
+}
+
+func logResult(matches bool, message string) {
+	if matches {
+		utils.Log(utils.Done, message)
+	} else {
+		utils.Log(utils.Error, message)
+	}
+}
+
+/*
+	Compare what the server recorded with what the Agents sent, and the
+	scoreboard with the expected one. Returns the number of differences.
+*/
+func report(repository storage.Repository, sim *simulation, hostScoring string) int {
+	differences := 0
+	now := time.Now()
+
+	/*
+		--- Checkins ---
+	*/
+	utils.Log(utils.Info, "Checkins by behavior, sent vs. recorded:")
+
+	sent, recorded, failed := map[string]int{}, map[string]int{}, map[string]int{}
+	for _, agent := range sim.Agents {
+		dbCheckins, err := repository.CountCheckins(agent.UUID)
+		utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not count checkins")
+
+		sent[agent.Behavior] += len(agent.Checkins)
+		recorded[agent.Behavior] += dbCheckins
+		failed[agent.Behavior] += agent.Failures
+		if dbCheckins != len(agent.Checkins) {
+			differences++
+			utils.Log(utils.List, "\tAgent", agent.UUID, "("+agent.Behavior+") sent", fmt.Sprint(len(agent.Checkins)), "checkins, but", fmt.Sprint(dbCheckins), "were recorded")
+		}
+	}
+	for _, behavior := range Behaviors {
+		logResult(sent[behavior] == recorded[behavior], fmt.Sprintf("\t%-10s  sent %5d  recorded %5d  failed to send %5d", behavior, sent[behavior], recorded[behavior], failed[behavior]))
+	}
+
+	/*
+		--- Callback events ---
+	*/
+	verdictCounts, err := repository.CountVerdicts()
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not count callback events")
+
+	utils.Log(utils.Info, "Callback events by verdict:")
+	for _, verdict := range utils.Verdicts {
+		if verdictCounts[verdict] != 0 {
+			utils.Log(utils.List, fmt.Sprintf("\t%-10s  %5d", verdict, verdictCounts[verdict]))
+		}
+	}
+
+	/*
+		--- Scoreboard ---
+	*/
+	results := expectedScores(sim, hostScoring, now)
+
+	scoreboardData, err := api.GetScoreboardData(repository, hostScoring)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not retrieve the scoreboard")
+	var scoreboard map[string]api.TeamScores
+	err = json.Unmarshal(scoreboardData, &scoreboard)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not parse the scoreboard")
+
+	teamNames := []string{}
+	for teamName, scores := range scoreboard {
+		if _, ok := results[teamName]; !ok {
+			results[teamName] = &teamResult{}
+		}
+		results[teamName].ActualPwnts, results[teamName].ActualHosts = scores.Pwnts, scores.PwnedHosts
+		teamNames = append(teamNames, teamName)
+	}
+	sort.Strings(teamNames)
+
+	utils.Log(utils.Info, "Scoreboard ("+hostScoring+" host scoring), expected vs. actual:")
+	for _, teamName := range teamNames {
+		result := results[teamName]
+		matches := result.ExpectedPwnts == result.ActualPwnts && result.ExpectedHosts == result.ActualHosts
+		if !matches {
+			differences++
+		}
+		logResult(matches, fmt.Sprintf("\t%-12s  pwnts %5d / %5d  hosts %3d / %3d", teamName, result.ExpectedPwnts, result.ActualPwnts, result.ExpectedHosts, result.ActualHosts))
+	}
+
+	return differences
+}
+
+func main() {
+	var argTeams int
+	var argTargets int
+	var argAgents int
+	var argTargetValue int
+	var argCallbackMinutes int
+	var argJitterPercent int
+	var argDuration time.Duration
+	var argBehaviors string
+	var argFlakyRate float64
+	var argKillAt time.Duration
+	var argReinfectAt time.Duration
+	var argSourceIPs string
+	var argServer string
+	var argStartServer bool
+	var argProxyProtocol string
+	var argConfigPath string
+	var argDatabasePath string
+	var argSeed int64
+
+	flag.IntVar(&argTeams, "teams", 3, "Number of teams")
+	flag.IntVar(&argTargets, "targets", 5, "Number of targets")
+	flag.IntVar(&argAgents, "agents", 4, "Number of Agents per team, spread over the targets")
+	flag.IntVar(&argTargetValue, "target-value", 100, "Point value of each target")
+	flag.IntVar(&argCallbackMinutes, "callback-mins", 1, "Every Agent's callback frequency in minutes")
+	flag.IntVar(&argJitterPercent, "jitter", 10, "Every Agent's callback jitter percentage")
+	flag.DurationVar(&argDuration, "duration", 5*time.Minute, "How long to run the Agents for")
+	flag.StringVar(&argBehaviors, "behaviors", "steady=4,flaky=2,killed=1,reinfected=1", "Weights of each Agent behavior: "+strings.Join(Behaviors, ", "))
+	flag.Float64Var(&argFlakyRate, "flaky-rate", 0.3, "Probability of a flaky Agent missing a callback")
+	flag.DurationVar(&argKillAt, "kill-at", 0, "When killed and reinfected Agents stop calling back (default a third of --duration)")
+	flag.DurationVar(&argReinfectAt, "reinfect-at", 0, "When reinfected Agents call back again (default two thirds of --duration)")
+	flag.StringVar(&argSourceIPs, "source-ips", "", "Comma-separated local addresses to use as targets, instead of loopback addresses")
+	flag.StringVar(&argServer, "server", "127.0.0.1:4444", "Address of the callback server")
+	flag.BoolVar(&argStartServer, "start-server", true, "Build and start a callback server on the scratch database")
+	flag.StringVar(&argProxyProtocol, "proxy-protocol", "", "\"v1\" or \"v2\" to call back through a redirector sending PROXY protocol headers")
+	flag.StringVar(&argConfigPath, "config", "", "JSON config file for the started server (default the default configuration)")
+	flag.StringVar(&argDatabasePath, "database", "", "Path of the scratch database (default a new temporary file)")
+	flag.Int64Var(&argSeed, "seed", time.Now().UnixNano(), "Random seed, for repeatable runs")
+	flag.Parse()
+
+	if argTeams < 1 || argTargets < 1 || argAgents < 1 || argTargetValue < 1 {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "--teams, --targets, --agents, and --target-value must be at least 1")
+	}
+	if argCallbackMinutes < 1 || argJitterPercent < 0 || argJitterPercent > 100 {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "--callback-mins must be at least 1 and --jitter between 0 and 100")
+	}
+	if argKillAt == 0 {
+		argKillAt = argDuration / 3
+	}
+	if argReinfectAt == 0 {
+		argReinfectAt = argDuration * 2 / 3
+	}
+	if argReinfectAt < argKillAt {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "--reinfect-at must not be before --kill-at")
+	}
+	if argProxyProtocol != "" && argProxyProtocol != "v1" && argProxyProtocol != "v2" {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "--proxy-protocol must be \"v1\" or \"v2\"")
+	}
+
+	behaviors, err := parseBehaviors(argBehaviors)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_USAGE, "Invalid --behaviors")
+
+	ips, err := targetIPs(argTargets, argSourceIPs)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_USAGE, "Invalid targets")
+
+	config := utils.DefaultConfig()
+	if argConfigPath != "" {
+		config = utils.LoadConfigExit(argConfigPath)
+	}
+	config.Callbacks.Listeners = []string{argServer}
+	if argProxyProtocol != "" {
+		redirectorNetwork, _ := utils.ParseIPNetwork(redirectorIP)
+		config.Callbacks.Redirectors = append(config.Callbacks.Redirectors, redirectorNetwork)
+	}
+
+	/*
+		--- Scratch database ---
+	*/
+	scratchDirectory, err := os.MkdirTemp("", "pwnts-simulate-")
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not create a scratch directory")
+	if argDatabasePath == "" {
+		argDatabasePath = filepath.Join(scratchDirectory, utils.DatabaseFilename)
+	}
+	if _, err = os.Stat(argDatabasePath); err == nil {
+		utils.LogPlainExit(utils.Error, utils.ERR_USAGE, "'"+argDatabasePath+"' already exists, the scratch database must be new")
+	}
+
+	utils.DatabaseFilepath = argDatabasePath
+	repository, err := storage.OpenSQLite(argDatabasePath)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_CONNECTION, "Could not open the scratch database")
+	defer utils.Close(repository)
+
+	storage.MigrateExit(repository)
+	utils.Log(utils.Done, "Created scratch database", argDatabasePath)
+
+	random := rand.New(rand.NewSource(argSeed))
+	sim := &simulation{Server: argServer, FlakyRate: argFlakyRate}
+	for _, ip := range ips {
+		sim.Targets = append(sim.Targets, simulatedTarget{IP: ip, Value: argTargetValue})
+	}
+
+	agentConfig := agentconfig.Config{CallbackMinutes: argCallbackMinutes, JitterPercent: argJitterPercent}
+	err = registerSimulation(repository, sim, argTeams, argAgents, behaviors, random, agentConfig)
+	utils.CheckErrorExit(utils.Error, err, utils.ERR_QUERY, "Could not register the simulation")
+	utils.Log(utils.Done, "Registered", fmt.Sprint(argTeams), "teams,", fmt.Sprint(len(sim.Targets)), "targets, and", fmt.Sprint(len(sim.Agents)), "Agents (seed "+fmt.Sprint(argSeed)+")")
+
+	/*
+		--- Callback server ---
+	*/
+	var server *exec.Cmd
+	if argStartServer {
+		server, err = startServer(scratchDirectory, argDatabasePath, config)
+		utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not start the callback server")
+	} else {
+		utils.Log(utils.Info, "Using the callback server at", argServer+", it must be running with `--database", argDatabasePath+"`")
+	}
+
+	if argProxyProtocol != "" {
+		sim.Server, err = startRedirector(argServer, argProxyProtocol)
+		utils.CheckErrorExit(utils.Error, err, utils.ERR_GENERIC, "Could not start the redirector")
+		utils.Log(utils.Done, "Agents call back through a PROXY protocol", argProxyProtocol, "redirector at", sim.Server+", the server must trust", redirectorIP, "as a redirector")
+	}
+
+	/*
+		--- Run the Agents ---
+	*/
+	sim.Start = time.Now()
+	sim.KillAt, sim.ReinfectAt, sim.End = sim.Start.Add(argKillAt), sim.Start.Add(argReinfectAt), sim.Start.Add(argDuration)
+	utils.Log(utils.Info, "Running Agents until", sim.End.Format(time.RFC3339)+", killing Agents at", sim.KillAt.Format(time.RFC3339), "and reinfecting at", sim.ReinfectAt.Format(time.RFC3339))
+
+	var agentsRunning sync.WaitGroup
+	for _, agent := range sim.Agents {
+		agentsRunning.Add(1)
+		go func(agent *simulatedAgent, random *rand.Rand) {
+			defer agentsRunning.Done()
+			runAgent(sim, agent, random)
+		}(agent, rand.New(rand.NewSource(random.Int63())))
+	}
+	agentsRunning.Wait()
+
+	if server != nil {
+		// Shutting down gracefully commits the last callbacks before the report reads them
+		server.Process.Signal(os.Interrupt)
+		server.Wait()
+	} else {
+		// Give the server's writer a moment to commit the last callbacks
+		time.Sleep(2 * time.Second)
+	}
+
+	/*
+		--- Report ---
+	*/
+	differences := report(repository, sim, config.Scoring.HostScoring)
+	utils.Log(utils.Info, "Scratch database and logs are in", scratchDirectory)
+	if differences != 0 {
+		utils.Log(utils.Error, fmt.Sprint(differences), "differences between the expected and actual results")
+		os.Exit(utils.ERR_DATABASE_INVALID)
+	}
+	utils.Log(utils.Done, "The server's results match the expected ones")
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+const (
+	DatabaseFilename string = "pwnts.db" // default, for the SQLite backend
+
+	ERR_DATABASE_INVALID int = 20
+	ERR_STATEMENT        int = 21
+	ERR_QUERY            int = 22
+	ERR_SCAN             int = 23
+)
+
+var (
+	CurrentDirectory, _        = os.Getwd()
+	DatabaseFilepath    string = CurrentDirectory + "/server/" + DatabaseFilename // default
+)
+
+/*
+	Utiliy to close an object that implements the `io.Closer` interface. Used
+	over `object.Close()` for automatic error checking.
+*/
+func Close(closable io.Closer) {
+	CheckError(Error, closable.Close(), "Failed to close")
+}
+
+/*
+	If err != nil, database error.
+	If err == nil and hash == "", user doesn't exist.
+*/
+// func GetUserPasswordHash(db *sql.DB, username string) (string, error) {
+// 	var dbPasswordHash string
+
+// 	getUserPasswordHashSQL := `
+// 		SELECT password_hash
+// 		FROM Teams
+// 		WHERE name = ?
+// 	`
+// 	getUserPasswordHashStatement, err := db.Prepare(getUserPasswordHashSQL)
+// 	if err != nil {
+// 		return dbPasswordHash, err
+// 	}
+
+// 	passwordHashRow := getUserPasswordHashStatement.QueryRow(username)
+// 	Close(getUserPasswordHashStatement)
+
+// 	err = passwordHashRow.Scan(&dbPasswordHash)
+// 	// We don't want to return an error if the user simply doesn't exist
+// 	if err != nil && err != sql.ErrNoRows {
+// 		return dbPasswordHash, err
+// 	}
+
+// 	return dbPasswordHash, nil // return hash; if hash == "", user doesn't exist
+// }
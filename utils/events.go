@@ -0,0 +1,31 @@
+// Callback events, the audit log of every connection to the callback server.
+package utils
+
+// What the callback server made of a connection.
+const (
+	VerdictAccepted string = "accepted" // checkin recorded and scored
+	VerdictTest     string = "test"     // an Agent testing its connection, nothing recorded
+	VerdictRejected string = "rejected" // a checkin that wasn't counted, see the event's reason
+	VerdictInvalid  string = "invalid"  // not an Agent checkin at all
+	VerdictError    string = "error"    // the server failed to process it
+)
+
+// What a connection claimed to be.
+const (
+	MessageNone    string = "none"    // nothing was received
+	MessageUnknown string = "unknown" // didn't start with an Agent UUID
+	MessageTest    string = "test"    // "<UUID> TEST"
+	MessageCheckin string = "checkin" // "<UUID>", optionally followed by a host fingerprint
+)
+
+var Verdicts []string = []string{VerdictAccepted, VerdictTest, VerdictRejected, VerdictInvalid, VerdictError}
+
+// Whether the string is one of the known `Verdicts`.
+func IsVerdict(verdict string) bool {
+	for _, knownVerdict := range Verdicts {
+		if verdict == knownVerdict {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+/*
+	Host holdings, the scoring state of each Agent on each target it has
+	called back from. The callback server updates an Agent's holding with
+	every checkin (see `storage.Tx`), so the scoreboard never has to scan
+	`AgentCheckins`.
+	`pwnts db rebuild-holdings` recomputes them from the raw checkins.
+*/
+package utils
+
+import (
+	"time"
+)
+
+type HostHolding struct {
+	TeamID        int
+	TargetIP      string
+	AgentUUID     string
+	LatestUnix    int64
+	PreviousUnix  int64 // 0 if the Agent has only called back once
+	Points        int   // as of the latest checkin, see `ScoreAgentOnTarget()`
+	Streak        int   // checkins in a row, each within the Agent's callback window of the one before
+	DeadAfterUnix int64 // when the Agent is considered dead unless it calls back again
+}
+
+/*
+	The holding after another checkin, from an Agent with the given callback
+	frequency and jitter on a target with the given value. `holding` is the
+	zero value for the Agent's first checkin on the target.
+*/
+func NextHostHolding(holding HostHolding, checkinUnix int64, callbackMinutes int, jitterPercent int, targetValue int) HostHolding {
+	holding.PreviousUnix, holding.LatestUnix = holding.LatestUnix, checkinUnix
+
+	checkinTime := time.Unix(checkinUnix, 0)
+	holding.Points, _ = ScoreAgentOnTarget(checkinTime, holding.LatestUnix, holding.PreviousUnix, callbackMinutes, jitterPercent, targetValue)
+	holding.DeadAfterUnix = checkinTime.Add(AgentDeadAfter(callbackMinutes, jitterPercent)).Unix()
+
+	_, maximum := CallbackWindow(callbackMinutes, jitterPercent)
+	if holding.PreviousUnix != 0 && checkinTime.Sub(time.Unix(holding.PreviousUnix, 0)) <= maximum {
+		holding.Streak++
+	} else {
+		holding.Streak = 1
+	}
+
+	return holding
+}
+
+// Holdings are kept by Agent and target.
+func HostHoldingKey(agentUUID string, targetIP string) string {
+	return agentUUID + " " + targetIP
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextHostHolding(t *testing.T) {
+	start := int64(1000000)
+	minutes := func(n int) int64 { return start + int64(n*60) }
+
+	tests := []struct {
+		name            string
+		callbackMinutes int
+		jitterPercent   int
+		checkins        []int64
+		want            HostHolding // after the last checkin
+	}{
+		{"first checkin", 5, 0, []int64{start},
+			HostHolding{LatestUnix: start, Points: 100, Streak: 1, DeadAfterUnix: minutes(15)}},
+		{"on time", 5, 0, []int64{start, minutes(5), minutes(10)},
+			HostHolding{LatestUnix: minutes(10), PreviousUnix: minutes(5), Points: 52, Streak: 3, DeadAfterUnix: minutes(25)}},
+		{"late breaks the streak", 5, 0, []int64{start, minutes(5), minutes(25)},
+			HostHolding{LatestUnix: minutes(25), PreviousUnix: minutes(5), Points: 1, Streak: 1, DeadAfterUnix: minutes(40)}},
+		{"streak starts again", 5, 0, []int64{start, minutes(20), minutes(25)},
+			HostHolding{LatestUnix: minutes(25), PreviousUnix: minutes(20), Points: 52, Streak: 2, DeadAfterUnix: minutes(40)}},
+		{"jittered", 10, 50, []int64{start, minutes(14), minutes(20)},
+			HostHolding{LatestUnix: minutes(20), PreviousUnix: minutes(14), Points: 23, Streak: 3, DeadAfterUnix: minutes(35) + 1}},
+	}
+	for _, test := range tests {
+		holding := HostHolding{TeamID: 3, TargetIP: "10.0.0.7", AgentUUID: "agent"}
+		for _, checkinUnix := range test.checkins {
+			holding = NextHostHolding(holding, checkinUnix, test.callbackMinutes, test.jitterPercent, 100)
+		}
+
+		test.want.TeamID, test.want.TargetIP, test.want.AgentUUID = 3, "10.0.0.7", "agent"
+		if holding != test.want {
+			t.Errorf("%s: NextHostHolding() = %+v, want %+v", test.name, holding, test.want)
+		}
+	}
+}
+
+// A holding must score the same as scoring its checkins directly.
+func TestNextHostHoldingMatchesScore(t *testing.T) {
+	holding := HostHolding{}
+	checkinUnix := int64(1000000)
+	for _, gap := range []time.Duration{0, 3 * time.Minute, 3 * time.Minute, 7 * time.Minute, 16 * time.Minute, 3 * time.Minute} {
+		checkinUnix += int64(gap / time.Second)
+		holding = NextHostHolding(holding, checkinUnix, 3, 10, 100)
+
+		points, alive := ScoreAgentOnTarget(time.Unix(checkinUnix, 0), holding.LatestUnix, holding.PreviousUnix, 3, 10, 100)
+		if !alive || points != holding.Points {
+			t.Errorf("After a %s gap the holding has %d points, scoring it gives %d (alive %v)", gap, holding.Points, points, alive)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Refills at `rate` tokens per second, up to `burst` tokens.
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+func (bucket *tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	if bucket.lastRefill.IsZero() {
+		bucket.tokens = burst
+	} else {
+		bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+	}
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (bucket *tokenBucket) full(now time.Time, rate float64, burst float64) bool {
+	return bucket.lastRefill.IsZero() || bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*rate >= burst
+}
+
+type sourceState struct {
+	inScope     bool // as of its last connection, decides which limits apply
+	connections tokenBucket
+	handshakes  tokenBucket
+	invalid     int // invalid payloads in a row, reset by a valid one
+	bannedUntil time.Time
+
+	// Counted since the last `TakeSourceChanges()`
+	throttled       int64
+	lastThrottled   time.Time
+	invalidPayloads int64
+	bans            int64
+}
+
+/*
+	What happened to a source since the last `TakeSourceChanges()`, for the
+	admins' view of throttled and banned sources.
+*/
+type SourceChange struct {
+	SourceIP          string
+	Throttled         int64 // connections refused by the rate limits or a ban
+	LastThrottledUnix int64 // 0 if not throttled
+	InvalidPayloads   int64
+	Bans              int64
+	BannedUntilUnix   int64 // 0 if not banned
+}
+
+/*
+	Rate limits connections and TLS handshakes per source IP with token
+	buckets, and bans sources that keep sending invalid payloads. Sources
+	`inScope` (the targets in scope) get their own, higher limits, so a
+	flood from them takes far more than their Agents' callbacks, but
+	they're still limited and banned.
+*/
+type SourceLimiter struct {
+	limits        LimitConfig
+	inScopeLimits LimitConfig
+	mutex         sync.Mutex
+	sources       map[string]*sourceState
+}
+
+func NewSourceLimiter(limits LimitConfig, inScopeLimits LimitConfig) *SourceLimiter {
+	return &SourceLimiter{limits: limits, inScopeLimits: inScopeLimits, sources: map[string]*sourceState{}}
+}
+
+// Apply new limits to every source, e.g. after the config is reloaded.
+func (limiter *SourceLimiter) SetLimits(limits LimitConfig, inScopeLimits LimitConfig) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.limits, limiter.inScopeLimits = limits, inScopeLimits
+}
+
+func (limiter *SourceLimiter) source(sourceIP string, inScope bool) *sourceState {
+	state, ok := limiter.sources[sourceIP]
+	if !ok {
+		state = &sourceState{}
+		limiter.sources[sourceIP] = state
+	}
+	state.inScope = inScope
+	return state
+}
+
+// The limits of a source, whether it's in scope or not.
+func (limiter *SourceLimiter) limitsFor(state *sourceState) LimitConfig {
+	if state.inScope {
+		return limiter.inScopeLimits
+	}
+	return limiter.limits
+}
+
+func (limiter *SourceLimiter) throttle(state *sourceState, now time.Time) {
+	state.throttled++
+	state.lastThrottled = now
+}
+
+/*
+	Whether to accept a new connection from the source, within the limits
+	for whether it's `inScope`. Returns the reason if not.
+*/
+func (limiter *SourceLimiter) AllowConnection(sourceIP string, now time.Time, inScope bool) (allowed bool, reason string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	state := limiter.source(sourceIP, inScope)
+	limits := limiter.limitsFor(state)
+	if now.Before(state.bannedUntil) {
+		limiter.throttle(state, now)
+		return false, "banned until " + state.bannedUntil.Format(time.RFC3339)
+	}
+	if !state.connections.take(now, limits.ConnectionsPerMinute/60, float64(limits.ConnectionBurst)) {
+		limiter.throttle(state, now)
+		return false, "connection rate exceeded"
+	}
+	return true, ""
+}
+
+// Whether the source may start another TLS handshake, within the limits for whether it's `inScope`.
+func (limiter *SourceLimiter) AllowHandshake(sourceIP string, now time.Time, inScope bool) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	state := limiter.source(sourceIP, inScope)
+	limits := limiter.limitsFor(state)
+	if !state.handshakes.take(now, limits.HandshakesPerMinute/60, float64(limits.HandshakeBurst)) {
+		limiter.throttle(state, now)
+		return false
+	}
+	return true
+}
+
+/*
+	Count an invalid payload from the source, banning it for
+	`ban_duration` once it has sent `max_invalid` in a row, both from the
+	limits for whether it's `inScope`. Returns when the ban ends, zero if
+	it wasn't banned.
+*/
+func (limiter *SourceLimiter) RecordInvalid(sourceIP string, now time.Time, inScope bool) (bannedUntil time.Time) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	state := limiter.source(sourceIP, inScope)
+	limits := limiter.limitsFor(state)
+	state.invalid++
+	state.invalidPayloads++
+	if limits.MaxInvalid == 0 || state.invalid < limits.MaxInvalid {
+		return
+	}
+
+	state.invalid = 0
+	state.bans++
+	state.bannedUntil = now.Add(limits.BanDuration.Duration)
+	return state.bannedUntil
+}
+
+// A valid payload from the source, its invalid ones no longer count toward a ban.
+func (limiter *SourceLimiter) RecordValid(sourceIP string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if state, ok := limiter.sources[sourceIP]; ok {
+		state.invalid = 0
+	}
+}
+
+/*
+	Ban a source until the given time, e.g. to restore bans after a
+	restart, whether it's in scope or not.
+*/
+func (limiter *SourceLimiter) Ban(sourceIP string, until time.Time) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	state, ok := limiter.sources[sourceIP]
+	if !ok {
+		state = &sourceState{}
+		limiter.sources[sourceIP] = state
+	}
+	state.bannedUntil = until
+}
+
+/*
+	Return and reset what happened to each source since the last call, and
+	forget sources that have nothing left to remember.
+*/
+func (limiter *SourceLimiter) TakeSourceChanges(now time.Time) (changes []SourceChange) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for sourceIP, state := range limiter.sources {
+		if state.throttled > 0 || state.invalidPayloads > 0 || state.bans > 0 {
+			change := SourceChange{
+				SourceIP:        sourceIP,
+				Throttled:       state.throttled,
+				InvalidPayloads: state.invalidPayloads,
+				Bans:            state.bans,
+			}
+			if state.throttled > 0 {
+				change.LastThrottledUnix = state.lastThrottled.Unix()
+			}
+			if now.Before(state.bannedUntil) {
+				change.BannedUntilUnix = state.bannedUntil.Unix()
+			}
+			changes = append(changes, change)
+
+			state.throttled, state.invalidPayloads, state.bans = 0, 0, 0
+		}
+
+		limits := limiter.limitsFor(state)
+		idle := state.invalid == 0 && !now.Before(state.bannedUntil) &&
+			state.connections.full(now, limits.ConnectionsPerMinute/60, float64(limits.ConnectionBurst)) &&
+			state.handshakes.full(now, limits.HandshakesPerMinute/60, float64(limits.HandshakeBurst))
+		if idle {
+			delete(limiter.sources, sourceIP)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func testLimits() LimitConfig {
+	return LimitConfig{
+		ConnectionsPerMinute: 60,
+		ConnectionBurst:      3,
+		HandshakesPerMinute:  60,
+		HandshakeBurst:       2,
+		MaxInvalid:           2,
+		BanDuration:          Duration{time.Minute},
+	}
+}
+
+func testInScopeLimits() LimitConfig {
+	return LimitConfig{
+		ConnectionsPerMinute: 60,
+		ConnectionBurst:      6,
+		HandshakesPerMinute:  60,
+		HandshakeBurst:       4,
+		MaxInvalid:           4,
+		BanDuration:          Duration{time.Minute},
+	}
+}
+
+func TestLimitsApplyOutOfScope(t *testing.T) {
+	limiter := NewSourceLimiter(testLimits(), testInScopeLimits())
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if allowed, reason := limiter.AllowConnection("10.0.0.1", now, false); !allowed {
+			t.Fatalf("Connection %d refused within the burst: %s", i+1, reason)
+		}
+	}
+	if allowed, _ := limiter.AllowConnection("10.0.0.1", now, false); allowed {
+		t.Error("Connection past the burst allowed")
+	}
+	if allowed, _ := limiter.AllowConnection("10.0.0.1", now.Add(time.Second), false); !allowed {
+		t.Error("Connection refused once the bucket refilled")
+	}
+
+	for i := 0; i < 2; i++ {
+		if !limiter.AllowHandshake("10.0.0.1", now, false) {
+			t.Fatalf("Handshake %d refused within the burst", i+1)
+		}
+	}
+	if limiter.AllowHandshake("10.0.0.1", now, false) {
+		t.Error("Handshake past the burst allowed")
+	}
+
+	// Other sources have their own buckets
+	if allowed, _ := limiter.AllowConnection("10.0.0.2", now, false); !allowed {
+		t.Error("Another source's connection refused")
+	}
+
+	limiter.RecordInvalid("10.0.0.1", now, false)
+	if bannedUntil := limiter.RecordInvalid("10.0.0.1", now, false); !bannedUntil.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Source banned until %v after max_invalid invalid payloads, want %v", bannedUntil, now.Add(time.Minute))
+	}
+	if allowed, reason := limiter.AllowConnection("10.0.0.1", now.Add(30*time.Second), false); allowed || reason == "" {
+		t.Error("Banned source's connection allowed")
+	}
+}
+
+func TestTargetsInScopeHaveTheirOwnLimits(t *testing.T) {
+	limiter := NewSourceLimiter(testLimits(), testInScopeLimits())
+	now := time.Unix(1700000000, 0)
+
+	// Past the limits of sources out of scope, up to their own
+	for i := 0; i < 6; i++ {
+		if allowed, reason := limiter.AllowConnection("10.0.0.1", now, true); !allowed {
+			t.Fatalf("Connection %d from a target in scope refused within its burst: %s", i+1, reason)
+		}
+	}
+	if allowed, _ := limiter.AllowConnection("10.0.0.1", now, true); allowed {
+		t.Error("Connection from a target in scope allowed past its burst")
+	}
+	for i := 0; i < 4; i++ {
+		if !limiter.AllowHandshake("10.0.0.1", now, true) {
+			t.Fatalf("Handshake %d from a target in scope refused within its burst", i+1)
+		}
+	}
+	if limiter.AllowHandshake("10.0.0.1", now, true) {
+		t.Error("Handshake from a target in scope allowed past its burst")
+	}
+
+	// Banned after their own max_invalid
+	for i := 0; i < 3; i++ {
+		if bannedUntil := limiter.RecordInvalid("10.0.0.1", now, true); !bannedUntil.IsZero() {
+			t.Fatalf("Target in scope banned after %d invalid payloads, want 4", i+1)
+		}
+	}
+	if bannedUntil := limiter.RecordInvalid("10.0.0.1", now, true); !bannedUntil.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Target in scope banned until %v after 4 invalid payloads, want %v", bannedUntil, now.Add(time.Minute))
+	}
+	if allowed, reason := limiter.AllowConnection("10.0.0.1", now.Add(30*time.Second), true); allowed || reason == "" {
+		t.Error("Banned target's connection allowed")
+	}
+
+	// A restored ban applies to them too
+	limiter.Ban("10.0.0.2", now.Add(time.Hour))
+	if allowed, _ := limiter.AllowConnection("10.0.0.2", now, true); allowed {
+		t.Error("Connection from a target in scope with a restored ban allowed")
+	}
+
+	changes := limiter.TakeSourceChanges(now)
+	if len(changes) != 2 {
+		t.Fatalf("TakeSourceChanges() = %+v, want both targets", changes)
+	}
+	for _, change := range changes {
+		if change.Throttled == 0 || change.BannedUntilUnix == 0 {
+			t.Errorf("%s wasn't throttled and banned: %+v", change.SourceIP, change)
+		}
+	}
+}
@@ -27,6 +27,7 @@ const (
 	ERR_INPUT     int = 11
 	ERR_UUID      int = 12
 	ERR_FILE_READ int = 13
+	ERR_CONFIG    int = 14
 
 	ERR_CONNECTION int = 30
 	ERR_WRITE      int = 31
@@ -0,0 +1,77 @@
+// Lists of IP networks, for deciding which peers to trust.
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+)
+
+/*
+	A list of IP networks, written in the JSON config file as IP addresses
+	and CIDRs, e.g. ["10.0.0.5", "192.168.50.0/24", "2001:db8::/32"]. A
+	single address is a network of just that address.
+*/
+type IPNetworks []*net.IPNet
+
+// Parse an IP address or a CIDR.
+func ParseIPNetwork(network string) (*net.IPNet, error) {
+	if strings.Contains(network, "/") {
+		_, ipNetwork, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, errors.New("invalid CIDR '" + network + "'")
+		}
+		return ipNetwork, nil
+	}
+
+	ip := net.ParseIP(network)
+	if ip == nil {
+		return nil, errors.New("invalid IP address '" + network + "'")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Whether any of the networks contains the IP address.
+func (networks IPNetworks) Contains(ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Same as `Contains()`, for an IP address that hasn't been parsed. Invalid ones are in no network.
+func (networks IPNetworks) ContainsString(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	return parsedIP != nil && networks.Contains(parsedIP)
+}
+
+func (networks IPNetworks) MarshalJSON() ([]byte, error) {
+	networkStrings := []string{}
+	for _, network := range networks {
+		networkStrings = append(networkStrings, network.String())
+	}
+	return json.Marshal(networkStrings)
+}
+
+func (networks *IPNetworks) UnmarshalJSON(data []byte) error {
+	var networkStrings []string
+	if err := json.Unmarshal(data, &networkStrings); err != nil {
+		return errors.New("networks must be a list of strings such as \"10.0.0.5\" or \"192.168.50.0/24\"")
+	}
+
+	*networks = IPNetworks{}
+	for _, networkString := range networkStrings {
+		network, err := ParseIPNetwork(networkString)
+		if err != nil {
+			return err
+		}
+		*networks = append(*networks, network)
+	}
+	return nil
+}
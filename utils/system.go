@@ -2,8 +2,32 @@ package utils
 
 import (
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
+/*
+	Block until SIGINT or SIGTERM, calling `reload` on every SIGHUP in the
+	meantime. After that, a second SIGINT or SIGTERM kills the process
+	without waiting for its shutdown to finish.
+*/
+func WaitForShutdown(reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for received := range signals {
+		if received == syscall.SIGHUP {
+			reload()
+			continue
+		}
+
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		Log(Info, "Received", received.String()+", shutting down")
+		return
+	}
+}
+
 // Get preferred outbound IP address of this machine
 func GetHostIP() (hostIP net.IP) {
 	netInterfaceAddresses, err := net.InterfaceAddrs()
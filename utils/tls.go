@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"sync"
+)
+
+/*
+	Return the hex-encoded SHA-256 hash of the certificate's public key
+	(SubjectPublicKeyInfo). Agents pin this value to make sure they're
+	talking to our callback server.
+*/
+func GetCertificateKeyPin(certPath string) (string, error) {
+	certFileContents, err := os.ReadFile(certPath)
+	if err != nil {
+		return "", err
+	}
+
+	certBlock, _ := pem.Decode(certFileContents)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return "", errors.New("no PEM certificate found")
+	}
+
+	return certificateKeyPin(certBlock.Bytes)
+}
+
+func certificateKeyPin(certDER []byte) (string, error) {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return "", err
+	}
+
+	keyHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(keyHash[:]), nil
+}
+
+/*
+	Read a PEM file of CA certificates, to check the certificates the other
+	side of a connection presents against.
+*/
+func LoadCertificatePool(caPath string) (*x509.CertPool, error) {
+	caFileContents, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caFileContents) {
+		return nil, errors.New("no PEM certificate found in '" + caPath + "'")
+	}
+	return pool, nil
+}
+
+/*
+	A TLS certificate that can be replaced while listeners keep serving it,
+	for reloading renewed certificates without dropping connections. Use
+	`GetCertificate` as the `tls.Config` field of the same name.
+*/
+type ReloadableCertificate struct {
+	certPath string
+	keyPath  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func LoadReloadableCertificate(certPath string, keyPath string) (*ReloadableCertificate, error) {
+	reloadable := &ReloadableCertificate{certPath: certPath, keyPath: keyPath}
+	return reloadable, reloadable.Reload()
+}
+
+// Read the certificate again. The current one is kept if that fails.
+func (reloadable *ReloadableCertificate) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(reloadable.certPath, reloadable.keyPath)
+	if err != nil {
+		return err
+	}
+
+	reloadable.mutex.Lock()
+	reloadable.certificate = &certificate
+	reloadable.mutex.Unlock()
+	return nil
+}
+
+func (reloadable *ReloadableCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloadable.mutex.RLock()
+	defer reloadable.mutex.RUnlock()
+
+	return reloadable.certificate, nil
+}
+
+// The key pin (see `GetCertificateKeyPin()`) of the certificate currently being served.
+func (reloadable *ReloadableCertificate) KeyPin() (string, error) {
+	reloadable.mutex.RLock()
+	defer reloadable.mutex.RUnlock()
+
+	return certificateKeyPin(reloadable.certificate.Certificate[0])
+}
+
+// The same as `GetCertificate`, for the client side of a connection.
+func (reloadable *ReloadableCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return reloadable.GetCertificate(nil)
+}
+
+// The subject common name of the certificate currently being served.
+func (reloadable *ReloadableCertificate) CommonName() (string, error) {
+	reloadable.mutex.RLock()
+	defer reloadable.mutex.RUnlock()
+
+	cert, err := x509.ParseCertificate(reloadable.certificate.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
+}
@@ -1,35 +1,48 @@
-// Utility functions used be `site/site.go` and `tools/databaseTools.go`.
+// Utility functions used by the site and the `pwnts` administration commands.
 // Functions in `web.go` should generally not interrupt the flow of the application by exiting on error. Instead, they should return their error status to be handled by the calling function.
 package utils
 
 import (
-	"database/sql"
 	"errors"
-	"fmt"
 
 	//"html/template"
 	"encoding/json"
 	"math"
-	"math/rand"
+	"net"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/golang-jwt/jwt"
-	"github.com/google/uuid"
 )
 
 const (
 	MaxCallbackTime   time.Duration = 15 * time.Minute
 	MaxTeamNameLength int           = 64
+
+	// Allowance for clock drift and network latency between two callbacks.
+	// In testing, callbacks have rarely came back 59 seconds apart instead of 60.
+	CallbackTolerance time.Duration = 1 * time.Second
+
+	// Kinds of Agents, stored in `Agents.agent_type`
+	AgentTypeBinary     string = "binary"
+	AgentTypeSh         string = "sh"
+	AgentTypePython     string = "python"
+	AgentTypePowerShell string = "powershell"
 )
 
 var (
 	JWTSigningKey []byte = []byte("supersecretsecret")
+
+	AgentTypes []string = []string{AgentTypeBinary, AgentTypeSh, AgentTypePython, AgentTypePowerShell}
+
+	// The site's `site.trusted_proxies`, see `SetTrustedProxies()`
+	trustedProxies      IPNetworks
+	trustedProxiesMutex sync.RWMutex
 )
 
 // https://pkg.go.dev/encoding/json#Marshal
@@ -38,6 +51,18 @@ type (
 		Message string `json:"message"`
 		Error   bool   `json:"error"`
 	}
+
+	// An Agent as it's generated, see `RegisterAgent()`.
+	AgentRegistration struct {
+		AgentUUID       string
+		TeamID          int
+		AgentType       string
+		CallbackMinutes int // 0 if unknown
+		JitterPercent   int
+		LocalPort       int    // the source port the Agent binds, 0 if it can't
+		Platform        string // "os/arch[/variant]" for binary Agents, empty if unknown
+		TargetIP        string // the only target the Agent may call back from, empty for any
+	}
 )
 
 /*
@@ -97,17 +122,117 @@ func ValidateFormData(writer http.ResponseWriter, request *http.Request, formDat
 	}
 }
 
+/*
+	Set the reverse proxies whose forwarding headers `GetUserIP()` believes.
+	The site calls this on startup and on every reload.
+*/
+func SetTrustedProxies(networks IPNetworks) {
+	trustedProxiesMutex.Lock()
+	trustedProxies = networks
+	trustedProxiesMutex.Unlock()
+}
+
+func isTrustedProxy(ip string) bool {
+	trustedProxiesMutex.RLock()
+	defer trustedProxiesMutex.RUnlock()
+
+	return trustedProxies.ContainsString(ip)
+}
+
+/*
+	The IP address of the client behind a request, for logging and anything
+	else that decides based on who's asking. Every part of the site must get
+	it from here.
+
+	Forwarding headers are only believed when the request comes straight
+	from a trusted proxy, since anyone can send them. The first of
+	`Forwarded` (RFC 7239), `X-Forwarded-For` and `X-Real-Ip` that is
+	present lists the hops the request went through, and each proxy appends
+	the one it saw. Reading them from right to left, the client is the first
+	hop that isn't a trusted proxy itself. Whatever is left of that hop was
+	written by the client, and is ignored. A hop that isn't an IP address
+	(e.g. `for=unknown`) leaves the proxy that reported it as the client.
+*/
 func GetUserIP(request *http.Request) string {
-	IPAddress := request.Header.Get("X-Real-Ip")
-	if IPAddress != "" {
-		IPAddress = strings.Split(IPAddress, ", ")[0]
-	} else { // header was empty
-		IPAddress = request.Header.Get("X-Forwarded-For")
-		if IPAddress == "" { // header was empty
-			IPAddress = request.RemoteAddr // extract IP from request (usually least accurate)
+	clientIP := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	if !isTrustedProxy(clientIP) {
+		return clientIP
+	}
+
+	var hops []string
+	if forwarded := request.Header.Values("Forwarded"); len(forwarded) != 0 {
+		hops = parseForwardedHeader(strings.Join(forwarded, ","))
+	} else if forwardedFor := request.Header.Values("X-Forwarded-For"); len(forwardedFor) != 0 {
+		hops = strings.Split(strings.Join(forwardedFor, ","), ",")
+	} else if realIP := request.Header.Get("X-Real-Ip"); realIP != "" {
+		hops = []string{realIP}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		clientIP = hop.String()
+		if !isTrustedProxy(clientIP) {
+			break
 		}
 	}
-	return IPAddress
+	return clientIP
+}
+
+/*
+	The `for` address of each element of a `Forwarded` header, in order,
+	without any port or the brackets around an IPv6 address. Elements
+	without one are empty strings, and obfuscated identifiers or "unknown"
+	are kept as they are.
+*/
+func parseForwardedHeader(header string) (hops []string) {
+	for _, element := range splitOutsideQuotes(header, ',') {
+		hop := ""
+		for _, pair := range splitOutsideQuotes(element, ';') {
+			keyValue := strings.SplitN(pair, "=", 2)
+			if len(keyValue) != 2 || !strings.EqualFold(strings.TrimSpace(keyValue[0]), "for") {
+				continue
+			}
+
+			hop = strings.Trim(strings.TrimSpace(keyValue[1]), "\"")
+			if strings.HasPrefix(hop, "[") {
+				// "[2001:db8::17]" or "[2001:db8::17]:4711"
+				hop = strings.TrimPrefix(hop, "[")
+				if end := strings.Index(hop, "]"); end != -1 {
+					hop = hop[:end]
+				}
+			} else if host, _, err := net.SplitHostPort(hop); err == nil {
+				hop = host // "192.0.2.43:47011"
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return
+}
+
+// Split the string at every separator that isn't inside a quoted string.
+func splitOutsideQuotes(s string, separator byte) (parts []string) {
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == separator:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
 }
 
 /*
@@ -195,12 +320,13 @@ func ClearAuthCookieAndRedirect(writer http.ResponseWriter, request *http.Reques
 	http.Redirect(writer, request, "/login", http.StatusFound)
 }
 
-func GenerateJWT(db *sql.DB, username string, teamID int) (tokenStirng string, err error) {
+func GenerateJWT(username string, teamID int, teamName string, admin bool) (tokenStirng string, err error) {
 	/*
 		--- Token Payload (Claims) ---
 		"user": <team_name>,
 		"teamId": <team_id>,
 		"teamName": <team_name>,
+		"admin": <whether to show the admin pages, access is still checked against the config>,
 		"exp": <timestamp_unix_seconds>
 
 		JWT is stored as a cookie with the name "auth"
@@ -209,14 +335,10 @@ func GenerateJWT(db *sql.DB, username string, teamID int) (tokenStirng string, e
 	token := jwt.New(jwt.SigningMethodHS256)
 
 	claims := token.Claims.(jwt.MapClaims)
-	teamName, err := GetTeamName(db, teamID)
-	if err != nil {
-		return
-	}
-
 	claims["user"] = username
 	claims["teamId"] = teamID
 	claims["teamName"] = teamName
+	claims["admin"] = admin
 	claims["exp"] = time.Now().Add(time.Minute * 30).Unix() // token expires after 30 minutes
 
 	tokenString, err := token.SignedString(JWTSigningKey)
@@ -248,109 +370,116 @@ func PromptFileDownload(writer http.ResponseWriter, request *http.Request, fileP
 	http.ServeFile(writer, request, filePath)
 }
 
-func CalculateCallbackPoints(timeDifference time.Duration, targetValue int) int {
-	// Only care about minutes, in cases where a callback might be 5 milliseconds off or something negligible we don't care about.
-	// We don't want to round on minimum time, but rounding on maximum time is fine.
-	// 14.50 => 15, 15.49 => 15
-	if timeDifference.Round(time.Minute) > MaxCallbackTime {
-		return 1 // only 1 point
+/*
+	The shortest and longest time expected between two callbacks of an Agent
+	calling back every `callbackMinutes` +/- `jitterPercent`%, give or take
+	CallbackTolerance. Agents registered without their callback frequency
+	(`callbackMinutes` of 0) fall back to the fixed bounds of one minute and
+	MaxCallbackTime.
+*/
+func CallbackWindow(callbackMinutes int, jitterPercent int) (minimum time.Duration, maximum time.Duration) {
+	if callbackMinutes <= 0 {
+		return time.Minute - CallbackTolerance, MaxCallbackTime
 	}
 
-	// Exponential decay in point value
-	// 1.2^(-0.9(x-1))
-	// 1 minute = 100 points, 5 minutes = 52 points, 10 minutes = 23 points, 15 minutes = 10 points
-	// Since UNIX time is used, accuracy is down to the second
-	// Score is calculated as minutes between callbacks
-	const baseValue float64 = 1.2
-	const decayValue float64 = -0.9
-	return int(math.Round(float64(targetValue) * math.Pow(baseValue, (decayValue*(float64(timeDifference/time.Minute)-1)))))
+	nominal := time.Duration(callbackMinutes) * time.Minute
+	deviation := nominal * time.Duration(jitterPercent) / 100
+	return nominal - deviation - CallbackTolerance, nominal + deviation + CallbackTolerance
 }
 
-func GetTeamName(db *sql.DB, teamID int) (teamName string, err error) {
-	getTeamNameSQL := `
-		SELECT name
-		FROM Teams
-		WHERE team_id = ?
-	`
-	getTeamNameStatement, err := db.Prepare(getTeamNameSQL)
-	if err != nil {
-		return
+/*
+	How long since an Agent's last callback before it's considered dead: the
+	longest time it could take to call back, but never less than
+	MaxCallbackTime.
+*/
+func AgentDeadAfter(callbackMinutes int, jitterPercent int) time.Duration {
+	_, maximum := CallbackWindow(callbackMinutes, jitterPercent)
+	if maximum < MaxCallbackTime {
+		return MaxCallbackTime
 	}
+	return maximum
+}
 
-	err = getTeamNameStatement.QueryRow(teamID).Scan(&teamName)
-	Close(getTeamNameStatement)
+/*
+	Points for a callback from an Agent with a known callback frequency and
+	jitter. Any callback arriving within the Agent's jitter bounds is scored
+	as if it arrived exactly on time, so the randomness is neither rewarded
+	nor penalized. Late callbacks are scored by the actual time difference.
+*/
+func CalculateAgentCallbackPoints(timeDifference time.Duration, callbackMinutes int, jitterPercent int, targetValue int) int {
+	if _, maximum := CallbackWindow(callbackMinutes, jitterPercent); callbackMinutes > 0 && timeDifference <= maximum {
+		timeDifference = time.Duration(callbackMinutes) * time.Minute
+	}
 
-	return
+	return CalculateCallbackPoints(timeDifference, targetValue)
 }
 
-func GetTeamNames(db *sql.DB) ([]string, error) {
-	var teamNames []string
-	var err error
-
-	getTeamNamesSQL := `
-		SELECT name
-		FROM Teams
-	`
-	getTeamNamesStatement, err := db.Prepare(getTeamNamesSQL)
-	if err != nil {
-		return teamNames, err
+/*
+	Points for an Agent's standing on a target, from its last two callbacks
+	there (`previousUnix` is 0 if it has only called back once). An Agent's
+	first callback is worth the full target value. An Agent that hasn't
+	called back within `AgentDeadAfter()` is dead and worth nothing.
+*/
+func ScoreAgentOnTarget(now time.Time, latestUnix int64, previousUnix int64, callbackMinutes int, jitterPercent int, targetValue int) (points int, alive bool) {
+	if now.Sub(time.Unix(latestUnix, 0)).Round(time.Second) > AgentDeadAfter(callbackMinutes, jitterPercent) {
+		return 0, false
 	}
-
-	teamNamesRows, err := getTeamNamesStatement.Query()
-	if err != nil {
-		return teamNames, err
+	if previousUnix == 0 {
+		return targetValue, true
 	}
-	Close(getTeamNamesStatement)
-
-	for teamNamesRows.Next() {
-		err = teamNamesRows.Err()
-		if err != nil {
-			return teamNames, err
-		}
 
-		var dbTeamName string
-		err = teamNamesRows.Scan(&dbTeamName)
-		if err != nil {
-			return teamNames, err
-		}
+	timeDifference := time.Duration(latestUnix-previousUnix) * time.Second
+	return CalculateAgentCallbackPoints(timeDifference, callbackMinutes, jitterPercent, targetValue), true
+}
 
-		teamNames = append(teamNames, dbTeamName)
+/*
+	A team's points for a target, from the points of the best of its live
+	Agents there and the total of them all, according to `hostScoring` (see
+	`HostScoringBest`).
+*/
+func CombineHostPoints(hostScoring string, bestPoints int, totalPoints int, targetValue int) int {
+	combinedPoints := bestPoints
+	if hostScoring == HostScoringSum {
+		combinedPoints = totalPoints
 	}
-	Close(teamNamesRows)
 
-	return teamNames, err
+	if combinedPoints > targetValue {
+		return targetValue
+	}
+	return combinedPoints
 }
 
 /*
-	Returns the teamId, name, password_hash, and created_date_unix for the
-	specified username, as well as an err if needed.
-
-	If user does not exist, err = sql.ErrNoRows
-	If backend server error, err = some error
-	Else, err = nil
+	Whether a callback proves the Agent is running as root: it came from the
+	Agent's configured local port, and that port is privileged (below 1024)
+	on the Agent's platform. Windows has no privileged ports, and callbacks
+	through a proxy arrive from the proxy's source port instead. Agents of
+	unknown platform or without a local port never count.
 */
-func GetUserInfo(db *sql.DB, username string) (teamId int, name string, passwordHash string, createdDateUnix int, err error) {
-	getUserInfoSQL := `
-		SELECT *
-		FROM Teams
-		WHERE name = ?
-	`
-	getUserInfoStatement, err := db.Prepare(getUserInfoSQL)
-	if CheckError(Error, err, "Could not prepare GetUserInfo statement") {
-		return
+func HasRootSignal(platform string, localPort int, remotePort int) bool {
+	if platform == "" || strings.HasPrefix(platform, "windows/") {
+		return false
 	}
 
-	userInfoRow := getUserInfoStatement.QueryRow(username)
-	Close(getUserInfoStatement)
+	return localPort > 0 && localPort < 1024 && remotePort == localPort
+}
 
-	err = userInfoRow.Scan(&teamId, &name, &passwordHash, &createdDateUnix)
-	if err == sql.ErrNoRows {
-		Log(Warning, "Attempted login for non-existent user '"+username+"'")
-	} else if err != nil {
-		LogError(Error, err, "Could not query using GetUserInfo statement")
+func CalculateCallbackPoints(timeDifference time.Duration, targetValue int) int {
+	// Only care about minutes, in cases where a callback might be 5 milliseconds off or something negligible we don't care about.
+	// We don't want to round on minimum time, but rounding on maximum time is fine.
+	// 14.50 => 15, 15.49 => 15
+	if timeDifference.Round(time.Minute) > MaxCallbackTime {
+		return 1 // only 1 point
 	}
 
-	return
+	// Exponential decay in point value
+	// 1.2^(-0.9(x-1))
+	// 1 minute = 100 points, 5 minutes = 52 points, 10 minutes = 23 points, 15 minutes = 10 points
+	// Since UNIX time is used, accuracy is down to the second
+	// Score is calculated as minutes between callbacks
+	const baseValue float64 = 1.2
+	const decayValue float64 = -0.9
+	return int(math.Round(float64(targetValue) * math.Pow(baseValue, (decayValue*(float64(timeDifference/time.Minute)-1)))))
 }
 
 func ValidatePasswordHash(password string, hash string) bool {
@@ -365,68 +494,6 @@ func HashPassword(password string) (string, error) {
 	return string(hashBytes), err
 }
 
-/*
-	Register a new Team by its name and password hash.
-
-	Returns `EXIT_SUCCESS` upon successful Team creation.
-
-	Otherwise, upon error, returns one of `ERR_INPUT` (team name too long), `ERR_STATEMENT`, or `ERR_QUERY`.
-*/
-func RegisterTeam(db *sql.DB, teamName string, teamPasswordHash string) error {
-	Log(List, "Registering new Team")
-
-	var err error
-
-	// Check that team name <= maxTeamNameLength
-	if len(teamName) > MaxTeamNameLength {
-		return errors.New("error registering team: team name can't be longer than " + fmt.Sprint(MaxTeamNameLength) + " characters")
-	}
-
-	// Check that new team name doesn't match pre-existing team name, stripping special characters for the comparison
-	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
-	if err != nil {
-		return err
-	}
-
-	dbTeamNames, err := GetTeamNames(db)
-	if err != nil {
-		return err
-	}
-	for _, dbTeamName := range dbTeamNames {
-		if strings.EqualFold(reg.ReplaceAllLiteralString(teamName, ""), reg.ReplaceAllLiteralString(dbTeamName, "")) {
-			return errors.New("error registering team: new team name is too similar to a pre-existing team name")
-		}
-	}
-
-	// Prepare statement
-	registerTeamSQL := `
-		INSERT INTO Teams(name, password_hash, created_date_unix)
-		VALUES (?, ?, ?)
-	`
-	registerTeamStatement, err := db.Prepare(registerTeamSQL)
-	if err != nil {
-		return err
-	}
-	defer Close(registerTeamStatement)
-
-	// Register Team
-	createdDate := int(time.Now().Unix())
-	registerTeamResult, err := registerTeamStatement.Exec(teamName, teamPasswordHash, createdDate)
-	if err != nil {
-		return err
-	}
-
-	// Print success (with possible warning of not knowing Team ID, if not returned by the database driver)
-	newTeamID, warn := registerTeamResult.LastInsertId()
-	if CheckError(Warning, warn, "Could not retrieve the ID for the newly-registered Team '"+teamName+"'") {
-		Log(Done, fmt.Sprintf("Team '%s' (ID: UNKNOWN) has been registered", teamName))
-	} else {
-		Log(Done, fmt.Sprintf("Team '%s' (ID: %d) has been registered", teamName, newTeamID))
-	}
-
-	return err
-}
-
 /*
 	Validate user login, checking that the user exists and that their hashed password matches the hash in the database.
 
@@ -440,53 +507,12 @@ func RegisterTeam(db *sql.DB, teamName string, teamPasswordHash string) error {
 // 	return CheckPasswordHash(password, passwordHash), nil
 // }
 
-func RegisterAgent(db *sql.DB, agentUUID string, teamID int) bool { //, serverPrivateKey string, agentPublicKey string, createdDate int, rootDate int) {
-	Log(Info, "Registering Agent", agentUUID)
-
-	// Check if the provided string is a valid UUID format
-	_, err := uuid.Parse(agentUUID)
-	CheckErrorExit(Error, err, ERR_UUID, "Provided UUID string is not a valid UUID")
-
-	addAgentSQL := `
-		INSERT INTO Agents(agent_uuid, team_id, server_private_key, agent_public_key, created_date_unix, root_date_unix)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`
-	addAgentStatement, err := db.Prepare(addAgentSQL)
-	if CheckError(Error, err, "\tCould not create AddAgent statement") {
-		return false
-	}
-	defer Close(addAgentStatement)
-
-	// TODO: Randomly generate this crypto keypair
-	// Temporary random number generators to satisfy the unique constraint
-	// TODO: Actually use the crypto keypair. The field currently only exists
-	// for future use and is not yet used. Should be used for encrypting
-	// communications.
-	randSource := rand.NewSource(time.Now().UnixNano())
-	seededRand := rand.New(randSource)
-	serverPrivateKey := seededRand.Intn(1000)
-
-	randSource = rand.NewSource(time.Now().UnixNano())
-	seededRand = rand.New(randSource)
-	agentPublicKey := seededRand.Intn(1000)
-
-	createdDate := int(time.Now().Unix())
-	rootDate := 0 // no agents have root status until proven by their first callback
-
-	_, err = addAgentStatement.Exec(agentUUID, teamID, serverPrivateKey, agentPublicKey, createdDate, rootDate)
-	if CheckError(Warning, err, "\tCould not register Agent") {
-		return false
-	}
-
-	// Count total Agents
-	agentsCount := db.QueryRow("SELECT COUNT(*) FROM Agents")
-	var numAgents int
-	err = agentsCount.Scan(&numAgents)
-	if CheckError(Error, err, "\tCould not scan GetAgentCount") {
-		return false
+// Whether the string is one of the known `AgentTypes`.
+func IsAgentType(agentType string) bool {
+	for _, knownType := range AgentTypes {
+		if agentType == knownType {
+			return true
+		}
 	}
-
-	Log(Done, "\tRegistered Agent", agentUUID)
-	Log(Done, "\tThere are now", fmt.Sprint(numAgents), "registered Agents")
-	return true
+	return false
 }
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScoreAgentOnTarget(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	ago := func(duration time.Duration) int64 { return now.Add(-duration).Unix() }
+
+	tests := []struct {
+		name            string
+		latestUnix      int64
+		previousUnix    int64
+		callbackMinutes int
+		jitterPercent   int
+		points          int
+		alive           bool
+	}{
+		{"first callback", ago(0), 0, 5, 0, 100, true},
+		{"first callback, about to die", ago(MaxCallbackTime), 0, 5, 0, 100, true},
+		{"on time", ago(0), ago(5 * time.Minute), 5, 0, 52, true},
+		{"early within the jitter", ago(0), ago(4*time.Minute + 10*time.Second), 5, 20, 52, true},
+		{"late within the jitter", ago(0), ago(6 * time.Minute), 5, 20, 52, true},
+		{"late", ago(0), ago(10 * time.Minute), 5, 0, 23, true},
+		{"unknown frequency, every minute", ago(0), ago(time.Minute), 0, 0, 100, true},
+		{"unknown frequency, every 10 minutes", ago(0), ago(10 * time.Minute), 0, 0, 23, true},
+		{"longer than the maximum callback time", ago(0), ago(20 * time.Minute), 0, 0, 1, true},
+		{"dead", ago(MaxCallbackTime + time.Second), ago(MaxCallbackTime + time.Minute + time.Second), 1, 0, 0, false},
+		{"dead after its first callback", ago(time.Hour), 0, 1, 0, 0, false},
+		{"slow and jittered, still alive", ago(20 * time.Minute), 0, 15, 50, 100, true},
+		{"slow and jittered, dead", ago(23 * time.Minute), 0, 15, 50, 0, false},
+	}
+	for _, test := range tests {
+		points, alive := ScoreAgentOnTarget(now, test.latestUnix, test.previousUnix, test.callbackMinutes, test.jitterPercent, 100)
+		if points != test.points || alive != test.alive {
+			t.Errorf("%s: ScoreAgentOnTarget() = %d, %v, want %d, %v", test.name, points, alive, test.points, test.alive)
+		}
+	}
+}
+
+func TestCombineHostPoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostScoring string
+		bestPoints  int
+		totalPoints int
+		points      int
+	}{
+		{"best of one", HostScoringBest, 52, 52, 52},
+		{"sum of one", HostScoringSum, 52, 52, 52},
+		{"best of several", HostScoringBest, 52, 75, 52},
+		{"sum of several", HostScoringSum, 52, 75, 75},
+		{"sum capped at the target's value", HostScoringSum, 52, 152, 100},
+		{"best capped at the target's value", HostScoringBest, 100, 200, 100},
+		{"nothing alive", HostScoringSum, 0, 0, 0},
+	}
+	for _, test := range tests {
+		if points := CombineHostPoints(test.hostScoring, test.bestPoints, test.totalPoints, 100); points != test.points {
+			t.Errorf("%s: CombineHostPoints() = %d, want %d", test.name, points, test.points)
+		}
+	}
+}
+
+// Several of a team's Agents on one host, as the scoreboard combines them.
+func TestSeveralAgentsOnOneHost(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	agents := []struct {
+		latestUnix, previousUnix int64
+		callbackMinutes          int
+	}{
+		{now.Unix(), now.Add(-5 * time.Minute).Unix(), 5},                     // 52
+		{now.Add(-time.Minute).Unix(), now.Add(-11 * time.Minute).Unix(), 10}, // 23
+		{now.Add(-2 * time.Minute).Unix(), 0, 1},                              // first callback, 100
+		{now.Add(-time.Hour).Unix(), now.Add(-61 * time.Minute).Unix(), 1},    // dead
+	}
+
+	bestPoints, totalPoints, numAlive := 0, 0, 0
+	for _, agent := range agents {
+		points, alive := ScoreAgentOnTarget(now, agent.latestUnix, agent.previousUnix, agent.callbackMinutes, 0, 100)
+		if !alive {
+			continue
+		}
+		numAlive++
+		totalPoints += points
+		if points > bestPoints {
+			bestPoints = points
+		}
+	}
+
+	if numAlive != 3 || bestPoints != 100 || totalPoints != 175 {
+		t.Fatalf("%d live Agents, best %d and total %d points, want 3, 100 and 175", numAlive, bestPoints, totalPoints)
+	}
+	if points := CombineHostPoints(HostScoringBest, bestPoints, totalPoints, 100); points != 100 {
+		t.Errorf("Best host scoring gave %d points, want 100", points)
+	}
+	if points := CombineHostPoints(HostScoringSum, bestPoints, totalPoints, 100); points != 100 {
+		t.Errorf("Summed host scoring gave %d points, want the target's value", points)
+	}
+}
+
+func TestGetUserIP(t *testing.T) {
+	var proxies IPNetworks
+	for _, network := range []string{"10.0.0.0/8", "2001:db8:ffff::/48"} {
+		proxy, err := ParseIPNetwork(network)
+		if err != nil {
+			t.Fatalf("Could not parse the trusted proxy %s: %v", network, err)
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	tests := []struct {
+		name       string
+		proxies    IPNetworks
+		remoteAddr string
+		headers    map[string][]string
+		clientIP   string
+	}{
+		{"no proxy", proxies, "198.51.100.7:40000", nil, "198.51.100.7"},
+		{"no proxy, IPv6", proxies, "[2001:db8::5]:40000", nil, "2001:db8::5"},
+		{"untrusted peer spoofing X-Forwarded-For", proxies, "203.0.113.9:40000", map[string][]string{"X-Forwarded-For": {"10.0.0.1"}}, "203.0.113.9"},
+		{"untrusted peer spoofing X-Real-Ip", proxies, "203.0.113.9:40000", map[string][]string{"X-Real-Ip": {"10.0.0.1"}}, "203.0.113.9"},
+		{"untrusted peer spoofing Forwarded", proxies, "203.0.113.9:40000", map[string][]string{"Forwarded": {"for=10.0.0.1"}}, "203.0.113.9"},
+		{"trusted proxy, no headers", proxies, "10.0.0.2:40000", nil, "10.0.0.2"},
+		{"X-Forwarded-For through trusted hops", proxies, "10.0.0.2:40000", map[string][]string{"X-Forwarded-For": {"192.0.2.1, 198.51.100.7, 10.0.0.4, 10.0.0.3"}}, "198.51.100.7"},
+		{"X-Forwarded-For of trusted hops only", proxies, "10.0.0.2:40000", map[string][]string{"X-Forwarded-For": {"10.0.0.4, 10.0.0.3"}}, "10.0.0.4"},
+		{"X-Forwarded-For over several lines", proxies, "10.0.0.2:40000", map[string][]string{"X-Forwarded-For": {"192.0.2.1", "198.51.100.7, 10.0.0.3"}}, "198.51.100.7"},
+		{"X-Forwarded-For with a hop that isn't an IP address", proxies, "10.0.0.2:40000", map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage, 10.0.0.3"}}, "10.0.0.3"},
+		{"X-Real-Ip", proxies, "10.0.0.2:40000", map[string][]string{"X-Real-Ip": {"198.51.100.7"}}, "198.51.100.7"},
+		{"Forwarded before X-Forwarded-For", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"192.0.2.1"}}, "198.51.100.7"},
+		{"Forwarded through trusted hops", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=192.0.2.1, for=198.51.100.7;proto=https, for=\"10.0.0.3:8080\""}}, "198.51.100.7"},
+		{"Forwarded with a quoted IPv6 address and port", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=\"[2001:db8::1]:443\""}}, "2001:db8::1"},
+		{"Forwarded through a trusted IPv6 hop", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=198.51.100.7, for=\"[2001:db8:ffff::3]\""}}, "198.51.100.7"},
+		{"Forwarded with a comma inside quotes", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=198.51.100.7;host=\"a,b\""}}, "198.51.100.7"},
+		{"Forwarded with a semicolon inside quotes", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"by=\"x;for=10.0.0.9\";for=198.51.100.7"}}, "198.51.100.7"},
+		{"Forwarded over several lines", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=198.51.100.7", "for=10.0.0.3"}}, "198.51.100.7"},
+		{"Forwarded for=unknown", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=unknown, for=10.0.0.3"}}, "10.0.0.3"},
+		{"Forwarded with an obfuscated identifier", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"for=_hidden"}}, "10.0.0.2"},
+		{"Forwarded without a for", proxies, "10.0.0.2:40000", map[string][]string{"Forwarded": {"proto=https"}}, "10.0.0.2"},
+		{"no trusted proxies", nil, "10.0.0.2:40000", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-Ip": {"198.51.100.7"}, "Forwarded": {"for=198.51.100.7"}}, "10.0.0.2"},
+	}
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+	for _, test := range tests {
+		SetTrustedProxies(test.proxies)
+		request := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for name, values := range test.headers {
+			for _, value := range values {
+				request.Header.Add(name, value)
+			}
+		}
+
+		if clientIP := GetUserIP(request); clientIP != test.clientIP {
+			t.Errorf("%s: GetUserIP() = %s, want %s", test.name, clientIP, test.clientIP)
+		}
+	}
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		hops   []string
+	}{
+		{"for=192.0.2.43", []string{"192.0.2.43"}},
+		{"for=192.0.2.43:47011", []string{"192.0.2.43"}},
+		{"For=\"[2001:db8:cafe::17]:4711\"", []string{"2001:db8:cafe::17"}},
+		{"for=\"[2001:db8::1]\"", []string{"2001:db8::1"}},
+		{"for=192.0.2.43, for=198.51.100.17;by=203.0.113.60;proto=http;host=example.com", []string{"192.0.2.43", "198.51.100.17"}},
+		{"for=\"_a,b;c\";proto=https, for=192.0.2.1", []string{"_a,b;c", "192.0.2.1"}},
+		{"for=unknown", []string{"unknown"}},
+		{"for=_hidden, for=_SEVKISEK", []string{"_hidden", "_SEVKISEK"}},
+		{"proto=https;by=10.0.0.1, for=192.0.2.1", []string{"", "192.0.2.1"}},
+	}
+	for _, test := range tests {
+		if hops := parseForwardedHeader(test.header); !reflect.DeepEqual(hops, test.hops) {
+			t.Errorf("parseForwardedHeader(%q) = %q, want %q", test.header, hops, test.hops)
+		}
+	}
+}
+
+func TestSplitOutsideQuotes(t *testing.T) {
+	tests := []struct {
+		s     string
+		parts []string
+	}{
+		{"", []string{""}},
+		{"a,b,c", []string{"a", "b", "c"}},
+		{"a,,b", []string{"a", "", "b"}},
+		{"a=\"x,y\",b", []string{"a=\"x,y\"", "b"}},
+		{"a=\"x\\\",y\",b", []string{"a=\"x\\\",y\"", "b"}},
+		{"a=\"unterminated,b", []string{"a=\"unterminated,b"}},
+	}
+	for _, test := range tests {
+		if parts := splitOutsideQuotes(test.s, ','); !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("splitOutsideQuotes(%q) = %q, want %q", test.s, parts, test.parts)
+		}
+	}
+}